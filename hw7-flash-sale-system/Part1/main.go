@@ -1,12 +1,24 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"log/slog"
+	"math"
 	"math/rand"
+	"mime"
 	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/google/uuid"
@@ -15,11 +27,48 @@ import (
 
 // Order represents an e-commerce order
 type Order struct {
-	OrderID    string    `json:"order_id"`
-	CustomerID int       `json:"customer_id"`
-	Status     string    `json:"status"` // pending, processing, completed
-	Items      []Item    `json:"items"`
-	CreatedAt  time.Time `json:"created_at"`
+	OrderID    string      `json:"order_id"`
+	CustomerID int         `json:"customer_id"`
+	Status     OrderStatus `json:"status"` // changed only through UpdateStatus
+	Items      []Item      `json:"items"`
+	CreatedAt  time.Time   `json:"created_at"`
+	Total      float64     `json:"total"` // rounded to cents
+}
+
+// OrderStatus is where an order is in its lifecycle
+type OrderStatus string
+
+const (
+	StatusPending    OrderStatus = "pending"
+	StatusProcessing OrderStatus = "processing"
+	StatusCompleted  OrderStatus = "completed"
+	StatusFailed     OrderStatus = "failed"
+)
+
+// statusTransitions lists the statuses each status may move to; completed
+// and failed are final. Kept in step with the order service, which has more
+// statuses.
+var statusTransitions = map[OrderStatus][]OrderStatus{
+	StatusPending:    {StatusProcessing},
+	StatusProcessing: {StatusCompleted, StatusFailed},
+}
+
+// Transition reports whether an order may move from one status to another
+func Transition(from, to OrderStatus) error {
+	if slices.Contains(statusTransitions[from], to) {
+		return nil
+	}
+	return fmt.Errorf("illegal status transition: %s -> %s", from, to)
+}
+
+// OrderTotal sums quantity * price across all items, in integer cents so
+// the result doesn't drift to 19.999999
+func (o Order) OrderTotal() float64 {
+	var cents int64
+	for _, item := range o.Items {
+		cents += int64(math.Round(item.Price*100)) * int64(item.Quantity)
+	}
+	return float64(cents) / 100
 }
 
 // Item represents a product in an order
@@ -29,43 +78,365 @@ type Item struct {
 	Price     float64 `json:"price"`
 }
 
+// fieldError names one invalid field of an order payload
+type fieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// orderLimits bound the size of one order: its line items (MAX_ITEMS) and
+// the quantity summed across them (MAX_QUANTITY). Zero disables a limit.
+type orderLimits struct {
+	maxItems    int
+	maxQuantity int
+}
+
+// loadOrderLimits reads MAX_ITEMS (default 50) and MAX_QUANTITY (default 1000)
+func loadOrderLimits() (orderLimits, error) {
+	limits := orderLimits{maxItems: 50, maxQuantity: 1000}
+	for name, target := range map[string]*int{
+		"MAX_ITEMS":    &limits.maxItems,
+		"MAX_QUANTITY": &limits.maxQuantity,
+	} {
+		if value := os.Getenv(name); value != "" {
+			parsed, err := strconv.Atoi(value)
+			if err != nil || parsed < 0 {
+				return orderLimits{}, fmt.Errorf("%s must be a non-negative integer, got %q", name, value)
+			}
+			*target = parsed
+		}
+	}
+	return limits, nil
+}
+
+// validateOrder reports every field that makes an order unchargeable:
+// a missing customer, no items or more than limits allow, or items with a
+// bad quantity or price. Kept in step with the order service's
+// validateOrder.
+func validateOrder(order *Order, limits orderLimits) []fieldError {
+	var problems []fieldError
+	if order.CustomerID <= 0 {
+		problems = append(problems, fieldError{"customer_id", "must be positive"})
+	}
+	if len(order.Items) == 0 {
+		problems = append(problems, fieldError{"items", "must contain at least one item"})
+	}
+	if limits.maxItems > 0 && len(order.Items) > limits.maxItems {
+		problems = append(problems, fieldError{"items", fmt.Sprintf("has %d items, the maximum is %d", len(order.Items), limits.maxItems)})
+	}
+	if limits.maxQuantity > 0 {
+		// Counting down from the limit can't overflow the way a sum can
+		remaining := limits.maxQuantity
+		for _, item := range order.Items {
+			if item.Quantity <= 0 {
+				continue
+			}
+			if remaining -= item.Quantity; remaining < 0 {
+				problems = append(problems, fieldError{"items", fmt.Sprintf("total quantity exceeds the maximum of %d", limits.maxQuantity)})
+				break
+			}
+		}
+	}
+	for i, item := range order.Items {
+		if item.Quantity <= 0 {
+			problems = append(problems, fieldError{fmt.Sprintf("items[%d].quantity", i), "must be positive"})
+		}
+		if item.Price < 0 {
+			problems = append(problems, fieldError{fmt.Sprintf("items[%d].price", i), "must not be negative"})
+		}
+	}
+	return problems
+}
+
+// writeValidationErrors answers 422 with the offending fields
+func writeValidationErrors(w http.ResponseWriter, problems []fieldError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":  "Invalid order",
+		"fields": problems,
+	})
+}
+
+// serverTimeouts bound how long the HTTP server spends on one connection,
+// so slow or stalled clients can't hold connections open indefinitely
+type serverTimeouts struct {
+	readHeader time.Duration
+	read       time.Duration
+	write      time.Duration
+	idle       time.Duration
+}
+
+// loadServerTimeouts reads HTTP_READ_HEADER_TIMEOUT, HTTP_READ_TIMEOUT,
+// HTTP_WRITE_TIMEOUT and HTTP_IDLE_TIMEOUT as durations; zero disables one
+func loadServerTimeouts() (serverTimeouts, error) {
+	timeouts := serverTimeouts{readHeader: 5 * time.Second, read: 30 * time.Second, write: 30 * time.Second, idle: 120 * time.Second}
+	for name, target := range map[string]*time.Duration{
+		"HTTP_READ_HEADER_TIMEOUT": &timeouts.readHeader,
+		"HTTP_READ_TIMEOUT":        &timeouts.read,
+		"HTTP_WRITE_TIMEOUT":       &timeouts.write,
+		"HTTP_IDLE_TIMEOUT":        &timeouts.idle,
+	} {
+		if value := os.Getenv(name); value != "" {
+			parsed, err := time.ParseDuration(value)
+			if err != nil || parsed < 0 {
+				return serverTimeouts{}, fmt.Errorf("%s must be a non-negative duration, got %q", name, value)
+			}
+			*target = parsed
+		}
+	}
+	return timeouts, nil
+}
+
+// newServer builds an HTTP server for handler with these timeouts
+func (t serverTimeouts) newServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: t.readHeader,
+		ReadTimeout:       t.read,
+		WriteTimeout:      t.write,
+		IdleTimeout:       t.idle,
+	}
+}
+
 // PaymentProcessor simulates payment verification with actual thread blocking
 type PaymentProcessor struct {
-	// Buffered channel with capacity of 1 creates actual bottleneck
-	// Only 1 payment can be processed at a time
+	// Buffered channel sized to the concurrency creates actual bottleneck;
+	// with the default of 1 only 1 payment can be processed at a time
 	processingSlot chan struct{}
+	concurrency    int
+	latency        paymentLatency
+	inFlight       int64 // payments holding a slot, updated atomically
 	mu             sync.Mutex
 	processedCount int
 	failedCount    int
+	// Failed payments by PaymentError reason, guarded by mu
+	failuresByReason map[string]int
+	// Relative frequency of each failure reason, from PAYMENT_FAILURE_REASONS
+	failureReasons []reasonWeight
+
+	// Bounded queue drained by concurrency workers; a payment that doesn't
+	// fit is rejected instead of parking another goroutine
+	jobs     chan paymentJob
+	rejected int64 // updated atomically
+}
+
+// paymentLatency is how long a simulated payment takes: mean, moved by up
+// to jitter either way, chosen uniformly for each payment
+type paymentLatency struct {
+	mean   time.Duration
+	jitter time.Duration
+}
+
+// loadPaymentLatency reads PAYMENT_LATENCY (default 3s) and
+// PAYMENT_LATENCY_JITTER (default 0) as durations; PAYMENT_LATENCY=0
+// makes payments instant for tests
+func loadPaymentLatency() (paymentLatency, error) {
+	latency := paymentLatency{mean: 3 * time.Second}
+	if value := os.Getenv("PAYMENT_LATENCY"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed < 0 {
+			return paymentLatency{}, fmt.Errorf("PAYMENT_LATENCY must be a non-negative duration, got %q", value)
+		}
+		latency.mean = parsed
+	}
+	if value := os.Getenv("PAYMENT_LATENCY_JITTER"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed < 0 {
+			return paymentLatency{}, fmt.Errorf("PAYMENT_LATENCY_JITTER must be a non-negative duration, got %q", value)
+		}
+		latency.jitter = parsed
+	}
+	return latency, nil
+}
+
+// next picks the duration of one payment, never below zero
+func (l paymentLatency) next() time.Duration {
+	if l.jitter <= 0 {
+		return l.mean
+	}
+	return max(0, l.mean+time.Duration(rand.Int63n(int64(2*l.jitter)+1))-l.jitter)
+}
+
+// throughput describes the most payments concurrency workers can finish
+func (l paymentLatency) throughput(concurrency int) string {
+	if l.mean <= 0 {
+		return fmt.Sprintf("unlimited (no payment latency, %d at a time)", concurrency)
+	}
+	return fmt.Sprintf("~%d orders/minute (%v per payment, %d at a time)", int(time.Minute/l.mean)*concurrency, l.mean, concurrency)
+}
+
+// Reasons a payment can be refused with, carried by PaymentError
+const (
+	ReasonDeclined          = "declined"
+	ReasonInsufficientFunds = "insufficient_funds"
+	ReasonFraudSuspected    = "fraud_suspected"
+	ReasonGatewayTimeout    = "gateway_timeout"
+)
+
+// paymentFailureReasons lists every reason, in the order /stats reports them
+var paymentFailureReasons = []string{ReasonDeclined, ReasonInsufficientFunds, ReasonFraudSuspected, ReasonGatewayTimeout}
+
+// PaymentError is a payment the simulated gateway refused; Reason is one
+// of the Reason constants
+type PaymentError struct {
+	OrderID string
+	Reason  string
+}
+
+func (e *PaymentError) Error() string {
+	return fmt.Sprintf("payment refused for order %s: %s", e.OrderID, e.Reason)
+}
+
+// reasonWeight is one entry of PAYMENT_FAILURE_REASONS
+type reasonWeight struct {
+	reason string
+	weight int
+}
+
+// loadFailureReasons reads PAYMENT_FAILURE_REASONS, comma-separated
+// reason=weight pairs giving the relative frequency of each failure
+// (default declined=50,insufficient_funds=30,fraud_suspected=10,gateway_timeout=10)
+func loadFailureReasons() ([]reasonWeight, error) {
+	value := "declined=50,insufficient_funds=30,fraud_suspected=10,gateway_timeout=10"
+	if configured := os.Getenv("PAYMENT_FAILURE_REASONS"); configured != "" {
+		value = configured
+	}
+	var weights []reasonWeight
+	for _, entry := range strings.Split(value, ",") {
+		reason, weightText, found := strings.Cut(strings.TrimSpace(entry), "=")
+		weight, err := strconv.Atoi(weightText)
+		if !found || err != nil || weight < 0 {
+			return nil, fmt.Errorf("PAYMENT_FAILURE_REASONS entries must be reason=weight with a non-negative weight, got %q", entry)
+		}
+		if !slices.Contains(paymentFailureReasons, reason) {
+			return nil, fmt.Errorf("PAYMENT_FAILURE_REASONS has unknown reason %q, want one of %s", reason, strings.Join(paymentFailureReasons, ", "))
+		}
+		if weight > 0 {
+			weights = append(weights, reasonWeight{reason: reason, weight: weight})
+		}
+	}
+	if len(weights) == 0 {
+		return nil, errors.New("PAYMENT_FAILURE_REASONS needs at least one reason with a positive weight")
+	}
+	return weights, nil
+}
+
+// pickFailureReason draws a reason according to the configured weights
+func (pp *PaymentProcessor) pickFailureReason() string {
+	total := 0
+	for _, candidate := range pp.failureReasons {
+		total += candidate.weight
+	}
+	pick := rand.Intn(total)
+	for _, candidate := range pp.failureReasons {
+		if pick < candidate.weight {
+			return candidate.reason
+		}
+		pick -= candidate.weight
+	}
+	return ReasonDeclined
+}
+
+// paymentJob is a queued payment; the worker sends its outcome on result
+type paymentJob struct {
+	// Carries the request ID of the order's sync request
+	ctx     context.Context
+	orderID string
+	result  chan error
+}
+
+// requestIDKey is the context key of the request ID that ties a sync
+// order's handler and payment log lines together
+type requestIDKey struct{}
+
+// withRequestID returns ctx carrying requestID
+func withRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, requestID)
+}
+
+// requestIDFrom returns the request ID carried by ctx, or "" if it has none
+func requestIDFrom(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDKey{}).(string)
+	return requestID
+}
+
+// errQueueFull is returned by Submit when the payment queue has no room
+var errQueueFull = errors.New("payment queue full")
+
+// NewPaymentProcessor creates a processor that verifies at most
+// concurrency payments at once, with up to queueSize more waiting, and
+// fails them with reasons drawn from failureReasons
+func NewPaymentProcessor(concurrency, queueSize int, latency paymentLatency, failureReasons []reasonWeight) *PaymentProcessor {
+	pp := &PaymentProcessor{
+		processingSlot:   make(chan struct{}, concurrency),
+		concurrency:      concurrency,
+		latency:          latency,
+		failuresByReason: make(map[string]int),
+		failureReasons:   failureReasons,
+		jobs:             make(chan paymentJob, queueSize),
+	}
+	for i := 0; i < concurrency; i++ {
+		go pp.work()
+	}
+	return pp
+}
+
+// work verifies queued payments one at a time
+func (pp *PaymentProcessor) work() {
+	for job := range pp.jobs {
+		job.result <- pp.VerifyPayment(job.ctx, job.orderID)
+	}
 }
 
-// NewPaymentProcessor creates a processor with limited throughput
-func NewPaymentProcessor() *PaymentProcessor {
-	return &PaymentProcessor{
-		processingSlot: make(chan struct{}, 1), // Only 1 concurrent payment!
+// Submit queues a payment without blocking and returns the channel its
+// outcome arrives on, or errQueueFull when the queue is at capacity. The
+// request ID in ctx is logged with the payment.
+func (pp *PaymentProcessor) Submit(ctx context.Context, orderID string) (<-chan error, error) {
+	job := paymentJob{ctx: ctx, orderID: orderID, result: make(chan error, 1)}
+	select {
+	case pp.jobs <- job:
+		return job.result, nil
+	default:
+		atomic.AddInt64(&pp.rejected, 1)
+		return nil, errQueueFull
 	}
 }
 
-// VerifyPayment simulates 3-second payment verification with actual blocking
-func (pp *PaymentProcessor) VerifyPayment(orderID string) error {
+// VerifyPayment simulates payment verification, taking the configured
+// latency, with actual blocking. Its log lines carry the request ID in ctx,
+// so they can be matched with the handler's.
+func (pp *PaymentProcessor) VerifyPayment(ctx context.Context, orderID string) error {
+	logger := slog.With("request_id", requestIDFrom(ctx), "order_id", orderID)
+
 	// Block until we can acquire the processing slot
 	pp.processingSlot <- struct{}{}
-	defer func() { <-pp.processingSlot }()
+	atomic.AddInt64(&pp.inFlight, 1)
+	defer func() {
+		atomic.AddInt64(&pp.inFlight, -1)
+		<-pp.processingSlot
+	}()
+	logger.Info("[PAYMENT] Verifying payment")
 
 	// Simulate actual payment processing time
-	time.Sleep(3 * time.Second)
+	time.Sleep(pp.latency.next())
 
 	// 5% chance of payment failure (simulate real-world conditions)
 	if rand.Float64() < 0.05 {
+		reason := pp.pickFailureReason()
 		pp.mu.Lock()
 		pp.failedCount++
+		pp.failuresByReason[reason]++
 		pp.mu.Unlock()
-		return fmt.Errorf("payment declined for order %s", orderID)
+		logger.Warn("[PAYMENT] Payment refused", "reason", reason)
+		return &PaymentError{OrderID: orderID, Reason: reason}
 	}
 
 	pp.mu.Lock()
 	pp.processedCount++
 	pp.mu.Unlock()
+	logger.Info("[PAYMENT] Payment verified")
 
 	return nil
 }
@@ -77,81 +448,247 @@ func (pp *PaymentProcessor) GetStats() (processed, failed int) {
 	return pp.processedCount, pp.failedCount
 }
 
+// FailuresByReason counts failed payments by reason, zeros included
+func (pp *PaymentProcessor) FailuresByReason() map[string]int {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	counts := make(map[string]int, len(paymentFailureReasons))
+	for _, reason := range paymentFailureReasons {
+		counts[reason] = pp.failuresByReason[reason]
+	}
+	return counts
+}
+
+// InFlight returns how many payments are being verified right now
+func (pp *PaymentProcessor) InFlight() int64 {
+	return atomic.LoadInt64(&pp.inFlight)
+}
+
+// QueueStats reports how many payments wait in the queue, its capacity and
+// how many were turned away because it was full
+func (pp *PaymentProcessor) QueueStats() (length, capacity int, rejected int64) {
+	return len(pp.jobs), cap(pp.jobs), atomic.LoadInt64(&pp.rejected)
+}
+
 // OrderService handles order operations
 type OrderService struct {
-	processor *PaymentProcessor
-	mu        sync.RWMutex
-	orders    map[string]*Order
+	processor  *PaymentProcessor
+	mu         sync.RWMutex
+	orders     map[string]*Order
+	newOrderID func() (string, error)
+	// Largest order body accepted, from MAX_BODY_BYTES
+	maxBodyBytes int64
+	// Caps on an order's line items and total quantity
+	limits orderLimits
+	// The server's HTTP_WRITE_TIMEOUT, re-armed once a sync payment is done
+	writeTimeout time.Duration
+
+	// Set once shutdown begins; new sync orders are turned away with 503
+	draining int32
+	// CreateOrderSync calls still running, including those waiting for a
+	// payment slot, updated atomically
+	activeOrders int64
+}
+
+// StartDraining refuses new sync orders and returns how many were still
+// in flight at that moment
+func (os *OrderService) StartDraining() int64 {
+	atomic.StoreInt32(&os.draining, 1)
+	return atomic.LoadInt64(&os.activeOrders)
+}
+
+// UpdateStatus is the only way a stored order's status changes; illegal
+// transitions are rejected and logged
+func (os *OrderService) UpdateStatus(order *Order, to OrderStatus) error {
+	os.mu.Lock()
+	from := order.Status
+	err := Transition(from, to)
+	if err == nil {
+		order.Status = to
+	}
+	os.mu.Unlock()
+
+	if err != nil {
+		slog.Warn("Rejected illegal status transition", "order_id", order.OrderID, "from", from, "to", to)
+	}
+	return err
 }
 
 // NewOrderService creates a new order service
-func NewOrderService() *OrderService {
+func NewOrderService(paymentConcurrency, paymentQueueSize int, latency paymentLatency, failureReasons []reasonWeight, maxBodyBytes int64, limits orderLimits, writeTimeout time.Duration) *OrderService {
 	return &OrderService{
-		processor: NewPaymentProcessor(),
-		orders:    make(map[string]*Order),
+		processor:    NewPaymentProcessor(paymentConcurrency, paymentQueueSize, latency, failureReasons),
+		orders:       make(map[string]*Order),
+		newOrderID:   generateOrderID,
+		maxBodyBytes: maxBodyBytes,
+		limits:       limits,
+		writeTimeout: writeTimeout,
+	}
+}
+
+// generateOrderID returns a random UUID, reporting an error instead of
+// panicking when the system's random source is unavailable
+func generateOrderID() (string, error) {
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return "", fmt.Errorf("failed to generate order ID: %w", err)
+	}
+	return id.String(), nil
+}
+
+// decodeJSONBody decodes a JSON request body into v. Bodies over
+// maxBodyBytes and fields v doesn't declare are errors, which
+// writeBodyError turns into a response.
+func (os *OrderService) decodeJSONBody(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	r.Body = http.MaxBytesReader(w, r.Body, os.maxBodyBytes)
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(v)
+}
+
+// writeBodyError answers a decodeJSONBody error: 413 for an oversized body,
+// 400 naming the field for an unknown one, and 400 with message otherwise
+func writeBodyError(w http.ResponseWriter, err error, message string) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, fmt.Sprintf("Request body exceeds %d bytes", tooLarge.Limit), http.StatusRequestEntityTooLarge)
+		return
 	}
+	if field, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+		http.Error(w, "Unknown field "+field, http.StatusBadRequest)
+		return
+	}
+	http.Error(w, message, http.StatusBadRequest)
+}
+
+// requireJSON rejects request bodies that aren't declared as JSON with 415.
+// Parameters such as "; charset=utf-8" are accepted.
+func requireJSON(w http.ResponseWriter, r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/json" {
+		http.Error(w, "Unsupported Media Type: Content-Type must be application/json", http.StatusUnsupportedMediaType)
+		return false
+	}
+	return true
 }
 
 // CreateOrderSync processes order synchronously (blocks until payment verified)
 func (os *OrderService) CreateOrderSync(w http.ResponseWriter, r *http.Request) {
 	start := time.Now()
+	atomic.AddInt64(&os.activeOrders, 1)
+	defer atomic.AddInt64(&os.activeOrders, -1)
+	if atomic.LoadInt32(&os.draining) == 1 {
+		w.Header().Set("Connection", "close")
+		http.Error(w, "Service shutting down, retry on another instance", http.StatusServiceUnavailable)
+		return
+	}
+
+	// Keep the caller's request ID, or start one, so this order's log lines
+	// and the payment processor's can be correlated with the client's. It
+	// is answered as X-Trace-ID too.
+	requestID := r.Header.Get("X-Request-ID")
+	if requestID == "" {
+		requestID = uuid.NewString()
+	}
+	w.Header().Set("X-Request-ID", requestID)
+	w.Header().Set("X-Trace-ID", requestID)
+	logger := slog.With("request_id", requestID)
+	ctx := withRequestID(r.Context(), requestID)
+
+	if !requireJSON(w, r) {
+		return
+	}
 
 	var order Order
-	if err := json.NewDecoder(r.Body).Decode(&order); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+	if err := os.decodeJSONBody(w, r, &order); err != nil {
+		writeBodyError(w, err, "Invalid request body")
+		return
+	}
+	if problems := validateOrder(&order, os.limits); len(problems) > 0 {
+		writeValidationErrors(w, problems)
 		return
 	}
 
 	// Generate order ID if not provided
 	if order.OrderID == "" {
-		order.OrderID = uuid.New().String()
+		id, err := os.newOrderID()
+		if err != nil {
+			logger.Error("[SYNC] Could not assign an order ID", "error", err)
+			http.Error(w, "Could not assign an order ID, please retry", http.StatusInternalServerError)
+			return
+		}
+		order.OrderID = id
 	}
-	order.Status = "pending"
+	order.Status = StatusPending
 	order.CreatedAt = time.Now()
+	order.Total = order.OrderTotal()
+
+	// Queue the payment before storing the order, so a rejected order
+	// leaves nothing behind
+	result, err := os.processor.Submit(ctx, order.OrderID)
+	if err != nil {
+		logger.Warn("[SYNC] Order rejected, payment queue full", "order_id", order.OrderID)
+		w.Header().Set("Retry-After", "3")
+		http.Error(w, "Payment queue full, retry later", http.StatusServiceUnavailable)
+		return
+	}
 
 	// Store order
 	os.mu.Lock()
 	os.orders[order.OrderID] = &order
 	os.mu.Unlock()
 
-	log.Printf("[SYNC] Order %s received, starting payment verification...", order.OrderID)
-
-	// THIS IS THE BOTTLENECK: Synchronous payment verification
-	order.Status = "processing"
-	if err := os.processor.VerifyPayment(order.OrderID); err != nil {
-		order.Status = "failed"
-		os.mu.Lock()
-		os.orders[order.OrderID] = &order
-		os.mu.Unlock()
+	logger = logger.With("order_id", order.OrderID)
+	logger.Info("[SYNC] Order received, starting payment verification")
+
+	// THIS IS THE BOTTLENECK: Synchronous payment verification. The wait
+	// is PAYMENT_LATENCY (3s by default) plus however long the order queues
+	// for a slot, which can outlast any fixed WriteTimeout and drop a
+	// charged client's connection, so the deadline is lifted while waiting
+	// and re-armed to cover writing the response.
+	os.UpdateStatus(&order, StatusProcessing)
+	controller := http.NewResponseController(w)
+	if os.writeTimeout > 0 {
+		controller.SetWriteDeadline(time.Time{})
+	}
+	err = <-result
+	if os.writeTimeout > 0 {
+		controller.SetWriteDeadline(time.Now().Add(os.writeTimeout))
+	}
+	if err != nil {
+		os.UpdateStatus(&order, StatusFailed)
 
 		duration := time.Since(start)
-		log.Printf("[SYNC] Order %s FAILED after %.2fs: %v", order.OrderID, duration.Seconds(), err)
+		logger.Error("[SYNC] Order FAILED", "duration_seconds", duration.Seconds(), "error", err)
 
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusPaymentRequired)
-		json.NewEncoder(w).Encode(map[string]interface{}{
+		response := map[string]interface{}{
 			"order_id": order.OrderID,
 			"status":   "failed",
 			"error":    err.Error(),
 			"duration": duration.Seconds(),
-		})
+		}
+		var refused *PaymentError
+		if errors.As(err, &refused) {
+			response["reason"] = refused.Reason
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusPaymentRequired)
+		json.NewEncoder(w).Encode(response)
 		return
 	}
 
 	// Payment succeeded
-	order.Status = "completed"
-	os.mu.Lock()
-	os.orders[order.OrderID] = &order
-	os.mu.Unlock()
+	os.UpdateStatus(&order, StatusCompleted)
 
 	duration := time.Since(start)
-	log.Printf("[SYNC] Order %s COMPLETED in %.2fs", order.OrderID, duration.Seconds())
+	logger.Info("[SYNC] Order COMPLETED", "duration_seconds", duration.Seconds())
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"order_id": order.OrderID,
 		"status":   "completed",
+		"total":    order.Total,
 		"duration": duration.Seconds(),
 		"message":  "Order processed successfully",
 	})
@@ -162,8 +699,14 @@ func (os *OrderService) GetOrder(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	orderID := vars["id"]
 
+	// Copy the order under the lock, since UpdateStatus may change its
+	// status while it is encoded
 	os.mu.RLock()
-	order, exists := os.orders[orderID]
+	stored, exists := os.orders[orderID]
+	var order Order
+	if exists {
+		order = *stored
+	}
 	os.mu.RUnlock()
 
 	if !exists {
@@ -178,6 +721,7 @@ func (os *OrderService) GetOrder(w http.ResponseWriter, r *http.Request) {
 // GetStats returns system statistics
 func (os *OrderService) GetStats(w http.ResponseWriter, r *http.Request) {
 	processed, failed := os.processor.GetStats()
+	queueLength, queueCapacity, rejected := os.processor.QueueStats()
 	
 	os.mu.RLock()
 	totalOrders := len(os.orders)
@@ -190,7 +734,7 @@ func (os *OrderService) GetStats(w http.ResponseWriter, r *http.Request) {
 	}
 	
 	for _, order := range os.orders {
-		statusCounts[order.Status]++
+		statusCounts[string(order.Status)]++
 	}
 	os.mu.RUnlock()
 
@@ -199,8 +743,16 @@ func (os *OrderService) GetStats(w http.ResponseWriter, r *http.Request) {
 		"total_orders":      totalOrders,
 		"payments_processed": processed,
 		"payments_failed":    failed,
+		"payment_failures_by_reason": os.processor.FailuresByReason(),
 		"status_breakdown":   statusCounts,
-		"throughput_limit":   "~20 orders/minute (3s per payment)",
+		"concurrency":        os.processor.concurrency,
+		"payments_in_flight": os.processor.InFlight(),
+		"payment_queue": map[string]interface{}{
+			"length":   queueLength,
+			"capacity": queueCapacity,
+			"rejected": rejected,
+		},
+		"throughput_limit":   os.processor.latency.throughput(os.processor.concurrency),
 	})
 }
 
@@ -214,10 +766,71 @@ func (os *OrderService) HealthCheck(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// setupLogging sends slog and the standard log package through one JSON
+// handler on stderr, filtered at LOG_LEVEL (debug, info, warn or error)
+func setupLogging() error {
+	level := slog.LevelInfo
+	if value := os.Getenv("LOG_LEVEL"); value != "" {
+		if err := level.UnmarshalText([]byte(value)); err != nil {
+			return fmt.Errorf("LOG_LEVEL must be debug, info, warn or error, got %q", value)
+		}
+	}
+	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
+	return nil
+}
+
 func main() {
+	if err := setupLogging(); err != nil {
+		log.Fatal(err)
+	}
 	rand.Seed(time.Now().UnixNano())
 	
-	service := NewOrderService()
+	// PAYMENT_CONCURRENCY widens the payment bottleneck for load tests
+	paymentConcurrency := 1
+	if value := os.Getenv("PAYMENT_CONCURRENCY"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 {
+			log.Fatalf("PAYMENT_CONCURRENCY must be a positive integer, got %q", value)
+		}
+		paymentConcurrency = parsed
+	}
+	// PAYMENT_QUEUE_SIZE caps how many orders may wait for a payment worker
+	paymentQueueSize := 100
+	if value := os.Getenv("PAYMENT_QUEUE_SIZE"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 0 {
+			log.Fatalf("PAYMENT_QUEUE_SIZE must be a non-negative integer, got %q", value)
+		}
+		paymentQueueSize = parsed
+	}
+	latency, err := loadPaymentLatency()
+	if err != nil {
+		log.Fatal(err)
+	}
+	failureReasons, err := loadFailureReasons()
+	if err != nil {
+		log.Fatal(err)
+	}
+	// MAX_BODY_BYTES bounds order bodies so one client can't exhaust memory
+	maxBodyBytes := int64(1 << 20)
+	if value := os.Getenv("MAX_BODY_BYTES"); value != "" {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || parsed < 1 {
+			log.Fatalf("MAX_BODY_BYTES must be a positive integer, got %q", value)
+		}
+		maxBodyBytes = parsed
+	}
+	limits, err := loadOrderLimits()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	timeouts, err := loadServerTimeouts()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	service := NewOrderService(paymentConcurrency, paymentQueueSize, latency, failureReasons, maxBodyBytes, limits, timeouts.write)
 	router := mux.NewRouter()
 
 	// Endpoints
@@ -228,14 +841,41 @@ func main() {
 
 	port := ":8080"
 	log.Printf("🚀 Synchronous Order Service starting on port %s", port)
-	log.Printf("⚠️  Payment bottleneck: 3 seconds per order (max ~20 orders/minute)")
+	log.Printf("⚠️  Payment bottleneck: %s", latency.throughput(paymentConcurrency))
 	log.Printf("📊 Test endpoints:")
 	log.Printf("   POST /orders/sync - Create order (blocks until payment verified)")
 	log.Printf("   GET  /orders/{id} - Check order status")
 	log.Printf("   GET  /stats       - View system statistics")
 	log.Printf("   GET  /health      - Health check")
 
-	if err := http.ListenAndServe(port, router); err != nil {
-		log.Fatal(err)
+	// Long enough for an order waiting on the payment slot to finish
+	shutdownTimeout := 30 * time.Second
+	if value := os.Getenv("SHUTDOWN_TIMEOUT"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 {
+			log.Fatalf("SHUTDOWN_TIMEOUT must be a positive duration, got %q", value)
+		}
+		shutdownTimeout = parsed
+	}
+
+	server := timeouts.newServer(port, router)
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	// On SIGTERM stop accepting connections and let in-flight orders finish
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-stop
+	inFlight := service.StartDraining()
+	slog.Info("Shutting down, draining in-flight orders", "signal", sig.String(), "in_flight", inFlight, "timeout", shutdownTimeout.String())
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		slog.Error("Shutdown grace period expired, dropping remaining orders", "error", err, "in_flight", atomic.LoadInt64(&service.activeOrders))
 	}
+	slog.Info("Order service stopped")
 }
\ No newline at end of file
@@ -0,0 +1,509 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// testFailureReasons gives the 5% of payments that fail a reason to fail
+// with
+var testFailureReasons = []reasonWeight{{reason: ReasonDeclined, weight: 1}}
+
+// newTestService builds an OrderService with one instant payment worker
+// and the default order limits
+func newTestService(t *testing.T) *OrderService {
+	t.Helper()
+	return NewOrderService(1, 10, paymentLatency{}, testFailureReasons, 1<<20, orderLimits{maxItems: 50, maxQuantity: 1000}, 0)
+}
+
+// postOrder sends body to CreateOrderSync, declared as contentType unless
+// that is empty
+func postOrder(s *OrderService, contentType, body string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(http.MethodPost, "/orders/sync", strings.NewReader(body))
+	if contentType != "" {
+		request.Header.Set("Content-Type", contentType)
+	}
+	rec := httptest.NewRecorder()
+	s.CreateOrderSync(rec, request)
+	return rec
+}
+
+func TestCreateOrderRequiresJSONContentType(t *testing.T) {
+	s := newTestService(t)
+	body := `{"customer_id":1,"items":[{"product_id":"a","quantity":1,"price":5}]}`
+
+	for _, tc := range []struct {
+		contentType string
+		accepted    bool
+	}{
+		{"", false},
+		{"text/plain", false},
+		{"application/x-www-form-urlencoded", false},
+		{"application/json", true},
+		{"application/json; charset=utf-8", true},
+	} {
+		rec := postOrder(s, tc.contentType, body)
+		if rejected := rec.Code == http.StatusUnsupportedMediaType; rejected == tc.accepted {
+			t.Errorf("Content-Type %q: %d %s", tc.contentType, rec.Code, rec.Body)
+		}
+		if !tc.accepted && !strings.Contains(rec.Body.String(), "application/json") {
+			t.Errorf("Content-Type %q: message %q doesn't name the expected type", tc.contentType, rec.Body)
+		}
+	}
+	if len(s.orders) != 2 {
+		t.Errorf("%d orders stored, want only the two sent as JSON", len(s.orders))
+	}
+}
+
+func TestOrderIDFailureIsAGraceful500(t *testing.T) {
+	s := newTestService(t)
+	s.newOrderID = func() (string, error) {
+		return "", errors.New("crypto/rand: entropy source unavailable")
+	}
+
+	rec := postOrder(s, "application/json", `{"customer_id":1,"items":[{"product_id":"a","quantity":1,"price":5}]}`)
+	if rec.Code != http.StatusInternalServerError || !strings.Contains(rec.Body.String(), "Could not assign an order ID") {
+		t.Errorf("order with a failing ID generator: %d %s, want 500 naming the ID failure", rec.Code, rec.Body)
+	}
+	if len(s.orders) != 0 {
+		t.Errorf("%d orders stored without IDs", len(s.orders))
+	}
+
+	// A client-supplied order ID needs no generator
+	rec = postOrder(s, "application/json", `{"order_id":"mine","customer_id":1,"items":[{"product_id":"a","quantity":1,"price":5}]}`)
+	if rec.Code == http.StatusInternalServerError {
+		t.Errorf("order with its own ID: %d %s", rec.Code, rec.Body)
+	}
+}
+
+func TestValidateOrderRejectsEachBadField(t *testing.T) {
+	valid := func() Order {
+		return Order{CustomerID: 1, Items: []Item{{ProductID: "a", Quantity: 2, Price: 5}, {ProductID: "b", Quantity: 1, Price: 0}}}
+	}
+	for _, tc := range []struct {
+		name   string
+		mutate func(*Order)
+		fields []string
+	}{
+		{"valid order", func(*Order) {}, nil},
+		{"no items", func(o *Order) { o.Items = nil }, []string{"items"}},
+		{"zero quantity", func(o *Order) { o.Items[1].Quantity = 0 }, []string{"items[1].quantity"}},
+		{"negative quantity", func(o *Order) { o.Items[0].Quantity = -3 }, []string{"items[0].quantity"}},
+		{"negative price", func(o *Order) { o.Items[0].Price = -0.01 }, []string{"items[0].price"}},
+		{"zero customer", func(o *Order) { o.CustomerID = 0 }, []string{"customer_id"}},
+		{"negative customer", func(o *Order) { o.CustomerID = -7 }, []string{"customer_id"}},
+		{"several problems", func(o *Order) { o.CustomerID = 0; o.Items[1].Price = -1 }, []string{"customer_id", "items[1].price"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			order := valid()
+			tc.mutate(&order)
+			var fields []string
+			for _, problem := range validateOrder(&order, orderLimits{}) {
+				fields = append(fields, problem.Field)
+			}
+			if strings.Join(fields, ",") != strings.Join(tc.fields, ",") {
+				t.Errorf("validateOrder flagged %v, want %v", fields, tc.fields)
+			}
+		})
+	}
+}
+
+func TestInvalidOrderIsRejectedWith422(t *testing.T) {
+	s := newTestService(t)
+	rec := postOrder(s, "application/json", `{"customer_id":0,"items":[{"product_id":"a","quantity":-1,"price":5}]}`)
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("invalid order = %d, want 422", rec.Code)
+	}
+	var body struct {
+		Fields []fieldError `json:"fields"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatalf("undecodable 422 body: %v", err)
+	}
+	if len(body.Fields) != 2 || body.Fields[0].Field != "customer_id" || body.Fields[1].Field != "items[0].quantity" {
+		t.Errorf("422 listed %+v, want customer_id and items[0].quantity", body.Fields)
+	}
+}
+
+func TestStatsReportConcurrencyAndInFlight(t *testing.T) {
+	s := NewOrderService(3, 10, paymentLatency{mean: 200 * time.Millisecond}, testFailureReasons, 1<<20, orderLimits{}, 0)
+	for i := 0; i < 5; i++ {
+		go postOrder(s, "application/json", `{"customer_id":1,"items":[{"product_id":"a","quantity":1,"price":5}]}`)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for s.processor.InFlight() < 3 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	// Sampled before any 200ms payment can finish and free its slot
+	rec := httptest.NewRecorder()
+	s.GetStats(rec, httptest.NewRequest(http.MethodGet, "/stats", nil))
+	var stats struct {
+		Concurrency int   `json:"concurrency"`
+		InFlight    int64 `json:"payments_in_flight"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&stats); err != nil {
+		t.Fatalf("undecodable stats: %v", err)
+	}
+	if stats.Concurrency != 3 || stats.InFlight != 3 {
+		t.Errorf("stats report concurrency %d with %d in flight, want 3 and 3", stats.Concurrency, stats.InFlight)
+	}
+}
+
+// BenchmarkPaymentConcurrency times 100 simultaneous sync orders of 10ms
+// payments; at concurrency 10 they should finish about ten times sooner
+func BenchmarkPaymentConcurrency(b *testing.B) {
+	logger := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	b.Cleanup(func() { slog.SetDefault(logger) })
+
+	for _, concurrency := range []int{1, 10} {
+		b.Run(fmt.Sprintf("concurrency=%d", concurrency), func(b *testing.B) {
+			s := NewOrderService(concurrency, 100, paymentLatency{mean: 10 * time.Millisecond}, testFailureReasons, 1<<20, orderLimits{}, 0)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				var wg sync.WaitGroup
+				for j := 0; j < 100; j++ {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						postOrder(s, "application/json", `{"customer_id":1,"items":[{"product_id":"a","quantity":1,"price":5}]}`)
+					}()
+				}
+				wg.Wait()
+			}
+		})
+	}
+}
+
+func TestTransitionAllowsOnlyTheLifecycle(t *testing.T) {
+	all := []OrderStatus{StatusPending, StatusProcessing, StatusCompleted, StatusFailed}
+	legal := map[[2]OrderStatus]bool{
+		{StatusPending, StatusProcessing}:   true,
+		{StatusProcessing, StatusCompleted}: true,
+		{StatusProcessing, StatusFailed}:    true,
+	}
+	for _, from := range all {
+		for _, to := range all {
+			if err := Transition(from, to); (err == nil) != legal[[2]OrderStatus{from, to}] {
+				t.Errorf("%s -> %s = %v", from, to, err)
+			}
+		}
+	}
+}
+
+func TestUpdateStatusRejectsIllegalMoves(t *testing.T) {
+	s := newTestService(t)
+	order := &Order{OrderID: "o1", Status: StatusPending}
+	for _, to := range []OrderStatus{StatusProcessing, StatusFailed} {
+		if err := s.UpdateStatus(order, to); err != nil {
+			t.Fatalf("move to %s: %v", to, err)
+		}
+	}
+	for _, to := range []OrderStatus{StatusPending, StatusProcessing, StatusCompleted} {
+		if err := s.UpdateStatus(order, to); err == nil {
+			t.Errorf("failed -> %s was allowed", to)
+		}
+	}
+	if order.Status != StatusFailed {
+		t.Errorf("status = %s after illegal moves, want failed", order.Status)
+	}
+}
+
+func TestOrderBodyLimitAndUnknownFields(t *testing.T) {
+	s := NewOrderService(1, 10, paymentLatency{}, testFailureReasons, 64, orderLimits{maxItems: 50, maxQuantity: 1000}, 0)
+	oversized := `{"customer_id":1,"items":[{"product_id":"` + strings.Repeat("a", 100) + `","quantity":1,"price":5}]}`
+	if rec := postOrder(s, "application/json", oversized); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized body = %d, want 413", rec.Code)
+	}
+	rec := postOrder(s, "application/json", `{"customer_id":1,"itemz":[]}`)
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), `"itemz"`) {
+		t.Errorf("unknown field = %d %q, want 400 naming itemz", rec.Code, rec.Body)
+	}
+}
+
+func TestEachPaymentFailureReasonIsReportedAndCounted(t *testing.T) {
+	for _, reason := range paymentFailureReasons {
+		t.Run(reason, func(t *testing.T) {
+			s := NewOrderService(1, 10, paymentLatency{}, []reasonWeight{{reason: reason, weight: 1}}, 1<<20, orderLimits{maxItems: 50, maxQuantity: 1000}, 0)
+			// Payments fail 5% of the time, so a refusal turns up well
+			// within this many orders
+			var rec *httptest.ResponseRecorder
+			for i := 0; i < 500; i++ {
+				if rec = postOrder(s, "application/json", `{"customer_id":1,"items":[{"product_id":"a","quantity":1,"price":5}]}`); rec.Code != http.StatusOK {
+					break
+				}
+			}
+			var body map[string]interface{}
+			json.NewDecoder(rec.Body).Decode(&body)
+			if rec.Code != http.StatusPaymentRequired || body["reason"] != reason {
+				t.Fatalf("failed order = %d %v, want 402 with reason %s", rec.Code, body, reason)
+			}
+
+			stats := httptest.NewRecorder()
+			s.GetStats(stats, httptest.NewRequest(http.MethodGet, "/stats", nil))
+			var got struct {
+				ByReason map[string]int `json:"payment_failures_by_reason"`
+			}
+			json.NewDecoder(stats.Body).Decode(&got)
+			for _, other := range paymentFailureReasons {
+				want := 0
+				if other == reason {
+					want = 1
+				}
+				if got.ByReason[other] != want {
+					t.Errorf("payment_failures_by_reason[%s] = %d, want %d", other, got.ByReason[other], want)
+				}
+			}
+		})
+	}
+}
+
+func TestFailureReasonWeightsAreValidated(t *testing.T) {
+	for value, valid := range map[string]bool{
+		"declined=1,gateway_timeout=3": true,
+		"declined=0,fraud_suspected=1": true,
+		"declined=0":                   false,
+		"stolen=1":                     false,
+		"declined=-1":                  false,
+		"declined":                     false,
+	} {
+		t.Setenv("PAYMENT_FAILURE_REASONS", value)
+		if _, err := loadFailureReasons(); (err == nil) != valid {
+			t.Errorf("PAYMENT_FAILURE_REASONS=%q: err = %v, want valid %v", value, err, valid)
+		}
+	}
+}
+
+// captureLogs sends the default logger's JSON lines to the returned buffer
+// until the test ends
+func captureLogs(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	logger := slog.Default()
+	var buf bytes.Buffer
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, nil)))
+	t.Cleanup(func() { slog.SetDefault(logger) })
+	return &buf
+}
+
+func TestSyncOrderRequestIDIsEchoedAndLoggedByPayment(t *testing.T) {
+	s := newTestService(t)
+	logs := captureLogs(t)
+	body := `{"customer_id":1,"items":[{"product_id":"a","quantity":1,"price":5}]}`
+
+	request := httptest.NewRequest(http.MethodPost, "/orders/sync", strings.NewReader(body))
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("X-Request-ID", "client-abc-123")
+	rec := httptest.NewRecorder()
+	s.CreateOrderSync(rec, request)
+
+	for _, header := range []string{"X-Request-ID", "X-Trace-ID"} {
+		if got := rec.Header().Get(header); got != "client-abc-123" {
+			t.Errorf("%s = %q, want the client's client-abc-123", header, got)
+		}
+	}
+	var syncLines, paymentLines int
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		var entry struct {
+			Msg       string `json:"msg"`
+			RequestID string `json:"request_id"`
+		}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("log line %q: %v", line, err)
+		}
+		switch {
+		case strings.HasPrefix(entry.Msg, "[SYNC]"):
+			syncLines++
+		case strings.HasPrefix(entry.Msg, "[PAYMENT]"):
+			paymentLines++
+		default:
+			continue
+		}
+		if entry.RequestID != "client-abc-123" {
+			t.Errorf("%q logged with request_id %q", entry.Msg, entry.RequestID)
+		}
+	}
+	if syncLines != 2 || paymentLines != 2 {
+		t.Errorf("%d [SYNC] and %d [PAYMENT] lines, want 2 of each:\n%s", syncLines, paymentLines, logs)
+	}
+}
+
+func TestSyncOrderWithoutRequestIDGetsAGeneratedOne(t *testing.T) {
+	s := newTestService(t)
+	captureLogs(t)
+	rec := postOrder(s, "application/json", `{"customer_id":1,"items":[{"product_id":"a","quantity":1,"price":5}]}`)
+	requestID := rec.Header().Get("X-Request-ID")
+	if _, err := uuid.Parse(requestID); err != nil {
+		t.Errorf("generated X-Request-ID %q is not a UUID: %v", requestID, err)
+	}
+	if traceID := rec.Header().Get("X-Trace-ID"); traceID != requestID {
+		t.Errorf("X-Trace-ID = %q, want the X-Request-ID %q", traceID, requestID)
+	}
+}
+
+// orderOf builds an order for customer 1 with one line item per quantity
+func orderOf(quantities ...int) Order {
+	order := Order{CustomerID: 1}
+	for i, quantity := range quantities {
+		order.Items = append(order.Items, Item{ProductID: fmt.Sprintf("p%d", i), Quantity: quantity, Price: 1})
+	}
+	return order
+}
+
+func TestValidateOrderEnforcesItemAndQuantityLimits(t *testing.T) {
+	limits := orderLimits{maxItems: 3, maxQuantity: 10}
+	for _, tc := range []struct {
+		name       string
+		limits     orderLimits
+		quantities []int
+		message    string
+	}{
+		{"items at the limit", limits, []int{1, 1, 1}, ""},
+		{"one item over", limits, []int{1, 1, 1, 1}, "has 4 items, the maximum is 3"},
+		{"quantity at the limit", limits, []int{5, 5}, ""},
+		{"quantity one over", limits, []int{5, 6}, "total quantity exceeds the maximum of 10"},
+		{"quantities that would overflow a sum", limits, []int{math.MaxInt, math.MaxInt}, "total quantity exceeds the maximum of 10"},
+		{"limits disabled", orderLimits{}, slices.Repeat([]int{1000}, 100), ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			order := orderOf(tc.quantities...)
+			var messages []string
+			for _, problem := range validateOrder(&order, tc.limits) {
+				messages = append(messages, problem.Message)
+			}
+			var want []string
+			if tc.message != "" {
+				want = []string{tc.message}
+			}
+			if !slices.Equal(messages, want) {
+				t.Errorf("validateOrder reported %q, want %q", messages, want)
+			}
+		})
+	}
+}
+
+func TestOversizedOrderIsRejectedWith422(t *testing.T) {
+	s := NewOrderService(1, 10, paymentLatency{}, testFailureReasons, 1<<20, orderLimits{maxItems: 2, maxQuantity: 20}, 0)
+	for _, tc := range []struct {
+		items string
+		code  int
+	}{
+		{`[{"product_id":"a","quantity":1,"price":1},{"product_id":"b","quantity":1,"price":1}]`, http.StatusOK},
+		{`[{"product_id":"a","quantity":1,"price":1},{"product_id":"b","quantity":1,"price":1},{"product_id":"c","quantity":1,"price":1}]`, http.StatusUnprocessableEntity},
+		{`[{"product_id":"a","quantity":20,"price":1}]`, http.StatusOK},
+		{`[{"product_id":"a","quantity":21,"price":1}]`, http.StatusUnprocessableEntity},
+	} {
+		// A 5% payment failure answers 402, which still passed validation
+		rec := postOrder(s, "application/json", `{"customer_id":1,"items":`+tc.items+`}`)
+		if got := rec.Code; got != tc.code && !(tc.code == http.StatusOK && got == http.StatusPaymentRequired) {
+			t.Errorf("items %s: %d %s, want %d", tc.items, got, rec.Body, tc.code)
+		}
+	}
+}
+
+func TestOrderLimitsComeFromTheEnvironment(t *testing.T) {
+	t.Setenv("MAX_ITEMS", "7")
+	t.Setenv("MAX_QUANTITY", "0")
+	if limits, err := loadOrderLimits(); err != nil || limits != (orderLimits{maxItems: 7}) {
+		t.Errorf("loadOrderLimits = %+v, %v; want 7 items and no quantity limit", limits, err)
+	}
+	for _, name := range []string{"MAX_ITEMS", "MAX_QUANTITY"} {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv(name, "-1")
+			if _, err := loadOrderLimits(); err == nil || !strings.Contains(err.Error(), name) {
+				t.Errorf("negative %s: %v, want an error naming it", name, err)
+			}
+		})
+	}
+}
+
+func TestGetOrderDoesNotRaceStatusChanges(t *testing.T) {
+	s := newTestService(t)
+	order := &Order{OrderID: "o1", CustomerID: 1, Status: StatusPending}
+	s.orders[order.OrderID] = order
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for _, to := range []OrderStatus{StatusProcessing, StatusCompleted} {
+			s.UpdateStatus(order, to)
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		request := mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/orders/o1", nil), map[string]string{"id": "o1"})
+		rec := httptest.NewRecorder()
+		s.GetOrder(rec, request)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET order: %d %s", rec.Code, rec.Body)
+		}
+	}
+	<-done
+}
+
+func TestFullPaymentQueueRejectsWith503(t *testing.T) {
+	// PAYMENT_QUEUE_SIZE=0: nothing may wait behind the one busy worker
+	s := NewOrderService(1, 0, paymentLatency{mean: time.Second}, testFailureReasons, 1<<20, orderLimits{}, 0)
+	body := `{"customer_id":1,"items":[{"product_id":"a","quantity":1,"price":5}]}`
+	// An unbuffered queue only hands a payment to a worker already waiting
+	// for one, so keep offering until the worker has picked it up
+	deadline := time.Now().Add(time.Second)
+	for s.processor.InFlight() < 1 && time.Now().Before(deadline) {
+		s.processor.Submit(context.Background(), "occupying")
+		time.Sleep(5 * time.Millisecond)
+	}
+	if s.processor.InFlight() != 1 {
+		t.Fatal("no payment ever occupied the worker")
+	}
+	_, _, before := s.processor.QueueStats()
+
+	for i := 0; i < 2; i++ {
+		rec := postOrder(s, "application/json", body)
+		if rec.Code != http.StatusServiceUnavailable {
+			t.Fatalf("order %d behind a full queue got %d, want 503", i, rec.Code)
+		}
+		if got := rec.Header().Get("Retry-After"); got != "3" {
+			t.Errorf("Retry-After = %q, want 3", got)
+		}
+	}
+	s.mu.RLock()
+	stored := len(s.orders)
+	s.mu.RUnlock()
+	if stored != 0 {
+		t.Errorf("%d rejected orders were stored", stored)
+	}
+
+	if _, _, rejected := s.processor.QueueStats(); rejected != before+2 {
+		t.Errorf("QueueStats reports %d rejected, want %d", rejected, before+2)
+	}
+	rec := httptest.NewRecorder()
+	s.GetStats(rec, httptest.NewRequest(http.MethodGet, "/stats", nil))
+	var stats struct {
+		PaymentQueue struct {
+			Length   int   `json:"length"`
+			Capacity int   `json:"capacity"`
+			Rejected int64 `json:"rejected"`
+		} `json:"payment_queue"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&stats); err != nil {
+		t.Fatalf("undecodable stats: %v", err)
+	}
+	if q := stats.PaymentQueue; q.Length != 0 || q.Capacity != 0 || q.Rejected != before+2 {
+		t.Errorf("payment_queue = %+v, want length 0, capacity 0, rejected %d", q, before+2)
+	}
+}
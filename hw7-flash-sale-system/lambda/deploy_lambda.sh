@@ -18,6 +18,12 @@ echo "Building Lambda function..."
 GOOS=linux GOARCH=amd64 CGO_ENABLED=0 go build -o main order_processor_lambda.go
 zip deployment.zip main
 
+# Record processed orders in DynamoDB when ORDERS_TABLE is set
+ENVIRONMENT_ARGS=()
+if [ -n "${ORDERS_TABLE}" ]; then
+    ENVIRONMENT_ARGS=(--environment "Variables={ORDERS_TABLE=${ORDERS_TABLE}}")
+fi
+
 # Create Lambda function
 echo "Creating Lambda function..."
 aws lambda create-function \
@@ -28,6 +34,7 @@ aws lambda create-function \
     --zip-file fileb://deployment.zip \
     --memory-size 512 \
     --timeout 10 \
+    "${ENVIRONMENT_ARGS[@]}" \
     --region ${AWS_REGION}
 
 # Add SNS trigger
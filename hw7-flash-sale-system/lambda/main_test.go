@@ -0,0 +1,392 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+)
+
+// fakeDynamo stands in for the DynamoDB JSON API, covering the GetItem and
+// conditional PutItem calls the handler makes against ORDERS_TABLE
+type fakeDynamo struct {
+	mu sync.Mutex
+	// order_id -> attribute -> {"S": value} or {"N": value}
+	items map[string]map[string]map[string]string
+	// Completed records written per order_id
+	completedPuts map[string]int
+}
+
+func (f *fakeDynamo) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var request struct {
+		Key  map[string]map[string]string `json:"Key"`
+		Item map[string]map[string]string `json:"Item"`
+	}
+	body, _ := io.ReadAll(r.Body)
+	json.Unmarshal(body, &request)
+	w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+
+	switch op := strings.TrimPrefix(r.Header.Get("X-Amz-Target"), "DynamoDB_20120810."); op {
+	case "GetItem":
+		item, found := f.items[request.Key["order_id"]["S"]]
+		if !found {
+			w.Write([]byte(`{}`))
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"Item": item})
+	case "PutItem":
+		orderID := request.Item["order_id"]["S"]
+		// The handler's condition: never overwrite a completed record
+		if f.items[orderID]["status"]["S"] == "completed" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"__type":"com.amazonaws.dynamodb.v20120810#ConditionalCheckFailedException","message":"The conditional request failed"}`))
+			return
+		}
+		f.items[orderID] = request.Item
+		if request.Item["status"]["S"] == "completed" {
+			f.completedPuts[orderID]++
+		}
+		w.Write([]byte(`{}`))
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"__type":"com.amazon.coral.service#UnknownOperationException","message":"` + op + `"}`))
+	}
+}
+
+// status returns the status recorded for an order, or "" if none
+func (f *fakeDynamo) status(orderID string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.items[orderID]["status"]["S"]
+}
+
+// puts returns how many completed records were written for an order
+func (f *fakeDynamo) puts(orderID string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.completedPuts[orderID]
+}
+
+// useFakeDynamo points ORDERS_TABLE at a fresh fakeDynamo and makes
+// payments instant and successful for the rest of the test
+func useFakeDynamo(t *testing.T) *fakeDynamo {
+	t.Helper()
+	fake := &fakeDynamo{items: map[string]map[string]map[string]string{}, completedPuts: map[string]int{}}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	previousClient, previousTable, previousLatency, previousFailure := dynamoClient, ordersTable, paymentLatency, simulatePaymentFailure
+	t.Cleanup(func() {
+		dynamoClient, ordersTable, paymentLatency, simulatePaymentFailure = previousClient, previousTable, previousLatency, previousFailure
+	})
+	dynamoClient = dynamodb.New(dynamodb.Options{
+		Region:       "us-east-1",
+		BaseEndpoint: aws.String(server.URL),
+		Credentials:  aws.AnonymousCredentials{},
+	})
+	ordersTable = "orders"
+	paymentLatency = paymentLatencyConfig{}
+	simulatePaymentFailure = func() bool { return false }
+	return fake
+}
+
+// failPaymentsOnce makes the payments at the given positions (counting from
+// zero across the rest of the test) fail and every other payment succeed.
+// The returned function counts the payments made so far.
+func failPaymentsOnce(positions ...int) (payments func() int) {
+	var mu sync.Mutex
+	calls := 0
+	simulatePaymentFailure = func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		position := calls
+		calls++
+		for _, failing := range positions {
+			if position == failing {
+				return true
+			}
+		}
+		return false
+	}
+	return func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return calls
+	}
+}
+
+// batchMessage is a {"orders": [...]} message carrying the given order IDs
+func batchMessage(t *testing.T, orderIDs ...string) string {
+	t.Helper()
+	orders := make([]Order, len(orderIDs))
+	for i, orderID := range orderIDs {
+		orders[i] = Order{OrderID: orderID, CustomerID: 1, Items: []Item{{ProductID: "p", Quantity: 1, Price: 5}}}
+	}
+	message, err := json.Marshal(map[string]interface{}{"orders": orders})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(message)
+}
+
+func discardLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+func TestProcessMessageSkipsOrdersAlreadyCompleted(t *testing.T) {
+	fake := useFakeDynamo(t)
+	fake.items["a"] = map[string]map[string]string{"order_id": {"S": "a"}, "status": {"S": "completed"}}
+
+	var result recordResult
+	if err := processMessage(context.Background(), discardLogger(), "m1", batchMessage(t, "a", "b"), &result); err != nil {
+		t.Fatalf("processMessage: %v", err)
+	}
+	if result.skipped != 1 || result.processed != 1 {
+		t.Errorf("skipped %d, processed %d; want 1 and 1", result.skipped, result.processed)
+	}
+	if got := fake.puts("a"); got != 0 {
+		t.Errorf("completed order a was recorded again %d times", got)
+	}
+	if got := fake.status("b"); got != "completed" {
+		t.Errorf("order b status %q, want completed", got)
+	}
+}
+
+func TestMixedSQSBatchRetriesOnlyTheFailedMessage(t *testing.T) {
+	fake := useFakeDynamo(t)
+	// The second of three single-order messages fails its payment
+	failPaymentsOnce(1)
+	event := events.SQSEvent{Records: []events.SQSMessage{
+		{MessageId: "m1", Body: `{"order_id":"a","customer_id":1,"items":[{"product_id":"p","quantity":1,"price":5}]}`},
+		{MessageId: "m2", Body: `{"order_id":"b","customer_id":1,"items":[{"product_id":"p","quantity":1,"price":5}]}`},
+		{MessageId: "m3", Body: `{"order_id":"c","customer_id":1,"items":[{"product_id":"p","quantity":1,"price":5}]}`},
+	}}
+
+	response, err := ProcessSQSOrders(context.Background(), event)
+	if err != nil {
+		t.Fatalf("ProcessSQSOrders: %v", err)
+	}
+	if len(response.BatchItemFailures) != 1 || response.BatchItemFailures[0].ItemIdentifier != "m2" {
+		t.Fatalf("batch item failures %+v, want only m2", response.BatchItemFailures)
+	}
+	for orderID, want := range map[string]string{"a": "completed", "b": "failed", "c": "completed"} {
+		if got := fake.status(orderID); got != want {
+			t.Errorf("order %s status %q, want %q", orderID, got, want)
+		}
+	}
+}
+
+func TestRetriedBatchMessageChargesOnlyTheFailedOrder(t *testing.T) {
+	fake := useFakeDynamo(t)
+	payments := failPaymentsOnce(1)
+	message := batchMessage(t, "a", "b", "c")
+
+	// First delivery: b fails, so the whole message is retried
+	var first recordResult
+	err := processMessage(context.Background(), discardLogger(), "m1", message, &first)
+	var refused *PaymentError
+	if !errors.As(err, &refused) || refused.OrderID != "b" {
+		t.Fatalf("first delivery returned %v, want b's payment error", err)
+	}
+	if first.processed != 2 || first.failed != 1 {
+		t.Errorf("first delivery processed %d, failed %d; want 2 and 1", first.processed, first.failed)
+	}
+
+	// Redelivery: a and c completed the first time and must not be charged again
+	var retry recordResult
+	if err := processMessage(context.Background(), discardLogger(), "m1", message, &retry); err != nil {
+		t.Fatalf("redelivery: %v", err)
+	}
+	if retry.processed != 1 || retry.skipped != 2 {
+		t.Errorf("redelivery processed %d, skipped %d; want 1 and 2", retry.processed, retry.skipped)
+	}
+	if got := payments(); got != 4 {
+		t.Errorf("%d payments made across both deliveries, want 4", got)
+	}
+	for _, orderID := range []string{"a", "b", "c"} {
+		if got := fake.puts(orderID); got != 1 {
+			t.Errorf("order %s recorded completed %d times, want once", orderID, got)
+		}
+	}
+}
+
+func TestSNSInvocationFailsWhenARecordFails(t *testing.T) {
+	fake := useFakeDynamo(t)
+	payments := failPaymentsOnce(0)
+	event := events.SNSEvent{Records: []events.SNSEventRecord{
+		{SNS: events.SNSEntity{MessageID: "m1", Message: `{"order_id":"a","customer_id":1,"items":[{"product_id":"p","quantity":1,"price":5}]}`}},
+		{SNS: events.SNSEntity{MessageID: "m2", Message: `{"order_id":"b","customer_id":1,"items":[{"product_id":"p","quantity":1,"price":5}]}`}},
+	}}
+
+	if err := ProcessOrder(context.Background(), event); err == nil {
+		t.Fatal("ProcessOrder succeeded with a failed record")
+	}
+	if got := fake.status("b"); got != "completed" {
+		t.Errorf("record after the failure has status %q, want completed", got)
+	}
+
+	// SNS retries the invocation; only a is charged this time
+	if err := ProcessOrder(context.Background(), event); err != nil {
+		t.Fatalf("retried invocation: %v", err)
+	}
+	if got := payments(); got != 3 {
+		t.Errorf("%d payments made across both invocations, want 3", got)
+	}
+	if got := fake.puts("b"); got != 1 {
+		t.Errorf("order b recorded completed %d times, want once", got)
+	}
+	if got := fake.status("a"); got != "completed" {
+		t.Errorf("order a status %q after retry, want completed", got)
+	}
+}
+
+func TestOrdersFromMessageTellsPayloadsApart(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		message string
+		orders  []string
+		invalid bool
+	}{
+		{"single order", `{"order_id":"a","customer_id":1,"items":[{"product_id":"p","quantity":1,"price":5}]}`, []string{"a"}, false},
+		{"batch", `{"orders":[{"order_id":"a","customer_id":1},{"order_id":"b","customer_id":2}]}`, []string{"a", "b"}, false},
+		{"empty batch", `{"orders":[]}`, []string{}, false},
+		{"control message", `{"type":"sale_closed","at":"2026-01-01T00:00:00Z"}`, nil, false},
+		{"unknown object", `{"hello":"world"}`, nil, false},
+		{"not JSON", `order a please`, nil, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			orders, err := ordersFromMessage(tc.message)
+			if (err != nil) != tc.invalid {
+				t.Fatalf("error %v, want invalid %v", err, tc.invalid)
+			}
+			if (orders == nil) != (tc.orders == nil) || len(orders) != len(tc.orders) {
+				t.Fatalf("orders %+v, want %v", orders, tc.orders)
+			}
+			for i, order := range orders {
+				if order.OrderID != tc.orders[i] {
+					t.Errorf("order %d is %s, want %s", i, order.OrderID, tc.orders[i])
+				}
+			}
+		})
+	}
+}
+
+func TestSNSInvocationSkipsControlMessages(t *testing.T) {
+	fake := useFakeDynamo(t)
+	event := events.SNSEvent{Records: []events.SNSEventRecord{
+		{SNS: events.SNSEntity{MessageID: "m1", Message: `{"order_id":"a","customer_id":1,"items":[{"product_id":"p","quantity":1,"price":5}]}`}},
+		{SNS: events.SNSEntity{MessageID: "m2", Message: `{"type":"sale_opened"}`}},
+		{SNS: events.SNSEntity{MessageID: "m3", Message: batchMessage(t, "b", "c")}},
+	}}
+
+	if err := ProcessOrder(context.Background(), event); err != nil {
+		t.Fatalf("invocation with a control message failed: %v", err)
+	}
+	for _, orderID := range []string{"a", "b", "c"} {
+		if got := fake.status(orderID); got != "completed" {
+			t.Errorf("order %s status %q, want completed", orderID, got)
+		}
+	}
+}
+
+func TestSQSBatchRetriesOnlyTheMalformedRecord(t *testing.T) {
+	useFakeDynamo(t)
+	event := events.SQSEvent{Records: []events.SQSMessage{
+		{MessageId: "control", Body: `{"Type":"Notification","MessageId":"n1","Message":"{\"type\":\"sale_closed\"}"}`},
+		{MessageId: "garbled", Body: `{"Type":"Notification","MessageId":"n2","Message":"not json"}`},
+		{MessageId: "batch", Body: batchMessage(t, "a", "b")},
+	}}
+
+	response, err := ProcessSQSOrders(context.Background(), event)
+	if err != nil {
+		t.Fatalf("ProcessSQSOrders: %v", err)
+	}
+	if len(response.BatchItemFailures) != 1 || response.BatchItemFailures[0].ItemIdentifier != "garbled" {
+		t.Errorf("batch item failures %+v, want only the garbled record", response.BatchItemFailures)
+	}
+}
+
+func TestFailedPaymentsAreCountedByReason(t *testing.T) {
+	for _, reason := range paymentFailureReasons {
+		t.Run(reason, func(t *testing.T) {
+			useFakeDynamo(t)
+			saved := failureReasons
+			failureReasons = failureReasonWeights{{reason, 1}}
+			t.Cleanup(func() { failureReasons = saved })
+			failPaymentsOnce(0, 2)
+
+			var result recordResult
+			err := processMessage(context.Background(), discardLogger(), "m1", batchMessage(t, "a", "b", "c"), &result)
+			var refused *PaymentError
+			if !errors.As(err, &refused) || refused.Reason != reason {
+				t.Fatalf("processMessage = %v, want a %s PaymentError", err, reason)
+			}
+			if want := map[string]int{reason: 2}; !maps.Equal(result.failuresByReason, want) || result.processed != 1 {
+				t.Errorf("failures by reason %v with %d processed, want %v and 1", result.failuresByReason, result.processed, want)
+			}
+		})
+	}
+}
+
+func TestCompletedReportCarriesTheChargeTime(t *testing.T) {
+	reports := make(chan map[string]interface{}, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var report map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&report)
+		reports <- report
+	}))
+	t.Cleanup(server.Close)
+	saved := orderServiceURL
+	orderServiceURL = server.URL
+	t.Cleanup(func() { orderServiceURL = saved })
+
+	before := time.Now()
+	reportStatus(discardLogger(), "o1", "processing")
+	reportStatus(discardLogger(), "o1", "completed")
+	if processing := <-reports; processing["processed_at"] != nil {
+		t.Errorf("processing report carried processed_at: %v", processing)
+	}
+	stamp, _ := (<-reports)["processed_at"].(string)
+	if processedAt, err := time.Parse(time.RFC3339Nano, stamp); err != nil || processedAt.Before(before.Add(-time.Second)) {
+		t.Errorf("completed report processed_at = %q, want the time it was sent", stamp)
+	}
+}
+
+func TestOrdersTheServiceGaveUpOnAreNotCharged(t *testing.T) {
+	for _, status := range []string{"cancelled", "expired", "rejected"} {
+		t.Run(status, func(t *testing.T) {
+			fake := useFakeDynamo(t)
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == http.MethodGet {
+					json.NewEncoder(w).Encode(map[string]string{"order_id": "a", "status": status})
+				}
+			}))
+			t.Cleanup(server.Close)
+			saved := orderServiceURL
+			orderServiceURL = server.URL
+			t.Cleanup(func() { orderServiceURL = saved })
+
+			if err := processOrder(context.Background(), discardLogger(), Order{OrderID: "a", CustomerID: 1}); !errors.Is(err, errOrderCancelled) {
+				t.Fatalf("processOrder = %v, want errOrderCancelled", err)
+			}
+			if got := fake.status("a"); got != "" {
+				t.Errorf("order recorded as %q, want nothing written", got)
+			}
+		})
+	}
+}
@@ -1,14 +1,30 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamotypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/smithy-go"
 )
 
 // Order represents an e-commerce order
@@ -19,6 +35,8 @@ type Order struct {
 	Items       []Item    `json:"items"`
 	CreatedAt   time.Time `json:"created_at"`
 	ProcessedAt time.Time `json:"processed_at"`
+	// X-Request-ID of the order service call that submitted the order
+	RequestID string `json:"request_id,omitempty"`
 }
 
 // Item represents a product in an order
@@ -28,35 +46,603 @@ type Item struct {
 	Price     float64 `json:"price"`
 }
 
-// ProcessOrder handles SNS events directly (no SQS needed)
+// snsPayload holds the fields that tell the message kinds on the topic
+// apart: a single order, a batch of orders, or a control message
+type snsPayload struct {
+	OrderID string  `json:"order_id"`
+	Orders  []Order `json:"orders"`
+	Type    string  `json:"type"`
+}
+
+// errOrderCancelled signals that the customer cancelled the order after it
+// was published, so it must not be charged
+var errOrderCancelled = errors.New("order cancelled")
+
+// orderServiceURL is where cancellations and amendments are checked and
+// status changes reported (ORDER_SERVICE_URL); when empty every order is
+// charged silently
+var orderServiceURL = strings.TrimRight(os.Getenv("ORDER_SERVICE_URL"), "/")
+
+var orderServiceClient = &http.Client{Timeout: 2 * time.Second}
+
+// orderServiceAPIKey is sent as X-API-Key when reporting status, for an
+// order service that requires authentication (ORDER_SERVICE_API_KEY)
+var orderServiceAPIKey = os.Getenv("ORDER_SERVICE_API_KEY")
+
+// serviceOrder is the order service's current copy of a published order
+type serviceOrder struct {
+	Status string `json:"status"`
+	Items  []Item `json:"items"`
+	// Set once PATCH /orders/{id} replaced the items after publishing
+	AmendedAt *time.Time `json:"amended_at"`
+}
+
+// lookupOrder asks the order service for its copy of the order, so one
+// cancelled with DELETE /orders/{id} or amended since it was published is
+// handled as it now stands. Orders it doesn't know about return nil.
+func lookupOrder(orderID string) (*serviceOrder, error) {
+	resp, err := orderServiceClient.Get(orderServiceURL + "/orders/" + url.PathEscape(orderID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up order %s: %w", orderID, err)
+	}
+	defer resp.Body.Close()
+	
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("order service returned %d for order %s", resp.StatusCode, orderID)
+	}
+	var order serviceOrder
+	if err := json.NewDecoder(resp.Body).Decode(&order); err != nil {
+		return nil, fmt.Errorf("failed to decode order %s: %w", orderID, err)
+	}
+	return &order, nil
+}
+
+// reportStatus writes an order's status back to the order service so
+// clients watching the order see it; failures are only logged
+func reportStatus(logger *slog.Logger, orderID, status string) {
+	if orderServiceURL == "" {
+		return
+	}
+	report := map[string]interface{}{"status": status}
+	// The order service measures its end-to-end SLO up to this moment
+	if status == "completed" {
+		report["processed_at"] = time.Now().UTC()
+	}
+	body, _ := json.Marshal(report)
+	req, err := http.NewRequest(http.MethodPost, orderServiceURL+"/admin/orders/"+url.PathEscape(orderID)+"/status", bytes.NewReader(body))
+	if err != nil {
+		logger.Warn("Failed to report order status", "status", status, "error", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if orderServiceAPIKey != "" {
+		req.Header.Set("X-API-Key", orderServiceAPIKey)
+	}
+	resp, err := orderServiceClient.Do(req)
+	if err != nil {
+		logger.Warn("Failed to report order status", "status", status, "error", err)
+		return
+	}
+	resp.Body.Close()
+}
+
+// ordersTable is the DynamoDB table that records each order's outcome
+// (ORDERS_TABLE); when empty nothing is recorded
+var ordersTable = os.Getenv("ORDERS_TABLE")
+
+// dynamoClient writes to ordersTable, set up in main when it is configured
+var dynamoClient *dynamodb.Client
+
+// errRecordRejected wraps DynamoDB errors that retrying can't fix, such as
+// a missing table or denied access, so the invocation isn't retried for them
+var errRecordRejected = errors.New("order record rejected")
+
+// recordOrder writes the order with its final status, keyed on order_id. An
+// already completed record is never overwritten, so a redelivered message
+// that fails can't undo an earlier success; that case is not an error.
+func recordOrder(ctx context.Context, logger *slog.Logger, order Order, status string) error {
+	if dynamoClient == nil {
+		return nil
+	}
+	
+	items, _ := json.Marshal(order.Items)
+	item := map[string]dynamotypes.AttributeValue{
+		"order_id":    &dynamotypes.AttributeValueMemberS{Value: order.OrderID},
+		"customer_id": &dynamotypes.AttributeValueMemberN{Value: strconv.Itoa(order.CustomerID)},
+		"status":      &dynamotypes.AttributeValueMemberS{Value: status},
+		"items":       &dynamotypes.AttributeValueMemberS{Value: string(items)},
+		"created_at":  &dynamotypes.AttributeValueMemberS{Value: order.CreatedAt.UTC().Format(time.RFC3339Nano)},
+	}
+	if status == "completed" {
+		item["processed_at"] = &dynamotypes.AttributeValueMemberS{Value: time.Now().UTC().Format(time.RFC3339Nano)}
+	}
+	if order.RequestID != "" {
+		item["request_id"] = &dynamotypes.AttributeValueMemberS{Value: order.RequestID}
+	}
+	
+	_, err := dynamoClient.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:                aws.String(ordersTable),
+		Item:                     item,
+		ConditionExpression:      aws.String("attribute_not_exists(order_id) OR #status <> :completed"),
+		ExpressionAttributeNames: map[string]string{"#status": "status"},
+		ExpressionAttributeValues: map[string]dynamotypes.AttributeValue{
+			":completed": &dynamotypes.AttributeValueMemberS{Value: "completed"},
+		},
+	})
+	if err == nil {
+		return nil
+	}
+	
+	var conditionFailed *dynamotypes.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		logger.Info("Order already recorded as completed, leaving record", "status", status)
+		return nil
+	}
+	if permanentDynamoError(err) {
+		return fmt.Errorf("%w: order %s: %v", errRecordRejected, order.OrderID, err)
+	}
+	return fmt.Errorf("failed to record order %s: %w", order.OrderID, err)
+}
+
+// errOrderCompleted signals that ORDERS_TABLE already records the order as
+// completed, so a redelivered message must not charge it again
+var errOrderCompleted = errors.New("order already completed")
+
+// checkNotCompleted returns errOrderCompleted if ORDERS_TABLE records the
+// order as completed. A record from an earlier failed attempt doesn't count.
+func checkNotCompleted(ctx context.Context, orderID string) error {
+	if dynamoClient == nil {
+		return nil
+	}
+	result, err := dynamoClient.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(ordersTable),
+		Key: map[string]dynamotypes.AttributeValue{
+			"order_id": &dynamotypes.AttributeValueMemberS{Value: orderID},
+		},
+		// An eventually consistent read could miss a completion just written
+		ConsistentRead:           aws.Bool(true),
+		ProjectionExpression:     aws.String("#status"),
+		ExpressionAttributeNames: map[string]string{"#status": "status"},
+	})
+	if err != nil {
+		if permanentDynamoError(err) {
+			return fmt.Errorf("%w: order %s: %v", errRecordRejected, orderID, err)
+		}
+		return fmt.Errorf("failed to look up order %s: %w", orderID, err)
+	}
+	if status, ok := result.Item["status"].(*dynamotypes.AttributeValueMemberS); ok && status.Value == "completed" {
+		return errOrderCompleted
+	}
+	return nil
+}
+
+// permanentDynamoError reports whether err is a client-side DynamoDB error
+// other than throttling; network errors and server faults are transient
+func permanentDynamoError(err error) bool {
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	switch apiErr.ErrorCode() {
+	case "ProvisionedThroughputExceededException", "ThrottlingException", "RequestLimitExceeded", "TransactionConflictException":
+		return false
+	}
+	return apiErr.ErrorFault() == smithy.FaultClient
+}
+
+// recordResult tallies what one invocation did with its records
+type recordResult struct {
+	processed int
+	failed    int
+	skipped   int
+	// IDs of the orders charged, logged so a retried batch can be traced
+	completed []string
+	// Failed payments by PaymentError reason
+	failuresByReason map[string]int
+}
+
+// invocationLogger tags log lines with the Lambda request ID, when known
+func invocationLogger(ctx context.Context) *slog.Logger {
+	logger := slog.Default()
+	if lc, ok := lambdacontext.FromContext(ctx); ok {
+		logger = logger.With("aws_request_id", lc.AwsRequestID)
+	}
+	return logger
+}
+
+// HandleEvent is the Lambda entry point. SQS batches (an event source
+// mapping with ReportBatchItemFailures) go to ProcessSQSOrders; anything
+// else is treated as an SNS event for ProcessOrder.
+func HandleEvent(ctx context.Context, event json.RawMessage) (interface{}, error) {
+	var source struct {
+		Records []struct {
+			// SQS spells the key eventSource and SNS EventSource; the
+			// case-insensitive match reads either
+			EventSource string `json:"eventSource"`
+		} `json:"Records"`
+	}
+	if err := json.Unmarshal(event, &source); err != nil {
+		return nil, fmt.Errorf("failed to parse event: %w", err)
+	}
+	
+	if len(source.Records) > 0 && source.Records[0].EventSource == "aws:sqs" {
+		var sqsEvent events.SQSEvent
+		if err := json.Unmarshal(event, &sqsEvent); err != nil {
+			return nil, fmt.Errorf("failed to parse SQS event: %w", err)
+		}
+		return ProcessSQSOrders(ctx, sqsEvent)
+	}
+	
+	var snsEvent events.SNSEvent
+	if err := json.Unmarshal(event, &snsEvent); err != nil {
+		return nil, fmt.Errorf("failed to parse SNS event: %w", err)
+	}
+	return nil, ProcessOrder(ctx, snsEvent)
+}
+
+// ProcessOrder handles SNS events directly (no SQS needed). Records may hold
+// a single order or a {"orders": [...]} batch; anything else is treated as a
+// control message and skipped. Every record is processed even after a
+// failure, but the invocation still fails if any order failed so SNS
+// retries all of its records. Before charging, processOrder skips orders
+// ORDERS_TABLE already records as completed, so the retry charges only the
+// orders that failed; without ORDERS_TABLE it charges every order again.
 func ProcessOrder(ctx context.Context, snsEvent events.SNSEvent) error {
+	var result recordResult
+	var errs []error
+	logger := invocationLogger(ctx)
+	
 	for _, record := range snsEvent.Records {
-		// Parse order from SNS message
-		var order Order
-		err := json.Unmarshal([]byte(record.SNS.Message), &order)
+		if err := processMessage(ctx, logger, record.SNS.MessageID, record.SNS.Message, &result); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	
+	logger.Info("Handled records", "records", len(snsEvent.Records),
+		"processed", result.processed, "failed", result.failed, "skipped", result.skipped, "completed", result.completed,
+		"payment_failures_by_reason", result.failuresByReason)
+	if len(errs) > 0 {
+		return fmt.Errorf("%d of %d orders failed: %w", result.failed, result.processed+result.failed, errors.Join(errs...))
+	}
+	return nil
+}
+
+// ProcessSQSOrders handles a batch from an SQS event source mapping and
+// reports only the messages that should be retried as batch item
+// failures, so the ones that succeeded are deleted rather than
+// redelivered. Bodies may be SNS notification envelopes or, with raw
+// message delivery, the order payload itself.
+func ProcessSQSOrders(ctx context.Context, sqsEvent events.SQSEvent) (events.SQSEventResponse, error) {
+	var result recordResult
+	var response events.SQSEventResponse
+	logger := invocationLogger(ctx)
+	
+	for _, record := range sqsEvent.Records {
+		message, err := unwrapNotification(record.Body)
+		if err == nil {
+			err = processMessage(ctx, logger, record.MessageId, message, &result)
+		} else {
+			logger.Error("Failed to parse message", "message_id", record.MessageId, "error", err)
+			result.failed++
+		}
 		if err != nil {
-			log.Printf("Failed to parse order: %v", err)
-			return err
+			response.BatchItemFailures = append(response.BatchItemFailures, events.SQSBatchItemFailure{ItemIdentifier: record.MessageId})
 		}
-		
-		log.Printf("Processing order %s for customer %d", order.OrderID, order.CustomerID)
-		
-		// Simulate 3-second payment processing
-		startTime := time.Now()
-		time.Sleep(3 * time.Second)
-		processingTime := time.Since(startTime)
-		
-		// Simulate 1% payment failures
-		if time.Now().UnixNano()%100 == 0 {
-			return fmt.Errorf("payment failed for order %s", order.OrderID)
+	}
+	
+	logger.Info("Handled records", "records", len(sqsEvent.Records),
+		"processed", result.processed, "failed", result.failed, "skipped", result.skipped,
+		"completed", result.completed, "retrying", len(response.BatchItemFailures),
+		"payment_failures_by_reason", result.failuresByReason)
+	return response, nil
+}
+
+// unwrapNotification returns the message inside an SNS notification
+// envelope ("Type": "Notification"), or body unchanged if it isn't one
+func unwrapNotification(body string) (string, error) {
+	var envelope struct {
+		Type      string `json:"Type"`
+		MessageID string `json:"MessageId"`
+		Message   string `json:"Message"`
+	}
+	if err := json.Unmarshal([]byte(body), &envelope); err != nil {
+		return "", fmt.Errorf("failed to parse message body: %w", err)
+	}
+	if envelope.Type != "Notification" {
+		return body, nil
+	}
+	if envelope.Message == "" {
+		return "", fmt.Errorf("SNS notification %s has no message", envelope.MessageID)
+	}
+	return envelope.Message, nil
+}
+
+// processMessage processes every order in one message, tallying outcomes
+// in result. It returns an error only if the message should be retried;
+// orders whose outcome can't be recorded are logged and not retried. A
+// retried message redelivers every order in it, but those that completed
+// are skipped rather than charged again.
+func processMessage(ctx context.Context, logger *slog.Logger, messageID, message string, result *recordResult) error {
+	orders, err := ordersFromMessage(message)
+	if err != nil {
+		logger.Error("Failed to parse message", "message_id", messageID, "error", err)
+		result.failed++
+		return err
+	}
+	if orders == nil {
+		logger.Info("Skipping non-order message", "message_id", messageID)
+		result.skipped++
+		return nil
+	}
+	
+	var errs []error
+	for _, order := range orders {
+		orderLog := logger.With("order_id", order.OrderID, "request_id", order.RequestID, "message_id", messageID)
+		err := processOrder(ctx, orderLog, order)
+		if errors.Is(err, errOrderCancelled) || errors.Is(err, errOrderCompleted) {
+			result.skipped++
+			continue
+		}
+		if errors.Is(err, errRecordRejected) {
+			// Retrying the message would fail the same way
+			orderLog.Error("Order outcome could not be recorded", "error", err)
+			result.failed++
+			continue
+		}
+		if err != nil {
+			orderLog.Error("Order failed", "error", err)
+			result.failed++
+			var refused *PaymentError
+			if errors.As(err, &refused) {
+				if result.failuresByReason == nil {
+					result.failuresByReason = map[string]int{}
+				}
+				result.failuresByReason[refused.Reason]++
+			}
+			errs = append(errs, err)
+			continue
+		}
+		result.processed++
+		result.completed = append(result.completed, order.OrderID)
+	}
+	return errors.Join(errs...)
+}
+
+// ordersFromMessage returns the orders carried by an SNS message, or nil if
+// it is a control message with no orders
+func ordersFromMessage(message string) ([]Order, error) {
+	var payload snsPayload
+	if err := json.Unmarshal([]byte(message), &payload); err != nil {
+		return nil, fmt.Errorf("failed to parse order: %w", err)
+	}
+	
+	switch {
+	case payload.Orders != nil:
+		return payload.Orders, nil
+	case payload.OrderID != "":
+		var order Order
+		if err := json.Unmarshal([]byte(message), &order); err != nil {
+			return nil, fmt.Errorf("failed to parse order: %w", err)
+		}
+		return []Order{order}, nil
+	default:
+		return nil, nil
+	}
+}
+
+// processOrder simulates payment for a single order and records the
+// outcome in ORDERS_TABLE, skipping with errOrderCompleted an order the
+// table already records as completed
+func processOrder(ctx context.Context, logger *slog.Logger, order Order) error {
+	if orderServiceURL != "" {
+		current, err := lookupOrder(order.OrderID)
+		switch {
+		case err != nil:
+			logger.Warn("Cancellation check failed, processing anyway", "error", err)
+		case current == nil:
+		// Expired orders and rejected holds were given up on by the service
+		// just like cancelled ones
+		case current.Status == "cancelled" || current.Status == "expired" || current.Status == "rejected":
+			logger.Info("Order was cancelled, skipping payment")
+			return errOrderCancelled
+		case current.AmendedAt != nil:
+			order.Items = current.Items
+			logger.Info("Order was amended, recording its current items", "items", len(order.Items))
+		}
+	}
+	
+	// A redelivered message may carry orders an earlier attempt charged
+	if err := checkNotCompleted(ctx, order.OrderID); err != nil {
+		if errors.Is(err, errOrderCompleted) {
+			logger.Info("Order already completed, skipping payment")
+		}
+		return err
+	}
+	
+	logger.Info("Processing order", "customer_id", order.CustomerID)
+	reportStatus(logger, order.OrderID, "processing")
+	
+	// Simulate payment processing
+	startTime := time.Now()
+	time.Sleep(paymentLatency.next())
+	processingTime := time.Since(startTime)
+	
+	if simulatePaymentFailure() {
+		// SNS retries the invocation, so the order may still complete
+		if err := recordOrder(ctx, logger, order, "failed"); err != nil {
+			logger.Error("Failed to record failed order", "error", err)
 		}
-		
-		log.Printf("Order %s processed successfully in %v", order.OrderID, processingTime)
+		reportStatus(logger, order.OrderID, "pending")
+		return &PaymentError{OrderID: order.OrderID, Reason: failureReasons.pick()}
 	}
 	
+	if err := recordOrder(ctx, logger, order, "completed"); err != nil {
+		return err
+	}
+	reportStatus(logger, order.OrderID, "completed")
+	logger.Info("Order processed successfully", "duration_ms", processingTime.Milliseconds())
+	return nil
+}
+
+// simulatePaymentFailure picks the 1% of simulated payments that fail;
+// tests replace it to fail chosen orders
+var simulatePaymentFailure = func() bool {
+	return time.Now().UnixNano()%100 == 0
+}
+
+// Reasons a payment can be refused with, carried by PaymentError
+const (
+	ReasonDeclined          = "declined"
+	ReasonInsufficientFunds = "insufficient_funds"
+	ReasonFraudSuspected    = "fraud_suspected"
+	ReasonGatewayTimeout    = "gateway_timeout"
+)
+
+// paymentFailureReasons lists every reason PAYMENT_FAILURE_REASONS accepts
+var paymentFailureReasons = []string{ReasonDeclined, ReasonInsufficientFunds, ReasonFraudSuspected, ReasonGatewayTimeout}
+
+// PaymentError is a payment the simulated gateway refused; Reason is one
+// of the Reason constants
+type PaymentError struct {
+	OrderID string
+	Reason  string
+}
+
+func (e *PaymentError) Error() string {
+	return fmt.Sprintf("payment refused for order %s: %s", e.OrderID, e.Reason)
+}
+
+// reasonWeight is one entry of PAYMENT_FAILURE_REASONS
+type reasonWeight struct {
+	reason string
+	weight int
+}
+
+// failureReasonWeights gives the relative frequency of each failure reason
+type failureReasonWeights []reasonWeight
+
+// failureReasons is read in main from PAYMENT_FAILURE_REASONS
+var failureReasons = failureReasonWeights{{ReasonDeclined, 50}, {ReasonInsufficientFunds, 30}, {ReasonFraudSuspected, 10}, {ReasonGatewayTimeout, 10}}
+
+// loadFailureReasons reads PAYMENT_FAILURE_REASONS, comma-separated
+// reason=weight pairs; unset keeps the default weights
+func loadFailureReasons() (failureReasonWeights, error) {
+	value := os.Getenv("PAYMENT_FAILURE_REASONS")
+	if value == "" {
+		return failureReasons, nil
+	}
+	var weights failureReasonWeights
+	for _, entry := range strings.Split(value, ",") {
+		reason, weightText, found := strings.Cut(strings.TrimSpace(entry), "=")
+		weight, err := strconv.Atoi(weightText)
+		if !found || err != nil || weight < 0 {
+			return nil, fmt.Errorf("PAYMENT_FAILURE_REASONS entries must be reason=weight with a non-negative weight, got %q", entry)
+		}
+		if !slices.Contains(paymentFailureReasons, reason) {
+			return nil, fmt.Errorf("PAYMENT_FAILURE_REASONS has unknown reason %q, want one of %s", reason, strings.Join(paymentFailureReasons, ", "))
+		}
+		if weight > 0 {
+			weights = append(weights, reasonWeight{reason: reason, weight: weight})
+		}
+	}
+	if len(weights) == 0 {
+		return nil, errors.New("PAYMENT_FAILURE_REASONS needs at least one reason with a positive weight")
+	}
+	return weights, nil
+}
+
+// pick draws a reason according to the weights
+func (w failureReasonWeights) pick() string {
+	total := 0
+	for _, candidate := range w {
+		total += candidate.weight
+	}
+	pick := rand.Intn(total)
+	for _, candidate := range w {
+		if pick < candidate.weight {
+			return candidate.reason
+		}
+		pick -= candidate.weight
+	}
+	return ReasonDeclined
+}
+
+// paymentLatencyConfig is how long a simulated payment takes: mean, moved
+// by up to jitter either way, chosen uniformly for each payment
+type paymentLatencyConfig struct {
+	mean   time.Duration
+	jitter time.Duration
+}
+
+// paymentLatency is read in main from PAYMENT_LATENCY (default 3s) and
+// PAYMENT_LATENCY_JITTER (default 0)
+var paymentLatency = paymentLatencyConfig{mean: 3 * time.Second}
+
+// loadPaymentLatency reads PAYMENT_LATENCY and PAYMENT_LATENCY_JITTER as
+// durations; PAYMENT_LATENCY=0 makes payments instant for tests
+func loadPaymentLatency() (paymentLatencyConfig, error) {
+	latency := paymentLatencyConfig{mean: 3 * time.Second}
+	if value := os.Getenv("PAYMENT_LATENCY"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed < 0 {
+			return paymentLatencyConfig{}, fmt.Errorf("PAYMENT_LATENCY must be a non-negative duration, got %q", value)
+		}
+		latency.mean = parsed
+	}
+	if value := os.Getenv("PAYMENT_LATENCY_JITTER"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed < 0 {
+			return paymentLatencyConfig{}, fmt.Errorf("PAYMENT_LATENCY_JITTER must be a non-negative duration, got %q", value)
+		}
+		latency.jitter = parsed
+	}
+	return latency, nil
+}
+
+// next picks the duration of one payment, never below zero
+func (l paymentLatencyConfig) next() time.Duration {
+	if l.jitter <= 0 {
+		return l.mean
+	}
+	return max(0, l.mean+time.Duration(rand.Int63n(int64(2*l.jitter)+1))-l.jitter)
+}
+
+// setupLogging sends slog and the standard log package through one JSON
+// handler on stderr, filtered at LOG_LEVEL (debug, info, warn or error)
+func setupLogging() error {
+	level := slog.LevelInfo
+	if value := os.Getenv("LOG_LEVEL"); value != "" {
+		if err := level.UnmarshalText([]byte(value)); err != nil {
+			return fmt.Errorf("LOG_LEVEL must be debug, info, warn or error, got %q", value)
+		}
+	}
+	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
 	return nil
 }
 
 func main() {
-	lambda.Start(ProcessOrder)
+	if err := setupLogging(); err != nil {
+		log.Fatal(err)
+	}
+	latency, err := loadPaymentLatency()
+	if err != nil {
+		log.Fatal(err)
+	}
+	paymentLatency = latency
+	reasons, err := loadFailureReasons()
+	if err != nil {
+		log.Fatal(err)
+	}
+	failureReasons = reasons
+	if ordersTable != "" {
+		cfg, err := config.LoadDefaultConfig(context.Background())
+		if err != nil {
+			log.Fatalf("Failed to load AWS config for ORDERS_TABLE: %v", err)
+		}
+		dynamoClient = dynamodb.NewFromConfig(cfg)
+	}
+	lambda.Start(HandleEvent)
 }
\ No newline at end of file
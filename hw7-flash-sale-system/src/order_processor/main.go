@@ -1,32 +1,84 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/fnv"
+	"io"
 	"log"
+	"log/slog"
+	"math"
+	"math/rand"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"slices"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamotypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
 	"github.com/aws/aws-sdk-go-v2/service/sqs"
 	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/google/uuid"
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	tracenoop "go.opentelemetry.io/otel/trace/noop"
 )
 
+// tracer resolves against the global provider, so spans started before
+// setupTracing runs are simply not recorded
+var tracer = otel.Tracer("order_processor")
+
 // Order represents an e-commerce order
 type Order struct {
 	OrderID     string    `json:"order_id"`
 	CustomerID  int       `json:"customer_id"`
 	Status      string    `json:"status"`
 	Items       []Item    `json:"items"`
+	Currency    string    `json:"currency,omitempty"`
 	CreatedAt   time.Time `json:"created_at"`
 	ProcessedAt *time.Time `json:"processed_at,omitempty"`
+	// Normalized to UTC RFC 3339 by the order service
+	ProcessAfter *time.Time `json:"process_after,omitempty"`
+	// Set by the order service; orders not charged within this many seconds
+	// of CreatedAt fail with errOrderTimedOut
+	MaxProcessingSeconds int `json:"max_processing_seconds,omitempty"`
+	// X-Request-ID of the order service call that submitted the order
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// processingDeadline returns when the order times out, if it can
+func (o Order) processingDeadline() (time.Time, bool) {
+	if o.MaxProcessingSeconds <= 0 {
+		return time.Time{}, false
+	}
+	return o.CreatedAt.Add(time.Duration(o.MaxProcessingSeconds) * time.Second), true
 }
 
 // Item represents a product in an order
@@ -34,261 +86,3855 @@ type Item struct {
 	ProductID string  `json:"product_id"`
 	Quantity  int     `json:"quantity"`
 	Price     float64 `json:"price"`
+	Currency  string  `json:"currency,omitempty"`
+	// Units the order service could not reserve; they are not charged
+	BackorderedQuantity int `json:"backordered_quantity,omitempty"`
 }
 
-// SQSMessage represents the structure of SNS->SQS messages
-type SQSMessage struct {
-	Type      string `json:"Type"`
-	MessageId string `json:"MessageId"`
-	Message   string `json:"Message"`
-	Timestamp string `json:"Timestamp"`
+// OrderTotal sums quantity * price across all items, leaving out
+// backordered units
+func (o Order) OrderTotal() float64 {
+	total := 0.0
+	for _, item := range o.Items {
+		total += float64(item.Quantity-item.BackorderedQuantity) * item.Price
+	}
+	return total
 }
 
-// OrderProcessor processes orders from SQS queue
-type OrderProcessor struct {
-	sqsClient   *sqs.Client
-	queueURL    string
-	workerCount int
-	
-	// Metrics
-	messagesReceived int64
-	ordersProcessed  int64
-	ordersFailed     int64
-	currentWorkers   int32
-	startTime        time.Time
+// errOrderHeld signals that an order was placed on hold rather than charged
+var errOrderHeld = errors.New("order placed on hold")
+
+// errOrderDeferred signals that a scheduled order is not due yet and its
+// message was left on the queue
+var errOrderDeferred = errors.New("order not due yet")
+
+// errOrderLocked signals that another replica holds the order's dedup lock;
+// the message is left to reappear once its visibility timeout lapses
+var errOrderLocked = errors.New("order locked by another replica")
+
+// errOrderTimedOut signals that an order passed its processing deadline
+// and was marked failed_timeout instead of being charged
+var errOrderTimedOut = errors.New("order timed out")
+
+// errDuplicateOrder signals that an order was already processed
+var errDuplicateOrder = errors.New("order already processed")
+
+// errOrderCancelled signals that the customer cancelled the order after it
+// was queued, so it must not be charged
+var errOrderCancelled = errors.New("order cancelled")
+
+// errPaymentAbandoned signals that the processor stopped waiting on a
+// charge while shutting down; nothing was charged, so the message is left
+// on the queue for redelivery
+var errPaymentAbandoned = errors.New("payment abandoned")
+
+// orderServiceClient talks back to the order service: it checks whether a
+// queued order has since been cancelled with DELETE /orders/{id} or had its
+// items replaced with PATCH /orders/{id}, and reports status changes so
+// clients watching the order see them
+type orderServiceClient struct {
+	baseURL string
+	client  *http.Client
+	// Sent as X-API-Key when the order service requires authentication
+	apiKey string
+}
+
+// newOrderServiceClient returns a client for ORDER_SERVICE_URL, or nil if
+// it is unset and the processor works without the order service
+func newOrderServiceClient() *orderServiceClient {
+	baseURL := strings.TrimRight(os.Getenv("ORDER_SERVICE_URL"), "/")
+	if baseURL == "" {
+		return nil
+	}
+	return &orderServiceClient{
+		baseURL: baseURL,
+		client:  &http.Client{Timeout: 2 * time.Second},
+		apiKey:  os.Getenv("ORDER_SERVICE_API_KEY"),
+	}
+}
+
+// ReportStatus writes an order's status back to the order service. A 409
+// means the order already reached a final status there and is not an error.
+func (c *orderServiceClient) ReportStatus(orderID, status string) error {
+	_, err := c.report(orderID, status)
+	return err
+}
+
+// ReportProcessing reports an order as processing, which also renews the
+// order service's lease on it, and returns when that lease runs out. A
+// zero time means the service holds no lease for the order, so there is
+// nothing to renew.
+func (c *orderServiceClient) ReportProcessing(orderID string) (leaseExpiresAt time.Time, err error) {
+	reply, err := c.report(orderID, "processing")
+	if err != nil || reply.LeaseExpiresAt == nil {
+		return time.Time{}, err
+	}
+	return *reply.LeaseExpiresAt, nil
+}
+
+// statusReply is the part of the order service's answer to a status
+// report the processor uses
+type statusReply struct {
+	LeaseExpiresAt *time.Time `json:"lease_expires_at"`
+}
+
+func (c *orderServiceClient) report(orderID, status string) (statusReply, error) {
+	var reply statusReply
+	report := map[string]interface{}{"status": status}
+	// The order service measures its end-to-end SLO up to this moment
+	if status == "completed" {
+		report["processed_at"] = time.Now().UTC()
+	}
+	body, _ := json.Marshal(report)
+	req, err := http.NewRequest(http.MethodPost, c.baseURL+"/admin/orders/"+url.PathEscape(orderID)+"/status", bytes.NewReader(body))
+	if err != nil {
+		return reply, fmt.Errorf("failed to report order %s as %s: %w", orderID, status, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.apiKey != "" {
+		req.Header.Set("X-API-Key", c.apiKey)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return reply, fmt.Errorf("failed to report order %s as %s: %w", orderID, status, err)
+	}
+	defer resp.Body.Close()
 	
-	// Control
-	stopChan chan struct{}
-	wg       sync.WaitGroup
-	mu       sync.RWMutex
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusConflict && resp.StatusCode != http.StatusNotFound {
+		return reply, fmt.Errorf("order service returned %d reporting order %s as %s", resp.StatusCode, orderID, status)
+	}
+	if resp.StatusCode == http.StatusOK {
+		// Only a lease matters here, and older services don't send one
+		json.NewDecoder(resp.Body).Decode(&reply)
+	}
+	return reply, nil
 }
 
-// NewOrderProcessor creates a new processor
-func NewOrderProcessor(workerCount int) (*OrderProcessor, error) {
-	cfg, err := config.LoadDefaultConfig(context.TODO(),
-		config.WithRegion(os.Getenv("AWS_REGION")),
-	)
+// serviceOrder is the order service's current copy of a queued order
+type serviceOrder struct {
+	Status string `json:"status"`
+	Items  []Item `json:"items"`
+	// Set once the items were amended after the order was queued
+	AmendedAt *time.Time `json:"amended_at"`
+}
+
+// cancelled reports whether the service gave up on the order. Expired
+// orders and rejected holds were given up on just like cancelled ones.
+func (o *serviceOrder) cancelled() bool {
+	return o.Status == "cancelled" || o.Status == "expired" || o.Status == "rejected"
+}
+
+// LookupOrder returns the order service's copy of an order, or nil if the
+// service doesn't know about it
+func (c *orderServiceClient) LookupOrder(orderID string) (*serviceOrder, error) {
+	resp, err := c.client.Get(c.baseURL + "/orders/" + url.PathEscape(orderID))
 	if err != nil {
-		return nil, fmt.Errorf("failed to load AWS config: %w", err)
+		return nil, fmt.Errorf("failed to look up order %s: %w", orderID, err)
 	}
+	defer resp.Body.Close()
 	
-	queueURL := os.Getenv("SQS_QUEUE_URL")
-	if queueURL == "" {
-		log.Println("Warning: SQS_QUEUE_URL not set, running in demo mode")
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("order service returned %d for order %s", resp.StatusCode, orderID)
+	}
+	var order serviceOrder
+	if err := json.NewDecoder(resp.Body).Decode(&order); err != nil {
+		return nil, fmt.Errorf("failed to decode order %s: %w", orderID, err)
+	}
+	return &order, nil
+}
+
+// heldOrder is an order waiting for manual approval before payment
+type heldOrder struct {
+	Order  Order     `json:"order"`
+	HeldAt time.Time `json:"held_at"`
+}
+
+// HoldStore keeps orders waiting for manual approval. The message of a held
+// order is deleted once the hold is saved, so with a shared backend a hold
+// survives restarts and can be approved or rejected through any replica.
+type HoldStore interface {
+	// Put saves a hold; added is false if the order was already held, in
+	// which case the existing hold is kept
+	Put(held heldOrder) (added bool, err error)
+	// Take removes and returns an order's hold, or nil if it has none. Of
+	// replicas racing to take one hold only one gets it.
+	Take(orderID string) (*heldOrder, error)
+	// List returns every hold
+	List() ([]heldOrder, error)
+}
+
+// memoryHoldStore keeps holds in memory for a single instance or local
+// development; they are lost when the processor restarts
+type memoryHoldStore struct {
+	mu    sync.Mutex
+	holds map[string]heldOrder
+}
+
+func newMemoryHoldStore() *memoryHoldStore {
+	return &memoryHoldStore{holds: make(map[string]heldOrder)}
+}
+
+func (m *memoryHoldStore) Put(held heldOrder) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, exists := m.holds[held.Order.OrderID]; exists {
+		return false, nil
+	}
+	m.holds[held.Order.OrderID] = held
+	return true, nil
+}
+
+func (m *memoryHoldStore) Take(orderID string) (*heldOrder, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	held, exists := m.holds[orderID]
+	if !exists {
+		return nil, nil
+	}
+	delete(m.holds, orderID)
+	return &held, nil
+}
+
+func (m *memoryHoldStore) List() ([]heldOrder, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	holds := make([]heldOrder, 0, len(m.holds))
+	for _, held := range m.holds {
+		holds = append(holds, held)
+	}
+	return holds, nil
+}
+
+// dynamoHoldStore shares holds across replicas in HOLD_TABLE, keyed by
+// order_id with the hold as JSON in its hold attribute
+type dynamoHoldStore struct {
+	client *dynamodb.Client
+	table  string
+}
+
+func (d *dynamoHoldStore) Put(held heldOrder) (bool, error) {
+	data, err := json.Marshal(held)
+	if err != nil {
+		return false, err
+	}
+	_, err = d.client.PutItem(context.TODO(), &dynamodb.PutItemInput{
+		TableName: aws.String(d.table),
+		Item: map[string]dynamotypes.AttributeValue{
+			"order_id": &dynamotypes.AttributeValueMemberS{Value: held.Order.OrderID},
+			"hold":     &dynamotypes.AttributeValueMemberS{Value: string(data)},
+		},
+		ConditionExpression: aws.String("attribute_not_exists(order_id)"),
+	})
+	var conditionFailed *dynamotypes.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to hold order %s: %w", held.Order.OrderID, err)
+	}
+	return true, nil
+}
+
+func (d *dynamoHoldStore) Take(orderID string) (*heldOrder, error) {
+	// DynamoDB returns the deleted item to only one of several racing deletes
+	result, err := d.client.DeleteItem(context.TODO(), &dynamodb.DeleteItemInput{
+		TableName: aws.String(d.table),
+		Key: map[string]dynamotypes.AttributeValue{
+			"order_id": &dynamotypes.AttributeValueMemberS{Value: orderID},
+		},
+		ReturnValues: dynamotypes.ReturnValueAllOld,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to take hold on order %s: %w", orderID, err)
+	}
+	if len(result.Attributes) == 0 {
+		return nil, nil
+	}
+	return decodeDynamoHold(result.Attributes)
+}
+
+func (d *dynamoHoldStore) List() ([]heldOrder, error) {
+	var holds []heldOrder
+	pages := dynamodb.NewScanPaginator(d.client, &dynamodb.ScanInput{
+		TableName:      aws.String(d.table),
+		ConsistentRead: aws.Bool(true),
+	})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(context.TODO())
+		if err != nil {
+			return nil, fmt.Errorf("failed to list holds: %w", err)
+		}
+		for _, item := range page.Items {
+			held, err := decodeDynamoHold(item)
+			if err != nil {
+				return nil, err
+			}
+			holds = append(holds, *held)
+		}
+	}
+	return holds, nil
+}
+
+// decodeDynamoHold reads a hold back from its HOLD_TABLE item
+func decodeDynamoHold(item map[string]dynamotypes.AttributeValue) (*heldOrder, error) {
+	data, ok := item["hold"].(*dynamotypes.AttributeValueMemberS)
+	if !ok {
+		return nil, errors.New("hold item has no hold attribute")
+	}
+	var held heldOrder
+	if err := json.Unmarshal([]byte(data.Value), &held); err != nil {
+		return nil, fmt.Errorf("failed to decode hold: %w", err)
+	}
+	return &held, nil
+}
+
+// redisHoldsKey is the Redis hash of holds, keyed by order ID
+const redisHoldsKey = "holds"
+
+// redisHoldStore shares holds across replicas in one Redis hash
+type redisHoldStore struct {
+	client *redis.Client
+}
+
+func (r *redisHoldStore) Put(held heldOrder) (bool, error) {
+	data, err := json.Marshal(held)
+	if err != nil {
+		return false, err
+	}
+	added, err := r.client.HSetNX(context.TODO(), redisHoldsKey, held.Order.OrderID, data).Result()
+	if err != nil {
+		return false, fmt.Errorf("failed to hold order %s: %w", held.Order.OrderID, err)
+	}
+	return added, nil
+}
+
+func (r *redisHoldStore) Take(orderID string) (*heldOrder, error) {
+	data, err := r.client.HGet(context.TODO(), redisHoldsKey, orderID).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to take hold on order %s: %w", orderID, err)
+	}
+	// Only the replica whose HDEL removes the field owns the hold
+	removed, err := r.client.HDel(context.TODO(), redisHoldsKey, orderID).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to take hold on order %s: %w", orderID, err)
 	}
+	if removed == 0 {
+		return nil, nil
+	}
+	var held heldOrder
+	if err := json.Unmarshal(data, &held); err != nil {
+		return nil, fmt.Errorf("failed to decode hold on order %s: %w", orderID, err)
+	}
+	return &held, nil
+}
+
+func (r *redisHoldStore) List() ([]heldOrder, error) {
+	values, err := r.client.HGetAll(context.TODO(), redisHoldsKey).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list holds: %w", err)
+	}
+	holds := make([]heldOrder, 0, len(values))
+	for orderID, data := range values {
+		var held heldOrder
+		if err := json.Unmarshal([]byte(data), &held); err != nil {
+			return nil, fmt.Errorf("failed to decode hold on order %s: %w", orderID, err)
+		}
+		holds = append(holds, held)
+	}
+	return holds, nil
+}
+
+// newHoldStore builds the backend named by HOLD_BACKEND: memory (the
+// default), dynamodb with HOLD_TABLE, or redis with REDIS_ADDR
+func newHoldStore(cfg aws.Config) (HoldStore, error) {
+	switch backend := os.Getenv("HOLD_BACKEND"); backend {
+	case "", "memory":
+		return newMemoryHoldStore(), nil
+	case "dynamodb":
+		table := os.Getenv("HOLD_TABLE")
+		if table == "" {
+			return nil, fmt.Errorf("HOLD_TABLE is required for the dynamodb hold backend")
+		}
+		return &dynamoHoldStore{client: dynamodb.NewFromConfig(cfg), table: table}, nil
+	case "redis":
+		addr := os.Getenv("REDIS_ADDR")
+		if addr == "" {
+			return nil, fmt.Errorf("REDIS_ADDR is required for the redis hold backend")
+		}
+		return &redisHoldStore{client: redis.NewClient(&redis.Options{Addr: addr})}, nil
+	default:
+		return nil, fmt.Errorf("unknown HOLD_BACKEND %q (want memory, dynamodb or redis)", backend)
+	}
+}
+
+// IdempotencyStore records which orders have already been processed so
+// redelivered messages are not charged twice
+type IdempotencyStore interface {
+	// MarkProcessed atomically records an order as processed; firstTime is
+	// false if the order had already been recorded
+	MarkProcessed(id string) (firstTime bool, err error)
+	IsProcessed(id string) (bool, error)
+}
+
+// memoryIdempotencyStore keeps processed order IDs in memory for a single
+// instance or local development; entries expire after ttl
+type memoryIdempotencyStore struct {
+	ttl       time.Duration
+	mu        sync.Mutex
+	expiresAt map[string]time.Time
+	lastSweep time.Time
+}
+
+func newMemoryIdempotencyStore(ttl time.Duration) *memoryIdempotencyStore {
+	return &memoryIdempotencyStore{
+		ttl:       ttl,
+		expiresAt: make(map[string]time.Time),
+		lastSweep: time.Now(),
+	}
+}
+
+func (m *memoryIdempotencyStore) MarkProcessed(id string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	
-	return &OrderProcessor{
-		sqsClient:   sqs.NewFromConfig(cfg),
-		queueURL:    queueURL,
-		workerCount: workerCount,
-		stopChan:    make(chan struct{}),
-		startTime:   time.Now(),
-	}, nil
+	now := time.Now()
+	m.sweep(now)
+	if expiry, exists := m.expiresAt[id]; exists && now.Before(expiry) {
+		return false, nil
+	}
+	m.expiresAt[id] = now.Add(m.ttl)
+	return true, nil
 }
 
-// Start begins processing messages with specified number of workers
-func (p *OrderProcessor) Start() {
-	log.Printf("Starting order processor with %d workers", p.workerCount)
+func (m *memoryIdempotencyStore) IsProcessed(id string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	
-	// Start worker goroutines
-	for i := 0; i < p.workerCount; i++ {
-		p.wg.Add(1)
-		go p.worker(i)
+	expiry, exists := m.expiresAt[id]
+	return exists && time.Now().Before(expiry), nil
+}
+
+// sweep evicts expired entries at most once per ttl; callers hold m.mu
+func (m *memoryIdempotencyStore) sweep(now time.Time) {
+	if now.Sub(m.lastSweep) < m.ttl {
+		return
+	}
+	for id, expiry := range m.expiresAt {
+		if !now.Before(expiry) {
+			delete(m.expiresAt, id)
+		}
+	}
+	m.lastSweep = now
+}
+
+// dynamoIdempotencyStore shares processed order IDs across instances using
+// a conditional PutItem; expires_at can be used as the table's TTL attribute
+type dynamoIdempotencyStore struct {
+	client *dynamodb.Client
+	table  string
+	ttl    time.Duration
+	health dependencyHealth
+}
+
+func (d *dynamoIdempotencyStore) MarkProcessed(id string) (bool, error) {
+	now := time.Now()
+	_, err := d.client.PutItem(context.TODO(), &dynamodb.PutItemInput{
+		TableName: aws.String(d.table),
+		Item: map[string]dynamotypes.AttributeValue{
+			"order_id":   &dynamotypes.AttributeValueMemberS{Value: id},
+			"expires_at": &dynamotypes.AttributeValueMemberN{Value: strconv.FormatInt(now.Add(d.ttl).Unix(), 10)},
+		},
+		// Expired entries may not have been deleted by DynamoDB TTL yet
+		ConditionExpression: aws.String("attribute_not_exists(order_id) OR expires_at < :now"),
+		ExpressionAttributeValues: map[string]dynamotypes.AttributeValue{
+			":now": &dynamotypes.AttributeValueMemberN{Value: strconv.FormatInt(now.Unix(), 10)},
+		},
+	})
+	if err != nil {
+		var conditionFailed *dynamotypes.ConditionalCheckFailedException
+		if errors.As(err, &conditionFailed) {
+			d.health.record(nil)
+			return false, nil
+		}
+		d.health.record(err)
+		return false, fmt.Errorf("failed to mark order %s processed: %w", id, err)
+	}
+	return true, nil
+}
+
+func (d *dynamoIdempotencyStore) IsProcessed(id string) (bool, error) {
+	result, err := d.client.GetItem(context.TODO(), &dynamodb.GetItemInput{
+		TableName: aws.String(d.table),
+		Key: map[string]dynamotypes.AttributeValue{
+			"order_id": &dynamotypes.AttributeValueMemberS{Value: id},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	d.health.record(err)
+	if err != nil {
+		return false, fmt.Errorf("failed to look up order %s: %w", id, err)
+	}
+	if result.Item == nil {
+		return false, nil
 	}
 	
-	log.Printf("All %d workers started", p.workerCount)
+	expiresAt, ok := result.Item["expires_at"].(*dynamotypes.AttributeValueMemberN)
+	if !ok {
+		return true, nil
+	}
+	expiry, err := strconv.ParseInt(expiresAt.Value, 10, 64)
+	if err != nil {
+		return true, nil
+	}
+	return time.Now().Unix() < expiry, nil
 }
 
-// worker continuously polls SQS and processes messages
-func (p *OrderProcessor) worker(id int) {
-	defer p.wg.Done()
-	atomic.AddInt32(&p.currentWorkers, 1)
-	defer atomic.AddInt32(&p.currentWorkers, -1)
+// redisIdempotencyStore shares processed order IDs across instances using
+// SET NX with an expiry
+type redisIdempotencyStore struct {
+	client *redis.Client
+	ttl    time.Duration
+}
+
+func (r *redisIdempotencyStore) key(id string) string {
+	return "processed:" + id
+}
+
+func (r *redisIdempotencyStore) MarkProcessed(id string) (bool, error) {
+	firstTime, err := r.client.SetNX(context.TODO(), r.key(id), 1, r.ttl).Result()
+	if err != nil {
+		return false, fmt.Errorf("failed to mark order %s processed: %w", id, err)
+	}
+	return firstTime, nil
+}
+
+func (r *redisIdempotencyStore) IsProcessed(id string) (bool, error) {
+	count, err := r.client.Exists(context.TODO(), r.key(id)).Result()
+	if err != nil {
+		return false, fmt.Errorf("failed to look up order %s: %w", id, err)
+	}
+	return count > 0, nil
+}
+
+// newIdempotencyStore builds the backend named by IDEMPOTENCY_BACKEND
+// (memory, dynamodb or redis); an empty backend disables deduplication
+func newIdempotencyStore(cfg aws.Config) (IdempotencyStore, error) {
+	ttl := 24 * time.Hour
+	if value := os.Getenv("IDEMPOTENCY_TTL"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 {
+			return nil, fmt.Errorf("IDEMPOTENCY_TTL must be a positive duration, got %q", value)
+		}
+		ttl = parsed
+	}
 	
-	log.Printf("Worker %d started", id)
+	switch backend := os.Getenv("IDEMPOTENCY_BACKEND"); backend {
+	case "":
+		return nil, nil
+	case "memory":
+		return newMemoryIdempotencyStore(ttl), nil
+	case "dynamodb":
+		table := os.Getenv("IDEMPOTENCY_TABLE")
+		if table == "" {
+			return nil, fmt.Errorf("IDEMPOTENCY_TABLE is required for the dynamodb idempotency backend")
+		}
+		return &dynamoIdempotencyStore{client: dynamodb.NewFromConfig(cfg), table: table, ttl: ttl}, nil
+	case "redis":
+		addr := os.Getenv("REDIS_ADDR")
+		if addr == "" {
+			return nil, fmt.Errorf("REDIS_ADDR is required for the redis idempotency backend")
+		}
+		return &redisIdempotencyStore{client: redis.NewClient(&redis.Options{Addr: addr}), ttl: ttl}, nil
+	default:
+		return nil, fmt.Errorf("unknown IDEMPOTENCY_BACKEND %q (want memory, dynamodb or redis)", backend)
+	}
+}
+
+// dedupLock stops two replicas reading the same standard queue from
+// charging one order at once. A replica takes the order's item in
+// DEDUP_TABLE with a conditional PutItem before charging; DynamoDB applies
+// conditional writes to an item one at a time, so of two replicas racing
+// for it exactly one put succeeds. A failed charge deletes the item so the
+// retry can take it, and a successful one marks it done so redeliveries
+// are skipped until expires_at, which can be the table's TTL attribute.
+type dedupLock struct {
+	client    *dynamodb.Client
+	table     string
+	ttl       time.Duration
+	owner     string
+	health    dependencyHealth
+	acquired  int64
+	contended int64
+}
+
+// newDedupLock reads DEDUP_TABLE and DEDUP_LOCK_TTL (default 15m, matching
+// the longest a message is kept hidden). It returns nil when DEDUP_TABLE is
+// unset.
+func newDedupLock(cfg aws.Config) (*dedupLock, error) {
+	table := os.Getenv("DEDUP_TABLE")
+	if table == "" {
+		return nil, nil
+	}
+	ttl := 15 * time.Minute
+	if value := os.Getenv("DEDUP_LOCK_TTL"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed < time.Second {
+			return nil, fmt.Errorf("DEDUP_LOCK_TTL must be a duration of at least 1s, got %q", value)
+		}
+		ttl = parsed
+	}
+	host, _ := os.Hostname()
+	return &dedupLock{
+		client: dynamodb.NewFromConfig(cfg),
+		table:  table,
+		ttl:    ttl,
+		owner:  host + "/" + uuid.NewString(),
+	}, nil
+}
+
+// acquire takes the lock for an order. It returns errDuplicateOrder when
+// the order was already charged and errOrderLocked when another replica is
+// charging it.
+func (d *dedupLock) acquire(orderID string) error {
+	now := time.Now()
+	_, err := d.client.PutItem(context.TODO(), &dynamodb.PutItemInput{
+		TableName: aws.String(d.table),
+		Item: map[string]dynamotypes.AttributeValue{
+			"order_id":   &dynamotypes.AttributeValueMemberS{Value: orderID},
+			"owner":      &dynamotypes.AttributeValueMemberS{Value: d.owner},
+			"state":      &dynamotypes.AttributeValueMemberS{Value: "processing"},
+			"expires_at": &dynamotypes.AttributeValueMemberN{Value: strconv.FormatInt(now.Add(d.ttl).Unix(), 10)},
+		},
+		// A lock left by a replica that died expires rather than blocking
+		// the order forever
+		ConditionExpression: aws.String("attribute_not_exists(order_id) OR expires_at < :now"),
+		ExpressionAttributeValues: map[string]dynamotypes.AttributeValue{
+			":now": &dynamotypes.AttributeValueMemberN{Value: strconv.FormatInt(now.Unix(), 10)},
+		},
+		ReturnValuesOnConditionCheckFailure: dynamotypes.ReturnValuesOnConditionCheckFailureAllOld,
+	})
+	var conditionFailed *dynamotypes.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		d.health.record(nil)
+		if state, ok := conditionFailed.Item["state"].(*dynamotypes.AttributeValueMemberS); ok && state.Value == "done" {
+			return errDuplicateOrder
+		}
+		atomic.AddInt64(&d.contended, 1)
+		return errOrderLocked
+	}
+	d.health.record(err)
+	if err != nil {
+		return fmt.Errorf("failed to lock order %s: %w", orderID, err)
+	}
+	atomic.AddInt64(&d.acquired, 1)
+	return nil
+}
+
+// release gives up the lock after a charge: it is marked done if the charge
+// succeeded and deleted otherwise. Both are conditional on this replica
+// still owning it, so a lock that expired and was taken by another replica
+// is left alone. An error only means the lock lingers until it expires.
+func (d *dedupLock) release(orderID string, charged bool) error {
+	key := map[string]dynamotypes.AttributeValue{
+		"order_id": &dynamotypes.AttributeValueMemberS{Value: orderID},
+	}
 	
-	for {
-		select {
-		case <-p.stopChan:
-			log.Printf("Worker %d stopping", id)
-			return
-		default:
-			// Skip if no queue URL
-			if p.queueURL == "" {
-				time.Sleep(5 * time.Second)
-				continue
-			}
-			
-			// Poll SQS for messages
-			messages, err := p.pollMessages()
-			if err != nil {
-				log.Printf("Worker %d: Error polling messages: %v", id, err)
-				time.Sleep(5 * time.Second)
-				continue
-			}
-			
-			// Process each message
-			for _, msg := range messages {
-				atomic.AddInt64(&p.messagesReceived, 1)
-				
-				// Process the order
-				if err := p.processMessage(msg); err != nil {
-					log.Printf("Worker %d: Failed to process message: %v", id, err)
-					atomic.AddInt64(&p.ordersFailed, 1)
-					continue
-				}
-				
-				// Delete message from queue after successful processing
-				if err := p.deleteMessage(msg); err != nil {
-					log.Printf("Worker %d: Failed to delete message: %v", id, err)
-				}
-				
-				atomic.AddInt64(&p.ordersProcessed, 1)
-			}
+	var err error
+	if charged {
+		_, err = d.client.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
+			TableName:           aws.String(d.table),
+			Key:                 key,
+			UpdateExpression:    aws.String("SET #state = :done, expires_at = :expires"),
+			ConditionExpression: aws.String("#owner = :owner"),
+			ExpressionAttributeNames: map[string]string{"#owner": "owner", "#state": "state"},
+			ExpressionAttributeValues: map[string]dynamotypes.AttributeValue{
+				":owner":   &dynamotypes.AttributeValueMemberS{Value: d.owner},
+				":done":    &dynamotypes.AttributeValueMemberS{Value: "done"},
+				":expires": &dynamotypes.AttributeValueMemberN{Value: strconv.FormatInt(time.Now().Add(d.ttl).Unix(), 10)},
+			},
+		})
+	} else {
+		_, err = d.client.DeleteItem(context.TODO(), &dynamodb.DeleteItemInput{
+			TableName:                aws.String(d.table),
+			Key:                      key,
+			ConditionExpression:      aws.String("#owner = :owner"),
+			ExpressionAttributeNames: map[string]string{"#owner": "owner"},
+			ExpressionAttributeValues: map[string]dynamotypes.AttributeValue{
+				":owner": &dynamotypes.AttributeValueMemberS{Value: d.owner},
+			},
+		})
+	}
+	var conditionFailed *dynamotypes.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		d.health.record(nil)
+		return fmt.Errorf("lock on order %s is no longer held by this replica", orderID)
+	}
+	d.health.record(err)
+	if err != nil {
+		return fmt.Errorf("failed to release lock on order %s: %w", orderID, err)
+	}
+	return nil
+}
+
+// status reports the lock settings and outcomes for /metrics
+func (d *dedupLock) status() map[string]interface{} {
+	return map[string]interface{}{
+		"enabled":   true,
+		"table":     d.table,
+		"lock_ttl":  d.ttl.String(),
+		"acquired":  loadCounter(&d.acquired),
+		"contended": loadCounter(&d.contended),
+	}
+}
+
+// SQSMessage represents the structure of SNS->SQS messages
+type SQSMessage struct {
+	Type      string `json:"Type"`
+	MessageId string `json:"MessageId"`
+	Message   string `json:"Message"`
+	Timestamp string `json:"Timestamp"`
+	// Publisher-set attributes, including the order's trace context
+	MessageAttributes map[string]struct {
+		Type  string `json:"Type"`
+		Value string `json:"Value"`
+	} `json:"MessageAttributes"`
+}
+
+// OrderHandler runs the payment step for a parsed order, giving up once
+// ctx is done
+type OrderHandler func(ctx context.Context, order Order) error
+
+// routeMetrics tracks outcomes for one processing route (stable or canary)
+type routeMetrics struct {
+	processed      int64
+	failed         int64
+	totalLatencyNs int64
+}
+
+// record adds a single processing outcome to the route metrics
+func (m *routeMetrics) record(latency time.Duration, err error) {
+	if err != nil {
+		atomic.AddInt64(&m.failed, 1)
+	} else {
+		atomic.AddInt64(&m.processed, 1)
+	}
+	atomic.AddInt64(&m.totalLatencyNs, int64(latency))
+}
+
+// reset zeroes the route's counts and returns the snapshot they made up
+func (m *routeMetrics) reset() map[string]interface{} {
+	old := routeMetrics{
+		processed:      atomic.SwapInt64(&m.processed, 0),
+		failed:         atomic.SwapInt64(&m.failed, 0),
+		totalLatencyNs: atomic.SwapInt64(&m.totalLatencyNs, 0),
+	}
+	return old.snapshot()
+}
+
+// snapshot returns success rate and average latency for the route
+func (m *routeMetrics) snapshot() map[string]interface{} {
+	processed := loadCounter(&m.processed)
+	failed := loadCounter(&m.failed)
+	total := processed + failed
+
+	successRate := 0.0
+	avgLatencyMs := 0.0
+	if total > 0 {
+		successRate = float64(processed) / float64(total)
+		avgLatencyMs = float64(loadCounter(&m.totalLatencyNs)) / float64(total) / float64(time.Millisecond)
+	}
+
+	return map[string]interface{}{
+		"processed":      processed,
+		"failed":         failed,
+		"success_rate":   successRate,
+		"avg_latency_ms": avgLatencyMs,
+	}
+}
+
+// defaultLatencyBuckets are the upper bounds, in milliseconds, used when
+// LATENCY_BUCKETS_MS is unset; they bracket the default 3 second payment
+var defaultLatencyBuckets = []float64{50, 100, 250, 500, 1000, 2000, 3000, 4000, 5000, 7500, 10000, 30000}
+
+// latencyShards is how many independent sets of counts a histogram keeps.
+// Each worker writes to the shard picked by its ID, so workers rarely share
+// a cache line, and reads merge every shard.
+const latencyShards = 16
+
+// latencyHistogram counts processMessage durations into fixed buckets
+type latencyHistogram struct {
+	bounds []float64 // bucket upper bounds in ms, ascending
+	shards [latencyShards]latencyShard
+}
+
+// latencyShard holds one bucket count per bound plus an overflow bucket
+type latencyShard struct {
+	counts []int64
+	sumNs  int64
+	maxNs  int64
+}
+
+// loadLatencyHistogram reads LATENCY_BUCKETS_MS, a comma-separated list of
+// ascending positive bucket bounds in milliseconds
+func loadLatencyHistogram() (*latencyHistogram, error) {
+	bounds := defaultLatencyBuckets
+	if value := os.Getenv("LATENCY_BUCKETS_MS"); value != "" {
+		bounds = nil
+		for _, field := range strings.Split(value, ",") {
+			bound, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+			if err != nil || bound <= 0 || (len(bounds) > 0 && bound <= bounds[len(bounds)-1]) {
+				return nil, fmt.Errorf("LATENCY_BUCKETS_MS must be ascending positive milliseconds, got %q", value)
+			}
+			bounds = append(bounds, bound)
+		}
+	}
+	return newLatencyHistogram(bounds), nil
+}
+
+func newLatencyHistogram(bounds []float64) *latencyHistogram {
+	h := &latencyHistogram{bounds: bounds}
+	for i := range h.shards {
+		h.shards[i].counts = make([]int64, len(bounds)+1)
+	}
+	return h
+}
+
+// record adds one duration to the given worker's shard
+func (h *latencyHistogram) record(worker int, latency time.Duration) {
+	shard := &h.shards[worker%latencyShards]
+	ms := float64(latency) / float64(time.Millisecond)
+	bucket := sort.SearchFloat64s(h.bounds, ms)
+	atomic.AddInt64(&shard.counts[bucket], 1)
+	atomic.AddInt64(&shard.sumNs, int64(latency))
+	for {
+		current := atomic.LoadInt64(&shard.maxNs)
+		if int64(latency) <= current || atomic.CompareAndSwapInt64(&shard.maxNs, current, int64(latency)) {
+			return
+		}
+	}
+}
+
+// snapshot merges the shards and reports count, mean, max and the p50, p95
+// and p99 estimates. A percentile is the upper bound of the bucket it
+// falls in, capped at the largest duration seen.
+func (h *latencyHistogram) snapshot() map[string]interface{} {
+	counts := make([]int64, len(h.bounds)+1)
+	var total, sumNs, maxNs int64
+	for i := range h.shards {
+		shard := &h.shards[i]
+		for bucket := range counts {
+			count := atomic.LoadInt64(&shard.counts[bucket])
+			counts[bucket] += count
+			total += count
+		}
+		sumNs += atomic.LoadInt64(&shard.sumNs)
+		maxNs = max(maxNs, atomic.LoadInt64(&shard.maxNs))
+	}
+	maxMs := float64(maxNs) / float64(time.Millisecond)
+	
+	percentile := func(q float64) float64 {
+		if total == 0 {
+			return 0
+		}
+		rank := int64(math.Ceil(q * float64(total)))
+		var seen int64
+		for bucket, count := range counts {
+			seen += count
+			if seen >= rank && bucket < len(h.bounds) {
+				return math.Min(h.bounds[bucket], maxMs)
+			}
+		}
+		return maxMs
+	}
+	
+	mean := 0.0
+	if total > 0 {
+		mean = float64(sumNs) / float64(total) / float64(time.Millisecond)
+	}
+	return map[string]interface{}{
+		"count":      total,
+		"mean":       mean,
+		"max":        maxMs,
+		"p50":        percentile(0.50),
+		"p95":        percentile(0.95),
+		"p99":        percentile(0.99),
+		"buckets_ms": h.bounds,
+	}
+}
+
+// reset zeroes the histogram and returns the snapshot it held. Each value
+// is swapped out on its own, so a duration recorded during the reset is
+// counted on one side of it or the other.
+func (h *latencyHistogram) reset() map[string]interface{} {
+	old := newLatencyHistogram(h.bounds)
+	for i := range h.shards {
+		shard, saved := &h.shards[i], &old.shards[i]
+		for bucket := range shard.counts {
+			saved.counts[bucket] = atomic.SwapInt64(&shard.counts[bucket], 0)
+		}
+		saved.sumNs = atomic.SwapInt64(&shard.sumNs, 0)
+		saved.maxNs = atomic.SwapInt64(&shard.maxNs, 0)
+	}
+	return old.snapshot()
+}
+
+// dependencyHealth tracks the outcome of recent calls to one AWS dependency
+type dependencyHealth struct {
+	mu          sync.Mutex
+	calls       int64
+	lastSuccess time.Time
+	lastError   string
+	lastErrorAt time.Time
+}
+
+// record notes the result of a single call to the dependency
+func (d *dependencyHealth) record(err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.calls++
+	if err != nil {
+		d.lastError = err.Error()
+		d.lastErrorAt = time.Now()
+	} else {
+		d.lastSuccess = time.Now()
+	}
+}
+
+// degraded reports whether the most recent call to the dependency failed
+func (d *dependencyHealth) degraded() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.lastErrorAt.After(d.lastSuccess)
+}
+
+// snapshot returns the dependency's last success and last error
+func (d *dependencyHealth) snapshot() map[string]interface{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	
+	status := "ok"
+	if d.calls == 0 {
+		status = "unknown"
+	} else if d.lastErrorAt.After(d.lastSuccess) {
+		status = "degraded"
+	}
+	snapshot := map[string]interface{}{
+		"status": status,
+		"calls":  d.calls,
+	}
+	if !d.lastSuccess.IsZero() {
+		snapshot["last_success"] = d.lastSuccess.UTC().Format(time.RFC3339)
+	}
+	if d.lastError != "" {
+		snapshot["last_error"] = d.lastError
+		snapshot["last_error_at"] = d.lastErrorAt.UTC().Format(time.RFC3339)
+	}
+	return snapshot
+}
+
+// readinessProbe caches the result of checking each dependency for ttl so
+// frequent /ready polling doesn't turn into a stream of AWS calls
+type readinessProbe struct {
+	ttl   time.Duration
+	check func(ctx context.Context) map[string]error
+	
+	mu        sync.Mutex
+	checkedAt time.Time
+	results   map[string]error
+}
+
+// result returns the latest check per dependency (nil error when
+// reachable), running the check again once the cached one is stale.
+// Concurrent callers share one check rather than each making their own.
+func (r *readinessProbe) result(ctx context.Context) (map[string]error, time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.checkedAt.IsZero() || time.Since(r.checkedAt) >= r.ttl {
+		r.results = r.check(ctx)
+		r.checkedAt = time.Now()
+	}
+	return r.results, r.checkedAt
+}
+
+// writeReadiness responds 200 when every dependency in results is
+// reachable, or 503 naming the ones that are not
+func writeReadiness(w http.ResponseWriter, results map[string]error, checkedAt time.Time) {
+	dependencies := map[string]interface{}{}
+	failed := []string{}
+	for name, err := range results {
+		if err != nil {
+			dependencies[name] = err.Error()
+			failed = append(failed, name)
+		} else {
+			dependencies[name] = "ok"
+		}
+	}
+	sort.Strings(failed)
+	
+	status := "ready"
+	w.Header().Set("Content-Type", "application/json")
+	if len(failed) > 0 {
+		status = "not_ready"
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":       status,
+		"dependencies": dependencies,
+		"failed":       failed,
+		"checked_at":   checkedAt.UTC().Format(time.RFC3339),
+	})
+}
+
+// paymentDelayConfig scales the simulated payment delay with order value,
+// since high-value orders take longer to verify
+type paymentDelayConfig struct {
+	base   time.Duration
+	per100 time.Duration
+	max    time.Duration
+	// Each delay lands uniformly within base±jitter before scaling
+	jitter time.Duration
+}
+
+// loadPaymentDelayConfig reads PAYMENT_LATENCY (a duration, taking
+// precedence over PAYMENT_BASE_MS) and PAYMENT_LATENCY_JITTER, plus
+// PAYMENT_PER_100_MS and PAYMENT_MAX_MS; the defaults keep the flat 3
+// second delay, and PAYMENT_LATENCY=0 makes payments instant
+func loadPaymentDelayConfig() (paymentDelayConfig, error) {
+	base, err := envMillis("PAYMENT_BASE_MS", 3000)
+	if err != nil {
+		return paymentDelayConfig{}, err
+	}
+	if value := os.Getenv("PAYMENT_LATENCY"); value != "" {
+		if base, err = time.ParseDuration(value); err != nil || base < 0 {
+			return paymentDelayConfig{}, fmt.Errorf("PAYMENT_LATENCY must be a non-negative duration, got %q", value)
+		}
+	}
+	var jitter time.Duration
+	if value := os.Getenv("PAYMENT_LATENCY_JITTER"); value != "" {
+		if jitter, err = time.ParseDuration(value); err != nil || jitter < 0 {
+			return paymentDelayConfig{}, fmt.Errorf("PAYMENT_LATENCY_JITTER must be a non-negative duration, got %q", value)
+		}
+	}
+	per100, err := envMillis("PAYMENT_PER_100_MS", 0)
+	if err != nil {
+		return paymentDelayConfig{}, err
+	}
+	maxDelay, err := envMillis("PAYMENT_MAX_MS", 0)
+	if err != nil {
+		return paymentDelayConfig{}, err
+	}
+	return paymentDelayConfig{base: base, per100: per100, max: maxDelay, jitter: jitter}, nil
+}
+
+// delayFor returns the base delay, moved by up to jitter either way, plus
+// one increment per full $100 of the total, capped at max when a cap is
+// configured
+func (c paymentDelayConfig) delayFor(total float64) time.Duration {
+	delay := c.base
+	if c.jitter > 0 {
+		delay = max(0, delay+time.Duration(rand.Int63n(int64(2*c.jitter)+1))-c.jitter)
+	}
+	delay += time.Duration(math.Floor(total/100)) * c.per100
+	if c.max > 0 && delay > c.max {
+		delay = c.max
+	}
+	return delay
+}
+
+// PaymentGateway decides the outcome of a charge once the simulated
+// processing delay has elapsed
+type PaymentGateway interface {
+	Charge(ctx context.Context, orderID string, amount float64) error
+}
+
+// Reasons a charge can be refused with, carried by PaymentError
+const (
+	ReasonDeclined          = "declined"
+	ReasonInsufficientFunds = "insufficient_funds"
+	ReasonFraudSuspected    = "fraud_suspected"
+	ReasonGatewayTimeout    = "gateway_timeout"
+)
+
+// paymentFailureReasons lists every reason, in the order metrics report them
+var paymentFailureReasons = []string{ReasonDeclined, ReasonInsufficientFunds, ReasonFraudSuspected, ReasonGatewayTimeout}
+
+// defaultPaymentFailureReasons is PAYMENT_FAILURE_REASONS when unset
+const defaultPaymentFailureReasons = "declined=50,insufficient_funds=30,fraud_suspected=10,gateway_timeout=10"
+
+// PaymentError is a charge the gateway refused; Reason is one of the
+// Reason constants, so clients and metrics can tell failures apart
+type PaymentError struct {
+	OrderID string
+	Amount  float64
+	Reason  string
+}
+
+func (e *PaymentError) Error() string {
+	return fmt.Sprintf("payment refused for order %s (%.2f): %s", e.OrderID, e.Amount, e.Reason)
+}
+
+// paymentFailureReason returns the reason of a PaymentError anywhere in
+// err's chain, or "" for other errors
+func paymentFailureReason(err error) string {
+	var refused *PaymentError
+	if errors.As(err, &refused) {
+		return refused.Reason
+	}
+	return ""
+}
+
+// reasonWeight is one entry of PAYMENT_FAILURE_REASONS
+type reasonWeight struct {
+	reason string
+	weight int
+}
+
+// parseFailureReasons reads a comma-separated list of reason=weight pairs.
+// Weights are relative frequencies; reasons left out never occur.
+func parseFailureReasons(value string) ([]reasonWeight, error) {
+	var weights []reasonWeight
+	total := 0
+	for _, entry := range strings.Split(value, ",") {
+		reason, weightText, found := strings.Cut(strings.TrimSpace(entry), "=")
+		weight, err := strconv.Atoi(weightText)
+		if !found || err != nil || weight < 0 {
+			return nil, fmt.Errorf("entries must be reason=weight with a non-negative weight, got %q", entry)
+		}
+		if !slices.Contains(paymentFailureReasons, reason) {
+			return nil, fmt.Errorf("unknown reason %q, want one of %s", reason, strings.Join(paymentFailureReasons, ", "))
+		}
+		if weight > 0 {
+			weights = append(weights, reasonWeight{reason: reason, weight: weight})
+			total += weight
+		}
+	}
+	if total == 0 {
+		return nil, errors.New("at least one reason needs a positive weight")
+	}
+	return weights, nil
+}
+
+// simulatedGateway declines a configurable fraction of charges, giving
+// each a reason drawn from configured weights, using its own seeded
+// source so a fixed seed replays the same outcomes
+type simulatedGateway struct {
+	mu          sync.Mutex
+	rng         *rand.Rand
+	failureRate float64
+	reasons     []reasonWeight
+	totalWeight int
+}
+
+// newSimulatedGateway builds a gateway that declines failureRate of charges;
+// rates of 0 and 1 with a single reason never consult the source and are
+// fully deterministic
+func newSimulatedGateway(failureRate float64, reasons []reasonWeight, seed int64) *simulatedGateway {
+	gateway := &simulatedGateway{rng: rand.New(rand.NewSource(seed)), failureRate: failureRate, reasons: reasons}
+	for _, reason := range reasons {
+		gateway.totalWeight += reason.weight
+	}
+	return gateway
+}
+
+// loadPaymentGateway reads PAYMENT_FAILURE_RATE (0-1, default 0.01),
+// PAYMENT_FAILURE_REASONS (reason=weight pairs, default
+// defaultPaymentFailureReasons) and PAYMENT_FAILURE_SEED (default
+// time-based)
+func loadPaymentGateway() (PaymentGateway, error) {
+	failureRate := 0.01
+	if value := os.Getenv("PAYMENT_FAILURE_RATE"); value != "" {
+		parsed, err := strconv.ParseFloat(value, 64)
+		if err != nil || parsed < 0 || parsed > 1 {
+			return nil, fmt.Errorf("PAYMENT_FAILURE_RATE must be between 0 and 1, got %q", value)
+		}
+		failureRate = parsed
+	}
+	reasonsValue := defaultPaymentFailureReasons
+	if value := os.Getenv("PAYMENT_FAILURE_REASONS"); value != "" {
+		reasonsValue = value
+	}
+	reasons, err := parseFailureReasons(reasonsValue)
+	if err != nil {
+		return nil, fmt.Errorf("PAYMENT_FAILURE_REASONS: %w", err)
+	}
+	seed := time.Now().UnixNano()
+	if value := os.Getenv("PAYMENT_FAILURE_SEED"); value != "" {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("PAYMENT_FAILURE_SEED must be an integer, got %q", value)
+		}
+		seed = parsed
+	}
+	return newSimulatedGateway(failureRate, reasons, seed), nil
+}
+
+// Charge declines the order with probability failureRate, returning a
+// PaymentError with a weighted random reason
+func (g *simulatedGateway) Charge(ctx context.Context, orderID string, amount float64) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("payment for order %s abandoned: %w", orderID, err)
+	}
+	declined := g.failureRate >= 1
+	if g.failureRate > 0 && g.failureRate < 1 {
+		g.mu.Lock()
+		declined = g.rng.Float64() < g.failureRate
+		g.mu.Unlock()
+	}
+	if !declined {
+		return nil
+	}
+	reason := g.reasons[0].reason
+	if len(g.reasons) > 1 {
+		g.mu.Lock()
+		pick := g.rng.Intn(g.totalWeight)
+		g.mu.Unlock()
+		for _, candidate := range g.reasons {
+			if pick < candidate.weight {
+				reason = candidate.reason
+				break
+			}
+			pick -= candidate.weight
+		}
+	}
+	return &PaymentError{OrderID: orderID, Amount: amount, Reason: reason}
+}
+
+// paymentFailureCounts tallies refused charges by PaymentError reason
+type paymentFailureCounts map[string]*int64
+
+func newPaymentFailureCounts() paymentFailureCounts {
+	counts := paymentFailureCounts{}
+	for _, reason := range paymentFailureReasons {
+		counts[reason] = new(int64)
+	}
+	return counts
+}
+
+// record counts err if it carries a known reason
+func (c paymentFailureCounts) record(err error) {
+	if count, ok := c[paymentFailureReason(err)]; ok {
+		atomic.AddInt64(count, 1)
+	}
+}
+
+// snapshot reads every reason's count, zeros included
+func (c paymentFailureCounts) snapshot() map[string]int64 {
+	counts := make(map[string]int64, len(c))
+	for reason, count := range c {
+		counts[reason] = loadCounter(count)
+	}
+	return counts
+}
+
+// errChaosInjected marks a payment failure forced through /admin/chaos
+var errChaosInjected = errors.New("chaos: injected payment failure")
+
+// chaosInjector holds fault-injection settings changed at runtime through
+// POST /admin/chaos, so retries and the dead-letter queue can be exercised
+// on demand. It only exists when CHAOS_ENABLED=true.
+type chaosInjector struct {
+	mu          sync.Mutex
+	rng         *rand.Rand
+	failureRate float64
+	// Replaces the simulated payment delay while set
+	latency  *time.Duration
+	injected int64
+}
+
+// loadChaosInjector returns nil unless CHAOS_ENABLED=true. It starts with
+// no failures and no latency override.
+func loadChaosInjector() *chaosInjector {
+	if os.Getenv("CHAOS_ENABLED") != "true" {
+		return nil
+	}
+	return &chaosInjector{rng: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+// set replaces the settings; a nil latency clears the override
+func (c *chaosInjector) set(failureRate float64, latency *time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.failureRate = failureRate
+	c.latency = latency
+}
+
+// delay returns the latency override, or normal when none is set
+func (c *chaosInjector) delay(normal time.Duration) time.Duration {
+	if c == nil {
+		return normal
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.latency != nil {
+		return *c.latency
+	}
+	return normal
+}
+
+// fail forces the charge for orderID to fail with probability failureRate
+func (c *chaosInjector) fail(orderID string) error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	failed := c.failureRate >= 1 || (c.failureRate > 0 && c.rng.Float64() < c.failureRate)
+	c.mu.Unlock()
+	if !failed {
+		return nil
+	}
+	atomic.AddInt64(&c.injected, 1)
+	return fmt.Errorf("%w for order %s", errChaosInjected, orderID)
+}
+
+// status reports the current settings for /metrics and /admin/chaos
+func (c *chaosInjector) status() map[string]interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var latencyMs interface{}
+	if c.latency != nil {
+		latencyMs = c.latency.Milliseconds()
+	}
+	return map[string]interface{}{
+		"enabled":           true,
+		"failure_rate":      c.failureRate,
+		"latency_ms":        latencyMs,
+		"failures_injected": loadCounter(&c.injected),
+	}
+}
+
+// envRange reads an integer from the environment and rejects values outside
+// [min, max]
+func envRange(name string, defaultValue, min, max int) (int, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue, nil
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil || parsed < min || parsed > max {
+		return 0, fmt.Errorf("%s must be an integer between %d and %d, got %q", name, min, max, value)
+	}
+	return parsed, nil
+}
+
+// autoscaleConfig bounds the worker pool when it follows queue depth
+type autoscaleConfig struct {
+	enabled     bool
+	targetDepth int
+	min         int
+	max         int
+	interval    time.Duration
+}
+
+// loadAutoscaleConfig reads AUTOSCALE_ENABLED, AUTOSCALE_TARGET_DEPTH,
+// AUTOSCALE_MIN, AUTOSCALE_MAX and AUTOSCALE_INTERVAL
+func loadAutoscaleConfig() (autoscaleConfig, error) {
+	cfg := autoscaleConfig{enabled: os.Getenv("AUTOSCALE_ENABLED") == "true", interval: 30 * time.Second}
+	var err error
+	if cfg.targetDepth, err = envRange("AUTOSCALE_TARGET_DEPTH", 100, 1, math.MaxInt32); err != nil {
+		return autoscaleConfig{}, err
+	}
+	// The same 1-100 range POST /scale accepts
+	if cfg.min, err = envRange("AUTOSCALE_MIN", 1, 1, 100); err != nil {
+		return autoscaleConfig{}, err
+	}
+	if cfg.max, err = envRange("AUTOSCALE_MAX", 10, 1, 100); err != nil {
+		return autoscaleConfig{}, err
+	}
+	if cfg.max < cfg.min {
+		return autoscaleConfig{}, fmt.Errorf("AUTOSCALE_MAX (%d) must not be below AUTOSCALE_MIN (%d)", cfg.max, cfg.min)
+	}
+	if value := os.Getenv("AUTOSCALE_INTERVAL"); value != "" {
+		cfg.interval, err = time.ParseDuration(value)
+		if err != nil || cfg.interval <= 0 {
+			return autoscaleConfig{}, fmt.Errorf("AUTOSCALE_INTERVAL must be a positive duration, got %q", value)
+		}
+	}
+	return cfg, nil
+}
+
+// desiredWorkers picks the pool size for an observed queue depth. Above
+// the target the pool grows in proportion to the overshoot; below half the
+// target it shrinks one worker at a time, so a brief lull doesn't undo a
+// scale-up. The result always lies within min and max.
+func (c autoscaleConfig) desiredWorkers(current, depth int) int {
+	desired := current
+	switch {
+	case depth > c.targetDepth:
+		desired = int(math.Ceil(float64(max(current, 1)) * float64(depth) / float64(c.targetDepth)))
+	case depth < c.targetDepth/2:
+		desired = current - 1
+	}
+	return min(max(desired, c.min), c.max)
+}
+
+// envMillis reads a non-negative millisecond count from the environment
+func envMillis(name string, defaultMs int) (time.Duration, error) {
+	ms := defaultMs
+	if value := os.Getenv(name); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 0 {
+			return 0, fmt.Errorf("%s must be a non-negative integer, got %q", name, value)
+		}
+		ms = parsed
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
+
+// serverTimeouts bound how long the HTTP server spends on one connection,
+// so slow or stalled clients can't hold connections open indefinitely
+type serverTimeouts struct {
+	readHeader time.Duration
+	read       time.Duration
+	write      time.Duration
+	idle       time.Duration
+}
+
+// loadServerTimeouts reads HTTP_READ_HEADER_TIMEOUT, HTTP_READ_TIMEOUT,
+// HTTP_WRITE_TIMEOUT and HTTP_IDLE_TIMEOUT; zero disables one. The
+// processor's handlers are all quick, so the write timeout only has to
+// cover /metrics waiting up to METRICS_AWS_TIMEOUT on AWS.
+func loadServerTimeouts() (serverTimeouts, error) {
+	timeouts := serverTimeouts{readHeader: 5 * time.Second, read: 30 * time.Second, write: 30 * time.Second, idle: 120 * time.Second}
+	for name, target := range map[string]*time.Duration{
+		"HTTP_READ_HEADER_TIMEOUT": &timeouts.readHeader,
+		"HTTP_READ_TIMEOUT":        &timeouts.read,
+		"HTTP_WRITE_TIMEOUT":       &timeouts.write,
+		"HTTP_IDLE_TIMEOUT":        &timeouts.idle,
+	} {
+		if value := os.Getenv(name); value != "" {
+			parsed, err := time.ParseDuration(value)
+			if err != nil || parsed < 0 {
+				return serverTimeouts{}, fmt.Errorf("%s must be a non-negative duration, got %q", name, value)
+			}
+			*target = parsed
+		}
+	}
+	return timeouts, nil
+}
+
+// newServer builds an HTTP server for handler with these timeouts
+func (t serverTimeouts) newServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: t.readHeader,
+		ReadTimeout:       t.read,
+		WriteTimeout:      t.write,
+		IdleTimeout:       t.idle,
+	}
+}
+
+// OrderProcessor processes orders from SQS queue
+type OrderProcessor struct {
+	sqsClient   *sqs.Client
+	queueURL    string
+	// FIFO queues deliver each message group in order and report its ID
+	fifo bool
+	// Optional high-priority lane: a second queue, fed by an SNS
+	// subscription filtered on priority=high, polled before queueURL. After
+	// highPriorityWeight high batches in a row the normal queue gets a turn.
+	highPriorityURL    string
+	highPriorityWeight int
+	highLane           laneMetrics
+	normalLane         laneMetrics
+	// RAW_DELIVERY: bodies are bare orders rather than SNS envelopes
+	rawDelivery bool
+	// SNS_SUBSCRIPTION_ARN, checked at startup against rawDelivery
+	subscriptionARN string
+	snsClient       *sns.Client
+	// Target worker count; guarded by mu and enforced by reconcileWorkers
+	workerCount int
+
+	// Canary routing: a stable hash of the order ID sends canaryPercent
+	// of orders through canaryHandler instead of stableHandler
+	canaryPercent int
+	stableHandler OrderHandler
+	canaryHandler OrderHandler
+	stableMetrics routeMetrics
+	canaryMetrics routeMetrics
+	// How long orders waited on SQS, from SentTimestamp; messages older
+	// than staleThreshold are logged as stale (zero disables the warning)
+	messageAge     messageAgeMetrics
+	staleThreshold time.Duration
+	// Orders a worker is inside processMessage for, and the load estimate
+	// built from them that the order service polls at GET /status
+	inFlight   int64
+	saturation *saturationTracker
+	// Distribution of processMessage durations, reported as latency_ms
+	latency *latencyHistogram
+
+	// Simulated payment delay, scaled by order total
+	paymentDelay paymentDelayConfig
+	// Decides whether each charge succeeds
+	payments PaymentGateway
+	// Refused charges by PaymentError reason
+	paymentFailures paymentFailureCounts
+	// Runtime fault injection; nil unless CHAOS_ENABLED=true
+	chaos *chaosInjector
+	// Artificial per-message delay before payment, simulating slow
+	// downstream dependencies (zero disables)
+	consumerExtraDelay time.Duration
+
+	// SQS long-poll wait and batch size, and the minimum time between polls
+	// that return nothing so a short or zero wait can't turn workers into a
+	// busy spin
+	pollWaitSeconds  int32
+	maxMessages      int32
+	emptyPollBackoff time.Duration
+	
+	// Failed messages are retried with exponential backoff (base
+	// retryBackoff) until received retryMax times, then sent to dlqURL
+	retryMax         int
+	retryBackoff     time.Duration
+	dlqURL           string
+	retriesScheduled int64
+	deadLettered     int64
+
+	// Messages with no parseable order are never retried: they go straight
+	// to parkingURL (or dlqURL when that is unset) and off the main queue
+	parkingURL     string
+	poisonMessages int64
+	
+	// How long a received message stays hidden from other consumers. While
+	// it is being charged its visibility is reset every visibilityInterval,
+	// for at most visibilityMax, so it can't reappear and be charged twice;
+	// a zero interval disables the heartbeat
+	visibilityTimeout    time.Duration
+	visibilityInterval   time.Duration
+	visibilityMax        time.Duration
+	visibilityExtensions int64
+	
+	// Outcome of recent SQS calls, reported by /metrics
+	sqsHealth dependencyHealth
+	// Cached SQS reachability check served at /ready
+	readiness readinessProbe
+	// Bounds the AWS calls /metrics makes so it still answers when AWS is slow
+	metricsAWSTimeout time.Duration
+	
+	// Skips orders that were already processed (nil if disabled)
+	idempotency       IdempotencyStore
+	duplicatesSkipped int64
+	// Serializes charging an order across replicas (nil unless DEDUP_TABLE)
+	dedup *dedupLock
+	
+	// Skips orders cancelled after they were queued and reports status
+	// back to the order service (nil if ORDER_SERVICE_URL is unset)
+	orderService    *orderServiceClient
+	ordersCancelled int64
+
+	// Delay between worker starts; zero starts all workers at once
+	rampInterval time.Duration
+	ramping      int32
+
+	// Set by POST /drain: workers stop polling SQS until POST /resume.
+	// drainedAt is the UnixNano time it was set.
+	drained   int32
+	drainedAt int64
+
+	// Optional queue-depth driven scaling between autoscale.min and max
+	autoscale        autoscaleConfig
+	autoscaleDepth   int64 // last observed queue depth, -1 before the first poll
+	autoscaleChanges int64
+
+	// Largest JSON request body accepted, from MAX_BODY_BYTES
+	maxBodyBytes int64
+	// HTTP server timeouts, from the HTTP_*_TIMEOUT variables
+	httpTimeouts serverTimeouts
+	
+	// How often the pool is reconciled against the target worker count
+	reconcileInterval time.Duration
+	nextWorkerID      int32
+	// Running workers, oldest first; guarded by mu. Retiring workers are
+	// dropped as soon as they are told to quit, so this is the one count
+	// scaling and reconciliation compare against workerCount.
+	workers []*workerSlot
+
+	// Orders with a total at or above holdThreshold wait for an operator
+	// to approve or reject them; holds older than holdExpiry are released
+	holdThreshold float64
+	holdExpiry    time.Duration
+	holds         HoldStore
+	ordersHeld    int64
+	holdsApproved int64
+	holdsRejected int64
+	holdsExpired  int64
+	
+	// Metrics
+	messagesReceived int64
+	ordersProcessed  int64
+	ordersFailed     int64
+	ordersTimedOut   int64
+	parseErrors      int64 // bodies that held no usable order
+	startTime        time.Time
+	// UnixNano time the counters last started from zero: startTime, or the
+	// latest POST /metrics/reset
+	countersSince int64
+	
+	// Prometheus view of the counters above, served at /metrics/prometheus
+	promRegistry   *prometheus.Registry
+	paymentSeconds prometheus.Histogram
+	
+	// Control. workCtx is the context workers charge orders under; Stop
+	// cancels it through abandonWork once its timeout runs out.
+	stopChan    chan struct{}
+	stopOnce    sync.Once
+	workCtx     context.Context
+	abandonWork context.CancelFunc
+	wg          sync.WaitGroup
+	mu          sync.RWMutex
+}
+
+// NewOrderProcessor creates a new processor
+func NewOrderProcessor(workerCount int) (*OrderProcessor, error) {
+	cfg, err := config.LoadDefaultConfig(context.TODO(),
+		config.WithRegion(os.Getenv("AWS_REGION")),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS config: %w", err)
+	}
+	
+	queueURL := os.Getenv("SQS_QUEUE_URL")
+	if queueURL == "" {
+		slog.Warn("SQS_QUEUE_URL not set, running in demo mode")
+	}
+	if err := preflightRegion(cfg.Region, queueURL); err != nil {
+		return nil, err
+	}
+	fifo, err := fifoMode(queueURL)
+	if err != nil {
+		return nil, err
+	}
+	highPriorityURL := os.Getenv("HIGH_PRIORITY_QUEUE_URL")
+	if highPriorityURL != "" {
+		if queueURL == "" {
+			return nil, errors.New("HIGH_PRIORITY_QUEUE_URL requires SQS_QUEUE_URL")
+		}
+		if highPriorityURL == queueURL {
+			return nil, errors.New("HIGH_PRIORITY_QUEUE_URL must differ from SQS_QUEUE_URL")
+		}
+		// Both lanes share the FIFO handling, so they must be the same kind
+		if strings.HasSuffix(highPriorityURL, ".fifo") != strings.HasSuffix(queueURL, ".fifo") {
+			return nil, errors.New("HIGH_PRIORITY_QUEUE_URL and SQS_QUEUE_URL must both be FIFO queues or both standard")
+		}
+	}
+	highPriorityWeight, err := envRange("HIGH_PRIORITY_WEIGHT", 3, 1, 1000)
+	if err != nil {
+		return nil, err
+	}
+	
+	canaryPercent := 0
+	if value := os.Getenv("CANARY_PERCENT"); value != "" {
+		canaryPercent, err = strconv.Atoi(value)
+		if err != nil || canaryPercent < 0 || canaryPercent > 100 {
+			return nil, fmt.Errorf("CANARY_PERCENT must be an integer between 0 and 100, got %q", value)
+		}
+	}
+	
+	autoscale, err := loadAutoscaleConfig()
+	if err != nil {
+		return nil, err
+	}
+	if autoscale.enabled && queueURL == "" {
+		slog.Warn("AUTOSCALE_ENABLED ignored in demo mode: there is no queue to measure")
+		autoscale.enabled = false
+	}
+	
+	var rampInterval time.Duration
+	if value := os.Getenv("WORKER_RAMP_INTERVAL"); value != "" {
+		rampInterval, err = time.ParseDuration(value)
+		if err != nil || rampInterval < 0 {
+			return nil, fmt.Errorf("WORKER_RAMP_INTERVAL must be a non-negative duration, got %q", value)
+		}
+	}
+	
+	reconcileInterval := 5 * time.Second
+	if value := os.Getenv("WORKER_RECONCILE_INTERVAL"); value != "" {
+		reconcileInterval, err = time.ParseDuration(value)
+		if err != nil || reconcileInterval <= 0 {
+			return nil, fmt.Errorf("WORKER_RECONCILE_INTERVAL must be a positive duration, got %q", value)
+		}
+	}
+	
+	holdThreshold := 0.0
+	if value := os.Getenv("HOLD_THRESHOLD"); value != "" {
+		holdThreshold, err = strconv.ParseFloat(value, 64)
+		if err != nil || holdThreshold < 0 {
+			return nil, fmt.Errorf("HOLD_THRESHOLD must be a non-negative number, got %q", value)
+		}
+	}
+	
+	holdExpiry := 30 * time.Minute
+	if value := os.Getenv("HOLD_EXPIRY"); value != "" {
+		holdExpiry, err = time.ParseDuration(value)
+		if err != nil || holdExpiry <= 0 {
+			return nil, fmt.Errorf("HOLD_EXPIRY must be a positive duration, got %q", value)
+		}
+	}
+	
+	staleThreshold := 5 * time.Minute
+	if value := os.Getenv("STALE_THRESHOLD"); value != "" {
+		staleThreshold, err = time.ParseDuration(value)
+		if err != nil || staleThreshold < 0 {
+			return nil, fmt.Errorf("STALE_THRESHOLD must be a non-negative duration, got %q", value)
+		}
+	}
+	
+	saturationWindow := 10 * time.Second
+	if value := os.Getenv("SATURATION_WINDOW"); value != "" {
+		saturationWindow, err = time.ParseDuration(value)
+		if err != nil || saturationWindow <= 0 {
+			return nil, fmt.Errorf("SATURATION_WINDOW must be a positive duration, got %q", value)
+		}
+	}
+	
+	paymentDelay, err := loadPaymentDelayConfig()
+	if err != nil {
+		return nil, err
+	}
+	
+	payments, err := loadPaymentGateway()
+	if err != nil {
+		return nil, err
+	}
+	
+	consumerExtraDelay, err := envMillis("CONSUMER_EXTRA_DELAY_MS", 0)
+	if err != nil {
+		return nil, err
+	}
+	
+	idempotency, err := newIdempotencyStore(cfg)
+	if err != nil {
+		return nil, err
+	}
+	holds, err := newHoldStore(cfg)
+	if err != nil {
+		return nil, err
+	}
+	dedup, err := newDedupLock(cfg)
+	if err != nil {
+		return nil, err
+	}
+	
+	pollWaitSeconds, err := envRange("SQS_WAIT_SECONDS", 20, 0, 20)
+	if err != nil {
+		return nil, err
+	}
+	// SQS_WAIT_TIME_SECONDS is the older name for the same setting
+	if os.Getenv("SQS_WAIT_SECONDS") == "" {
+		if pollWaitSeconds, err = envRange("SQS_WAIT_TIME_SECONDS", 20, 0, 20); err != nil {
+			return nil, err
+		}
+	}
+	maxMessages, err := envRange("SQS_MAX_MESSAGES", 10, 1, 10)
+	if err != nil {
+		return nil, err
+	}
+	// SQS allows visibility timeouts of up to 12 hours
+	visibilityTimeoutSeconds, err := envRange("SQS_VISIBILITY_TIMEOUT", 30, 1, 43200)
+	if err != nil {
+		return nil, err
+	}
+	visibilityTimeout := time.Duration(visibilityTimeoutSeconds) * time.Second
+	emptyPollBackoff, err := envMillis("EMPTY_POLL_BACKOFF_MS", 1000)
+	if err != nil {
+		return nil, err
+	}
+	
+	retryMax := 3
+	if value := os.Getenv("RETRY_MAX"); value != "" {
+		retryMax, err = strconv.Atoi(value)
+		if err != nil || retryMax < 1 {
+			return nil, fmt.Errorf("RETRY_MAX must be a positive integer, got %q", value)
+		}
+	}
+	retryBackoff := 2 * time.Second
+	if value := os.Getenv("RETRY_BACKOFF_BASE"); value != "" {
+		retryBackoff, err = time.ParseDuration(value)
+		if err != nil || retryBackoff <= 0 {
+			return nil, fmt.Errorf("RETRY_BACKOFF_BASE must be a positive duration, got %q", value)
+		}
+	}
+	
+	// By default the heartbeat fires two thirds of the way through the timeout
+	visibilityInterval := visibilityTimeout * 2 / 3
+	if value := os.Getenv("VISIBILITY_HEARTBEAT_INTERVAL"); value != "" {
+		visibilityInterval, err = time.ParseDuration(value)
+		if err != nil || visibilityInterval < 0 || visibilityInterval >= visibilityTimeout {
+			return nil, fmt.Errorf("VISIBILITY_HEARTBEAT_INTERVAL must be a duration from 0 up to %ds, got %q", visibilityTimeoutSeconds, value)
+		}
+	}
+	visibilityMax := 15 * time.Minute
+	if value := os.Getenv("VISIBILITY_MAX_EXTENSION"); value != "" {
+		visibilityMax, err = time.ParseDuration(value)
+		if err != nil || visibilityMax <= 0 {
+			return nil, fmt.Errorf("VISIBILITY_MAX_EXTENSION must be a positive duration, got %q", value)
+		}
+	}
+	
+	metricsAWSTimeout := 2 * time.Second
+	if value := os.Getenv("METRICS_AWS_TIMEOUT"); value != "" {
+		metricsAWSTimeout, err = time.ParseDuration(value)
+		if err != nil || metricsAWSTimeout <= 0 {
+			return nil, fmt.Errorf("METRICS_AWS_TIMEOUT must be a positive duration, got %q", value)
+		}
+	}
+	maxBodyBytes, err := envRange("MAX_BODY_BYTES", 1<<20, 1, math.MaxInt32)
+	if err != nil {
+		return nil, err
+	}
+	httpTimeouts, err := loadServerTimeouts()
+	if err != nil {
+		return nil, err
+	}
+	
+	latency, err := loadLatencyHistogram()
+	if err != nil {
+		return nil, err
+	}
+	
+	readyCacheTTL := 5 * time.Second
+	if value := os.Getenv("READY_CACHE_TTL"); value != "" {
+		readyCacheTTL, err = time.ParseDuration(value)
+		if err != nil || readyCacheTTL < 0 {
+			return nil, fmt.Errorf("READY_CACHE_TTL must be a non-negative duration, got %q", value)
+		}
+	}
+	
+	p := &OrderProcessor{
+		sqsClient:          sqs.NewFromConfig(cfg),
+		queueURL:           queueURL,
+		fifo:               fifo,
+		highPriorityURL:    highPriorityURL,
+		highPriorityWeight: highPriorityWeight,
+		rawDelivery:        os.Getenv("RAW_DELIVERY") == "true",
+		subscriptionARN:    os.Getenv("SNS_SUBSCRIPTION_ARN"),
+		snsClient:          sns.NewFromConfig(cfg),
+		workerCount:        workerCount,
+		canaryPercent:      canaryPercent,
+		paymentDelay:       paymentDelay,
+		payments:           payments,
+		paymentFailures:    newPaymentFailureCounts(),
+		chaos:              loadChaosInjector(),
+		latency:            latency,
+		maxBodyBytes:       int64(maxBodyBytes),
+		httpTimeouts:       httpTimeouts,
+		consumerExtraDelay: consumerExtraDelay,
+		idempotency:        idempotency,
+		dedup:              dedup,
+		orderService:       newOrderServiceClient(),
+		metricsAWSTimeout:  metricsAWSTimeout,
+		pollWaitSeconds:    int32(pollWaitSeconds),
+		maxMessages:        int32(maxMessages),
+		emptyPollBackoff:   emptyPollBackoff,
+		retryMax:           retryMax,
+		retryBackoff:       retryBackoff,
+		visibilityTimeout:  visibilityTimeout,
+		visibilityInterval: visibilityInterval,
+		visibilityMax:      visibilityMax,
+		dlqURL:             os.Getenv("DLQ_URL"),
+		parkingURL:         os.Getenv("PARKING_QUEUE_URL"),
+		rampInterval:       rampInterval,
+		autoscale:          autoscale,
+		autoscaleDepth:     -1,
+		reconcileInterval:  reconcileInterval,
+		holdThreshold:      holdThreshold,
+		holdExpiry:         holdExpiry,
+		staleThreshold:     staleThreshold,
+		saturation:         newSaturationTracker(saturationWindow),
+		holds:              holds,
+		stopChan:           make(chan struct{}),
+		startTime:          time.Now(),
+	}
+	p.workCtx, p.abandonWork = context.WithCancel(context.Background())
+	// Both routes use the standard payment path until a canary is plugged in
+	p.countersSince = p.startTime.UnixNano()
+	p.stableHandler = p.processPayment
+	p.canaryHandler = p.processPayment
+	p.readiness = readinessProbe{ttl: readyCacheTTL, check: p.checkDependencies}
+	p.registerPrometheus()
+	
+	return p, nil
+}
+
+// registerPrometheus builds the registry for /metrics/prometheus. Counters
+// read the same atomics through loadCounter as the JSON /metrics, so the
+// two never disagree, even about a wrapped counter.
+func (p *OrderProcessor) registerPrometheus() {
+	counter := func(name, help string, value *int64) prometheus.CounterFunc {
+		return prometheus.NewCounterFunc(prometheus.CounterOpts{Name: name, Help: help}, func() float64 {
+			return float64(loadCounter(value))
+		})
+	}
+	
+	p.paymentSeconds = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "payment_processing_duration_seconds",
+		Help:    "Time spent charging an order, successful or not.",
+		Buckets: prometheus.ExponentialBuckets(0.05, 2, 10),
+	})
+	
+	p.promRegistry = prometheus.NewRegistry()
+	p.promRegistry.MustRegister(
+		counter("messages_received_total", "Messages received from SQS.", &p.messagesReceived),
+		counter("orders_processed_total", "Orders charged successfully.", &p.ordersProcessed),
+		counter("orders_failed_total", "Orders whose payment failed.", &p.ordersFailed),
+		counter("orders_timed_out_total", "Orders abandoned at their processing deadline.", &p.ordersTimedOut),
+		counter("orders_cancelled_total", "Queued orders skipped because they were cancelled.", &p.ordersCancelled),
+		counter("message_parse_errors_total", "Messages whose body held no usable order.", &p.parseErrors),
+		counter("poison_messages_total", "Unparseable messages parked or dropped instead of retried.", &p.poisonMessages),
+		counter("visibility_extensions_total", "Visibility timeout resets made while an order was processing.", &p.visibilityExtensions),
+		counter("stale_messages_total", "Order messages older than STALE_THRESHOLD when received.", &p.messageAge.stale),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{Name: "message_age_max_seconds", Help: "Oldest message received since counters_since, by SentTimestamp."}, func() float64 {
+			return float64(atomic.LoadInt64(&p.messageAge.maxMs)) / 1000
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{Name: "workers", Help: "Running worker goroutines."}, func() float64 {
+			return float64(p.liveWorkers())
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{Name: "drained", Help: "1 while POST /drain has paused SQS consumption."}, func() float64 {
+			return float64(atomic.LoadInt32(&p.drained))
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{Name: "orders_in_flight", Help: "Orders a worker is processing right now."}, func() float64 {
+			return float64(atomic.LoadInt64(&p.inFlight))
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{Name: "saturation", Help: "Mean share of workers busy over SATURATION_WINDOW, from 0 to 1."}, func() float64 {
+			return p.saturation.value()
+		}),
+		p.paymentSeconds,
+	)
+	if p.dedup != nil {
+		p.promRegistry.MustRegister(counter("dedup_lock_contended_total", "Orders skipped because another replica held their dedup lock.", &p.dedup.contended))
+	}
+	for _, reason := range paymentFailureReasons {
+		p.promRegistry.MustRegister(prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name:        "payment_failures_total",
+			Help:        "Charges refused by the payment gateway, by reason.",
+			ConstLabels: prometheus.Labels{"reason": reason},
+		}, func() float64 {
+			return float64(loadCounter(p.paymentFailures[reason]))
+		}))
+	}
+	if p.chaos != nil {
+		p.promRegistry.MustRegister(counter("chaos_failures_injected_total", "Payments failed on purpose by the /admin/chaos settings.", &p.chaos.injected))
+	}
+}
+
+// fifoMode reports whether queueURL is a FIFO queue. FIFO_MODE (true or
+// false) overrides detection by the ".fifo" suffix.
+func fifoMode(queueURL string) (bool, error) {
+	detected := strings.HasSuffix(queueURL, ".fifo")
+	value := os.Getenv("FIFO_MODE")
+	if value == "" {
+		return detected, nil
+	}
+	
+	fifo, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("FIFO_MODE must be true or false, got %q", value)
+	}
+	if fifo && queueURL != "" && !detected {
+		return false, fmt.Errorf("FIFO_MODE is true but %s is not a .fifo queue", queueURL)
+	}
+	return fifo, nil
+}
+
+// regionFromQueueURL extracts the region from an SQS queue URL such as
+// https://sqs.us-west-2.amazonaws.com/123456789012/orders or the legacy
+// https://us-west-2.queue.amazonaws.com/... form. Unrecognized hosts (for
+// example a local emulator) yield an empty region.
+func regionFromQueueURL(queueURL string) (string, error) {
+	parsed, err := url.Parse(queueURL)
+	if err != nil || parsed.Host == "" {
+		return "", fmt.Errorf("malformed SQS queue URL %q", queueURL)
+	}
+	
+	labels := strings.Split(parsed.Hostname(), ".")
+	switch {
+	case len(labels) >= 4 && labels[0] == "sqs":
+		return labels[1], nil
+	case len(labels) >= 4 && labels[1] == "queue":
+		return labels[0], nil
+	}
+	return "", nil
+}
+
+// checkRawDelivery compares RAW_DELIVERY with the RawMessageDelivery
+// attribute of SNS_SUBSCRIPTION_ARN. A mismatch is logged as an error,
+// since with RAW_DELIVERY=true every envelope fails to parse, but startup
+// carries on because the subscription can be fixed without a restart.
+func (p *OrderProcessor) checkRawDelivery() {
+	if p.subscriptionARN == "" {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	
+	result, err := p.snsClient.GetSubscriptionAttributes(ctx, &sns.GetSubscriptionAttributesInput{
+		SubscriptionArn: aws.String(p.subscriptionARN),
+	})
+	if err != nil {
+		slog.Warn("Could not check subscription RawMessageDelivery", "subscription_arn", p.subscriptionARN, "error", err)
+		return
+	}
+	actual := result.Attributes["RawMessageDelivery"] == "true"
+	if actual != p.rawDelivery {
+		slog.Error("RAW_DELIVERY does not match the subscription's RawMessageDelivery setting",
+			"subscription_arn", p.subscriptionARN, "raw_delivery", p.rawDelivery, "raw_message_delivery", actual)
+		return
+	}
+	slog.Info("Subscription delivery mode matches RAW_DELIVERY", "raw_delivery", actual)
+}
+
+// preflightRegion fails fast when SQS_QUEUE_URL belongs to a different
+// region than the AWS client, a common copy-paste misconfiguration that
+// otherwise surfaces as confusing receive errors. SKIP_PREFLIGHT=true
+// disables the check for local development.
+func preflightRegion(configured, queueURL string) error {
+	if os.Getenv("SKIP_PREFLIGHT") == "true" || queueURL == "" || configured == "" {
+		return nil
+	}
+	
+	queueRegion, err := regionFromQueueURL(queueURL)
+	if err != nil {
+		return fmt.Errorf("preflight: %w", err)
+	}
+	if queueRegion != "" && queueRegion != configured {
+		return fmt.Errorf("preflight: SQS_QUEUE_URL is in region %s but AWS_REGION is %s", queueRegion, configured)
+	}
+	return nil
+}
+
+// SetCanaryHandler plugs in the alternate processing logic for canary orders
+func (p *OrderProcessor) SetCanaryHandler(handler OrderHandler) {
+	p.canaryHandler = handler
+}
+
+// isCanary deterministically assigns an order to the canary route so
+// redeliveries of the same order always take the same path
+func (p *OrderProcessor) isCanary(orderID string) bool {
+	if p.canaryPercent <= 0 {
+		return false
+	}
+	h := fnv.New32a()
+	h.Write([]byte(orderID))
+	return int(h.Sum32()%100) < p.canaryPercent
+}
+
+// Start begins processing messages with specified number of workers
+func (p *OrderProcessor) Start() {
+	slog.Info("Starting order processor", "workers", p.workerCount, "raw_delivery", p.rawDelivery)
+	p.checkRawDelivery()
+	
+	if p.holdThreshold > 0 {
+		go p.expireHolds()
+	}
+	
+	go p.superviseWorkers()
+	go p.sampleSaturation()
+	if p.autoscale.enabled {
+		go p.autoscaleWorkers()
+	}
+	
+	if p.rampInterval > 0 {
+		atomic.StoreInt32(&p.ramping, 1)
+		go p.rampWorkers(p.workerCount)
+		return
+	}
+	
+	// Start worker goroutines
+	p.mu.Lock()
+	for i := 0; i < p.workerCount; i++ {
+		p.spawnWorker()
+	}
+	p.mu.Unlock()
+	
+	slog.Info("All workers started", "workers", p.workerCount)
+}
+
+// Stop tells every worker to finish its current message and exit, then
+// waits up to timeout for them; it reports whether they all exited. Charges
+// still running at the timeout are abandoned.
+func (p *OrderProcessor) Stop(timeout time.Duration) bool {
+	p.stopOnce.Do(func() { close(p.stopChan) })
+	
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+	
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		p.abandonWork()
+		return false
+	}
+}
+
+// workerSlot is a running worker's handle. Closing quit retires that one
+// worker; retired is set when it is retired so it can report its exit.
+type workerSlot struct {
+	id      int
+	quit    chan struct{}
+	retired *sync.WaitGroup
+}
+
+// spawnWorker starts one worker goroutine; callers must hold p.mu. The
+// slot is added here rather than inside the goroutine so reconciliation
+// never sees a worker that was started but not yet counted.
+func (p *OrderProcessor) spawnWorker() {
+	slot := &workerSlot{
+		id:   int(atomic.AddInt32(&p.nextWorkerID, 1)) - 1,
+		quit: make(chan struct{}),
+	}
+	p.workers = append(p.workers, slot)
+	p.wg.Add(1)
+	go p.worker(slot)
+}
+
+// liveWorkers counts the running workers that aren't being retired
+func (p *OrderProcessor) liveWorkers() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return len(p.workers)
+}
+
+// removeWorker drops a slot from the running list; callers must hold p.mu
+func (p *OrderProcessor) removeWorker(slot *workerSlot) {
+	for i, running := range p.workers {
+		if running == slot {
+			p.workers = append(p.workers[:i], p.workers[i+1:]...)
+			return
+		}
+	}
+}
+
+// reconcileWorkers starts workers until the live count matches the target,
+// replacing any that died; callers must hold p.mu
+func (p *OrderProcessor) reconcileWorkers() {
+	select {
+	case <-p.stopChan:
+		return
+	default:
+	}
+	
+	live := len(p.workers)
+	if live >= p.workerCount {
+		return
+	}
+	
+	missing := p.workerCount - live
+	slog.Info("Reconciling workers", "live", live, "target", p.workerCount, "starting", missing)
+	for i := 0; i < missing; i++ {
+		p.spawnWorker()
+	}
+}
+
+// superviseWorkers periodically reconciles the pool so it self-heals after
+// worker deaths
+func (p *OrderProcessor) superviseWorkers() {
+	ticker := time.NewTicker(p.reconcileInterval)
+	defer ticker.Stop()
+	
+	for {
+		select {
+		case <-p.stopChan:
+			return
+		case <-ticker.C:
+			// Let a gradual ramp finish at its own pace
+			if atomic.LoadInt32(&p.ramping) == 1 {
+				continue
+			}
+			p.mu.Lock()
+			p.reconcileWorkers()
+			p.mu.Unlock()
+		}
+	}
+}
+
+// rampWorkers starts workers one at a time, rampInterval apart
+func (p *OrderProcessor) rampWorkers(count int) {
+	defer atomic.StoreInt32(&p.ramping, 0)
+	
+	for i := 0; i < count; i++ {
+		if i > 0 {
+			select {
+			case <-p.stopChan:
+				return
+			case <-time.After(p.rampInterval):
+			}
+		}
+		// Stop early if the pool was scaled down mid-ramp
+		p.mu.Lock()
+		if len(p.workers) < p.workerCount {
+			p.spawnWorker()
+		}
+		p.mu.Unlock()
+	}
+	
+	slog.Info("All workers started", "workers", count, "ramp_interval", p.rampInterval.String())
+}
+
+// workerPhase reports "ramping" while a gradual start is still bringing
+// workers up, and "running" once it has finished
+func (p *OrderProcessor) workerPhase() string {
+	if atomic.LoadInt32(&p.ramping) == 1 {
+		return "ramping"
+	}
+	return "running"
+}
+
+// worker continuously polls SQS and processes messages until the
+// processor stops or this worker is retired
+func (p *OrderProcessor) worker(slot *workerSlot) {
+	id := slot.id
+	defer p.wg.Done()
+	defer func() {
+		p.mu.Lock()
+		p.removeWorker(slot)
+		retired := slot.retired
+		p.mu.Unlock()
+		if retired != nil {
+			retired.Done()
+		}
+	}()
+	// A panicking worker dies on its own; the supervisor replaces it
+	defer func() {
+		if r := recover(); r != nil {
+			slog.Error("Worker died", "worker", id, "panic", fmt.Sprint(r))
+		}
+	}()
+	
+	// Cancel an in-progress long poll as soon as the worker is told to stop
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-p.stopChan:
+		case <-slot.quit:
+		case <-ctx.Done():
+		}
+		cancel()
+	}()
+	
+	// High-priority batches taken in a row, for pollLanes' fairness
+	highStreak := 0
+	slog.Info("Worker started", "worker", id)
+	
+	for {
+		select {
+		case <-p.stopChan:
+			slog.Info("Worker stopping", "worker", id)
+			return
+		case <-slot.quit:
+			slog.Info("Worker retired", "worker", id)
+			return
+		default:
+			// Drained workers idle without polling until resumed
+			if atomic.LoadInt32(&p.drained) == 1 {
+				sleepCtx(ctx, time.Second)
+				continue
+			}
+			
+			// Skip if no queue URL
+			if p.queueURL == "" {
+				sleepCtx(ctx, 5*time.Second)
+				continue
+			}
+			
+			// Poll SQS for messages
+			pollStart := time.Now()
+			messages, lane, err := p.pollLanes(ctx, &highStreak)
+			if ctx.Err() != nil {
+				// Stopping; any received messages become visible again
+				continue
+			}
+			if err != nil {
+				slog.Error("Error polling messages", "worker", id, "error", err)
+				sleepCtx(ctx, 5*time.Second)
+				continue
+			}
+			
+			// An empty poll that returned early means the wait time is short
+			// or zero; back off instead of polling again immediately
+			if len(messages) == 0 {
+				if backoff := p.emptyPollBackoff - time.Since(pollStart); backoff > 0 {
+					sleepCtx(ctx, backoff)
+				}
+				continue
+			}
+			
+			// Process each message, high-priority orders first, leaving the
+			// rest of the batch on the queue if the worker is told to stop.
+			// Finished messages are deleted together at the end of the batch.
+			priorities := prioritizeMessages(messages, p.fifo)
+			deletes := p.newDeleteBatch()
+			for i, msg := range messages {
+				if ctx.Err() != nil {
+					break
+				}
+				if deletes.due() {
+					deletes.flush()
+				}
+				atomic.AddInt64(&p.messagesReceived, 1)
+				atomic.AddInt64(&lane.received, 1)
+				
+				// Process the order, tagging the worker's log lines with it
+				attrs := []any{"worker", id, "message_id", aws.ToString(msg.MessageId)}
+				if group, ok := msg.Attributes[string(types.MessageSystemAttributeNameMessageGroupId)]; ok {
+					attrs = append(attrs, "message_group_id", group)
+				}
+				if priorities[i] != "" {
+					attrs = append(attrs, "priority", priorities[i])
+				}
+				logger := slog.With(attrs...)
+				order, err := parseOrderMessage(msg, p.rawDelivery)
+				if err != nil {
+					// Redelivery can't make the body parse
+					atomic.AddInt64(&p.parseErrors, 1)
+					p.parkMessage(msg, err, logger)
+					continue
+				}
+				logger = orderLogger(order.OrderID, order.RequestID).With(attrs...)
+				if age, ok := messageAge(msg, time.Now()); ok {
+					stale := p.staleThreshold > 0 && age > p.staleThreshold
+					p.messageAge.record(age, stale)
+					if stale {
+						// The worker's later log lines for the order carry the flag
+						logger = logger.With("delayed", true)
+						logger.Warn("Order message is stale", "age", age.Round(time.Second).String(), "stale_threshold", p.staleThreshold.String())
+					}
+				}
+				logger.Info("Received order message")
+				started := time.Now()
+				atomic.AddInt64(&p.inFlight, 1)
+				err = p.processMessage(p.workCtx, msg, order)
+				atomic.AddInt64(&p.inFlight, -1)
+				p.latency.record(id, time.Since(started))
+				if errors.Is(err, errOrderHeld) || errors.Is(err, errDuplicateOrder) || errors.Is(err, errOrderCancelled) {
+					// Held orders live in the hold store until reviewed,
+					// duplicates were already charged and cancelled orders
+					// must not be, so none of them is redelivered
+					deletes.add(msg, logger)
+					continue
+				}
+				if errors.Is(err, errOrderTimedOut) {
+					// Redelivery can't bring the order back inside its deadline
+					atomic.AddInt64(&p.ordersTimedOut, 1)
+					logger.Warn("Order timed out, marked failed_timeout", "error", err)
+					deletes.add(msg, logger)
+					continue
+				}
+				if errors.Is(err, errOrderDeferred) || errors.Is(err, errOrderLocked) || errors.Is(err, errPaymentAbandoned) {
+					// The message reappears on the queue once the order is
+					// due or, if locked or abandoned, once its visibility
+					// timeout lapses
+					continue
+				}
+				if err != nil {
+					logger.Error("Failed to process message", "error", err)
+					atomic.AddInt64(&p.ordersFailed, 1)
+					p.retryOrDeadLetter(msg, order, err)
+					continue
+				}
+				
+				// Delete message from queue after successful processing
+				deletes.add(msg, logger)
+				
+				atomic.AddInt64(&p.ordersProcessed, 1)
+				atomic.AddInt64(&lane.processed, 1)
+			}
+			deletes.flush()
+		}
+	}
+}
+
+// maxDeleteBatch is the most entries one SQS DeleteMessageBatch accepts
+const maxDeleteBatch = 10
+
+// deleteBatch collects a poll's finished messages for one
+// DeleteMessageBatch. Once a message's heartbeat stops it can reappear
+// after visibilityTimeout-visibilityInterval, so the batch is sent early
+// when its oldest entry has waited half that long.
+type deleteBatch struct {
+	p       *OrderProcessor
+	msgs    []types.Message
+	loggers []*slog.Logger
+	oldest  time.Time
+	maxWait time.Duration
+}
+
+// newDeleteBatch starts an empty batch for one poll cycle
+func (p *OrderProcessor) newDeleteBatch() *deleteBatch {
+	var maxWait time.Duration
+	if p.visibilityInterval > 0 {
+		maxWait = (p.visibilityTimeout - p.visibilityInterval) / 2
+	}
+	return &deleteBatch{p: p, maxWait: maxWait}
+}
+
+// add queues msg for deletion, sending the batch once it is full
+func (b *deleteBatch) add(msg types.Message, logger *slog.Logger) {
+	if len(b.msgs) == 0 {
+		b.oldest = time.Now()
+	}
+	b.msgs = append(b.msgs, msg)
+	b.loggers = append(b.loggers, logger)
+	if len(b.msgs) == maxDeleteBatch {
+		b.flush()
+	}
+}
+
+// due reports whether the oldest queued delete can't wait any longer
+func (b *deleteBatch) due() bool {
+	return len(b.msgs) > 0 && time.Since(b.oldest) >= b.maxWait
+}
+
+// flush deletes every queued message in one call. Entries SQS fails to
+// delete are logged and left to be redelivered, where an idempotency
+// store (IDEMPOTENCY_BACKEND) keeps the order from being charged twice.
+func (b *deleteBatch) flush() {
+	if len(b.msgs) == 0 {
+		return
+	}
+	defer func() { b.msgs, b.loggers = b.msgs[:0], b.loggers[:0] }()
+	
+	entries := make([]types.DeleteMessageBatchRequestEntry, len(b.msgs))
+	for i, msg := range b.msgs {
+		entries[i] = types.DeleteMessageBatchRequestEntry{Id: aws.String(strconv.Itoa(i)), ReceiptHandle: msg.ReceiptHandle}
+	}
+	// A batch holds one poll's messages, so they share a queue
+	result, err := b.p.sqsClient.DeleteMessageBatch(context.TODO(), &sqs.DeleteMessageBatchInput{
+		QueueUrl: aws.String(b.p.sourceQueue(b.msgs[0])),
+		Entries:  entries,
+	})
+	b.p.sqsHealth.record(err)
+	if err != nil {
+		for _, logger := range b.loggers {
+			logger.Error("Failed to delete message", "error", err)
+		}
+		return
+	}
+	for _, failed := range result.Failed {
+		i, convErr := strconv.Atoi(aws.ToString(failed.Id))
+		if convErr != nil || i < 0 || i >= len(b.loggers) {
+			continue
+		}
+		b.loggers[i].Error("Failed to delete message", "code", aws.ToString(failed.Code), "error", aws.ToString(failed.Message), "sender_fault", failed.SenderFault)
+	}
+}
+
+// sleepCtx sleeps for d or until ctx is cancelled, whichever comes first
+func sleepCtx(ctx context.Context, d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+}
+
+// laneMetrics counts one priority lane's messages
+type laneMetrics struct {
+	received  int64
+	processed int64
+}
+
+// snapshot reports the lane's counts and its processing rate since since
+func (m *laneMetrics) snapshot(since time.Time) map[string]interface{} {
+	processed := loadCounter(&m.processed)
+	return map[string]interface{}{
+		"received":       loadCounter(&m.received),
+		"processed":      processed,
+		"processed_rate": float64(processed) / time.Since(since).Seconds(),
+	}
+}
+
+// reset zeroes the lane's counts and returns what they were
+func (m *laneMetrics) reset() map[string]interface{} {
+	return map[string]interface{}{
+		"received":  atomic.SwapInt64(&m.received, 0),
+		"processed": atomic.SwapInt64(&m.processed, 0),
+	}
+}
+
+// saturationSampleInterval is how often saturationTracker samples the pool
+const saturationSampleInterval = 250 * time.Millisecond
+
+// saturationTracker estimates how close the worker pool is to capacity.
+// Every saturationSampleInterval it takes one sample: orders in flight
+// (messages a worker is inside processMessage for) divided by live
+// workers, or 1 when no worker is live. Saturation is the mean of the
+// samples from the last window, so 0 means every worker sat idle and 1
+// that every worker was busy the whole time. Workers take one message at a
+// time, so a sample never exceeds 1; a queue backlog shows up as the
+// value staying at 1 rather than as anything above it.
+type saturationTracker struct {
+	window time.Duration
+	
+	mu      sync.Mutex
+	samples []float64 // ring holding the last window of samples
+	next    int
+	filled  int
+}
+
+func newSaturationTracker(window time.Duration) *saturationTracker {
+	size := max(1, int(window/saturationSampleInterval))
+	return &saturationTracker{window: window, samples: make([]float64, size)}
+}
+
+// record adds one sample taken with inFlight orders across workers
+func (t *saturationTracker) record(inFlight int64, workers int32) {
+	sample := 1.0
+	if workers > 0 {
+		sample = min(1, float64(inFlight)/float64(workers))
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.samples[t.next] = sample
+	t.next = (t.next + 1) % len(t.samples)
+	t.filled = min(t.filled+1, len(t.samples))
+}
+
+// value is the mean of the samples in the window, or 0 before the first
+func (t *saturationTracker) value() float64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.filled == 0 {
+		return 0
+	}
+	total := 0.0
+	for _, sample := range t.samples[:t.filled] {
+		total += sample
+	}
+	return total / float64(t.filled)
+}
+
+// sampleSaturation feeds the saturation tracker until the processor stops
+func (p *OrderProcessor) sampleSaturation() {
+	ticker := time.NewTicker(saturationSampleInterval)
+	defer ticker.Stop()
+	
+	for {
+		select {
+		case <-p.stopChan:
+			return
+		case <-ticker.C:
+			p.saturation.record(atomic.LoadInt64(&p.inFlight), int32(p.liveWorkers()))
+		}
+	}
+}
+
+// saturationStatus is the saturation estimate with the figures behind it
+func (p *OrderProcessor) saturationStatus() map[string]interface{} {
+	return map[string]interface{}{
+		"saturation":     math.Round(p.saturation.value()*1000) / 1000,
+		"in_flight":      atomic.LoadInt64(&p.inFlight),
+		"workers":        p.liveWorkers(),
+		"window_seconds": p.saturation.window.Seconds(),
+		"drained":        atomic.LoadInt32(&p.drained) == 1,
+	}
+}
+
+// messageAgeMetrics tracks how long messages sat on the queue before a
+// worker received them. Redelivered messages keep their original
+// SentTimestamp, so their age includes earlier attempts.
+type messageAgeMetrics struct {
+	count   int64
+	totalMs int64
+	maxMs   int64
+	stale   int64
+}
+
+// messageAge is how long ago SQS accepted msg, from its SentTimestamp
+// attribute; ok is false if the attribute is missing or malformed
+func messageAge(msg types.Message, now time.Time) (age time.Duration, ok bool) {
+	sent, err := strconv.ParseInt(msg.Attributes[string(types.MessageSystemAttributeNameSentTimestamp)], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	// Clock skew between SQS and this host can make a fresh message look
+	// like it was sent in the future
+	return max(0, now.Sub(time.UnixMilli(sent))), true
+}
+
+// record adds one message's age, counting it as stale if it is
+func (m *messageAgeMetrics) record(age time.Duration, stale bool) {
+	ms := age.Milliseconds()
+	atomic.AddInt64(&m.count, 1)
+	atomic.AddInt64(&m.totalMs, ms)
+	for {
+		current := atomic.LoadInt64(&m.maxMs)
+		if ms <= current || atomic.CompareAndSwapInt64(&m.maxMs, current, ms) {
+			break
+		}
+	}
+	if stale {
+		atomic.AddInt64(&m.stale, 1)
+	}
+}
+
+// snapshot reports the largest and mean message age and the stale count
+func (m *messageAgeMetrics) snapshot(threshold time.Duration) map[string]interface{} {
+	count := loadCounter(&m.count)
+	avgMs := 0.0
+	if count > 0 {
+		avgMs = float64(loadCounter(&m.totalMs)) / float64(count)
+	}
+	return map[string]interface{}{
+		"measured":        count,
+		"max_ms":          loadCounter(&m.maxMs),
+		"avg_ms":          avgMs,
+		"stale":           loadCounter(&m.stale),
+		"stale_threshold": threshold.String(),
+	}
+}
+
+// reset zeroes the ages and returns them as snapshot would have
+func (m *messageAgeMetrics) reset() map[string]interface{} {
+	count := atomic.SwapInt64(&m.count, 0)
+	totalMs := atomic.SwapInt64(&m.totalMs, 0)
+	avgMs := 0.0
+	if count > 0 {
+		avgMs = float64(totalMs) / float64(count)
+	}
+	return map[string]interface{}{
+		"measured": count,
+		"max_ms":   atomic.SwapInt64(&m.maxMs, 0),
+		"avg_ms":   avgMs,
+		"stale":    atomic.SwapInt64(&m.stale, 0),
+	}
+}
+
+// sourceQueueAttribute records, in a received message's Attributes, the
+// queue it came from when that isn't queueURL. SQS system attribute names
+// have no dots, so it can't collide with one.
+const sourceQueueAttribute = "orderprocessor.SourceQueueUrl"
+
+// sourceQueue is the queue msg was received from, which its deletes and
+// visibility changes must be sent to
+func (p *OrderProcessor) sourceQueue(msg types.Message) string {
+	if queueURL, ok := msg.Attributes[sourceQueueAttribute]; ok {
+		return queueURL
+	}
+	return p.queueURL
+}
+
+// pollLanes receives a worker's next batch and the lane it came from.
+// Without a high-priority queue that is a plain poll of queueURL.
+// Otherwise the high queue is polled first, without waiting so an empty
+// one doesn't hold up normal orders. After highPriorityWeight high batches
+// in a row (counted in streak) the normal queue goes first, also without
+// waiting since the high queue has a backlog, so normal orders get at
+// least one batch in every highPriorityWeight+1 under sustained VIP load.
+func (p *OrderProcessor) pollLanes(ctx context.Context, streak *int) ([]types.Message, *laneMetrics, error) {
+	if p.highPriorityURL == "" {
+		messages, err := p.pollMessages(ctx, p.queueURL, p.pollWaitSeconds)
+		return messages, &p.normalLane, err
+	}
+	
+	if *streak < p.highPriorityWeight {
+		messages, err := p.pollMessages(ctx, p.highPriorityURL, 0)
+		if err != nil || len(messages) > 0 {
+			if err == nil {
+				*streak++
+			}
+			return messages, &p.highLane, err
+		}
+		*streak = 0
+		messages, err = p.pollMessages(ctx, p.queueURL, p.pollWaitSeconds)
+		return messages, &p.normalLane, err
+	}
+	
+	*streak = 0
+	messages, err := p.pollMessages(ctx, p.queueURL, 0)
+	if err != nil || len(messages) > 0 {
+		return messages, &p.normalLane, err
+	}
+	// Nothing is waiting in the normal lane, so its turn goes back to the
+	// high one
+	*streak = 1
+	messages, err = p.pollMessages(ctx, p.highPriorityURL, 0)
+	return messages, &p.highLane, err
+}
+
+// pollMessages receives messages from queueURL, waiting up to waitSeconds
+// for one to arrive and returning early if ctx is cancelled
+func (p *OrderProcessor) pollMessages(ctx context.Context, queueURL string, waitSeconds int32) ([]types.Message, error) {
+	attributes := []types.MessageSystemAttributeName{
+		types.MessageSystemAttributeNameApproximateReceiveCount,
+		types.MessageSystemAttributeNameSentTimestamp,
+	}
+	if p.fifo {
+		attributes = append(attributes, types.MessageSystemAttributeNameMessageGroupId)
+	}
+	result, err := p.sqsClient.ReceiveMessage(ctx, &sqs.ReceiveMessageInput{
+		QueueUrl:                    aws.String(queueURL),
+		MaxNumberOfMessages:         p.maxMessages,
+		WaitTimeSeconds:             waitSeconds,
+		VisibilityTimeout:           int32(p.visibilityTimeout / time.Second),
+		MessageSystemAttributeNames: attributes,
+		MessageAttributeNames:       []string{"All"},
+	})
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	p.sqsHealth.record(err)
+	
+	if err != nil {
+		return nil, fmt.Errorf("failed to receive messages: %w", err)
+	}
+	
+	if queueURL != p.queueURL {
+		for i := range result.Messages {
+			if result.Messages[i].Attributes == nil {
+				result.Messages[i].Attributes = map[string]string{}
+			}
+			result.Messages[i].Attributes[sourceQueueAttribute] = queueURL
+		}
+	}
+	return result.Messages, nil
+}
+
+// Ways a message body can fail to yield an order
+var (
+	errMalformedBody     = errors.New("message body is not a JSON object")
+	errMalformedEnvelope = errors.New("SNS notification has no message")
+	errMalformedOrder    = errors.New("malformed order")
+)
+
+// parseOrderMessage decodes the order in a message. With raw delivery the
+// body is the order itself. Otherwise bodies delivered via SNS are
+// notification envelopes ("Type": "Notification") with the order in
+// Message, and anything else is treated as a bare order sent straight to
+// the queue, as in local testing.
+func parseOrderMessage(msg types.Message, raw bool) (Order, error) {
+	var snsMessage SQSMessage
+	if msg.Body == nil {
+		return Order{}, fmt.Errorf("%w: empty body", errMalformedBody)
+	}
+	if err := json.Unmarshal([]byte(*msg.Body), &snsMessage); err != nil {
+		return Order{}, fmt.Errorf("%w: %v", errMalformedBody, err)
+	}
+	
+	payload := *msg.Body
+	if raw {
+		if snsMessage.Type == "Notification" {
+			return Order{}, fmt.Errorf("%w: got an SNS envelope but RAW_DELIVERY=true", errMalformedOrder)
+		}
+	} else if snsMessage.Type == "Notification" {
+		if snsMessage.Message == "" {
+			return Order{}, fmt.Errorf("%w (SNS message %s)", errMalformedEnvelope, snsMessage.MessageId)
+		}
+		payload = snsMessage.Message
+	}
+	
+	var order Order
+	if err := json.Unmarshal([]byte(payload), &order); err != nil {
+		return Order{}, fmt.Errorf("%w: %v", errMalformedOrder, err)
+	}
+	if order.OrderID == "" {
+		return Order{}, fmt.Errorf("%w: missing order_id", errMalformedOrder)
+	}
+	return order, nil
+}
+
+// messageAttributes returns the attributes the order service published
+// with an order, read from the SNS envelope or, with raw message delivery,
+// from the SQS message attributes
+func messageAttributes(msg types.Message) map[string]string {
+	attributes := map[string]string{}
+	var snsMessage SQSMessage
+	if msg.Body != nil && json.Unmarshal([]byte(*msg.Body), &snsMessage) == nil {
+		for key, value := range snsMessage.MessageAttributes {
+			attributes[key] = value.Value
+		}
+	}
+	for key, value := range msg.MessageAttributes {
+		if value.StringValue != nil {
+			attributes[key] = *value.StringValue
+		}
+	}
+	return attributes
+}
+
+// messageTraceContext returns ctx carrying the trace the order service
+// started
+func messageTraceContext(ctx context.Context, msg types.Message) context.Context {
+	return otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier(messageAttributes(msg)))
+}
+
+// prioritizeMessages moves priority=high orders to the front of a batch,
+// keeping arrival order otherwise, and returns each message's priority
+// ("" when it wasn't published with one). A FIFO batch is left in order
+// so each message group stays in sequence.
+func prioritizeMessages(messages []types.Message, fifo bool) []string {
+	type prioritized struct {
+		msg      types.Message
+		priority string
+	}
+	batch := make([]prioritized, len(messages))
+	for i, msg := range messages {
+		batch[i] = prioritized{msg, messageAttributes(msg)["priority"]}
+	}
+	if !fifo {
+		sort.SliceStable(batch, func(i, j int) bool {
+			return batch[i].priority == "high" && batch[j].priority != "high"
+		})
+	}
+	
+	priorities := make([]string, len(batch))
+	for i, entry := range batch {
+		messages[i] = entry.msg
+		priorities[i] = entry.priority
+	}
+	return priorities
+}
+
+// processMessage processes a single order message
+func (p *OrderProcessor) processMessage(ctx context.Context, msg types.Message, order Order) (chargeErr error) {
+	ctx, span := tracer.Start(messageTraceContext(ctx, msg), "processMessage", trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(attribute.String("order.id", order.OrderID)))
+	defer span.End()
+	logger := orderLogger(order.OrderID, order.RequestID)
+	
+	// Skip redelivered orders that were already charged
+	if p.idempotency != nil {
+		processed, err := p.idempotency.IsProcessed(order.OrderID)
+		if err != nil {
+			logger.Warn("Idempotency check failed, processing anyway", "error", err)
+		} else if processed {
+			atomic.AddInt64(&p.duplicatesSkipped, 1)
+			logger.Info("Order already processed, skipping duplicate")
+			return errDuplicateOrder
+		}
+	}
+	
+	// Skip orders the customer cancelled while they were queued, and charge
+	// the current items of one amended since it was published
+	if p.orderService != nil {
+		current, err := p.orderService.LookupOrder(order.OrderID)
+		switch {
+		case err != nil:
+			logger.Warn("Cancellation check failed, processing anyway", "error", err)
+		case current == nil:
+		case current.cancelled():
+			atomic.AddInt64(&p.ordersCancelled, 1)
+			logger.Info("Order was cancelled, skipping payment")
+			return errOrderCancelled
+		case current.AmendedAt != nil:
+			order.Items = current.Items
+			logger.Info("Order was amended, charging its current items", "items", len(order.Items))
+		}
+	}
+	
+	// Scheduled orders stay hidden on the queue until they are due
+	if order.ProcessAfter != nil {
+		if wait := time.Until(*order.ProcessAfter); wait > 0 {
+			if err := p.extendVisibility(msg, wait-p.visibilityTimeout); err != nil {
+				return fmt.Errorf("failed to defer order %s: %w", order.OrderID, err)
+			}
+			logger.Info("Order scheduled, deferring", "process_after", order.ProcessAfter.Format(time.RFC3339))
+			return errOrderDeferred
+		}
+	}
+	
+	// Flagged orders wait for manual approval instead of being charged
+	if p.holdThreshold > 0 && order.OrderTotal() >= p.holdThreshold {
+		if err := p.placeOnHold(order); err != nil {
+			return err
+		}
+		return errOrderHeld
+	}
+	
+	// Only one replica charges an order at a time
+	if p.dedup != nil {
+		if err := p.dedup.acquire(order.OrderID); errors.Is(err, errDuplicateOrder) {
+			atomic.AddInt64(&p.duplicatesSkipped, 1)
+			logger.Info("Order already charged by another replica, skipping duplicate")
+			return err
+		} else if errors.Is(err, errOrderLocked) {
+			logger.Info("Order is being charged by another replica, leaving message for redelivery")
+			return err
+		} else if err != nil {
+			logger.Warn("Dedup lock unavailable, processing anyway", "error", err)
+		} else {
+			defer func() {
+				if err := p.dedup.release(order.OrderID, chargeErr == nil); err != nil {
+					logger.Warn("Failed to release dedup lock", "error", err)
+				}
+			}()
+		}
+	}
+	
+	// Keep the message hidden until payment finishes; stopped before the
+	// caller deletes the message or schedules a retry
+	defer p.keepHidden(msg, logger)()
+	
+	// Simulate a slow downstream dependency before payment, keeping the
+	// message hidden for long enough that it isn't redelivered meanwhile
+	if p.consumerExtraDelay > 0 {
+		if err := p.extendVisibility(msg, p.consumerExtraDelay); err != nil {
+			logger.Error("Failed to extend visibility", "error", err)
+		}
+		sleepCtx(ctx, p.consumerExtraDelay)
+		// Shutting down mid-delay leaves the order for redelivery
+		if err := ctx.Err(); err != nil {
+			return abandonedPayment(order, err)
+		}
+	}
+	
+	return p.processOrder(ctx, order)
+}
+
+// extendVisibility resets a message's visibility timeout so it stays hidden
+// for the standard timeout plus extra, measured from now
+func (p *OrderProcessor) extendVisibility(msg types.Message, extra time.Duration) error {
+	return p.setVisibility(msg, p.visibilityTimeout+extra)
+}
+
+// keepHidden resets msg's visibility timeout every visibilityInterval until
+// the returned stop func is called or visibilityMax has passed. stop waits
+// for an in-flight reset, so none lands after the caller's own change.
+func (p *OrderProcessor) keepHidden(msg types.Message, logger *slog.Logger) (stop func()) {
+	if p.visibilityInterval <= 0 || p.queueURL == "" {
+		return func() {}
+	}
+	
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(p.visibilityInterval)
+		defer ticker.Stop()
+		giveUp := time.After(p.visibilityMax)
+		for {
+			select {
+			case <-done:
+				return
+			case <-giveUp:
+				logger.Warn("Still processing after the maximum visibility extension, message may be redelivered", "max_extension", p.visibilityMax.String())
+				return
+			case <-ticker.C:
+				if err := p.setVisibility(msg, p.visibilityTimeout); err != nil {
+					logger.Error("Failed to extend visibility", "error", err)
+					continue
+				}
+				atomic.AddInt64(&p.visibilityExtensions, 1)
+			}
+		}
+	}()
+	
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// setVisibility hides a message for d from now, rounded up to whole seconds
+func (p *OrderProcessor) setVisibility(msg types.Message, d time.Duration) error {
+	timeout := int32(math.Ceil(d.Seconds()))
+	// SQS caps visibility at 12 hours
+	if timeout > 43200 {
+		timeout = 43200
+	}
+	if timeout < 0 {
+		timeout = 0
+	}
+	_, err := p.sqsClient.ChangeMessageVisibility(context.TODO(), &sqs.ChangeMessageVisibilityInput{
+		QueueUrl:          aws.String(p.sourceQueue(msg)),
+		ReceiptHandle:     msg.ReceiptHandle,
+		VisibilityTimeout: timeout,
+	})
+	p.sqsHealth.record(err)
+	return err
+}
+
+// retryOrDeadLetter handles a message whose processing failed. Until it has
+// been received retryMax times it is hidden for an exponentially growing
+// backoff and retried; after that it is moved to the dead-letter queue.
+func (p *OrderProcessor) retryOrDeadLetter(msg types.Message, order Order, cause error) {
+	attempts, err := strconv.Atoi(msg.Attributes[string(types.MessageSystemAttributeNameApproximateReceiveCount)])
+	if err != nil || attempts < 1 {
+		attempts = 1
+	}
+	
+	if attempts >= p.retryMax {
+		if p.dlqURL == "" {
+			slog.Warn("Message failed repeatedly and DLQ_URL is not set, leaving it for redelivery", "message_id", aws.ToString(msg.MessageId), "attempts", attempts)
+			return
+		}
+		if err := p.moveMessage(p.dlqURL, msg, attempts, cause); err != nil {
+			slog.Error("Failed to dead-letter message", "message_id", aws.ToString(msg.MessageId), "error", err)
+			return
+		}
+		atomic.AddInt64(&p.deadLettered, 1)
+		p.reportStatus(order, "failed")
+		slog.Warn("Message dead-lettered", "message_id", aws.ToString(msg.MessageId), "attempts", attempts, "error", cause)
+		return
+	}
+	
+	backoff := 12 * time.Hour
+	if attempts <= 20 && p.retryBackoff<<(attempts-1) < backoff {
+		backoff = p.retryBackoff << (attempts - 1)
+	}
+	if err := p.setVisibility(msg, backoff); err != nil {
+		slog.Error("Failed to set retry backoff", "message_id", aws.ToString(msg.MessageId), "error", err)
+		return
+	}
+	atomic.AddInt64(&p.retriesScheduled, 1)
+	p.reportStatus(order, "pending")
+	slog.Info("Message will be retried", "message_id", aws.ToString(msg.MessageId), "backoff", backoff.String(), "attempt", attempts, "retry_max", p.retryMax)
+}
+
+// parkMessage moves a message whose body holds no usable order to the
+// parking queue, or the dead-letter queue if there is none, without
+// retrying it. With neither configured the body is logged and the message
+// deleted, so it can't cycle through the workers forever. If the move
+// fails the message is left to reappear and be parked on a later receive.
+func (p *OrderProcessor) parkMessage(msg types.Message, cause error, logger *slog.Logger) {
+	queueURL := p.parkingURL
+	if queueURL == "" {
+		queueURL = p.dlqURL
+	}
+	if queueURL == "" {
+		logger.Error("Dropping unparseable message, PARKING_QUEUE_URL and DLQ_URL are not set", "error", cause, "body", aws.ToString(msg.Body))
+		if err := p.deleteMessage(msg); err != nil {
+			logger.Error("Failed to delete unparseable message", "error", err)
+			return
+		}
+		atomic.AddInt64(&p.poisonMessages, 1)
+		return
+	}
+	
+	attempts, err := strconv.Atoi(msg.Attributes[string(types.MessageSystemAttributeNameApproximateReceiveCount)])
+	if err != nil || attempts < 1 {
+		attempts = 1
+	}
+	if err := p.moveMessage(queueURL, msg, attempts, cause); err != nil {
+		logger.Error("Failed to park unparseable message", "error", err)
+		return
+	}
+	atomic.AddInt64(&p.poisonMessages, 1)
+	logger.Warn("Parked unparseable message", "queue_url", queueURL, "error", cause)
+}
+
+// moveMessage copies a message to queueURL with the reason it failed, then
+// deletes the original
+func (p *OrderProcessor) moveMessage(queueURL string, msg types.Message, attempts int, cause error) error {
+	input := &sqs.SendMessageInput{
+		QueueUrl:    aws.String(queueURL),
+		MessageBody: msg.Body,
+		MessageAttributes: map[string]types.MessageAttributeValue{
+			"failure_reason": {DataType: aws.String("String"), StringValue: aws.String(cause.Error())},
+			"attempts":       {DataType: aws.String("Number"), StringValue: aws.String(strconv.Itoa(attempts))},
+		},
+	}
+	// A FIFO destination keeps the original group; retrying the send after
+	// a failed delete must not leave two copies
+	if strings.HasSuffix(queueURL, ".fifo") {
+		group := msg.Attributes[string(types.MessageSystemAttributeNameMessageGroupId)]
+		if group == "" {
+			group = "dead-letter"
+		}
+		input.MessageGroupId = aws.String(group)
+		input.MessageDeduplicationId = msg.MessageId
+	}
+	_, err := p.sqsClient.SendMessage(context.TODO(), input)
+	p.sqsHealth.record(err)
+	if err != nil {
+		return fmt.Errorf("failed to send to %s: %w", queueURL, err)
+	}
+	return p.deleteMessage(msg)
+}
+
+// reportStatus tells the order service about a status change, if it is
+// configured; a failure only costs the client an update, so it is logged
+func (p *OrderProcessor) reportStatus(order Order, status string) {
+	if p.orderService == nil || order.OrderID == "" {
+		return
+	}
+	if err := p.orderService.ReportStatus(order.OrderID, status); err != nil {
+		orderLogger(order.OrderID, order.RequestID).Warn("Failed to report order status", "status", status, "error", err)
+	}
+}
+
+// minLeaseRenewal spaces out renewals of a lease that is about to lapse,
+// or that couldn't be renewed at all
+const minLeaseRenewal = time.Second
+
+// holdLease reports order as processing and, until the returned stop func
+// is called, reports it again a third of the way before each lease the
+// order service hands back runs out. The service marks an order whose
+// lease lapses failed_stalled, so a processor that dies mid-payment stops
+// renewing and its order doesn't stay processing forever. stop waits for
+// an in-flight renewal, so none lands after the caller's next report.
+func (p *OrderProcessor) holdLease(order Order) (stop func()) {
+	if p.orderService == nil || order.OrderID == "" {
+		return func() {}
+	}
+	logger := orderLogger(order.OrderID, order.RequestID)
+	leaseExpiresAt, err := p.orderService.ReportProcessing(order.OrderID)
+	if err != nil {
+		logger.Warn("Failed to report order status", "status", "processing", "error", err)
+	} else if leaseExpiresAt.IsZero() {
+		return func() {}
+	}
+	
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			wait := time.Until(leaseExpiresAt) / 3
+			if wait < minLeaseRenewal {
+				wait = minLeaseRenewal
+			}
+			timer := time.NewTimer(wait)
+			select {
+			case <-done:
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+			renewed, err := p.orderService.ReportProcessing(order.OrderID)
+			if err != nil {
+				logger.Warn("Failed to renew processing lease", "error", err)
+				continue
+			}
+			if renewed.IsZero() {
+				// The order moved on without us, so it has no lease left
+				return
+			}
+			leaseExpiresAt = renewed
+		}
+	}()
+	
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// processOrder runs the payment step for a parsed order
+func (p *OrderProcessor) processOrder(ctx context.Context, order Order) error {
+	// Route the order to the canary or stable handler
+	route, handler, metrics := "stable", p.stableHandler, &p.stableMetrics
+	if p.isCanary(order.OrderID) {
+		route, handler, metrics = "canary", p.canaryHandler, &p.canaryMetrics
+	}
+	
+	logger := orderLogger(order.OrderID, order.RequestID).With("route", route)
+	logger.Info("Processing order", "customer_id", order.CustomerID)
+	
+	if deadline, ok := order.processingDeadline(); ok && !time.Now().Before(deadline) {
+		p.reportStatus(order, "failed_timeout")
+		return fmt.Errorf("%w: order %s exceeded %ds", errOrderTimedOut, order.OrderID, order.MaxProcessingSeconds)
+	}
+	
+	stopLease := p.holdLease(order)
+	_, span := tracer.Start(ctx, "payment.process",
+		trace.WithAttributes(attribute.String("order.id", order.OrderID), attribute.String("route", route)))
+	startTime := time.Now()
+	err := handler(ctx, order)
+	processingTime := time.Since(startTime)
+	stopLease()
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "payment failed")
+	}
+	span.End()
+	metrics.record(processingTime, err)
+	p.paymentSeconds.Observe(processingTime.Seconds())
+	
+	if errors.Is(err, errOrderTimedOut) {
+		p.reportStatus(order, "failed_timeout")
+	}
+	if errors.Is(err, errPaymentAbandoned) {
+		// Another worker picks the order up again when it is redelivered
+		p.reportStatus(order, "pending")
+	}
+	if err != nil {
+		return err
+	}
+	
+	if p.idempotency != nil {
+		firstTime, err := p.idempotency.MarkProcessed(order.OrderID)
+		if err != nil {
+			logger.Error("Failed to record order as processed", "error", err)
+		} else if !firstTime {
+			logger.Warn("Order was also processed by another worker")
+		}
+	}
+	
+	p.reportStatus(order, "completed")
+	logger.Info("Order processed successfully", "duration_ms", processingTime.Milliseconds())
+	return nil
+}
+
+// processPayment is the stable payment path. A charge still waiting when
+// ctx is done or the order's deadline passes is abandoned uncharged.
+func (p *OrderProcessor) processPayment(ctx context.Context, order Order) error {
+	total := order.OrderTotal()
+	orderLogger(order.OrderID, order.RequestID).Info("Charging order", "amount", total, "currency", order.Currency)
+	delay := p.chaos.delay(p.paymentDelay.delayFor(total))
+	
+	// Abandon the charge at the deadline rather than finishing late
+	if deadline, ok := order.processingDeadline(); ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+	
+	// Simulate payment processing (delay scales with the order total)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+		return abandonedPayment(order, ctx.Err())
+	}
+	
+	if err := p.chaos.fail(order.OrderID); err != nil {
+		return err
+	}
+	err := p.payments.Charge(ctx, order.OrderID, total)
+	if err != nil && ctx.Err() != nil {
+		return abandonedPayment(order, ctx.Err())
+	}
+	p.paymentFailures.record(err)
+	return err
+}
+
+// abandonedPayment explains why ctx ended a charge early: the order ran
+// past its deadline, or the processor is shutting down
+func abandonedPayment(order Order, err error) error {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("%w: order %s exceeded %ds during payment", errOrderTimedOut, order.OrderID, order.MaxProcessingSeconds)
+	}
+	return fmt.Errorf("%w: order %s: %v", errPaymentAbandoned, order.OrderID, err)
+}
+
+// placeOnHold parks an order until an operator approves or rejects it. An
+// error leaves the message on the queue, since without a saved hold
+// deleting it would lose the order.
+func (p *OrderProcessor) placeOnHold(order Order) error {
+	logger := orderLogger(order.OrderID, order.RequestID)
+	added, err := p.holds.Put(heldOrder{Order: order, HeldAt: time.Now()})
+	if err != nil {
+		return err
+	}
+	if !added {
+		logger.Info("Order already on hold")
+		return nil
+	}
+	
+	atomic.AddInt64(&p.ordersHeld, 1)
+	logger.Info("Order placed on hold", "total", order.OrderTotal(), "hold_threshold", p.holdThreshold)
+	return nil
+}
+
+// expireHolds periodically releases holds that were never reviewed,
+// reporting them expired so the order service frees their stock
+func (p *OrderProcessor) expireHolds() {
+	interval := p.holdExpiry / 10
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	
+	for {
+		select {
+		case <-p.stopChan:
+			return
+		case <-ticker.C:
+			p.expireHoldsBefore(time.Now().Add(-p.holdExpiry))
+		}
+	}
+}
+
+// expireHoldsBefore releases every hold placed before cutoff. Replicas
+// sweeping the same shared store each take a hold at most once between them.
+func (p *OrderProcessor) expireHoldsBefore(cutoff time.Time) {
+	holds, err := p.holds.List()
+	if err != nil {
+		slog.Warn("Failed to list holds", "error", err)
+		return
+	}
+	for _, listed := range holds {
+		if !listed.HeldAt.Before(cutoff) {
+			continue
+		}
+		held, err := p.holds.Take(listed.Order.OrderID)
+		if err != nil {
+			slog.Warn("Failed to release expired hold", "order_id", listed.Order.OrderID, "error", err)
+			continue
+		}
+		if held == nil {
+			// Reviewed or expired through another replica meanwhile
+			continue
+		}
+		atomic.AddInt64(&p.holdsExpired, 1)
+		p.reportStatus(held.Order, "expired")
+		orderLogger(held.Order.OrderID, held.Order.RequestID).Info("Hold expired, releasing", "hold_expiry", p.holdExpiry.String())
+	}
+}
+
+// deleteMessage removes a message from the queue
+func (p *OrderProcessor) deleteMessage(msg types.Message) error {
+	_, err := p.sqsClient.DeleteMessage(context.TODO(), &sqs.DeleteMessageInput{
+		QueueUrl:      aws.String(p.sourceQueue(msg)),
+		ReceiptHandle: msg.ReceiptHandle,
+	})
+	p.sqsHealth.record(err)
+	return err
+}
+
+// queueDepth reads ApproximateNumberOfMessages, summed over both lanes
+// when there is a high-priority queue, since workers serve both
+func (p *OrderProcessor) queueDepth(ctx context.Context) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, p.metricsAWSTimeout)
+	defer cancel()
+	queues := []string{p.queueURL}
+	if p.highPriorityURL != "" {
+		queues = append(queues, p.highPriorityURL)
+	}
+	
+	total := 0
+	for _, queueURL := range queues {
+		result, err := p.sqsClient.GetQueueAttributes(ctx, &sqs.GetQueueAttributesInput{
+			QueueUrl:       aws.String(queueURL),
+			AttributeNames: []types.QueueAttributeName{types.QueueAttributeNameApproximateNumberOfMessages},
+		})
+		p.sqsHealth.record(err)
+		if err != nil {
+			return 0, err
+		}
+		depth, err := strconv.Atoi(result.Attributes[string(types.QueueAttributeNameApproximateNumberOfMessages)])
+		if err != nil {
+			return 0, err
 		}
+		total += depth
 	}
+	return total, nil
 }
 
-// pollMessages receives messages from SQS
-func (p *OrderProcessor) pollMessages() ([]types.Message, error) {
-	result, err := p.sqsClient.ReceiveMessage(context.TODO(), &sqs.ReceiveMessageInput{
-		QueueUrl:            aws.String(p.queueURL),
-		MaxNumberOfMessages: 10,
-		WaitTimeSeconds:     20,
-		VisibilityTimeout:   30,
-	})
+
+// autoscaleWorkers polls queue depth every autoscale.interval and resizes
+// the pool through UpdateWorkerCount. It overrides manual POST /scale
+// calls on its next tick.
+func (p *OrderProcessor) autoscaleWorkers() {
+	ticker := time.NewTicker(p.autoscale.interval)
+	defer ticker.Stop()
 	
-	if err != nil {
-		return nil, fmt.Errorf("failed to receive messages: %w", err)
+	for {
+		select {
+		case <-p.stopChan:
+			return
+		case <-ticker.C:
+		}
+		// Let a gradual ramp finish before judging the pool size, and don't
+		// grow the pool for a backlog that builds up while drained
+		if atomic.LoadInt32(&p.ramping) == 1 || atomic.LoadInt32(&p.drained) == 1 {
+			continue
+		}
+		
+		depth, err := p.queueDepth(context.Background())
+		if err != nil {
+			slog.Warn("Autoscaler could not read queue depth", "error", err)
+			continue
+		}
+		atomic.StoreInt64(&p.autoscaleDepth, int64(depth))
+		
+		p.mu.RLock()
+		current := p.workerCount
+		p.mu.RUnlock()
+		desired := p.autoscale.desiredWorkers(current, depth)
+		if desired == current {
+			continue
+		}
+		
+		atomic.AddInt64(&p.autoscaleChanges, 1)
+		slog.Info("Autoscaling workers", "queue_depth", depth, "target_depth", p.autoscale.targetDepth, "from", current, "to", desired)
+		p.UpdateWorkerCount(desired)
 	}
-	
-	return result.Messages, nil
 }
 
-// processMessage processes a single order message
-func (p *OrderProcessor) processMessage(msg types.Message) error {
-	// Parse SNS message wrapper
-	var snsMessage SQSMessage
-	if err := json.Unmarshal([]byte(*msg.Body), &snsMessage); err != nil {
-		return fmt.Errorf("failed to parse SNS message: %w", err)
+// UpdateWorkerCount dynamically adjusts the number of workers and returns
+// how many it told to retire. Retiring workers finish their current
+// message in the background; they no longer count as live meanwhile.
+func (p *OrderProcessor) UpdateWorkerCount(newCount int) (retiring int) {
+	p.mu.Lock()
+	running := len(p.workers)
+	if newCount == p.workerCount && running == newCount {
+		p.mu.Unlock()
+		return 0
 	}
+	p.workerCount = newCount
 	
-	// Parse the actual order
-	var order Order
-	if err := json.Unmarshal([]byte(snsMessage.Message), &order); err != nil {
-		return fmt.Errorf("failed to parse order: %w", err)
+	if newCount >= running {
+		slog.Info("Scaling up", "target", newCount, "live", running)
+		p.reconcileWorkers()
+		p.mu.Unlock()
+		return 0
 	}
 	
-	log.Printf("Processing order %s for customer %d", order.OrderID, order.CustomerID)
-	
-	// Simulate payment processing (3 second delay)
-	startTime := time.Now()
-	time.Sleep(3 * time.Second)
-	processingTime := time.Since(startTime)
-	
-	// Simulate 1% payment failures
-	if time.Now().UnixNano()%100 == 0 {
-		return fmt.Errorf("payment failed for order %s", order.OrderID)
+	// Retire the newest workers; each finishes its current message first
+	var retired sync.WaitGroup
+	extra := p.workers[newCount:]
+	p.workers = append([]*workerSlot(nil), p.workers[:newCount]...)
+	for _, slot := range extra {
+		retired.Add(1)
+		slot.retired = &retired
+		close(slot.quit)
 	}
+	p.mu.Unlock()
 	
-	log.Printf("Order %s processed successfully in %v", order.OrderID, processingTime)
-	return nil
+	slog.Info("Scaling down", "retiring", len(extra), "live", newCount)
+	go func() {
+		retired.Wait()
+		slog.Info("Scaled down", "workers", newCount, "retired", len(extra))
+	}()
+	return len(extra)
 }
 
-// deleteMessage removes a message from the queue
-func (p *OrderProcessor) deleteMessage(msg types.Message) error {
-	_, err := p.sqsClient.DeleteMessage(context.TODO(), &sqs.DeleteMessageInput{
-		QueueUrl:      aws.String(p.queueURL),
-		ReceiptHandle: msg.ReceiptHandle,
-	})
-	return err
+// loadCounter reads a monotonically increasing metrics counter. An int64
+// counter would only wrap after ~9.2e18 increments, but if it ever does the
+// reading saturates at math.MaxInt64 instead of going negative; counts are
+// relative to counters_since, which moves on a restart or POST /metrics/reset.
+func loadCounter(addr *int64) int64 {
+	value := atomic.LoadInt64(addr)
+	if value < 0 {
+		return math.MaxInt64
+	}
+	return value
 }
 
-// UpdateWorkerCount dynamically adjusts the number of workers
-func (p *OrderProcessor) UpdateWorkerCount(newCount int) {
-	p.mu.Lock()
-	defer p.mu.Unlock()
-	
-	currentCount := int(atomic.LoadInt32(&p.currentWorkers))
+// laneStatus reports per-lane throughput, or only that the high-priority
+// lane is off
+func (p *OrderProcessor) laneStatus(since time.Time) map[string]interface{} {
+	if p.highPriorityURL == "" {
+		return map[string]interface{}{"enabled": false}
+	}
+	return map[string]interface{}{
+		"enabled": true,
+		"weight":  p.highPriorityWeight,
+		"high":    p.highLane.snapshot(since),
+		"normal":  p.normalLane.snapshot(since),
+	}
+}
+
+// resettableCounter is one counter zeroed by POST /metrics/reset, named by
+// its /metrics section and key
+type resettableCounter struct {
+	section string
+	name    string
+	addr    *int64
+}
+
+// resettableCounters lists the counters POST /metrics/reset zeroes. Gauges
+// such as the worker count and queue depth describe the present and are
+// left alone.
+func (p *OrderProcessor) resettableCounters() []resettableCounter {
+	counters := []resettableCounter{
+		{"processor", "messages_received", &p.messagesReceived},
+		{"processor", "orders_processed", &p.ordersProcessed},
+		{"processor", "orders_failed", &p.ordersFailed},
+		{"processor", "duplicates_skipped", &p.duplicatesSkipped},
+		{"processor", "parse_errors", &p.parseErrors},
+		{"processor", "orders_timed_out", &p.ordersTimedOut},
+		{"processor", "orders_cancelled", &p.ordersCancelled},
+		{"processor", "retries_scheduled", &p.retriesScheduled},
+		{"processor", "dead_lettered", &p.deadLettered},
+		{"processor", "poison_messages", &p.poisonMessages},
+		{"processor", "visibility_extensions", &p.visibilityExtensions},
+		{"holds", "held", &p.ordersHeld},
+		{"holds", "approved", &p.holdsApproved},
+		{"holds", "rejected", &p.holdsRejected},
+		{"holds", "expired", &p.holdsExpired},
+		{"autoscale", "changes", &p.autoscaleChanges},
+	}
+	if p.chaos != nil {
+		counters = append(counters, resettableCounter{"chaos", "failures_injected", &p.chaos.injected})
+	}
+	for _, reason := range paymentFailureReasons {
+		counters = append(counters, resettableCounter{"payment_failures_by_reason", reason, p.paymentFailures[reason]})
+	}
+	if p.dedup != nil {
+		counters = append(counters,
+			resettableCounter{"dedup", "acquired", &p.dedup.acquired},
+			resettableCounter{"dedup", "contended", &p.dedup.contended})
+	}
+	return counters
+}
+
+// HandleResetMetrics zeroes the /metrics counters, so load-test runs can
+// start from a clean slate without restarting the pod, and returns their
+// values from just before. Each counter is swapped to zero on its own: an
+// increment racing the reset lands in the returned snapshot or in the new
+// counts, never in neither. Prometheus sees the drop as a counter reset.
+func (p *OrderProcessor) HandleResetMetrics(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	since := time.Unix(0, atomic.SwapInt64(&p.countersSince, now.UnixNano()))
 	
-	if newCount > currentCount {
-		diff := newCount - currentCount
-		log.Printf("Scaling up: adding %d workers", diff)
-		for i := 0; i < diff; i++ {
-			p.wg.Add(1)
-			go p.worker(currentCount + i)
+	snapshot := map[string]interface{}{
+		"counters_since": since.UTC().Format(time.RFC3339),
+		"reset_at":       now.UTC().Format(time.RFC3339),
+		"routes": map[string]interface{}{
+			"stable": p.stableMetrics.reset(),
+			"canary": p.canaryMetrics.reset(),
+		},
+		"lanes": map[string]interface{}{
+			"high":   p.highLane.reset(),
+			"normal": p.normalLane.reset(),
+		},
+		"message_age": p.messageAge.reset(),
+	}
+	sections := map[string]map[string]interface{}{
+		"processor": {"latency_ms": p.latency.reset()},
+	}
+	for _, counter := range p.resettableCounters() {
+		if sections[counter.section] == nil {
+			sections[counter.section] = map[string]interface{}{}
 		}
-		p.workerCount = newCount
-	} else {
-		log.Printf("Scaling down not implemented")
+		value := atomic.SwapInt64(counter.addr, 0)
+		if value < 0 {
+			value = math.MaxInt64
+		}
+		sections[counter.section][counter.name] = value
+	}
+	for name, section := range sections {
+		snapshot[name] = section
 	}
+	slog.Info("Metrics counters reset", "counters_since", snapshot["counters_since"], "request_id", requestIDFrom(r.Context()))
+	
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(snapshot)
 }
 
 // HandleHealth returns processor health
 func (p *OrderProcessor) HandleHealth(w http.ResponseWriter, r *http.Request) {
+	p.mu.RLock()
+	target := p.workerCount
+	active := len(p.workers)
+	p.mu.RUnlock()
+	
+	// Being mid-ramp is expected after a deploy or scale-up and does not
+	// make the instance unhealthy
 	w.Header().Set("Content-Type", "application/json")
 	health := map[string]interface{}{
 		"status": "healthy",
+		"phase": p.workerPhase(),
 		"timestamp": time.Now().Unix(),
 		"workers": map[string]interface{}{
-			"configured": p.workerCount,
-			"active": atomic.LoadInt32(&p.currentWorkers),
+			"target": target,
+			"current": active,
 		},
 		"metrics": map[string]int64{
-			"messages_received": atomic.LoadInt64(&p.messagesReceived),
-			"orders_processed": atomic.LoadInt64(&p.ordersProcessed),
-			"orders_failed": atomic.LoadInt64(&p.ordersFailed),
+			"messages_received": loadCounter(&p.messagesReceived),
+			"orders_processed": loadCounter(&p.ordersProcessed),
+			"orders_failed": loadCounter(&p.ordersFailed),
 		},
+		"drain": p.drainStatus(),
 	}
 	json.NewEncoder(w).Encode(health)
 }
 
+// checkDependencies confirms the SQS queue is reachable. Demo mode has no
+// queue, so there is nothing to wait for.
+func (p *OrderProcessor) checkDependencies(ctx context.Context) map[string]error {
+	results := map[string]error{}
+	if p.queueURL == "" {
+		return results
+	}
+	
+	ctx, cancel := context.WithTimeout(ctx, p.metricsAWSTimeout)
+	defer cancel()
+	_, err := p.sqsClient.GetQueueAttributes(ctx, &sqs.GetQueueAttributesInput{
+		QueueUrl:       aws.String(p.queueURL),
+		AttributeNames: []types.QueueAttributeName{types.QueueAttributeNameQueueArn},
+	})
+	p.sqsHealth.record(err)
+	results["sqs"] = err
+	return results
+}
+
+// HandleStatus is the cheap load signal the order service polls through
+// PROCESSOR_STATUS_URL to shed async orders: the saturation estimate and
+// the figures behind it, without the AWS calls /metrics makes
+func (p *OrderProcessor) HandleStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p.saturationStatus())
+}
+
+// HandleReady reports whether the processor can take work: 503 until the
+// SQS queue answers. /health stays a liveness check that never calls AWS.
+func (p *OrderProcessor) HandleReady(w http.ResponseWriter, r *http.Request) {
+	results, checkedAt := p.readiness.result(r.Context())
+	writeReadiness(w, results, checkedAt)
+}
+
 // HandleMetrics returns detailed metrics
 func (p *OrderProcessor) HandleMetrics(w http.ResponseWriter, r *http.Request) {
 	// Get queue attributes if available
 	queueMetrics := map[string]interface{}{}
 	if p.queueURL != "" {
-		queueAttrs, err := p.sqsClient.GetQueueAttributes(context.TODO(), &sqs.GetQueueAttributesInput{
+		ctx, cancel := context.WithTimeout(r.Context(), p.metricsAWSTimeout)
+		defer cancel()
+		queueAttrs, err := p.sqsClient.GetQueueAttributes(ctx, &sqs.GetQueueAttributesInput{
 			QueueUrl: aws.String(p.queueURL),
 			AttributeNames: []types.QueueAttributeName{
 				"ApproximateNumberOfMessages",
 				"ApproximateNumberOfMessagesNotVisible",
 			},
 		})
+		p.sqsHealth.record(err)
 		if err == nil {
 			queueMetrics["queue_depth"] = queueAttrs.Attributes["ApproximateNumberOfMessages"]
 			queueMetrics["in_flight"] = queueAttrs.Attributes["ApproximateNumberOfMessagesNotVisible"]
+		} else {
+			queueMetrics["error"] = err.Error()
 		}
 	}
 	
+	// Local counters are reported regardless; the dependency section tells
+	// monitoring whether missing AWS data is an AWS problem
+	dependencies := map[string]interface{}{
+		"sqs": p.sqsHealth.snapshot(),
+	}
+	awsDegraded := p.sqsHealth.degraded()
+	if store, ok := p.idempotency.(*dynamoIdempotencyStore); ok {
+		dependencies["dynamodb"] = store.health.snapshot()
+		awsDegraded = awsDegraded || store.health.degraded()
+	}
+	
+	chaos := map[string]interface{}{"enabled": false}
+	if p.chaos != nil {
+		chaos = p.chaos.status()
+	}
+	dedup := map[string]interface{}{"enabled": false}
+	if p.dedup != nil {
+		dedup = p.dedup.status()
+		dependencies["dedup_dynamodb"] = p.dedup.health.snapshot()
+		awsDegraded = awsDegraded || p.dedup.health.degraded()
+	}
+	
 	uptime := time.Since(p.startTime).Seconds()
-	processed := atomic.LoadInt64(&p.ordersProcessed)
-	processingRate := float64(processed) / uptime
+	countersSince := time.Unix(0, atomic.LoadInt64(&p.countersSince))
+	processed := loadCounter(&p.ordersProcessed)
+	processingRate := float64(processed) / time.Since(countersSince).Seconds()
 	
 	w.Header().Set("Content-Type", "application/json")
 	metrics := map[string]interface{}{
 		"timestamp": time.Now().Unix(),
+		"counters_since": countersSince.UTC().Format(time.RFC3339),
 		"processor": map[string]interface{}{
-			"messages_received": atomic.LoadInt64(&p.messagesReceived),
+			"messages_received": loadCounter(&p.messagesReceived),
 			"orders_processed": processed,
-			"orders_failed": atomic.LoadInt64(&p.ordersFailed),
-			"workers_active": atomic.LoadInt32(&p.currentWorkers),
+			"orders_failed": loadCounter(&p.ordersFailed),
+			"duplicates_skipped": loadCounter(&p.duplicatesSkipped),
+			"parse_errors": loadCounter(&p.parseErrors),
+			"orders_timed_out": loadCounter(&p.ordersTimedOut),
+			"orders_cancelled": loadCounter(&p.ordersCancelled),
+			"retries_scheduled": loadCounter(&p.retriesScheduled),
+			"dead_lettered": loadCounter(&p.deadLettered),
+			"poison_messages": loadCounter(&p.poisonMessages),
+			"visibility_extensions": loadCounter(&p.visibilityExtensions),
+			"workers_active": p.liveWorkers(),
+			"drained": atomic.LoadInt32(&p.drained) == 1,
 			"processing_rate": processingRate,
+			"latency_ms": p.latency.snapshot(),
 			"uptime_seconds": uptime,
 		},
 		"queue": queueMetrics,
+		"message_age": p.messageAge.snapshot(p.staleThreshold),
+		"saturation": p.saturationStatus(),
+		"aws_degraded": awsDegraded,
+		"dependencies": dependencies,
+		"holds": p.holdMetrics(),
+		"chaos": chaos,
+		"payment_failures_by_reason": p.paymentFailures.snapshot(),
+		"dedup": dedup,
+		"autoscale": map[string]interface{}{
+			"enabled":      p.autoscale.enabled,
+			"target_depth": p.autoscale.targetDepth,
+			"min":          p.autoscale.min,
+			"max":          p.autoscale.max,
+			"interval":     p.autoscale.interval.String(),
+			"last_depth":   atomic.LoadInt64(&p.autoscaleDepth),
+			"changes":      loadCounter(&p.autoscaleChanges),
+		},
+		"routes": map[string]interface{}{
+			"canary_percent": p.canaryPercent,
+			"stable":         p.stableMetrics.snapshot(),
+			"canary":         p.canaryMetrics.snapshot(),
+		},
+		"lanes": p.laneStatus(countersSince),
 	}
 	json.NewEncoder(w).Encode(metrics)
 }
 
-// HandleScaleWorkers allows dynamic scaling
+// takeHold removes and returns a held order for a review handler, writing
+// a 404 if the order isn't held or a 503 if the hold store failed
+func (p *OrderProcessor) takeHold(w http.ResponseWriter, orderID string) (*heldOrder, bool) {
+	held, err := p.holds.Take(orderID)
+	if err != nil {
+		orderLogger(orderID, "").Error("Failed to take hold", "error", err)
+		http.Error(w, "Hold store unavailable", http.StatusServiceUnavailable)
+		return nil, false
+	}
+	if held == nil {
+		http.Error(w, "Order not on hold", http.StatusNotFound)
+		return nil, false
+	}
+	return held, true
+}
+
+// HandleApproveHold charges a held order after manual review
+func (p *OrderProcessor) HandleApproveHold(w http.ResponseWriter, r *http.Request) {
+	orderID := mux.Vars(r)["orderId"]
+	
+	held, ok := p.takeHold(w, orderID)
+	if !ok {
+		return
+	}
+	
+	atomic.AddInt64(&p.holdsApproved, 1)
+	orderLogger(orderID, held.Order.RequestID).Info("Hold approved, processing payment")
+	
+	// The hold is already taken, so the charge goes ahead even if the
+	// operator's request goes away
+	status := "completed"
+	if err := p.processOrder(context.WithoutCancel(r.Context()), held.Order); err != nil {
+		orderLogger(orderID, held.Order.RequestID).Error("Approved order failed", "error", err)
+		atomic.AddInt64(&p.ordersFailed, 1)
+		status = "failed"
+		// processOrder already reported a timed-out order as failed_timeout
+		if errors.Is(err, errOrderTimedOut) {
+			status = "failed_timeout"
+		} else {
+			p.reportStatus(held.Order, status)
+		}
+	} else {
+		atomic.AddInt64(&p.ordersProcessed, 1)
+	}
+	
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"order_id": orderID,
+		"status":   status,
+	})
+}
+
+// HandleRejectHold releases a held order without charging it, reporting it
+// rejected so the order service frees its stock
+func (p *OrderProcessor) HandleRejectHold(w http.ResponseWriter, r *http.Request) {
+	orderID := mux.Vars(r)["orderId"]
+	
+	held, ok := p.takeHold(w, orderID)
+	if !ok {
+		return
+	}
+	
+	atomic.AddInt64(&p.holdsRejected, 1)
+	p.reportStatus(held.Order, "rejected")
+	orderLogger(orderID, held.Order.RequestID).Info("Hold rejected")
+	
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"order_id": orderID,
+		"status":   "rejected",
+	})
+}
+
+// holdMetrics summarizes the manual review queue
+func (p *OrderProcessor) holdMetrics() map[string]interface{} {
+	metrics := map[string]interface{}{
+		"threshold": p.holdThreshold,
+		"held":      loadCounter(&p.ordersHeld),
+		"approved":  loadCounter(&p.holdsApproved),
+		"rejected":  loadCounter(&p.holdsRejected),
+		"expired":   loadCounter(&p.holdsExpired),
+	}
+	if holds, err := p.holds.List(); err != nil {
+		metrics["error"] = err.Error()
+	} else {
+		metrics["pending"] = len(holds)
+	}
+	return metrics
+}
+
+// decodeJSONBody decodes a JSON request body into v. Bodies over
+// maxBodyBytes and fields v doesn't declare are errors, which
+// writeBodyError turns into a response.
+func (p *OrderProcessor) decodeJSONBody(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	r.Body = http.MaxBytesReader(w, r.Body, p.maxBodyBytes)
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(v)
+}
+
+// writeBodyError answers a decodeJSONBody error: 413 for an oversized body,
+// 400 naming the field for an unknown one, and 400 with message otherwise
+func writeBodyError(w http.ResponseWriter, err error, message string) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, fmt.Sprintf("Request body exceeds %d bytes", tooLarge.Limit), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if field, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+		http.Error(w, "Unknown field "+field, http.StatusBadRequest)
+		return
+	}
+	http.Error(w, message, http.StatusBadRequest)
+}
+
+// drainStatus reports whether SQS consumption is paused, and since when
+func (p *OrderProcessor) drainStatus() map[string]interface{} {
+	status := map[string]interface{}{"drained": atomic.LoadInt32(&p.drained) == 1}
+	if status["drained"] == true {
+		status["drained_since"] = time.Unix(0, atomic.LoadInt64(&p.drainedAt)).UTC().Format(time.RFC3339)
+	}
+	return status
+}
+
+// HandleDrain stops workers polling SQS for new messages, for maintenance
+// on the payment backend. Messages already received finish normally and
+// the HTTP API stays up; POST /resume undoes it.
+func (p *OrderProcessor) HandleDrain(w http.ResponseWriter, r *http.Request) {
+	if atomic.CompareAndSwapInt32(&p.drained, 0, 1) {
+		atomic.StoreInt64(&p.drainedAt, time.Now().UnixNano())
+		slog.Warn("Draining: workers stop polling SQS until resumed")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p.drainStatus())
+}
+
+// HandleResume lets workers poll SQS again after POST /drain
+func (p *OrderProcessor) HandleResume(w http.ResponseWriter, r *http.Request) {
+	if atomic.CompareAndSwapInt32(&p.drained, 1, 0) {
+		slog.Info("Resumed: workers polling SQS again")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p.drainStatus())
+}
+
+// HandleScaleWorkers allows dynamic scaling. Scaling down answers 202 at
+// once; the retired workers finish their current message in the
+// background.
 func (p *OrderProcessor) HandleScaleWorkers(w http.ResponseWriter, r *http.Request) {
 	var request struct {
 		Workers int `json:"workers"`
 	}
 	
-	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
-		http.Error(w, "Invalid request", http.StatusBadRequest)
+	if err := p.decodeJSONBody(w, r, &request); err != nil {
+		writeBodyError(w, err, "Invalid request")
 		return
 	}
 	
@@ -297,17 +3943,355 @@ func (p *OrderProcessor) HandleScaleWorkers(w http.ResponseWriter, r *http.Reque
 		return
 	}
 	
-	p.UpdateWorkerCount(request.Workers)
+	retiring := p.UpdateWorkerCount(request.Workers)
 	
 	w.Header().Set("Content-Type", "application/json")
 	response := map[string]interface{}{
 		"message": "Worker count updated",
-		"workers": request.Workers,
+		"workers": p.liveWorkers(),
+		"target":  request.Workers,
+	}
+	if retiring > 0 {
+		response["retiring"] = retiring
+		w.WriteHeader(http.StatusAccepted)
 	}
 	json.NewEncoder(w).Encode(response)
 }
 
+// HandleChaos replaces the chaos settings from a JSON body. failure_rate
+// (0-1) is required; latency_ms replaces the payment delay, and leaving it
+// out restores the normal delay.
+func (p *OrderProcessor) HandleChaos(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		FailureRate *float64 `json:"failure_rate"`
+		LatencyMs   *int64   `json:"latency_ms"`
+	}
+	
+	if err := p.decodeJSONBody(w, r, &request); err != nil {
+		writeBodyError(w, err, "Invalid request")
+		return
+	}
+	
+	if request.FailureRate == nil || *request.FailureRate < 0 || *request.FailureRate > 1 {
+		http.Error(w, "failure_rate must be between 0 and 1", http.StatusBadRequest)
+		return
+	}
+	var latency *time.Duration
+	if request.LatencyMs != nil {
+		if *request.LatencyMs < 0 {
+			http.Error(w, "latency_ms must not be negative", http.StatusBadRequest)
+			return
+		}
+		override := time.Duration(*request.LatencyMs) * time.Millisecond
+		latency = &override
+	}
+	
+	p.chaos.set(*request.FailureRate, latency)
+	status := p.chaos.status()
+	slog.Warn("Chaos settings changed", "failure_rate", status["failure_rate"], "latency_ms", status["latency_ms"])
+	
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// accessLogWriter captures the status and size of a response for the
+// access log
+type accessLogWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *accessLogWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *accessLogWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Flush lets streaming handlers push data through the wrapper
+func (w *accessLogWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// accessLogBody counts the request body bytes a handler reads
+type accessLogBody struct {
+	io.ReadCloser
+	bytes int64
+}
+
+func (b *accessLogBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.bytes += int64(n)
+	return n, err
+}
+
+// withAccessLog wraps next so every request, matched or not and let
+// through by next or refused by it, produces one JSON line on stdout,
+// apart from the business logs on stderr. router names the matched route.
+// Latency is measured until the handler returns, so for streaming
+// responses it is the connection duration.
+func withAccessLog(router *mux.Router, next http.Handler) http.Handler {
+	accessLog := log.New(os.Stdout, "", 0)
+	
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		
+		route := "unmatched"
+		var match mux.RouteMatch
+		if router.Match(r, &match) && match.Route != nil {
+			if template, err := match.Route.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+		
+		body := &accessLogBody{ReadCloser: r.Body}
+		r.Body = body
+		recorder := &accessLogWriter{ResponseWriter: w}
+		next.ServeHTTP(recorder, r)
+		
+		status := recorder.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		line, _ := json.Marshal(map[string]interface{}{
+			"time":           start.UTC().Format(time.RFC3339Nano),
+			"request_id":     requestIDFrom(r.Context()),
+			"method":         r.Method,
+			"route":          route,
+			"path":           r.URL.Path,
+			"status":         status,
+			"latency_ms":     float64(time.Since(start).Microseconds()) / 1000,
+			"request_bytes":  body.bytes,
+			"response_bytes": recorder.bytes,
+			"client_ip":      clientIP(r),
+			"user_agent":     r.UserAgent(),
+		})
+		accessLog.Println(string(line))
+	})
+}
+
+// withMiddleware wraps router in request IDs, the access log when
+// accessLog is set, and API key auth. The access log sits outside auth, so
+// refused requests are logged too.
+func withMiddleware(router *mux.Router, keys apiKeys, accessLog bool) http.Handler {
+	handler := withAPIKeyAuth(router, keys)
+	if accessLog {
+		handler = withAccessLog(router, handler)
+	}
+	return withRequestID(handler)
+}
+
+// requestIDKey is the context key withRequestID stores the request ID under
+type requestIDKey struct{}
+
+// withRequestID gives every request an ID, keeping an incoming X-Request-ID
+// or generating a UUID, and echoes it in the response
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get("X-Request-ID")
+		if requestID == "" {
+			requestID = uuid.NewString()
+			r.Header.Set("X-Request-ID", requestID)
+		}
+		w.Header().Set("X-Request-ID", requestID)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, requestID)))
+	})
+}
+
+// apiKeys holds SHA-256 digests of the accepted API keys. Comparing
+// fixed-length digests in constant time reveals neither a key's contents
+// nor its length.
+type apiKeys [][sha256.Size]byte
+
+// loadAPIKeys reads AUTH_ENABLED and the comma-separated API_KEYS, plus one
+// key per line from API_KEYS_FILE, the same settings the order service
+// uses. It returns nil when authentication is disabled.
+func loadAPIKeys() (apiKeys, error) {
+	if os.Getenv("AUTH_ENABLED") != "true" {
+		return nil, nil
+	}
+	raw := strings.Split(os.Getenv("API_KEYS"), ",")
+	if path := os.Getenv("API_KEYS_FILE"); path != "" {
+		contents, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read API_KEYS_FILE: %w", err)
+		}
+		raw = append(raw, strings.Split(string(contents), "\n")...)
+	}
+	var keys apiKeys
+	for _, key := range raw {
+		if key = strings.TrimSpace(key); key != "" {
+			keys = append(keys, sha256.Sum256([]byte(key)))
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("AUTH_ENABLED is set but API_KEYS and API_KEYS_FILE provide no keys")
+	}
+	return keys, nil
+}
+
+// valid reports whether key is one of the accepted keys, checking every
+// key so the time taken doesn't depend on which one matched
+func (k apiKeys) valid(key string) bool {
+	digest := sha256.Sum256([]byte(key))
+	matched := 0
+	for _, accepted := range k {
+		matched |= subtle.ConstantTimeCompare(digest[:], accepted[:])
+	}
+	return matched == 1
+}
+
+// presentedAPIKey returns the key from X-API-Key or an
+// "Authorization: Bearer" header, or "" if the request carries neither
+func presentedAPIKey(r *http.Request) string {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if ok && strings.EqualFold(scheme, "Bearer") {
+		return strings.TrimSpace(token)
+	}
+	return ""
+}
+
+// withAPIKeyAuth requires a valid API key on every request that changes
+// state (scaling, hold decisions, chaos settings); reads stay open. A
+// missing key gets 401 and an unknown one 403.
+func withAPIKeyAuth(next http.Handler, keys apiKeys) http.Handler {
+	if keys == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			next.ServeHTTP(w, r)
+			return
+		}
+		
+		key := presentedAPIKey(r)
+		if key == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="order-processor"`)
+			http.Error(w, "API key required", http.StatusUnauthorized)
+			return
+		}
+		if !keys.valid(key) {
+			slog.Warn("Rejected request with invalid API key", "request_id", requestIDFrom(r.Context()), "method", r.Method, "path", r.URL.Path)
+			http.Error(w, "Invalid API key", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requestIDFrom returns the ID withRequestID attached to ctx, or ""
+func requestIDFrom(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDKey{}).(string)
+	return requestID
+}
+
+// orderLogger tags log lines with the order and, when known, the request
+// that submitted it
+func orderLogger(orderID, requestID string) *slog.Logger {
+	logger := slog.With("order_id", orderID)
+	if requestID != "" {
+		logger = logger.With("request_id", requestID)
+	}
+	return logger
+}
+
+// setupLogging sends slog and the standard log package through one JSON
+// handler on stderr, filtered at LOG_LEVEL (debug, info, warn or error)
+func setupLogging() error {
+	level := slog.LevelInfo
+	if value := os.Getenv("LOG_LEVEL"); value != "" {
+		if err := level.UnmarshalText([]byte(value)); err != nil {
+			return fmt.Errorf("LOG_LEVEL must be debug, info, warn or error, got %q", value)
+		}
+	}
+	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
+	return nil
+}
+
+// setupTracing exports spans over OTLP/HTTP to OTEL_EXPORTER_OTLP_ENDPOINT.
+// Without an endpoint a noop provider is installed, so local runs need no
+// collector. The returned func flushes buffered spans on shutdown.
+func setupTracing(serviceName string) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		otel.SetTracerProvider(tracenoop.NewTracerProvider())
+		return func(context.Context) error { return nil }, nil
+	}
+	
+	ctx := context.Background()
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		otel.SetTracerProvider(tracenoop.NewTracerProvider())
+		return func(context.Context) error { return nil }, fmt.Errorf("failed to create OTLP exporter: %w", err)
+	}
+	// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES override the default name
+	res, err := resource.New(ctx,
+		resource.WithAttributes(attribute.String("service.name", serviceName)),
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build trace resource: %w", err)
+	}
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// clientIP prefers the first X-Forwarded-For hop set by the load balancer
+func clientIP(r *http.Request) string {
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		first, _, _ := strings.Cut(forwarded, ",")
+		return strings.TrimSpace(first)
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// registerMonitoringRoutes mounts the health and metrics handlers for a
+// component under /{component}/health and /{component}/metrics. The bare
+// /health and /metrics paths go to the first component registered on the
+// router, so a combined deployment can compose several components without
+// route collisions.
+func registerMonitoringRoutes(router *mux.Router, component string, health, metrics http.HandlerFunc) {
+	sub := router.PathPrefix("/" + component).Subrouter()
+	sub.HandleFunc("/health", health).Methods("GET")
+	sub.HandleFunc("/metrics", metrics).Methods("GET")
+	
+	if router.Get("health") == nil {
+		router.HandleFunc("/health", health).Methods("GET").Name("health")
+	}
+	if router.Get("metrics") == nil {
+		router.HandleFunc("/metrics", metrics).Methods("GET").Name("metrics")
+	}
+}
+
 func main() {
+	if err := setupLogging(); err != nil {
+		log.Fatal(err)
+	}
+	shutdownTracing, err := setupTracing("order-processor")
+	if err != nil {
+		slog.Warn("Tracing disabled", "error", err)
+	}
+	
 	// Get worker count from environment
 	workerCount := 1
 	if count := os.Getenv("WORKER_COUNT"); count != "" {
@@ -316,8 +4300,16 @@ func main() {
 	
 	// Create processor
 	processor, err := NewOrderProcessor(workerCount)
+	if processor == nil {
+		log.Fatalf("Failed to create processor: %v", err)
+	}
+	if err != nil {
+		slog.Warn("Processor created with limited functionality", "error", err)
+	}
+	
+	keys, err := loadAPIKeys()
 	if err != nil {
-		log.Printf("Warning: Processor created with limited functionality: %v", err)
+		log.Fatal(err)
 	}
 	
 	// Start processing
@@ -325,19 +4317,66 @@ func main() {
 	
 	// Setup HTTP server
 	router := mux.NewRouter()
-	router.HandleFunc("/health", processor.HandleHealth).Methods("GET")
-	router.HandleFunc("/metrics", processor.HandleMetrics).Methods("GET")
+	registerMonitoringRoutes(router, "processor", processor.HandleHealth, processor.HandleMetrics)
+	router.Handle("/metrics/prometheus", promhttp.HandlerFor(processor.promRegistry, promhttp.HandlerOpts{})).Methods("GET")
+	router.HandleFunc("/ready", processor.HandleReady).Methods("GET")
+	router.HandleFunc("/status", processor.HandleStatus).Methods("GET")
+	router.HandleFunc("/metrics/reset", processor.HandleResetMetrics).Methods("POST")
 	router.HandleFunc("/scale", processor.HandleScaleWorkers).Methods("POST")
+	router.HandleFunc("/drain", processor.HandleDrain).Methods("POST")
+	router.HandleFunc("/resume", processor.HandleResume).Methods("POST")
+	router.HandleFunc("/admin/orders/{orderId}/approve", processor.HandleApproveHold).Methods("POST")
+	router.HandleFunc("/admin/orders/{orderId}/reject", processor.HandleRejectHold).Methods("POST")
+	if processor.chaos != nil {
+		router.HandleFunc("/admin/chaos", processor.HandleChaos).Methods("POST")
+	}
 	
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8081"
 	}
 	
-	log.Printf("Order Processor started on port %s", port)
-	log.Printf("Worker count: %d", workerCount)
+	slog.Info("Order Processor started", "port", port, "workers", workerCount)
+	
+	handler := withMiddleware(router, keys, os.Getenv("ACCESS_LOG") == "true")
+	
+	// Longer than the visibility timeout so an in-flight payment can finish
+	// before its message would be redelivered anyway
+	shutdownTimeout := 35 * time.Second
+	if value := os.Getenv("SHUTDOWN_TIMEOUT"); value != "" {
+		if shutdownTimeout, err = time.ParseDuration(value); err != nil {
+			log.Fatalf("Invalid SHUTDOWN_TIMEOUT %q: %v", value, err)
+		}
+	}
+	
+	server := processor.httpTimeouts.newServer(":"+port, handler)
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("Server failed: %v", err)
+		}
+	}()
+	
+	// Wait for a termination signal, then let workers finish their messages
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-stop
+	slog.Info("Shutting down", "signal", sig.String(), "timeout", shutdownTimeout.String())
 	
-	if err := http.ListenAndServe(":"+port, router); err != nil {
-		log.Fatalf("Server failed: %v", err)
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		slog.Error("HTTP server shutdown", "error", err)
+	}
+	deadline, _ := ctx.Deadline()
+	if !processor.Stop(time.Until(deadline)) {
+		slog.Warn("Timed out waiting for workers; unfinished messages will be redelivered")
+	}
+	if shutdownTracing != nil {
+		flushCtx, cancelFlush := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancelFlush()
+		if err := shutdownTracing(flushCtx); err != nil {
+			slog.Error("Tracing shutdown", "error", err)
+		}
 	}
+	slog.Info("Order Processor stopped")
 }
\ No newline at end of file
@@ -0,0 +1,2549 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/redis/go-redis/v9"
+)
+
+// newTestProcessor builds a processor with workers workers in demo mode
+// (no queue) whose payments are instant and always succeed; env is applied
+// on top
+func newTestProcessor(t *testing.T, workers int, env map[string]string) *OrderProcessor {
+	t.Helper()
+	setTestEnv(t, env)
+	p, err := NewOrderProcessor(workers)
+	if err != nil {
+		t.Fatalf("NewOrderProcessor: %v", err)
+	}
+	t.Cleanup(func() { p.Stop(time.Second) })
+	return p
+}
+
+// setTestEnv sets the environment newTestProcessor builds from
+func setTestEnv(t *testing.T, env map[string]string) {
+	t.Helper()
+	defaults := map[string]string{
+		"AWS_REGION":            "us-east-1",
+		"AWS_ACCESS_KEY_ID":     "test",
+		"AWS_SECRET_ACCESS_KEY": "test",
+		"SQS_QUEUE_URL":         "",
+		"ORDER_SERVICE_URL":     "",
+		"PAYMENT_LATENCY":       "0",
+		"PAYMENT_FAILURE_RATE":  "0",
+	}
+	for name, value := range defaults {
+		t.Setenv(name, value)
+	}
+	for name, value := range env {
+		t.Setenv(name, value)
+	}
+}
+
+// testOrder is a one-item order for 5.00
+func testOrder(orderID string) Order {
+	return Order{OrderID: orderID, CustomerID: 1, Items: []Item{{ProductID: "p", Quantity: 1, Price: 5}}, CreatedAt: time.Now()}
+}
+
+// getJSON calls handler with a GET for path and decodes the JSON reply
+func getJSON(t *testing.T, handler http.HandlerFunc, path string) map[string]interface{} {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	var body map[string]interface{}
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatalf("GET %s returned %d with undecodable body: %v", path, rec.Code, err)
+	}
+	return body
+}
+
+// fakeDynamo stands in for the DynamoDB JSON API. It keeps every table's
+// items keyed by order_id and evaluates the handful of condition and update
+// expressions the processor sends; requests are served one at a time, so
+// conditional writes are atomic as they are in DynamoDB.
+type fakeDynamo struct {
+	mu sync.Mutex
+	// table -> order_id -> attribute -> {"S": value} or {"N": value}
+	tables map[string]map[string]map[string]map[string]string
+}
+
+// dynamoRequest is the union of the request fields the fake reads
+type dynamoRequest struct {
+	TableName                           string
+	Key                                 map[string]map[string]string
+	Item                                map[string]map[string]string
+	ConditionExpression                 string
+	UpdateExpression                    string
+	ExpressionAttributeNames            map[string]string
+	ExpressionAttributeValues           map[string]map[string]string
+	ReturnValues                        string
+	ReturnValuesOnConditionCheckFailure string
+}
+
+var notExistsClause = regexp.MustCompile(`^attribute_not_exists\((\w+)\)$`)
+
+func (f *fakeDynamo) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var request dynamoRequest
+	body, _ := io.ReadAll(r.Body)
+	json.Unmarshal(body, &request)
+	w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+	table := f.tables[request.TableName]
+	if table == nil {
+		table = map[string]map[string]map[string]string{}
+		f.tables[request.TableName] = table
+	}
+	key := request.Key["order_id"]["S"]
+	if request.Item != nil {
+		key = request.Item["order_id"]["S"]
+	}
+	current := table[key]
+
+	op := strings.TrimPrefix(r.Header.Get("X-Amz-Target"), "DynamoDB_20120810.")
+	switch op {
+	case "PutItem", "UpdateItem", "DeleteItem":
+		if !f.conditionHolds(current, request) {
+			failure := map[string]interface{}{
+				"__type":  "com.amazonaws.dynamodb.v20120810#ConditionalCheckFailedException",
+				"message": "The conditional request failed",
+			}
+			if request.ReturnValuesOnConditionCheckFailure == "ALL_OLD" && current != nil {
+				failure["Item"] = current
+			}
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(failure)
+			return
+		}
+	}
+	switch op {
+	case "GetItem":
+		if current == nil {
+			w.Write([]byte(`{}`))
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"Item": current})
+	case "PutItem":
+		table[key] = request.Item
+		w.Write([]byte(`{}`))
+	case "UpdateItem":
+		updated := maps.Clone(current)
+		if updated == nil {
+			updated = map[string]map[string]string{"order_id": {"S": key}}
+		}
+		for _, assignment := range strings.Split(strings.TrimPrefix(request.UpdateExpression, "SET "), ",") {
+			name, value, _ := strings.Cut(assignment, "=")
+			updated[request.attributeName(strings.TrimSpace(name))] = request.ExpressionAttributeValues[strings.TrimSpace(value)]
+		}
+		table[key] = updated
+		w.Write([]byte(`{}`))
+	case "DeleteItem":
+		delete(table, key)
+		if request.ReturnValues == "ALL_OLD" && current != nil {
+			json.NewEncoder(w).Encode(map[string]interface{}{"Attributes": current})
+			return
+		}
+		w.Write([]byte(`{}`))
+	case "Scan":
+		items := make([]map[string]map[string]string, 0, len(table))
+		for _, item := range table {
+			items = append(items, item)
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"Items": items, "Count": len(items)})
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"__type":"com.amazon.coral.service#UnknownOperationException","message":"` + op + `"}`))
+	}
+}
+
+// conditionHolds evaluates request's condition, made of clauses joined by
+// OR, each attribute_not_exists(name), "name = :value" or "name < :value"
+func (f *fakeDynamo) conditionHolds(item map[string]map[string]string, request dynamoRequest) bool {
+	if request.ConditionExpression == "" {
+		return true
+	}
+	for _, clause := range strings.Split(request.ConditionExpression, " OR ") {
+		if match := notExistsClause.FindStringSubmatch(clause); match != nil {
+			if item[match[1]] == nil {
+				return true
+			}
+			continue
+		}
+		fields := strings.Fields(clause)
+		if len(fields) != 3 {
+			continue
+		}
+		stored, want := item[request.attributeName(fields[0])], request.ExpressionAttributeValues[fields[2]]
+		if stored == nil {
+			continue
+		}
+		switch fields[1] {
+		case "=":
+			if maps.Equal(stored, want) {
+				return true
+			}
+		case "<":
+			storedN, _ := strconv.ParseFloat(stored["N"], 64)
+			wantN, _ := strconv.ParseFloat(want["N"], 64)
+			if storedN < wantN {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// attributeName resolves a #placeholder through ExpressionAttributeNames
+func (r dynamoRequest) attributeName(name string) string {
+	if resolved, ok := r.ExpressionAttributeNames[name]; ok {
+		return resolved
+	}
+	return name
+}
+
+// newFakeDynamoClient serves a fresh fakeDynamo for the rest of the test
+func newFakeDynamoClient(t *testing.T) *dynamodb.Client {
+	t.Helper()
+	server := httptest.NewServer(&fakeDynamo{tables: map[string]map[string]map[string]map[string]string{}})
+	t.Cleanup(server.Close)
+	return dynamodb.New(dynamodb.Options{
+		Region:       "us-east-1",
+		BaseEndpoint: aws.String(server.URL),
+		Credentials:  aws.AnonymousCredentials{},
+	})
+}
+
+// newMiniredisClient connects to an in-process Redis for the rest of the test
+func newMiniredisClient(t *testing.T) *redis.Client {
+	t.Helper()
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// fakeSQS stands in for the SQS JSON API. Pushed messages are handed out
+// once each by ReceiveMessage; deletes, visibility changes and sends are
+// recorded so tests can check what the processor did with them. With
+// longPoll set, a receive from an empty queue waits that long for a
+// message, as a long poll does; receipt handles in failDeletes come back
+// as failed entries of a DeleteMessageBatch.
+type fakeSQS struct {
+	longPoll    time.Duration
+	failDeletes map[string]bool
+
+	mu         sync.Mutex
+	queues     map[string][]fakeSQSMessage
+	nextID     int
+	deleted    []string
+	visibility map[string][]int
+	sent       map[string][]string
+	sentIDs    map[string][]fakeSQSSendIDs
+	calls      map[string]int
+	failing    map[string]bool
+}
+
+// fakeSQSSendIDs are the FIFO IDs a SendMessage carried
+type fakeSQSSendIDs struct {
+	MessageGroupId         string
+	MessageDeduplicationId string
+}
+
+// fakeSQSMessage is a queued message in the wire shape ReceiveMessage returns
+type fakeSQSMessage struct {
+	MessageId         string
+	ReceiptHandle     string
+	Body              string
+	Attributes        map[string]string
+	MessageAttributes map[string]map[string]string `json:",omitempty"`
+}
+
+func (f *fakeSQS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		QueueUrl            string
+		MaxNumberOfMessages int
+		ReceiptHandle       string
+		VisibilityTimeout   int
+		MessageBody         string
+		fakeSQSSendIDs
+		Entries []struct {
+			Id                string
+			ReceiptHandle     string
+			VisibilityTimeout int
+			MessageBody       string
+		}
+	}
+	body, _ := io.ReadAll(r.Body)
+	json.Unmarshal(body, &request)
+	w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+	op := strings.TrimPrefix(r.Header.Get("X-Amz-Target"), "AmazonSQS.")
+	f.mu.Lock()
+	f.calls[op]++
+	failing := f.failing[op]
+	f.mu.Unlock()
+	if failing {
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, `{"__type":"com.amazonaws.sqs#InternalError","message":"We encountered an internal error"}`)
+		return
+	}
+	if op == "ReceiveMessage" && f.longPoll > 0 {
+		f.waitForMessages(r.Context(), request.QueueUrl)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var response interface{} = map[string]interface{}{}
+	switch op {
+	case "ReceiveMessage":
+		n := min(max(request.MaxNumberOfMessages, 1), len(f.queues[request.QueueUrl]))
+		messages := f.queues[request.QueueUrl][:n]
+		f.queues[request.QueueUrl] = f.queues[request.QueueUrl][n:]
+		if n > 0 {
+			response = map[string]interface{}{"Messages": messages}
+		}
+	case "DeleteMessage":
+		f.deleted = append(f.deleted, request.ReceiptHandle)
+	case "ChangeMessageVisibility":
+		f.visibility[request.ReceiptHandle] = append(f.visibility[request.ReceiptHandle], request.VisibilityTimeout)
+	case "SendMessage":
+		f.sent[request.QueueUrl] = append(f.sent[request.QueueUrl], request.MessageBody)
+		f.sentIDs[request.QueueUrl] = append(f.sentIDs[request.QueueUrl], request.fakeSQSSendIDs)
+		response = map[string]interface{}{"MessageId": fmt.Sprintf("sent-%d", len(f.sent[request.QueueUrl]))}
+	case "DeleteMessageBatch", "ChangeMessageVisibilityBatch", "SendMessageBatch":
+		successful, failed := []map[string]string{}, []map[string]interface{}{}
+		for _, entry := range request.Entries {
+			switch op {
+			case "DeleteMessageBatch":
+				if f.failDeletes[entry.ReceiptHandle] {
+					failed = append(failed, map[string]interface{}{"Id": entry.Id, "Code": "ReceiptHandleIsInvalid", "SenderFault": true})
+					continue
+				}
+				f.deleted = append(f.deleted, entry.ReceiptHandle)
+			case "ChangeMessageVisibilityBatch":
+				f.visibility[entry.ReceiptHandle] = append(f.visibility[entry.ReceiptHandle], entry.VisibilityTimeout)
+			default:
+				f.sent[request.QueueUrl] = append(f.sent[request.QueueUrl], entry.MessageBody)
+			}
+			successful = append(successful, map[string]string{"Id": entry.Id, "MessageId": entry.Id})
+		}
+		response = map[string]interface{}{"Successful": successful, "Failed": failed}
+	case "GetQueueAttributes":
+		response = map[string]interface{}{"Attributes": map[string]string{
+			"ApproximateNumberOfMessages":           strconv.Itoa(len(f.queues[request.QueueUrl])),
+			"ApproximateNumberOfMessagesNotVisible": "0",
+			"ApproximateNumberOfMessagesDelayed":    "0",
+		}}
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// waitForMessages returns once queueURL has a message, longPoll has passed
+// or the request is cancelled
+func (f *fakeSQS) waitForMessages(ctx context.Context, queueURL string) {
+	deadline := time.After(f.longPoll)
+	for {
+		f.mu.Lock()
+		queued := len(f.queues[queueURL])
+		f.mu.Unlock()
+		if queued > 0 {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-deadline:
+			return
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// fail makes every request for op answer an internal error, or stops
+// doing so
+func (f *fakeSQS) fail(op string, failing bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failing[op] = failing
+}
+
+// calledTimes returns how many requests for op were served
+func (f *fakeSQS) calledTimes(op string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls[op]
+}
+
+// push queues a message body on queueURL and returns its receipt handle
+func (f *fakeSQS) push(queueURL, body string) string {
+	return f.pushMessage(queueURL, fakeSQSMessage{Body: body})
+}
+
+// pushMessage queues msg on queueURL, filling in its IDs and the
+// attributes the processor reads, and returns its receipt handle
+func (f *fakeSQS) pushMessage(queueURL string, msg fakeSQSMessage) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.nextID++
+	msg.MessageId = fmt.Sprintf("m%d", f.nextID)
+	msg.ReceiptHandle = fmt.Sprintf("rh%d", f.nextID)
+	if msg.Attributes == nil {
+		msg.Attributes = map[string]string{}
+	}
+	if msg.Attributes["ApproximateReceiveCount"] == "" {
+		msg.Attributes["ApproximateReceiveCount"] = "1"
+	}
+	if msg.Attributes["SentTimestamp"] == "" {
+		msg.Attributes["SentTimestamp"] = strconv.FormatInt(time.Now().UnixMilli(), 10)
+	}
+	f.queues[queueURL] = append(f.queues[queueURL], msg)
+	return msg.ReceiptHandle
+}
+
+// wasDeleted reports whether the message with receiptHandle was deleted
+func (f *fakeSQS) wasDeleted(receiptHandle string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Contains(f.deleted, receiptHandle)
+}
+
+// sentTo returns the bodies sent to queueURL, oldest first
+func (f *fakeSQS) sentTo(queueURL string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.sent[queueURL]...)
+}
+
+// sentIDsTo returns the FIFO IDs of the single messages sent to queueURL,
+// oldest first
+func (f *fakeSQS) sentIDsTo(queueURL string) []fakeSQSSendIDs {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]fakeSQSSendIDs(nil), f.sentIDs[queueURL]...)
+}
+
+// visibilityChanges returns the visibility timeouts set on a message
+func (f *fakeSQS) visibilityChanges(receiptHandle string) []int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]int(nil), f.visibility[receiptHandle]...)
+}
+
+// useFakeSQS points the SQS client at a fresh fakeSQS and returns it with
+// the URL of its orders queue. Empty polls return at once and workers
+// retry them quickly.
+func useFakeSQS(t *testing.T) (*fakeSQS, string) {
+	t.Helper()
+	fake := &fakeSQS{
+		queues:     map[string][]fakeSQSMessage{},
+		visibility: map[string][]int{},
+		sent:       map[string][]string{},
+		sentIDs:    map[string][]fakeSQSSendIDs{},
+		calls:      map[string]int{},
+		failing:    map[string]bool{},
+	}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	t.Setenv("AWS_ENDPOINT_URL_SQS", server.URL)
+	t.Setenv("SKIP_PREFLIGHT", "true")
+	t.Setenv("SQS_WAIT_SECONDS", "0")
+	t.Setenv("EMPTY_POLL_BACKOFF_MS", "10")
+	return fake, server.URL + "/000000000000/orders"
+}
+
+// eventually polls condition every 10ms until it holds or timeout passes
+func eventually(t *testing.T, timeout time.Duration, condition func() bool) bool {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return true
+}
+
+// fakeOrderService records the statuses the processor reports back and
+// answers order lookups with a pending order
+type fakeOrderService struct {
+	mu      sync.Mutex
+	reports map[string][]string
+}
+
+func (f *fakeOrderService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method == http.MethodGet {
+		json.NewEncoder(w).Encode(map[string]interface{}{"status": "pending"})
+		return
+	}
+	orderID := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/admin/orders/"), "/status")
+	var report struct {
+		Status string `json:"status"`
+	}
+	json.NewDecoder(r.Body).Decode(&report)
+	f.mu.Lock()
+	f.reports[orderID] = append(f.reports[orderID], report.Status)
+	f.mu.Unlock()
+	json.NewEncoder(w).Encode(map[string]interface{}{"order_id": orderID, "status": report.Status})
+}
+
+// statuses returns the statuses reported for an order, oldest first
+func (f *fakeOrderService) statuses(orderID string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.reports[orderID]...)
+}
+
+// newFakeOrderService serves a fakeOrderService and returns it with its URL
+func newFakeOrderService(t *testing.T) (*fakeOrderService, string) {
+	t.Helper()
+	fake := &fakeOrderService{reports: map[string][]string{}}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	return fake, server.URL
+}
+
+// orderMessage is the SQS message carrying order, as the handlers see it
+func orderMessage(t *testing.T, order Order) types.Message {
+	t.Helper()
+	body, err := json.Marshal(order)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return types.Message{MessageId: aws.String("m-" + order.OrderID), Body: aws.String(string(body)), ReceiptHandle: aws.String("r-" + order.OrderID)}
+}
+
+// postOrderAction calls an /admin/orders/{orderId}/... handler for orderID
+func postOrderAction(handler http.HandlerFunc, orderID string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(http.MethodPost, "/admin/orders/"+orderID, nil)
+	request = mux.SetURLVars(request, map[string]string{"orderId": orderID})
+	rec := httptest.NewRecorder()
+	handler(rec, request)
+	return rec
+}
+
+func TestCanaryAssignmentIsStable(t *testing.T) {
+	p := newTestProcessor(t, 1, map[string]string{"CANARY_PERCENT": "20"})
+
+	canaries := 0
+	for i := 0; i < 1000; i++ {
+		orderID := fmt.Sprintf("order-%d", i)
+		first := p.isCanary(orderID)
+		for repeat := 0; repeat < 3; repeat++ {
+			if p.isCanary(orderID) != first {
+				t.Fatalf("order %s changed route between calls", orderID)
+			}
+		}
+		if first {
+			canaries++
+		}
+	}
+	if canaries < 100 || canaries > 300 {
+		t.Errorf("%d of 1000 orders routed to the canary, want about 200", canaries)
+	}
+
+	for percent, want := range map[string]bool{"0": false, "100": true} {
+		p := newTestProcessor(t, 1, map[string]string{"CANARY_PERCENT": percent})
+		for i := 0; i < 100; i++ {
+			if got := p.isCanary(fmt.Sprintf("order-%d", i)); got != want {
+				t.Fatalf("CANARY_PERCENT=%s routed order-%d to canary=%v", percent, i, got)
+			}
+		}
+	}
+}
+
+func TestCanaryMetricsAreSeparate(t *testing.T) {
+	p := newTestProcessor(t, 1, map[string]string{"CANARY_PERCENT": "50"})
+	p.SetCanaryHandler(func(ctx context.Context, order Order) error {
+		return errors.New("canary path refused the order")
+	})
+
+	var stable, canary int64
+	for i := 0; i < 40; i++ {
+		order := testOrder(fmt.Sprintf("order-%d", i))
+		err := p.processOrder(context.Background(), order)
+		if p.isCanary(order.OrderID) {
+			canary++
+			if err == nil {
+				t.Errorf("canary order %s succeeded", order.OrderID)
+			}
+		} else {
+			stable++
+			if err != nil {
+				t.Errorf("stable order %s: %v", order.OrderID, err)
+			}
+		}
+	}
+	if stable == 0 || canary == 0 {
+		t.Fatalf("orders split %d stable / %d canary, want both routes used", stable, canary)
+	}
+
+	stableStats, canaryStats := p.stableMetrics.snapshot(), p.canaryMetrics.snapshot()
+	if stableStats["processed"] != stable || stableStats["failed"] != int64(0) {
+		t.Errorf("stable metrics %v, want %d processed and none failed", stableStats, stable)
+	}
+	if canaryStats["processed"] != int64(0) || canaryStats["failed"] != canary {
+		t.Errorf("canary metrics %v, want %d failed and none processed", canaryStats, canary)
+	}
+	if stableStats["success_rate"] != 1.0 || canaryStats["success_rate"] != 0.0 {
+		t.Errorf("success rates stable %v, canary %v; want 1 and 0", stableStats["success_rate"], canaryStats["success_rate"])
+	}
+}
+
+func TestHealthDuringAndAfterRamp(t *testing.T) {
+	p := newTestProcessor(t, 3, map[string]string{"WORKER_RAMP_INTERVAL": "150ms"})
+	p.Start()
+
+	health := getJSON(t, p.HandleHealth, "/health")
+	workers := health["workers"].(map[string]interface{})
+	if health["phase"] != "ramping" || health["status"] != "healthy" {
+		t.Errorf("mid-ramp health %v, want a healthy instance in phase ramping", health)
+	}
+	if workers["target"] != 3.0 || workers["current"].(float64) >= 3 {
+		t.Errorf("mid-ramp workers %v, want target 3 and fewer current", workers)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for getJSON(t, p.HandleHealth, "/health")["phase"] == "ramping" {
+		if time.Now().After(deadline) {
+			t.Fatal("still ramping after 2s")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	health = getJSON(t, p.HandleHealth, "/health")
+	if workers := health["workers"].(map[string]interface{}); workers["current"] != 3.0 || workers["target"] != 3.0 {
+		t.Errorf("after the ramp workers %v, want 3 of 3", workers)
+	}
+	if len(health["workers"].(map[string]interface{})) != 2 {
+		t.Errorf("workers %v, want only target and current", health["workers"])
+	}
+}
+
+// newHoldingProcessor holds every order worth 100 or more and reports to a
+// fake order service
+func newHoldingProcessor(t *testing.T) (*OrderProcessor, *fakeOrderService) {
+	t.Helper()
+	service, url := newFakeOrderService(t)
+	p := newTestProcessor(t, 1, map[string]string{"HOLD_THRESHOLD": "100", "ORDER_SERVICE_URL": url})
+	return p, service
+}
+
+// holdOrder sends a 150.00 order through processMessage, which must hold it
+func holdOrder(t *testing.T, p *OrderProcessor, orderID string) {
+	t.Helper()
+	order := Order{OrderID: orderID, CustomerID: 1, Items: []Item{{ProductID: "p", Quantity: 1, Price: 150}}}
+	if err := p.processMessage(context.Background(), orderMessage(t, order), order); !errors.Is(err, errOrderHeld) {
+		t.Fatalf("processMessage returned %v, want the order held", err)
+	}
+}
+
+func TestApprovedHoldIsCharged(t *testing.T) {
+	p, service := newHoldingProcessor(t)
+	holdOrder(t, p, "big")
+	if got := service.statuses("big"); len(got) != 0 {
+		t.Fatalf("held order reported %v before review", got)
+	}
+
+	rec := postOrderAction(p.HandleApproveHold, "big")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"completed"`) {
+		t.Fatalf("approve returned %d %s, want 200 completed", rec.Code, rec.Body)
+	}
+	if got := service.statuses("big"); strings.Join(got, ",") != "processing,completed" {
+		t.Errorf("approved order reported %v, want processing then completed", got)
+	}
+	if rec := postOrderAction(p.HandleApproveHold, "big"); rec.Code != http.StatusNotFound {
+		t.Errorf("second approve returned %d, want 404", rec.Code)
+	}
+}
+
+func TestRejectedHoldIsReportedRejected(t *testing.T) {
+	p, service := newHoldingProcessor(t)
+	holdOrder(t, p, "big")
+
+	if rec := postOrderAction(p.HandleRejectHold, "big"); rec.Code != http.StatusOK {
+		t.Fatalf("reject returned %d %s", rec.Code, rec.Body)
+	}
+	if got := service.statuses("big"); strings.Join(got, ",") != "rejected" {
+		t.Errorf("rejected order reported %v, want only rejected", got)
+	}
+	if rec := postOrderAction(p.HandleRejectHold, "big"); rec.Code != http.StatusNotFound {
+		t.Errorf("second reject returned %d, want 404", rec.Code)
+	}
+	if rec := postOrderAction(p.HandleApproveHold, "big"); rec.Code != http.StatusNotFound {
+		t.Errorf("approving a rejected hold returned %d, want 404", rec.Code)
+	}
+}
+
+func TestUnreviewedHoldsExpire(t *testing.T) {
+	p, service := newHoldingProcessor(t)
+	holdOrder(t, p, "old")
+
+	// Holds placed after the cutoff stay
+	p.expireHoldsBefore(time.Now().Add(-time.Minute))
+	if got := service.statuses("old"); len(got) != 0 {
+		t.Fatalf("fresh hold reported %v", got)
+	}
+
+	p.expireHoldsBefore(time.Now().Add(time.Minute))
+	if got := service.statuses("old"); strings.Join(got, ",") != "expired" {
+		t.Errorf("expired hold reported %v, want only expired", got)
+	}
+	if rec := postOrderAction(p.HandleApproveHold, "old"); rec.Code != http.StatusNotFound {
+		t.Errorf("approving an expired hold returned %d, want 404", rec.Code)
+	}
+	if got := loadCounter(&p.holdsExpired); got != 1 {
+		t.Errorf("holds expired %d, want 1", got)
+	}
+}
+
+func TestHoldStoreBackends(t *testing.T) {
+	backends := map[string]func(t *testing.T) HoldStore{
+		"memory":   func(t *testing.T) HoldStore { return newMemoryHoldStore() },
+		"dynamodb": func(t *testing.T) HoldStore { return &dynamoHoldStore{client: newFakeDynamoClient(t), table: "holds"} },
+		"redis":    func(t *testing.T) HoldStore { return &redisHoldStore{client: newMiniredisClient(t)} },
+	}
+	for name, newStore := range backends {
+		t.Run(name, func(t *testing.T) {
+			store := newStore(t)
+			heldAt := time.Now().Add(-time.Hour).UTC().Truncate(time.Second)
+			if added, err := store.Put(heldOrder{Order: testOrder("a"), HeldAt: heldAt}); err != nil || !added {
+				t.Fatalf("first Put = %v, %v; want added", added, err)
+			}
+			if added, err := store.Put(heldOrder{Order: testOrder("a"), HeldAt: time.Now()}); err != nil || added {
+				t.Fatalf("second Put = %v, %v; want the existing hold kept", added, err)
+			}
+			holds, err := store.List()
+			if err != nil || len(holds) != 1 || holds[0].Order.OrderID != "a" || !holds[0].HeldAt.Equal(heldAt) {
+				t.Fatalf("List = %+v, %v; want the first hold on a", holds, err)
+			}
+
+			// Of several replicas taking one hold, only one gets it
+			var wg sync.WaitGroup
+			var mu sync.Mutex
+			taken := 0
+			for i := 0; i < 10; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					held, err := store.Take("a")
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					if held != nil {
+						mu.Lock()
+						taken++
+						mu.Unlock()
+					}
+				}()
+			}
+			wg.Wait()
+			if taken != 1 {
+				t.Errorf("hold taken %d times, want once", taken)
+			}
+			if holds, err := store.List(); err != nil || len(holds) != 0 {
+				t.Errorf("List after Take = %+v, %v; want empty", holds, err)
+			}
+		})
+	}
+}
+
+func TestCombinedRouterKeepsMonitoringRoutesApart(t *testing.T) {
+	p := newTestProcessor(t, 1, nil)
+	router := mux.NewRouter()
+	registerMonitoringRoutes(router, "service", labelled("service health"), labelled("service metrics"))
+	// Registering the processor second must not panic or collide
+	registerMonitoringRoutes(router, "processor", p.HandleHealth, p.HandleMetrics)
+
+	for path, want := range map[string]string{
+		"/service/health":  "service health",
+		"/service/metrics": "service metrics",
+		"/health":          "service health",
+		"/metrics":         "service metrics",
+	} {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != http.StatusOK || rec.Body.String() != want {
+			t.Errorf("GET %s = %d %q, want %q", path, rec.Code, rec.Body, want)
+		}
+	}
+	for _, path := range []string{"/processor/health", "/processor/metrics"} {
+		body := getJSON(t, router.ServeHTTP, path)
+		if len(body) == 0 {
+			t.Errorf("GET %s returned an empty document", path)
+		}
+	}
+}
+
+// labelled answers with a fixed body so tests can tell handlers apart
+func labelled(label string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) { w.Write([]byte(label)) }
+}
+
+func TestPaymentDelayScalesWithTotalWithinCap(t *testing.T) {
+	t.Setenv("PAYMENT_LATENCY", "")
+	t.Setenv("PAYMENT_LATENCY_JITTER", "")
+	t.Setenv("PAYMENT_BASE_MS", "1000")
+	t.Setenv("PAYMENT_PER_100_MS", "250")
+	t.Setenv("PAYMENT_MAX_MS", "2000")
+	delays, err := loadPaymentDelayConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		total float64
+		want  time.Duration
+	}{
+		{0, time.Second},
+		{99.99, time.Second},
+		{100, 1250 * time.Millisecond},
+		{350, 1750 * time.Millisecond},
+		{400, 2 * time.Second},
+		{10000, 2 * time.Second},
+	} {
+		if got := delays.delayFor(tc.total); got != tc.want {
+			t.Errorf("delayFor(%v) = %v, want %v", tc.total, got, tc.want)
+		}
+	}
+
+	t.Setenv("PAYMENT_PER_100_MS", "-1")
+	if _, err := loadPaymentDelayConfig(); err == nil {
+		t.Error("negative PAYMENT_PER_100_MS accepted")
+	}
+}
+
+func TestMetricsCountersStaySaneNearMax(t *testing.T) {
+	p := newTestProcessor(t, 1, nil)
+	p.ordersProcessed = math.MaxInt64 - 2
+	p.messagesReceived = math.MaxInt64 - 2
+
+	previous := 0.0
+	for i := 0; i < 5; i++ {
+		metrics := getJSON(t, p.HandleMetrics, "/metrics")
+		if _, err := time.Parse(time.RFC3339, fmt.Sprint(metrics["counters_since"])); err != nil {
+			t.Fatalf("counters_since %v: %v", metrics["counters_since"], err)
+		}
+		counts := metrics["processor"].(map[string]interface{})
+		for _, name := range []string{"orders_processed", "messages_received"} {
+			if value := counts[name].(float64); value < 0 {
+				t.Fatalf("after %d increments %s = %v", i, name, value)
+			}
+		}
+		processed := counts["orders_processed"].(float64)
+		if processed < previous {
+			t.Fatalf("orders_processed went from %v to %v", previous, processed)
+		}
+		previous = processed
+		// The third increment wraps the raw int64
+		atomic.AddInt64(&p.ordersProcessed, 1)
+		atomic.AddInt64(&p.messagesReceived, 1)
+	}
+	if p.ordersProcessed >= 0 {
+		t.Fatal("counter never wrapped; the test did not exercise saturation")
+	}
+	if got := loadCounter(&p.ordersProcessed); got != math.MaxInt64 {
+		t.Errorf("wrapped counter reads %d, want math.MaxInt64", got)
+	}
+}
+
+func TestIdempotencyStoreConformance(t *testing.T) {
+	const ttl = 50 * time.Millisecond
+	backends := map[string]func(t *testing.T) (store IdempotencyStore, expire func()){
+		"memory": func(t *testing.T) (IdempotencyStore, func()) {
+			return newMemoryIdempotencyStore(ttl), func() { time.Sleep(2 * ttl) }
+		},
+		"dynamodb": func(t *testing.T) (IdempotencyStore, func()) {
+			// expires_at has whole-second resolution, too coarse to wait out here
+			return &dynamoIdempotencyStore{client: newFakeDynamoClient(t), table: "processed", ttl: time.Hour}, nil
+		},
+		"redis": func(t *testing.T) (IdempotencyStore, func()) {
+			server := miniredis.RunT(t)
+			client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+			t.Cleanup(func() { client.Close() })
+			return &redisIdempotencyStore{client: client, ttl: ttl}, func() { server.FastForward(2 * ttl) }
+		},
+	}
+	for name, newStore := range backends {
+		t.Run(name, func(t *testing.T) {
+			store, expire := newStore(t)
+			if processed, err := store.IsProcessed("a"); err != nil || processed {
+				t.Fatalf("IsProcessed before marking = %v, %v", processed, err)
+			}
+
+			// Of many workers racing on one redelivered order, exactly one wins
+			var wg sync.WaitGroup
+			var firsts int64
+			for i := 0; i < 20; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					firstTime, err := store.MarkProcessed("a")
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					if firstTime {
+						atomic.AddInt64(&firsts, 1)
+					}
+				}()
+			}
+			wg.Wait()
+			if firsts != 1 {
+				t.Fatalf("%d workers saw the first MarkProcessed, want exactly 1", firsts)
+			}
+			if processed, err := store.IsProcessed("a"); err != nil || !processed {
+				t.Errorf("IsProcessed after marking = %v, %v", processed, err)
+			}
+			if firstTime, err := store.MarkProcessed("b"); err != nil || !firstTime {
+				t.Errorf("MarkProcessed of another order = %v, %v; want first time", firstTime, err)
+			}
+
+			if expire == nil {
+				return
+			}
+			expire()
+			if processed, err := store.IsProcessed("a"); err != nil || processed {
+				t.Errorf("IsProcessed after the TTL = %v, %v; want false", processed, err)
+			}
+			if firstTime, err := store.MarkProcessed("a"); err != nil || !firstTime {
+				t.Errorf("MarkProcessed after the TTL = %v, %v; want first time again", firstTime, err)
+			}
+		})
+	}
+}
+
+func TestIdempotencyBackendSelection(t *testing.T) {
+	for backend, want := range map[string]string{
+		"":         "<nil>",
+		"memory":   "*main.memoryIdempotencyStore",
+		"dynamodb": "*main.dynamoIdempotencyStore",
+		"redis":    "*main.redisIdempotencyStore",
+	} {
+		t.Setenv("IDEMPOTENCY_BACKEND", backend)
+		t.Setenv("IDEMPOTENCY_TABLE", "processed")
+		t.Setenv("REDIS_ADDR", "localhost:6379")
+		store, err := newIdempotencyStore(aws.Config{Region: "us-east-1"})
+		if err != nil {
+			t.Errorf("IDEMPOTENCY_BACKEND=%q: %v", backend, err)
+			continue
+		}
+		if got := fmt.Sprintf("%T", store); got != want {
+			t.Errorf("IDEMPOTENCY_BACKEND=%q built %s, want %s", backend, got, want)
+		}
+	}
+	t.Setenv("IDEMPOTENCY_BACKEND", "etcd")
+	if _, err := newIdempotencyStore(aws.Config{}); err == nil {
+		t.Error("unknown IDEMPOTENCY_BACKEND accepted")
+	}
+}
+
+func TestWorkerPoolHealsAfterAWorkerDies(t *testing.T) {
+	sqsFake, queueURL := useFakeSQS(t)
+	p := newTestProcessor(t, 3, map[string]string{"SQS_QUEUE_URL": queueURL, "WORKER_RECONCILE_INTERVAL": "50ms"})
+	var panics int64
+	p.stableHandler = func(ctx context.Context, order Order) error {
+		if order.OrderID == "boom" {
+			atomic.AddInt64(&panics, 1)
+			panic("payment gateway crashed")
+		}
+		return nil
+	}
+	p.canaryHandler = p.stableHandler
+	body, _ := json.Marshal(testOrder("boom"))
+	sqsFake.push(queueURL, string(body))
+
+	p.Start()
+	if !eventually(t, 5*time.Second, func() bool { return atomic.LoadInt64(&panics) == 1 }) {
+		t.Fatal("the crashing order was never processed")
+	}
+	// The dead worker was replaced, so a fourth worker ID was handed out
+	if !eventually(t, 5*time.Second, func() bool { return atomic.LoadInt32(&p.nextWorkerID) > 3 && p.liveWorkers() == 3 }) {
+		t.Fatalf("pool did not heal: %d live, %d workers started", p.liveWorkers(), atomic.LoadInt32(&p.nextWorkerID))
+	}
+	workers := getJSON(t, p.HandleHealth, "/health")["workers"].(map[string]interface{})
+	if workers["target"] != 3.0 || workers["current"] != 3.0 {
+		t.Errorf("health workers %v, want target and current 3", workers)
+	}
+}
+
+func TestStopInterruptsLongPolls(t *testing.T) {
+	sqsFake, queueURL := useFakeSQS(t)
+	sqsFake.longPoll = 20 * time.Second
+	p := newTestProcessor(t, 3, map[string]string{"SQS_QUEUE_URL": queueURL, "SQS_WAIT_SECONDS": "20"})
+	p.Start()
+	if !eventually(t, 5*time.Second, func() bool { return sqsFake.calledTimes("ReceiveMessage") >= 3 }) {
+		t.Fatal("workers never started polling")
+	}
+
+	started := time.Now()
+	if !p.Stop(5 * time.Second) {
+		t.Fatal("Stop timed out with workers only waiting in a long poll")
+	}
+	if took := time.Since(started); took > time.Second {
+		t.Errorf("Stop took %v to interrupt the long polls", took)
+	}
+}
+
+func TestStopLetsInFlightPaymentsFinish(t *testing.T) {
+	sqsFake, queueURL := useFakeSQS(t)
+	p := newTestProcessor(t, 1, map[string]string{"SQS_QUEUE_URL": queueURL})
+	charging := make(chan struct{})
+	p.stableHandler = func(ctx context.Context, order Order) error {
+		close(charging)
+		time.Sleep(300 * time.Millisecond)
+		return nil
+	}
+	p.canaryHandler = p.stableHandler
+	body, _ := json.Marshal(testOrder("slow"))
+	receipt := sqsFake.push(queueURL, string(body))
+
+	p.Start()
+	<-charging
+	if !p.Stop(5 * time.Second) {
+		t.Fatal("Stop timed out waiting for a 300ms payment")
+	}
+	if !sqsFake.wasDeleted(receipt) {
+		t.Error("message of the payment finished during shutdown was not deleted")
+	}
+}
+
+func TestStopAbandonsChargesAtTheTimeout(t *testing.T) {
+	sqsFake, queueURL := useFakeSQS(t)
+	p := newTestProcessor(t, 1, map[string]string{"SQS_QUEUE_URL": queueURL})
+	charging := make(chan struct{})
+	p.stableHandler = func(ctx context.Context, order Order) error {
+		close(charging)
+		<-ctx.Done()
+		return fmt.Errorf("%w: %v", errPaymentAbandoned, ctx.Err())
+	}
+	p.canaryHandler = p.stableHandler
+	body, _ := json.Marshal(testOrder("stuck"))
+	receipt := sqsFake.push(queueURL, string(body))
+
+	p.Start()
+	<-charging
+	if p.Stop(100 * time.Millisecond) {
+		t.Fatal("Stop reported every worker exited while a charge was stuck")
+	}
+	// The abandoned charge unblocks its worker, which leaves the message
+	if !eventually(t, 2*time.Second, func() bool { return p.liveWorkers() == 0 }) {
+		t.Fatal("worker still running after its charge was abandoned")
+	}
+	if sqsFake.wasDeleted(receipt) {
+		t.Error("message of an abandoned charge was deleted instead of redelivered")
+	}
+}
+
+// promValues gathers registry and returns each unlabelled metric's value,
+// with histograms reduced to their sample count
+func promValues(t *testing.T, registry *prometheus.Registry) map[string]float64 {
+	t.Helper()
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("Gather: %v", err)
+	}
+	values := make(map[string]float64)
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			if len(metric.GetLabel()) > 0 {
+				continue
+			}
+			switch {
+			case metric.GetCounter() != nil:
+				values[family.GetName()] = metric.GetCounter().GetValue()
+			case metric.GetGauge() != nil:
+				values[family.GetName()] = metric.GetGauge().GetValue()
+			case metric.GetHistogram() != nil:
+				values[family.GetName()] = float64(metric.GetHistogram().GetSampleCount())
+			}
+		}
+	}
+	return values
+}
+
+func TestPrometheusCountersFollowProcessing(t *testing.T) {
+	sqsFake, queueURL := useFakeSQS(t)
+	p := newTestProcessor(t, 2, map[string]string{"SQS_QUEUE_URL": queueURL})
+	p.stableHandler = func(ctx context.Context, order Order) error {
+		if order.OrderID == "declined" {
+			return errors.New("card declined")
+		}
+		return nil
+	}
+	p.canaryHandler = p.stableHandler
+
+	before := promValues(t, p.promRegistry)
+	for _, name := range []string{"messages_received_total", "orders_processed_total", "orders_failed_total", "payment_processing_duration_seconds"} {
+		if before[name] != 0 {
+			t.Errorf("%s = %v before any message, want 0", name, before[name])
+		}
+	}
+
+	for _, id := range []string{"paid-1", "paid-2", "declined"} {
+		body, _ := json.Marshal(testOrder(id))
+		sqsFake.push(queueURL, string(body))
+	}
+	p.Start()
+	var after map[string]float64
+	if !eventually(t, 5*time.Second, func() bool {
+		after = promValues(t, p.promRegistry)
+		return after["orders_processed_total"] == 2 && after["orders_failed_total"] >= 1
+	}) {
+		t.Fatalf("counters never caught up: %v", after)
+	}
+	if after["messages_received_total"] != 3 {
+		t.Errorf("messages_received_total = %v, want 3", after["messages_received_total"])
+	}
+	if after["payment_processing_duration_seconds"] < 3 {
+		t.Errorf("payment histogram has %v samples, want one per charge", after["payment_processing_duration_seconds"])
+	}
+
+	rec := httptest.NewRecorder()
+	promhttp.HandlerFor(p.promRegistry, promhttp.HandlerOpts{}).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics/prometheus", nil))
+	if !strings.Contains(rec.Body.String(), "orders_processed_total 2") {
+		t.Errorf("scrape is missing orders_processed_total 2:\n%s", rec.Body)
+	}
+}
+
+func TestVisibilityHeartbeatCoversSlowPayments(t *testing.T) {
+	for _, tc := range []struct {
+		name                 string
+		charge, maxExtension time.Duration
+		least, most          int
+	}{
+		{"fast payment", 0, time.Minute, 0, 0},
+		{"slow payment", 350 * time.Millisecond, time.Minute, 4, 7},
+		{"past the maximum extension", 350 * time.Millisecond, 120 * time.Millisecond, 1, 2},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			sqsFake, queueURL := useFakeSQS(t)
+			p := newTestProcessor(t, 1, map[string]string{
+				"SQS_QUEUE_URL":                 queueURL,
+				"SQS_VISIBILITY_TIMEOUT":        "2",
+				"VISIBILITY_HEARTBEAT_INTERVAL": "50ms",
+				"VISIBILITY_MAX_EXTENSION":      tc.maxExtension.String(),
+			})
+			p.stableHandler = func(ctx context.Context, order Order) error {
+				time.Sleep(tc.charge)
+				return nil
+			}
+			p.canaryHandler = p.stableHandler
+			body, _ := json.Marshal(testOrder("charge"))
+			receipt := sqsFake.push(queueURL, string(body))
+
+			p.Start()
+			if !eventually(t, 5*time.Second, func() bool { return sqsFake.wasDeleted(receipt) }) {
+				t.Fatal("message was never deleted")
+			}
+			changes := sqsFake.visibilityChanges(receipt)
+			if len(changes) < tc.least || len(changes) > tc.most {
+				t.Errorf("visibility extended %d times, want %d to %d", len(changes), tc.least, tc.most)
+			}
+			for _, timeout := range changes {
+				if timeout != 2 {
+					t.Errorf("visibility extended to %ds, want the full 2s timeout", timeout)
+				}
+			}
+			if got := loadCounter(&p.visibilityExtensions); got != int64(len(changes)) {
+				t.Errorf("visibility_extensions = %d, want %d", got, len(changes))
+			}
+		})
+	}
+}
+
+func TestParseOrderMessageShapes(t *testing.T) {
+	bare := `{"order_id":"o1","customer_id":7,"items":[{"product_id":"a","quantity":1,"price":5}]}`
+	envelope, _ := json.Marshal(map[string]string{"Type": "Notification", "MessageId": "sns-1", "Message": bare})
+	for _, tc := range []struct {
+		name string
+		body *string
+		want error
+	}{
+		{"SNS envelope", aws.String(string(envelope)), nil},
+		{"bare order", aws.String(bare), nil},
+		{"no body", nil, errMalformedBody},
+		{"garbage", aws.String("not json at all"), errMalformedBody},
+		{"envelope without a message", aws.String(`{"Type":"Notification","MessageId":"sns-2"}`), errMalformedEnvelope},
+		{"envelope around garbage", aws.String(`{"Type":"Notification","Message":"{oops"}`), errMalformedOrder},
+		{"order without an ID", aws.String(`{"customer_id":7}`), errMalformedOrder},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			order, err := parseOrderMessage(types.Message{Body: tc.body}, false)
+			if !errors.Is(err, tc.want) {
+				t.Fatalf("parseOrderMessage error = %v, want %v", err, tc.want)
+			}
+			if tc.want == nil && (order.OrderID != "o1" || order.CustomerID != 7 || len(order.Items) != 1) {
+				t.Errorf("parsed %+v, want order o1 of customer 7", order)
+			}
+		})
+	}
+}
+
+func TestUnparseableMessagesCountAsParseErrors(t *testing.T) {
+	sqsFake, queueURL := useFakeSQS(t)
+	p := newTestProcessor(t, 1, map[string]string{"SQS_QUEUE_URL": queueURL})
+	charged := make(chan string, 2)
+	p.stableHandler = func(ctx context.Context, order Order) error {
+		charged <- order.OrderID
+		return nil
+	}
+	p.canaryHandler = p.stableHandler
+	envelope, _ := json.Marshal(map[string]string{"Type": "Notification", "Message": `{"order_id":"wrapped","customer_id":1}`})
+	sqsFake.push(queueURL, string(envelope))
+	sqsFake.push(queueURL, `{"order_id":"bare","customer_id":1}`)
+	sqsFake.push(queueURL, "garbage")
+
+	p.Start()
+	if !eventually(t, 5*time.Second, func() bool { return loadCounter(&p.parseErrors) == 1 && len(charged) == 2 }) {
+		t.Fatalf("parse_errors = %d with %d orders charged, want 1 and both well-formed orders", loadCounter(&p.parseErrors), len(charged))
+	}
+	if got := []string{<-charged, <-charged}; !slices.Contains(got, "wrapped") || !slices.Contains(got, "bare") {
+		t.Errorf("charged %v, want the wrapped and the bare order", got)
+	}
+}
+
+// recordingGateway is a deterministic PaymentGateway that refuses the
+// orders in decline and records every charge it sees
+type recordingGateway struct {
+	mu      sync.Mutex
+	decline map[string]bool
+	charged []string
+}
+
+func (g *recordingGateway) Charge(ctx context.Context, orderID string, amount float64) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.charged = append(g.charged, orderID)
+	if g.decline[orderID] {
+		return &PaymentError{OrderID: orderID, Amount: amount, Reason: ReasonDeclined}
+	}
+	return nil
+}
+
+func TestSimulatedGatewayReplaysItsSeed(t *testing.T) {
+	reasons, err := parseFailureReasons(defaultPaymentFailureReasons)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outcomes := func(seed int64) []string {
+		gateway := newSimulatedGateway(0.5, reasons, seed)
+		var got []string
+		for i := 0; i < 50; i++ {
+			got = append(got, paymentFailureReason(gateway.Charge(context.Background(), fmt.Sprintf("o%d", i), 10)))
+		}
+		return got
+	}
+	first := outcomes(42)
+	if !slices.Equal(first, outcomes(42)) {
+		t.Error("the same seed gave different outcomes")
+	}
+	if !slices.Contains(first, "") || !slices.ContainsFunc(first, func(reason string) bool { return reason != "" }) {
+		t.Errorf("half-failing gateway gave %v, want both outcomes", first)
+	}
+}
+
+func TestPaymentFailureRateDecidesOutcomes(t *testing.T) {
+	for _, tc := range []struct {
+		rate    string
+		refused bool
+	}{
+		{"0", false},
+		{"1", true},
+	} {
+		p := newTestProcessor(t, 1, map[string]string{"PAYMENT_FAILURE_RATE": tc.rate, "PAYMENT_FAILURE_REASONS": "gateway_timeout=1"})
+		for i := 0; i < 20; i++ {
+			err := p.processPayment(context.Background(), testOrder(fmt.Sprintf("o%d", i)))
+			if refused := paymentFailureReason(err) == ReasonGatewayTimeout; refused != tc.refused || (!refused && err != nil) {
+				t.Fatalf("rate %s: charge %d = %v", tc.rate, i, err)
+			}
+		}
+	}
+}
+
+func TestInjectedGatewayDecidesQueuedOrders(t *testing.T) {
+	sqsFake, queueURL := useFakeSQS(t)
+	p := newTestProcessor(t, 1, map[string]string{"SQS_QUEUE_URL": queueURL})
+	gateway := &recordingGateway{decline: map[string]bool{"declined": true}}
+	p.payments = gateway
+	receipts := map[string]string{}
+	for _, id := range []string{"paid", "declined"} {
+		body, _ := json.Marshal(testOrder(id))
+		receipts[id] = sqsFake.push(queueURL, string(body))
+	}
+
+	p.Start()
+	if !eventually(t, 5*time.Second, func() bool { return loadCounter(&p.ordersProcessed) == 1 && loadCounter(&p.ordersFailed) == 1 }) {
+		t.Fatalf("processed %d and failed %d, want one each", loadCounter(&p.ordersProcessed), loadCounter(&p.ordersFailed))
+	}
+	if !eventually(t, time.Second, func() bool { return sqsFake.wasDeleted(receipts["paid"]) }) {
+		t.Error("paid order's message was not deleted")
+	}
+	gateway.mu.Lock()
+	defer gateway.mu.Unlock()
+	if !slices.Contains(gateway.charged, "paid") || !slices.Contains(gateway.charged, "declined") {
+		t.Errorf("gateway charged %v, want both orders", gateway.charged)
+	}
+}
+
+func TestPollSettingsAreValidatedAtStartup(t *testing.T) {
+	for _, tc := range []struct {
+		name, value string
+		valid       bool
+	}{
+		{"SQS_MAX_MESSAGES", "0", false},
+		{"SQS_MAX_MESSAGES", "1", true},
+		{"SQS_MAX_MESSAGES", "10", true},
+		{"SQS_MAX_MESSAGES", "11", false},
+		{"SQS_MAX_MESSAGES", "five", false},
+		{"SQS_WAIT_SECONDS", "-1", false},
+		{"SQS_WAIT_SECONDS", "0", true},
+		{"SQS_WAIT_SECONDS", "20", true},
+		{"SQS_WAIT_SECONDS", "21", false},
+		{"SQS_VISIBILITY_TIMEOUT", "0", false},
+		{"SQS_VISIBILITY_TIMEOUT", "1", true},
+		{"SQS_VISIBILITY_TIMEOUT", "43200", true},
+		{"SQS_VISIBILITY_TIMEOUT", "43201", false},
+	} {
+		t.Run(tc.name+"="+tc.value, func(t *testing.T) {
+			env := map[string]string{tc.name: tc.value}
+			if tc.name == "SQS_VISIBILITY_TIMEOUT" {
+				// The default heartbeat interval follows the timeout
+				env["VISIBILITY_HEARTBEAT_INTERVAL"] = ""
+			}
+			setTestEnv(t, env)
+			p, err := NewOrderProcessor(1)
+			if !tc.valid {
+				if err == nil || !strings.Contains(err.Error(), tc.name) {
+					t.Errorf("NewOrderProcessor error = %v, want one naming %s", err, tc.name)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NewOrderProcessor: %v", err)
+			}
+			want, _ := strconv.Atoi(tc.value)
+			got := map[string]int{
+				"SQS_MAX_MESSAGES":       int(p.maxMessages),
+				"SQS_WAIT_SECONDS":       int(p.pollWaitSeconds),
+				"SQS_VISIBILITY_TIMEOUT": int(p.visibilityTimeout / time.Second),
+			}[tc.name]
+			if got != want {
+				t.Errorf("%s stored as %d, want %d", tc.name, got, want)
+			}
+		})
+	}
+
+	setTestEnv(t, nil)
+	p, err := NewOrderProcessor(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.maxMessages != 10 || p.pollWaitSeconds != 20 || p.visibilityTimeout != 30*time.Second {
+		t.Errorf("defaults: %d messages, %ds wait, %v visibility; want 10, 20 and 30s", p.maxMessages, p.pollWaitSeconds, p.visibilityTimeout)
+	}
+}
+
+func TestFinishedMessagesAreDeletedInOneBatch(t *testing.T) {
+	sqsFake, queueURL := useFakeSQS(t)
+	p := newTestProcessor(t, 1, map[string]string{"SQS_QUEUE_URL": queueURL})
+	var receipts []string
+	for i := 0; i < 10; i++ {
+		body, _ := json.Marshal(testOrder(fmt.Sprintf("o%d", i)))
+		receipts = append(receipts, sqsFake.push(queueURL, string(body)))
+	}
+
+	p.Start()
+	if !eventually(t, 5*time.Second, func() bool { return sqsFake.wasDeleted(receipts[9]) }) {
+		t.Fatal("messages were never deleted")
+	}
+	for _, receipt := range receipts {
+		if !sqsFake.wasDeleted(receipt) {
+			t.Errorf("message %s not deleted", receipt)
+		}
+	}
+	if batches, singles := sqsFake.calledTimes("DeleteMessageBatch"), sqsFake.calledTimes("DeleteMessage"); batches != 1 || singles != 0 {
+		t.Errorf("%d batch and %d single deletes, want one batch for the poll of 10", batches, singles)
+	}
+	if got := loadCounter(&p.ordersProcessed); got != 10 {
+		t.Errorf("orders_processed = %d, want 10", got)
+	}
+}
+
+func TestFailedBatchEntriesAreLeftForRedelivery(t *testing.T) {
+	sqsFake, queueURL := useFakeSQS(t)
+	p := newTestProcessor(t, 1, map[string]string{"SQS_QUEUE_URL": queueURL})
+	var receipts []string
+	for i := 0; i < 3; i++ {
+		body, _ := json.Marshal(testOrder(fmt.Sprintf("o%d", i)))
+		receipts = append(receipts, sqsFake.push(queueURL, string(body)))
+	}
+	sqsFake.failDeletes = map[string]bool{receipts[1]: true}
+
+	p.Start()
+	if !eventually(t, 5*time.Second, func() bool { return sqsFake.calledTimes("DeleteMessageBatch") == 1 }) {
+		t.Fatal("no batch delete was sent")
+	}
+	if !sqsFake.wasDeleted(receipts[0]) || sqsFake.wasDeleted(receipts[1]) || !sqsFake.wasDeleted(receipts[2]) {
+		t.Error("want every entry but the failed one deleted")
+	}
+	// The charge happened either way; only the delete is retried later
+	if got := loadCounter(&p.ordersProcessed); got != 3 {
+		t.Errorf("orders_processed = %d, want 3", got)
+	}
+}
+
+// setChaos posts body to HandleChaos and returns the recorded response
+func setChaos(handler http.HandlerFunc, body string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(http.MethodPost, "/admin/chaos", strings.NewReader(body))
+	request.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	handler(rec, request)
+	return rec
+}
+
+func TestChaosFailsEveryPaymentAtRateOne(t *testing.T) {
+	p := newTestProcessor(t, 1, map[string]string{"CHAOS_ENABLED": "true"})
+	if rec := setChaos(p.HandleChaos, `{"failure_rate":1}`); rec.Code != http.StatusOK {
+		t.Fatalf("set chaos: %d %s", rec.Code, rec.Body)
+	}
+	for i := 0; i < 20; i++ {
+		if err := p.processPayment(context.Background(), testOrder(fmt.Sprintf("o%d", i))); !errors.Is(err, errChaosInjected) {
+			t.Fatalf("charge %d = %v, want errChaosInjected", i, err)
+		}
+	}
+	chaos, _ := getJSON(t, p.HandleMetrics, "/metrics")["chaos"].(map[string]interface{})
+	if chaos["failure_rate"] != 1.0 || chaos["failures_injected"] != 20.0 {
+		t.Errorf("/metrics chaos = %v, want rate 1 with 20 failures injected", chaos)
+	}
+
+	// A latency override replaces the normal payment delay
+	setChaos(p.HandleChaos, `{"failure_rate":0,"latency_ms":150}`)
+	started := time.Now()
+	if err := p.processPayment(context.Background(), testOrder("slow")); err != nil {
+		t.Errorf("charge with chaos off = %v", err)
+	}
+	if took := time.Since(started); took < 150*time.Millisecond {
+		t.Errorf("charge took %v, want the 150ms override", took)
+	}
+
+	for _, body := range []string{`{}`, `{"failure_rate":1.5}`, `{"failure_rate":0.5,"latency_ms":-1}`} {
+		if rec := setChaos(p.HandleChaos, body); rec.Code != http.StatusBadRequest {
+			t.Errorf("chaos %s = %d, want 400", body, rec.Code)
+		}
+	}
+}
+
+func TestChaosIsOffUnlessEnabled(t *testing.T) {
+	p := newTestProcessor(t, 1, map[string]string{"CHAOS_ENABLED": ""})
+	if p.chaos != nil {
+		t.Fatal("chaos injector built without CHAOS_ENABLED")
+	}
+	if chaos, _ := getJSON(t, p.HandleMetrics, "/metrics")["chaos"].(map[string]interface{}); chaos["enabled"] != false {
+		t.Errorf("/metrics chaos = %v, want disabled", chaos)
+	}
+}
+
+func TestLatencyPercentilesFromKnownDurations(t *testing.T) {
+	h := newLatencyHistogram(defaultLatencyBuckets)
+	// 90 fast, 8 medium and 2 slow charges, spread across workers
+	for i := 0; i < 100; i++ {
+		latency := 40 * time.Millisecond
+		switch {
+		case i >= 98:
+			latency = 900 * time.Millisecond
+		case i >= 90:
+			latency = 200 * time.Millisecond
+		}
+		h.record(i, latency)
+	}
+
+	got := h.snapshot()
+	want := map[string]float64{"p50": 50, "p95": 250, "p99": 900, "max": 900}
+	for name, value := range want {
+		if got[name] != value {
+			t.Errorf("%s = %v, want %v", name, got[name], value)
+		}
+	}
+	if got["count"] != int64(100) {
+		t.Errorf("count = %v, want 100", got["count"])
+	}
+	if mean := got["mean"].(float64); math.Abs(mean-70) > 1e-9 {
+		t.Errorf("mean = %v, want 70", mean)
+	}
+
+	if reset := h.reset(); reset["count"] != int64(100) {
+		t.Errorf("reset returned count %v, want 100", reset["count"])
+	}
+	if after := h.snapshot(); after["count"] != int64(0) || after["p99"] != 0.0 {
+		t.Errorf("after reset = %v, want empty", after)
+	}
+}
+
+func TestLatencyHistogramMergesConcurrentWorkers(t *testing.T) {
+	h := newLatencyHistogram([]float64{10, 100})
+	var wg sync.WaitGroup
+	for worker := 0; worker < 32; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				h.record(worker, time.Duration(worker)*time.Millisecond)
+				h.snapshot()
+			}
+		}(worker)
+	}
+	wg.Wait()
+	if got := h.snapshot(); got["count"] != int64(32*500) || got["max"] != 31.0 {
+		t.Errorf("snapshot = %v, want %d samples with max 31", got, 32*500)
+	}
+}
+
+func TestLatencyBucketsAreConfigurable(t *testing.T) {
+	p := newTestProcessor(t, 1, map[string]string{"LATENCY_BUCKETS_MS": "5, 20,80"})
+	p.latency.record(0, 30*time.Millisecond)
+	processor, _ := getJSON(t, p.HandleMetrics, "/metrics")["processor"].(map[string]interface{})
+	latency, _ := processor["latency_ms"].(map[string]interface{})
+	if !reflect.DeepEqual(latency["buckets_ms"], []interface{}{5.0, 20.0, 80.0}) || latency["p50"] != 30.0 {
+		t.Errorf("processor.latency_ms = %v, want buckets 5,20,80 and p50 30", latency)
+	}
+
+	for _, buckets := range []string{"20,5", "0,10", "ten"} {
+		t.Setenv("LATENCY_BUCKETS_MS", buckets)
+		if _, err := loadLatencyHistogram(); err == nil {
+			t.Errorf("LATENCY_BUCKETS_MS=%q accepted", buckets)
+		}
+	}
+}
+
+func TestScaleWorkersBodyLimitAndUnknownFields(t *testing.T) {
+	p := newTestProcessor(t, 1, map[string]string{"MAX_BODY_BYTES": "32"})
+	scale := func(body string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodPost, "/admin/workers", strings.NewReader(body))
+		request.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		p.HandleScaleWorkers(rec, request)
+		return rec
+	}
+	if rec := scale(`{"workers":2` + strings.Repeat(" ", 64) + `}`); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized body = %d, want 413", rec.Code)
+	}
+	if rec := scale(`{"worker":2}`); rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), `"worker"`) {
+		t.Errorf("unknown field = %d %q, want 400 naming worker", rec.Code, rec.Body)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.workerCount != 1 {
+		t.Errorf("worker target %d after rejected requests, want 1", p.workerCount)
+	}
+}
+
+// dedupReplicas returns n dedup locks on one fake table, one per replica
+func dedupReplicas(t *testing.T, n int, ttl time.Duration) []*dedupLock {
+	t.Helper()
+	client := newFakeDynamoClient(t)
+	locks := make([]*dedupLock, n)
+	for i := range locks {
+		locks[i] = &dedupLock{client: client, table: "dedup", ttl: ttl, owner: fmt.Sprintf("replica-%d", i)}
+	}
+	return locks
+}
+
+func TestDedupLockContendedPutHasOneWinner(t *testing.T) {
+	locks := dedupReplicas(t, 8, time.Minute)
+	results := make([]error, len(locks))
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i, lock := range locks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			results[i] = lock.acquire("o1")
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	winner := -1
+	for i, err := range results {
+		switch {
+		case err == nil && winner >= 0:
+			t.Fatalf("replicas %d and %d both took the lock", winner, i)
+		case err == nil:
+			winner = i
+		case !errors.Is(err, errOrderLocked):
+			t.Errorf("replica %d: %v, want errOrderLocked", i, err)
+		}
+	}
+	if winner < 0 {
+		t.Fatal("no replica took the lock")
+	}
+
+	other := locks[(winner+1)%len(locks)]
+	if err := other.release("o1", true); err == nil {
+		t.Error("a replica released a lock it doesn't hold")
+	}
+	if err := locks[winner].release("o1", true); err != nil {
+		t.Fatalf("release: %v", err)
+	}
+	if err := other.acquire("o1"); !errors.Is(err, errDuplicateOrder) {
+		t.Errorf("acquire after charge = %v, want errDuplicateOrder", err)
+	}
+}
+
+func TestDedupLockFreedByFailedChargeOrExpiry(t *testing.T) {
+	locks := dedupReplicas(t, 2, time.Minute)
+	if err := locks[0].acquire("failed"); err != nil {
+		t.Fatal(err)
+	}
+	if err := locks[0].release("failed", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := locks[1].acquire("failed"); err != nil {
+		t.Errorf("retry after a failed charge = %v, want the lock", err)
+	}
+
+	// A replica that died leaves a lock that has already expired
+	expired := dedupReplicas(t, 2, -time.Minute)
+	if err := expired[0].acquire("orphaned"); err != nil {
+		t.Fatal(err)
+	}
+	if err := expired[1].acquire("orphaned"); err != nil {
+		t.Errorf("acquire over an expired lock = %v, want the lock", err)
+	}
+	if got := expired[1].status(); got["acquired"] != int64(1) || got["contended"] != int64(0) {
+		t.Errorf("status = %v", got)
+	}
+}
+
+func TestRedeliveredOrderIsChargedOnceAcrossReplicas(t *testing.T) {
+	sqsFake, queueURL := useFakeSQS(t)
+	gateway := &recordingGateway{}
+	locks := dedupReplicas(t, 2, time.Minute)
+	body, _ := json.Marshal(testOrder("o1"))
+	var wg sync.WaitGroup
+	for _, lock := range locks {
+		p := newTestProcessor(t, 1, map[string]string{"SQS_QUEUE_URL": queueURL})
+		p.payments = gateway
+		p.dedup = lock
+		receipt := sqsFake.push(queueURL, string(body))
+		msg := types.Message{MessageId: aws.String(receipt), ReceiptHandle: aws.String(receipt), Body: aws.String(string(body))}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.processMessage(context.Background(), msg, testOrder("o1"))
+		}()
+	}
+	wg.Wait()
+
+	gateway.mu.Lock()
+	defer gateway.mu.Unlock()
+	if len(gateway.charged) != 1 {
+		t.Errorf("charged %v, want o1 once", gateway.charged)
+	}
+}
+
+// postAdmin serves an empty POST to handler
+func postAdmin(handler http.HandlerFunc, path string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodPost, path, nil))
+	return rec
+}
+
+func TestDrainStopsPollingUntilResumed(t *testing.T) {
+	sqsFake, queueURL := useFakeSQS(t)
+	p := newTestProcessor(t, 2, map[string]string{"SQS_QUEUE_URL": queueURL, "SQS_WAIT_SECONDS": "0"})
+	p.Start()
+	if !eventually(t, 5*time.Second, func() bool { return sqsFake.calledTimes("ReceiveMessage") >= 2 }) {
+		t.Fatal("workers never started polling")
+	}
+
+	if rec := postAdmin(p.HandleDrain, "/drain"); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"drained":true`) {
+		t.Fatalf("drain = %d %s", rec.Code, rec.Body)
+	}
+	// Let polls already under way come back before counting
+	time.Sleep(200 * time.Millisecond)
+	before := sqsFake.calledTimes("ReceiveMessage")
+	body, _ := json.Marshal(testOrder("queued"))
+	receipt := sqsFake.push(queueURL, string(body))
+	time.Sleep(1500 * time.Millisecond)
+	if after := sqsFake.calledTimes("ReceiveMessage"); after != before {
+		t.Errorf("%d receives while drained", after-before)
+	}
+	drain, _ := getJSON(t, p.HandleHealth, "/health")["drain"].(map[string]interface{})
+	if drain["drained"] != true || drain["drained_since"] == nil {
+		t.Errorf("/health drain = %v, want drained with a start time", drain)
+	}
+
+	postAdmin(p.HandleResume, "/resume")
+	if !eventually(t, 5*time.Second, func() bool { return sqsFake.wasDeleted(receipt) }) {
+		t.Error("order queued while drained was not processed after resuming")
+	}
+	if drain, _ := getJSON(t, p.HandleHealth, "/health")["drain"].(map[string]interface{}); drain["drained"] != false {
+		t.Errorf("/health drain after resume = %v", drain)
+	}
+}
+
+func TestDrainLetsInFlightMessagesFinish(t *testing.T) {
+	sqsFake, queueURL := useFakeSQS(t)
+	p := newTestProcessor(t, 1, map[string]string{"SQS_QUEUE_URL": queueURL})
+	charging := make(chan struct{})
+	p.stableHandler = func(ctx context.Context, order Order) error {
+		close(charging)
+		time.Sleep(300 * time.Millisecond)
+		return nil
+	}
+	p.canaryHandler = p.stableHandler
+	body, _ := json.Marshal(testOrder("slow"))
+	receipt := sqsFake.push(queueURL, string(body))
+
+	p.Start()
+	<-charging
+	postAdmin(p.HandleDrain, "/drain")
+	if !eventually(t, 2*time.Second, func() bool { return sqsFake.wasDeleted(receipt) }) {
+		t.Error("payment in flight when draining was not finished and deleted")
+	}
+}
+
+// poisonBodies fail both parses: one isn't JSON at all, and the other is
+// an SNS envelope whose Message isn't an order
+var poisonBodies = []string{
+	"garbage",
+	`{"Type":"Notification","MessageId":"n1","Message":"not an order"}`,
+}
+
+func TestPoisonMessagesAreParkedNotRetried(t *testing.T) {
+	sqsFake, queueURL := useFakeSQS(t)
+	parkingURL := queueURL + "-parking"
+	p := newTestProcessor(t, 1, map[string]string{"SQS_QUEUE_URL": queueURL, "PARKING_QUEUE_URL": parkingURL})
+	gateway := &recordingGateway{}
+	p.payments = gateway
+	var receipts []string
+	for _, body := range poisonBodies {
+		receipts = append(receipts, sqsFake.push(queueURL, body))
+	}
+
+	p.Start()
+	if !eventually(t, 5*time.Second, func() bool { return loadCounter(&p.poisonMessages) == 2 }) {
+		t.Fatalf("poison_messages = %d, want 2", loadCounter(&p.poisonMessages))
+	}
+	if parked := sqsFake.sentTo(parkingURL); !slices.Equal(parked, poisonBodies) {
+		t.Errorf("parked %q, want the raw bodies %q", parked, poisonBodies)
+	}
+	for _, receipt := range receipts {
+		if !sqsFake.wasDeleted(receipt) {
+			t.Errorf("parked message %s left on the main queue", receipt)
+		}
+		if changes := sqsFake.visibilityChanges(receipt); len(changes) > 0 {
+			t.Errorf("parked message %s was scheduled for retry: %v", receipt, changes)
+		}
+	}
+	gateway.mu.Lock()
+	defer gateway.mu.Unlock()
+	if loadCounter(&p.retriesScheduled) != 0 || len(gateway.charged) != 0 {
+		t.Errorf("%d retries and charges %v for unparseable messages", loadCounter(&p.retriesScheduled), gateway.charged)
+	}
+	if got := promValues(t, p.promRegistry)["poison_messages_total"]; got != 2 {
+		t.Errorf("poison_messages_total = %v, want 2", got)
+	}
+}
+
+func TestPoisonMessagesAreDroppedWithoutAParkingQueue(t *testing.T) {
+	sqsFake, queueURL := useFakeSQS(t)
+	p := newTestProcessor(t, 1, map[string]string{"SQS_QUEUE_URL": queueURL, "PARKING_QUEUE_URL": "", "DLQ_URL": ""})
+	receipt := sqsFake.push(queueURL, poisonBodies[0])
+
+	p.Start()
+	if !eventually(t, 5*time.Second, func() bool { return sqsFake.wasDeleted(receipt) }) {
+		t.Fatal("unparseable message was not deleted")
+	}
+	if got := loadCounter(&p.poisonMessages); got != 1 {
+		t.Errorf("poison_messages = %d, want 1", got)
+	}
+}
+
+func TestResetMetricsZeroesCountersButNotWorkers(t *testing.T) {
+	sqsFake, queueURL := useFakeSQS(t)
+	p := newTestProcessor(t, 2, map[string]string{"SQS_QUEUE_URL": queueURL})
+	for i := 0; i < 3; i++ {
+		body, _ := json.Marshal(testOrder(fmt.Sprintf("o%d", i)))
+		sqsFake.push(queueURL, string(body))
+	}
+	p.Start()
+	if !eventually(t, 5*time.Second, func() bool { return loadCounter(&p.ordersProcessed) == 3 }) {
+		t.Fatalf("processed %d orders, want 3", loadCounter(&p.ordersProcessed))
+	}
+	workers := p.liveWorkers()
+	if got := promValues(t, p.promRegistry)["orders_processed_total"]; got != 3 {
+		t.Fatalf("orders_processed_total = %v before reset, want 3", got)
+	}
+
+	rec := postAdmin(p.HandleResetMetrics, "/metrics/reset")
+	var snapshot struct {
+		Processor map[string]interface{} `json:"processor"`
+	}
+	json.NewDecoder(rec.Body).Decode(&snapshot)
+	if snapshot.Processor["orders_processed"] != 3.0 || snapshot.Processor["messages_received"] != 3.0 {
+		t.Errorf("reset snapshot = %v, want the 3 orders processed before it", snapshot.Processor)
+	}
+
+	processor, _ := getJSON(t, p.HandleMetrics, "/metrics")["processor"].(map[string]interface{})
+	for _, name := range []string{"messages_received", "orders_processed", "orders_failed"} {
+		if processor[name] != 0.0 {
+			t.Errorf("%s = %v after reset, want 0", name, processor[name])
+		}
+	}
+	if latency, _ := processor["latency_ms"].(map[string]interface{}); latency["count"] != 0.0 {
+		t.Errorf("latency count = %v after reset, want 0", latency["count"])
+	}
+	if got := p.liveWorkers(); got != workers || got != 2 {
+		t.Errorf("%d workers after reset, want %d", got, workers)
+	}
+	if promValues(t, p.promRegistry)["orders_processed_total"] != 0 {
+		t.Error("prometheus orders_processed_total not reset")
+	}
+}
+
+func TestHighPriorityLaneGoesFirstWithoutStarvingNormal(t *testing.T) {
+	sqsFake, queueURL := useFakeSQS(t)
+	highURL := queueURL + "-high"
+	p := newTestProcessor(t, 1, map[string]string{
+		"SQS_QUEUE_URL":           queueURL,
+		"HIGH_PRIORITY_QUEUE_URL": highURL,
+		"HIGH_PRIORITY_WEIGHT":    "2",
+		"SQS_MAX_MESSAGES":        "1",
+	})
+	gateway := &recordingGateway{}
+	p.payments = gateway
+	for i := 1; i <= 3; i++ {
+		body, _ := json.Marshal(testOrder(fmt.Sprintf("n%d", i)))
+		sqsFake.push(queueURL, string(body))
+	}
+	for i := 1; i <= 5; i++ {
+		body, _ := json.Marshal(testOrder(fmt.Sprintf("h%d", i)))
+		sqsFake.push(highURL, string(body))
+	}
+
+	p.Start()
+	if !eventually(t, 5*time.Second, func() bool { return loadCounter(&p.ordersProcessed) == 8 }) {
+		t.Fatalf("processed %d orders, want 8", loadCounter(&p.ordersProcessed))
+	}
+	gateway.mu.Lock()
+	got := strings.Join(gateway.charged, ",")
+	gateway.mu.Unlock()
+	// Two high batches, then the normal lane gets its turn
+	if want := "h1,h2,n1,h3,h4,n2,h5,n3"; got != want {
+		t.Errorf("charged %s, want %s", got, want)
+	}
+
+	lanes, _ := getJSON(t, p.HandleMetrics, "/metrics")["lanes"].(map[string]interface{})
+	high, _ := lanes["high"].(map[string]interface{})
+	normal, _ := lanes["normal"].(map[string]interface{})
+	if high["processed"] != 5.0 || normal["processed"] != 3.0 {
+		t.Errorf("/metrics lanes = %v, want 5 high and 3 normal processed", lanes)
+	}
+}
+
+func TestEachPaymentFailureReasonIsCounted(t *testing.T) {
+	for _, reason := range paymentFailureReasons {
+		t.Run(reason, func(t *testing.T) {
+			p := newTestProcessor(t, 1, map[string]string{"PAYMENT_FAILURE_RATE": "1", "PAYMENT_FAILURE_REASONS": reason + "=1"})
+			for i := 0; i < 3; i++ {
+				if err := p.processPayment(context.Background(), testOrder(fmt.Sprintf("o%d", i))); paymentFailureReason(err) != reason {
+					t.Fatalf("charge = %v, want a %s refusal", err, reason)
+				}
+			}
+
+			byReason, _ := getJSON(t, p.HandleMetrics, "/metrics")["payment_failures_by_reason"].(map[string]interface{})
+			families, err := p.promRegistry.Gather()
+			if err != nil {
+				t.Fatal(err)
+			}
+			counted := map[string]float64{}
+			for _, family := range families {
+				if family.GetName() == "payment_failures_total" {
+					for _, metric := range family.GetMetric() {
+						counted[metric.GetLabel()[0].GetValue()] = metric.GetCounter().GetValue()
+					}
+				}
+			}
+			for _, other := range paymentFailureReasons {
+				want := 0.0
+				if other == reason {
+					want = 3
+				}
+				if byReason[other] != want || counted[other] != want {
+					t.Errorf("%s failures: /metrics %v, prometheus %v; want %v", other, byReason[other], counted[other], want)
+				}
+			}
+		})
+	}
+}
+
+// lockedBuffer is a bytes.Buffer safe to write from workers while the
+// test reads it
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// captureLogs sends the default logger's JSON lines to a buffer for the
+// rest of the test
+func captureLogs(t *testing.T) *lockedBuffer {
+	t.Helper()
+	logs := &lockedBuffer{}
+	saved := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(logs, nil)))
+	t.Cleanup(func() { slog.SetDefault(saved) })
+	return logs
+}
+
+func TestStaleMessagesAreMeasuredAndWarnedAbout(t *testing.T) {
+	logs := captureLogs(t)
+	sqsFake, queueURL := useFakeSQS(t)
+	p := newTestProcessor(t, 1, map[string]string{"SQS_QUEUE_URL": queueURL, "STALE_THRESHOLD": "10m"})
+	sent := func(ago time.Duration) map[string]string {
+		return map[string]string{"SentTimestamp": strconv.FormatInt(time.Now().Add(-ago).UnixMilli(), 10)}
+	}
+	for id, ago := range map[string]time.Duration{"old": time.Hour, "fresh": 0} {
+		body, _ := json.Marshal(testOrder(id))
+		sqsFake.pushMessage(queueURL, fakeSQSMessage{Body: string(body), Attributes: sent(ago)})
+	}
+
+	p.Start()
+	if !eventually(t, 5*time.Second, func() bool { return loadCounter(&p.ordersProcessed) == 2 }) {
+		t.Fatalf("processed %d orders, want 2", loadCounter(&p.ordersProcessed))
+	}
+	age, _ := getJSON(t, p.HandleMetrics, "/metrics")["message_age"].(map[string]interface{})
+	if age["measured"] != 2.0 || age["stale"] != 1.0 || age["stale_threshold"] != "10m0s" {
+		t.Errorf("message_age = %v, want 2 measured and 1 stale", age)
+	}
+	if maxMs, _ := age["max_ms"].(float64); maxMs < float64(time.Hour.Milliseconds()) || maxMs > float64((time.Hour+time.Minute).Milliseconds()) {
+		t.Errorf("max_ms = %v, want about an hour", maxMs)
+	}
+	if got := promValues(t, p.promRegistry)["stale_messages_total"]; got != 1 {
+		t.Errorf("stale_messages_total = %v, want 1", got)
+	}
+
+	var warnings []map[string]interface{}
+	for _, line := range strings.Split(logs.String(), "\n") {
+		var entry map[string]interface{}
+		if json.Unmarshal([]byte(line), &entry) == nil && entry["msg"] == "Order message is stale" {
+			warnings = append(warnings, entry)
+		}
+	}
+	if len(warnings) != 1 || warnings[0]["order_id"] != "old" || warnings[0]["delayed"] != true || warnings[0]["level"] != "WARN" {
+		t.Errorf("stale warnings = %v, want one delayed warning for order old", warnings)
+	}
+}
+
+func TestMessageAgeNeedsAValidSentTimestamp(t *testing.T) {
+	now := time.Now()
+	at := func(timestamp string) types.Message {
+		return types.Message{Attributes: map[string]string{"SentTimestamp": timestamp}}
+	}
+	if age, ok := messageAge(at(strconv.FormatInt(now.Add(-90*time.Second).UnixMilli(), 10)), now); !ok || age.Round(time.Second) != 90*time.Second {
+		t.Errorf("age = %v, %v; want 90s", age, ok)
+	}
+	// Clock skew can put SentTimestamp in the future
+	if age, ok := messageAge(at(strconv.FormatInt(now.Add(time.Minute).UnixMilli(), 10)), now); !ok || age != 0 {
+		t.Errorf("future age = %v, %v; want 0", age, ok)
+	}
+	for _, msg := range []types.Message{{}, at("yesterday")} {
+		if _, ok := messageAge(msg, now); ok {
+			t.Errorf("age measured from %v", msg.Attributes)
+		}
+	}
+}
+
+func TestCompletedReportsCarryTheChargeTime(t *testing.T) {
+	var mu sync.Mutex
+	reports := map[string]map[string]interface{}{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var report map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&report)
+		mu.Lock()
+		reports[report["status"].(string)] = report
+		mu.Unlock()
+		w.Write([]byte(`{}`))
+	}))
+	t.Cleanup(server.Close)
+	t.Setenv("ORDER_SERVICE_URL", server.URL)
+	client := newOrderServiceClient()
+
+	before := time.Now()
+	for _, status := range []string{"processing", "completed"} {
+		if err := client.ReportStatus("o1", status); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if _, ok := reports["processing"]["processed_at"]; ok {
+		t.Errorf("processing report carried processed_at: %v", reports["processing"])
+	}
+	stamp, _ := reports["completed"]["processed_at"].(string)
+	processedAt, err := time.Parse(time.RFC3339Nano, stamp)
+	if err != nil || processedAt.Before(before.Add(-time.Second)) || processedAt.After(time.Now()) {
+		t.Errorf("completed report processed_at = %q, want the time it was sent", stamp)
+	}
+}
+
+func TestSaturationIsTheMeanBusyShareOverTheWindow(t *testing.T) {
+	tracker := newSaturationTracker(time.Second)
+	if got := tracker.value(); got != 0 {
+		t.Errorf("saturation before any sample = %v, want 0", got)
+	}
+
+	// Only the samples taken so far count while the window fills
+	tracker.record(1, 4)
+	tracker.record(3, 4)
+	if got := tracker.value(); got != 0.5 {
+		t.Errorf("saturation of samples 0.25 and 0.75 = %v, want 0.5", got)
+	}
+
+	// More in flight than workers caps at 1, and no workers at all is 1
+	tracker.record(10, 2)
+	tracker.record(0, 0)
+	if got := tracker.value(); got != 0.75 {
+		t.Errorf("saturation after two full samples = %v, want 0.75", got)
+	}
+
+	// A second's window keeps four samples, so older ones age out
+	for i := 0; i < 4; i++ {
+		tracker.record(0, 4)
+	}
+	if got := tracker.value(); got != 0 {
+		t.Errorf("saturation once idle samples fill the window = %v, want 0", got)
+	}
+	tracker.record(2, 2)
+	if got := tracker.value(); got != 0.25 {
+		t.Errorf("saturation with one busy sample in four = %v, want 0.25", got)
+	}
+}
+
+func TestSaturationWindowShorterThanASampleKeepsOne(t *testing.T) {
+	tracker := newSaturationTracker(time.Millisecond)
+	tracker.record(1, 1)
+	tracker.record(0, 1)
+	if got := tracker.value(); got != 0 {
+		t.Errorf("saturation = %v, want only the newest sample, 0", got)
+	}
+}
+
+func TestStatusReportsSaturation(t *testing.T) {
+	p := newTestProcessor(t, 2, map[string]string{"SATURATION_WINDOW": "2s"})
+	p.saturation.record(1, 3)
+
+	status := getJSON(t, p.HandleStatus, "/status")
+	if got := status["saturation"]; got != 0.333 {
+		t.Errorf("saturation = %v, want 0.333", got)
+	}
+	if got := status["window_seconds"]; got != 2.0 {
+		t.Errorf("window_seconds = %v, want 2", got)
+	}
+	for _, field := range []string{"in_flight", "workers", "drained"} {
+		if _, ok := status[field]; !ok {
+			t.Errorf("status is missing %s: %v", field, status)
+		}
+	}
+	if got := promValues(t, p.promRegistry)["saturation"]; math.Abs(got-1.0/3) > 1e-9 {
+		t.Errorf("saturation gauge = %v, want 1/3", got)
+	}
+}
+
+// captureStdout sends os.Stdout to a pipe until the returned func is
+// called, which restores it and returns the JSON lines written meanwhile
+func captureStdout(t *testing.T) func() []map[string]interface{} {
+	t.Helper()
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := os.Stdout
+	os.Stdout = writer
+	output := make(chan []byte)
+	go func() {
+		data, _ := io.ReadAll(reader)
+		output <- data
+	}()
+	var lines []map[string]interface{}
+	return func() []map[string]interface{} {
+		if os.Stdout == writer {
+			os.Stdout = saved
+			writer.Close()
+			for _, line := range strings.Split(strings.TrimSpace(string(<-output)), "\n") {
+				var entry map[string]interface{}
+				if err := json.Unmarshal([]byte(line), &entry); err != nil {
+					t.Fatalf("stdout line %q is not JSON: %v", line, err)
+				}
+				lines = append(lines, entry)
+			}
+		}
+		return lines
+	}
+}
+
+func TestRefusedRequestsAreAccessLogged(t *testing.T) {
+	t.Setenv("AUTH_ENABLED", "true")
+	t.Setenv("API_KEYS", "key-one")
+	keys, err := loadAPIKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := mux.NewRouter()
+	router.HandleFunc("/admin/drain", labelled("served")).Methods("POST")
+	logged := captureStdout(t)
+	handler := withMiddleware(router, keys, true)
+	t.Cleanup(func() { logged() })
+
+	for _, key := range []string{"", "key-two"} {
+		request := httptest.NewRequest(http.MethodPost, "/admin/drain", nil)
+		if key != "" {
+			request.Header.Set("X-API-Key", key)
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), request)
+	}
+	lines := logged()
+	if len(lines) != 2 {
+		t.Fatalf("%d access log lines, want one per refused request: %v", len(lines), lines)
+	}
+	for i, want := range []float64{http.StatusUnauthorized, http.StatusForbidden} {
+		if lines[i]["status"] != want || lines[i]["route"] != "/admin/drain" {
+			t.Errorf("line %d = %v, want status %v on /admin/drain", i, lines[i], want)
+		}
+	}
+}
+
+func TestAccessLogLineFields(t *testing.T) {
+	p := newTestProcessor(t, 1, nil)
+	router := mux.NewRouter()
+	router.HandleFunc("/status", p.HandleStatus).Methods("GET")
+	logged := captureStdout(t)
+	handler := withMiddleware(router, nil, true)
+	t.Cleanup(func() { logged() })
+
+	request := httptest.NewRequest(http.MethodGet, "/status", nil)
+	request.Header.Set("X-Request-ID", "req-1")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, request)
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/status", strings.NewReader("{}")))
+
+	lines := logged()
+	if len(lines) != 2 {
+		t.Fatalf("%d access log lines, want 2: %v", len(lines), lines)
+	}
+	line := lines[0]
+	for field, want := range map[string]interface{}{
+		"method":         "GET",
+		"route":          "/status",
+		"status":         float64(http.StatusOK),
+		"request_id":     "req-1",
+		"request_bytes":  float64(0),
+		"response_bytes": float64(rec.Body.Len()),
+	} {
+		if line[field] != want {
+			t.Errorf("%s = %v, want %v", field, line[field], want)
+		}
+	}
+	if latency, ok := line["latency_ms"].(float64); !ok || latency < 0 {
+		t.Errorf("latency_ms = %v, want a duration", line["latency_ms"])
+	}
+	if refused := lines[1]; refused["method"] != "POST" || refused["status"] != float64(http.StatusMethodNotAllowed) || refused["request_id"] == "" {
+		t.Errorf("wrong-method request logged as %v, want a 405 with a request ID", refused)
+	}
+}
+
+func TestConsumerExtraDelayHoldsPaymentAndExtendsVisibility(t *testing.T) {
+	sqsFake, queueURL := useFakeSQS(t)
+	p := newTestProcessor(t, 1, map[string]string{
+		"SQS_QUEUE_URL":           queueURL,
+		"SQS_VISIBILITY_TIMEOUT":  "2",
+		"CONSUMER_EXTRA_DELAY_MS": "300",
+	})
+	charged := make(chan time.Time, 1)
+	p.stableHandler = func(ctx context.Context, order Order) error {
+		charged <- time.Now()
+		return nil
+	}
+	p.canaryHandler = p.stableHandler
+	body, _ := json.Marshal(testOrder("slow"))
+	receipt := sqsFake.push(queueURL, string(body))
+
+	started := time.Now()
+	p.Start()
+	select {
+	case at := <-charged:
+		if waited := at.Sub(started); waited < 300*time.Millisecond {
+			t.Errorf("payment started %v after the worker, want at least the 300ms extra delay", waited)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("order was never charged")
+	}
+	if !eventually(t, 5*time.Second, func() bool { return sqsFake.wasDeleted(receipt) }) {
+		t.Fatal("message was never deleted")
+	}
+	// The 2s timeout plus the extra 300ms, rounded up to whole seconds
+	if changes := sqsFake.visibilityChanges(receipt); !slices.Equal(changes, []int{3}) {
+		t.Errorf("visibility changes %v, want one extension to 3s", changes)
+	}
+}
+
+func TestConsumerExtraDelayEndsWithShutdown(t *testing.T) {
+	sqsFake, queueURL := useFakeSQS(t)
+	p := newTestProcessor(t, 1, map[string]string{
+		"SQS_QUEUE_URL":           queueURL,
+		"CONSUMER_EXTRA_DELAY_MS": "10000",
+	})
+	var charges int64
+	p.stableHandler = func(ctx context.Context, order Order) error {
+		atomic.AddInt64(&charges, 1)
+		return nil
+	}
+	p.canaryHandler = p.stableHandler
+	body, _ := json.Marshal(testOrder("abandoned"))
+	receipt := sqsFake.push(queueURL, string(body))
+
+	p.Start()
+	if !eventually(t, 5*time.Second, func() bool { return len(sqsFake.visibilityChanges(receipt)) > 0 }) {
+		t.Fatal("worker never started the extra delay")
+	}
+	stopped := time.Now()
+	p.Stop(50 * time.Millisecond)
+	exited := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(exited)
+	}()
+	select {
+	case <-exited:
+	case <-time.After(2 * time.Second):
+		t.Fatal("worker kept sleeping through shutdown")
+	}
+	if took := time.Since(stopped); took > 2*time.Second {
+		t.Errorf("shutdown took %v", took)
+	}
+	if got := atomic.LoadInt64(&charges); got != 0 {
+		t.Errorf("order charged %d times after shutdown cut its delay short", got)
+	}
+}
+
+func TestFIFOModeFollowsTheQueueSuffixUnlessOverridden(t *testing.T) {
+	tests := []struct {
+		name, queueURL, override string
+		want                     bool
+		wantErr                  string
+	}{
+		{name: "fifo suffix", queueURL: "https://sqs.us-east-1.amazonaws.com/1/orders.fifo", want: true},
+		{name: "standard queue", queueURL: "https://sqs.us-east-1.amazonaws.com/1/orders"},
+		{name: "forced off", queueURL: "https://sqs.us-east-1.amazonaws.com/1/orders.fifo", override: "false"},
+		{name: "forced on without a queue", override: "true", want: true},
+		{name: "forced on a standard queue", queueURL: "https://sqs.us-east-1.amazonaws.com/1/orders", override: "true", wantErr: "not a .fifo queue"},
+		{name: "not a bool", queueURL: "https://sqs.us-east-1.amazonaws.com/1/orders.fifo", override: "sometimes", wantErr: "must be true or false"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("FIFO_MODE", tt.override)
+			got, err := fifoMode(tt.queueURL)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("fifoMode error = %v, want one mentioning %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("fifoMode = %v, %v; want %v", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestMoveToAFIFODeadLetterQueueKeepsTheGroup(t *testing.T) {
+	fake, queueURL := useFakeSQS(t)
+	p := newTestProcessor(t, 1, map[string]string{"SQS_QUEUE_URL": queueURL})
+	fifoDLQ := strings.TrimSuffix(queueURL, "orders") + "orders-dlq.fifo"
+	standardDLQ := strings.TrimSuffix(queueURL, "orders") + "orders-dlq"
+
+	grouped := types.Message{
+		MessageId:     aws.String("m-grouped"),
+		ReceiptHandle: aws.String("rh-grouped"),
+		Body:          aws.String(`{"order_id":"o1"}`),
+		Attributes:    map[string]string{"MessageGroupId": "customer-7"},
+	}
+	ungrouped := types.Message{
+		MessageId:     aws.String("m-ungrouped"),
+		ReceiptHandle: aws.String("rh-ungrouped"),
+		Body:          aws.String(`{"order_id":"o2"}`),
+	}
+	cause := errors.New("payment kept failing")
+	for _, msg := range []types.Message{grouped, ungrouped} {
+		if err := p.moveMessage(fifoDLQ, msg, 3, cause); err != nil {
+			t.Fatalf("moveMessage: %v", err)
+		}
+		if !fake.wasDeleted(aws.ToString(msg.ReceiptHandle)) {
+			t.Errorf("%s was not deleted after the move", aws.ToString(msg.MessageId))
+		}
+	}
+	want := []fakeSQSSendIDs{
+		{MessageGroupId: "customer-7", MessageDeduplicationId: "m-grouped"},
+		{MessageGroupId: "dead-letter", MessageDeduplicationId: "m-ungrouped"},
+	}
+	if got := fake.sentIDsTo(fifoDLQ); !reflect.DeepEqual(got, want) {
+		t.Errorf("FIFO dead-letter sends carried %+v, want %+v", got, want)
+	}
+
+	// A standard queue rejects FIFO IDs, so none are sent to one
+	if err := p.moveMessage(standardDLQ, grouped, 3, cause); err != nil {
+		t.Fatalf("moveMessage: %v", err)
+	}
+	if got := fake.sentIDsTo(standardDLQ); !reflect.DeepEqual(got, []fakeSQSSendIDs{{}}) {
+		t.Errorf("standard dead-letter send carried %+v, want no FIFO IDs", got)
+	}
+}
+
+func TestRawDeliveryTakesOnlyBareOrders(t *testing.T) {
+	bare, _ := json.Marshal(testOrder("o1"))
+	envelope, _ := json.Marshal(map[string]string{"Type": "Notification", "MessageId": "sns-1", "Message": string(bare)})
+	for _, tc := range []struct {
+		name string
+		body []byte
+		raw  bool
+		want error
+	}{
+		{"bare order, raw", bare, true, nil},
+		{"SNS envelope, raw", envelope, true, errMalformedOrder},
+		{"bare order, enveloped", bare, false, nil},
+		{"SNS envelope, enveloped", envelope, false, nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			order, err := parseOrderMessage(types.Message{Body: aws.String(string(tc.body))}, tc.raw)
+			if !errors.Is(err, tc.want) {
+				t.Fatalf("parseOrderMessage error = %v, want %v", err, tc.want)
+			}
+			if tc.want != nil && !strings.Contains(err.Error(), "RAW_DELIVERY=true") {
+				t.Errorf("error %q does not point at RAW_DELIVERY", err)
+			}
+			if tc.want == nil && order.OrderID != "o1" {
+				t.Errorf("parsed %+v, want order o1", order)
+			}
+		})
+	}
+}
+
+// useFakeSNSSubscription points the SNS client at a server answering
+// GetSubscriptionAttributes with the given RawMessageDelivery, or with an
+// error if it is empty
+func useFakeSNSSubscription(t *testing.T, rawMessageDelivery string) {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/xml")
+		if rawMessageDelivery == "" {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `<ErrorResponse><Error><Type>Sender</Type><Code>NotFound</Code><Message>Subscription does not exist</Message></Error></ErrorResponse>`)
+			return
+		}
+		fmt.Fprintf(w, `<GetSubscriptionAttributesResponse><GetSubscriptionAttributesResult><Attributes>`+
+			`<entry><key>RawMessageDelivery</key><value>%s</value></entry>`+
+			`</Attributes></GetSubscriptionAttributesResult></GetSubscriptionAttributesResponse>`, rawMessageDelivery)
+	}))
+	t.Cleanup(server.Close)
+	t.Setenv("AWS_ENDPOINT_URL_SNS", server.URL)
+}
+
+func TestRawDeliveryIsCheckedAgainstTheSubscription(t *testing.T) {
+	for _, tc := range []struct {
+		name, rawDelivery, subscription string
+		wantLevel, wantMessage          string
+	}{
+		{"both raw", "true", "true", "INFO", "Subscription delivery mode matches RAW_DELIVERY"},
+		{"both enveloped", "false", "false", "INFO", "Subscription delivery mode matches RAW_DELIVERY"},
+		{"raw but enveloped", "true", "false", "ERROR", "RAW_DELIVERY does not match the subscription's RawMessageDelivery setting"},
+		{"enveloped but raw", "false", "true", "ERROR", "RAW_DELIVERY does not match the subscription's RawMessageDelivery setting"},
+		{"unreadable subscription", "true", "", "WARN", "Could not check subscription RawMessageDelivery"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			useFakeSNSSubscription(t, tc.subscription)
+			p := newTestProcessor(t, 1, map[string]string{
+				"RAW_DELIVERY":         tc.rawDelivery,
+				"SNS_SUBSCRIPTION_ARN": "arn:aws:sns:us-east-1:000000000000:orders:sub-1",
+			})
+			logs := captureLogs(t)
+			p.checkRawDelivery()
+
+			var entry struct {
+				Level string `json:"level"`
+				Msg   string `json:"msg"`
+			}
+			json.Unmarshal([]byte(logs.String()), &entry)
+			if entry.Level != tc.wantLevel || entry.Msg != tc.wantMessage {
+				t.Errorf("logged %s %q, want %s %q", entry.Level, entry.Msg, tc.wantLevel, tc.wantMessage)
+			}
+		})
+	}
+}
+
+func TestEmptyPollsBackOffWithoutLongPolling(t *testing.T) {
+	sqsFake, queueURL := useFakeSQS(t)
+	// useFakeSQS already sets SQS_WAIT_SECONDS=0, so every poll is empty
+	// and returns at once
+	p := newTestProcessor(t, 2, map[string]string{"SQS_QUEUE_URL": queueURL, "EMPTY_POLL_BACKOFF_MS": "100"})
+	p.Start()
+	time.Sleep(500 * time.Millisecond)
+	p.Stop(time.Second)
+
+	// Each worker polls at most once per 100ms backoff, plus its first poll
+	polls := sqsFake.calledTimes("ReceiveMessage")
+	if polls < 2 || polls > 2*(500/100+1) {
+		t.Errorf("2 workers polled an empty queue %d times in 500ms, want 2 to 12", polls)
+	}
+
+	// A message is still picked up within one backoff
+	charged := make(chan string, 1)
+	q := newTestProcessor(t, 1, map[string]string{"SQS_QUEUE_URL": queueURL, "EMPTY_POLL_BACKOFF_MS": "100"})
+	q.stableHandler = func(ctx context.Context, order Order) error {
+		charged <- order.OrderID
+		return nil
+	}
+	q.Start()
+	time.Sleep(150 * time.Millisecond)
+	body, _ := json.Marshal(testOrder("o1"))
+	sqsFake.push(queueURL, string(body))
+	select {
+	case <-charged:
+	case <-time.After(time.Second):
+		t.Error("message pushed between empty polls was not processed")
+	}
+}
+
+func TestMetricsReportSQSFailuresAlongsideLocalCounters(t *testing.T) {
+	sqsFake, queueURL := useFakeSQS(t)
+	p := newTestProcessor(t, 1, map[string]string{"SQS_QUEUE_URL": queueURL, "AWS_MAX_ATTEMPTS": "1"})
+	p.stableHandler = func(ctx context.Context, order Order) error { return nil }
+	body, _ := json.Marshal(testOrder("o1"))
+	sqsFake.push(queueURL, string(body))
+	p.Start()
+	if !eventually(t, 5*time.Second, func() bool { return loadCounter(&p.ordersProcessed) == 1 }) {
+		t.Fatal("order was not processed")
+	}
+	p.Stop(time.Second)
+
+	sqsStatus := func(metrics map[string]interface{}) map[string]interface{} {
+		dependencies, _ := metrics["dependencies"].(map[string]interface{})
+		status, _ := dependencies["sqs"].(map[string]interface{})
+		return status
+	}
+	healthy := getJSON(t, p.HandleMetrics, "/metrics")
+	if healthy["aws_degraded"] != false || sqsStatus(healthy)["status"] != "ok" {
+		t.Errorf("healthy SQS reported aws_degraded %v, sqs %v", healthy["aws_degraded"], sqsStatus(healthy))
+	}
+
+	sqsFake.fail("GetQueueAttributes", true)
+	degraded := getJSON(t, p.HandleMetrics, "/metrics")
+	if degraded["aws_degraded"] != true {
+		t.Errorf("aws_degraded = %v with SQS failing, want true", degraded["aws_degraded"])
+	}
+	if sqs := sqsStatus(degraded); sqs["status"] != "degraded" || !strings.Contains(fmt.Sprint(sqs["last_error"]), "InternalError") {
+		t.Errorf("dependencies.sqs = %v, want degraded with the last error", sqs)
+	}
+	if queue, _ := degraded["queue"].(map[string]interface{}); queue["error"] == nil || queue["queue_depth"] != nil {
+		t.Errorf("queue = %v, want the error in place of the depth", queue)
+	}
+	processor, _ := degraded["processor"].(map[string]interface{})
+	if processor["orders_processed"] != float64(1) || processor["messages_received"] != float64(1) {
+		t.Errorf("local counters = %v, want the processed order still reported", processor)
+	}
+
+	sqsFake.fail("GetQueueAttributes", false)
+	if recovered := getJSON(t, p.HandleMetrics, "/metrics"); recovered["aws_degraded"] != false || sqsStatus(recovered)["status"] != "ok" {
+		t.Errorf("recovered SQS reported aws_degraded %v, sqs %v", recovered["aws_degraded"], sqsStatus(recovered))
+	}
+}
+
+func TestPreflightComparesTheQueueRegion(t *testing.T) {
+	for _, tc := range []struct {
+		queueURL, region string
+	}{
+		{"https://sqs.us-west-2.amazonaws.com/123456789012/orders", "us-west-2"},
+		{"https://us-west-2.queue.amazonaws.com/123456789012/orders", "us-west-2"},
+		{"https://sqs.eu-central-1.amazonaws.com/123456789012/orders.fifo", "eu-central-1"},
+		{"http://localhost:4566/000000000000/orders", ""},
+	} {
+		if region, err := regionFromQueueURL(tc.queueURL); err != nil || region != tc.region {
+			t.Errorf("regionFromQueueURL(%s) = %q, %v; want %q", tc.queueURL, region, err, tc.region)
+		}
+	}
+	if _, err := regionFromQueueURL("not a url"); err == nil {
+		t.Error("regionFromQueueURL accepted a URL without a host")
+	}
+
+	t.Setenv("SKIP_PREFLIGHT", "")
+	for _, queueURL := range []string{
+		"https://sqs.us-west-2.amazonaws.com/123456789012/orders",
+		"https://us-west-2.queue.amazonaws.com/123456789012/orders",
+	} {
+		if err := preflightRegion("us-west-2", queueURL); err != nil {
+			t.Errorf("matching region %s: %v", queueURL, err)
+		}
+		err := preflightRegion("us-east-1", queueURL)
+		if err == nil || !strings.Contains(err.Error(), "region us-west-2 but AWS_REGION is us-east-1") {
+			t.Errorf("mismatched region %s: %v, want an error naming both regions", queueURL, err)
+		}
+	}
+	if err := preflightRegion("us-east-1", "http://localhost:4566/000000000000/orders"); err != nil {
+		t.Errorf("emulator URL: %v, want it allowed", err)
+	}
+
+	t.Setenv("SKIP_PREFLIGHT", "true")
+	if err := preflightRegion("us-east-1", "https://sqs.us-west-2.amazonaws.com/123456789012/orders"); err != nil {
+		t.Errorf("SKIP_PREFLIGHT=true still checked the region: %v", err)
+	}
+}
+
+func TestProcessorRefusesToStartOnAnotherRegionsQueue(t *testing.T) {
+	setTestEnv(t, map[string]string{"SQS_QUEUE_URL": "https://sqs.eu-west-1.amazonaws.com/123456789012/orders", "SKIP_PREFLIGHT": ""})
+	if _, err := NewOrderProcessor(1); err == nil || !strings.Contains(err.Error(), "preflight") {
+		t.Errorf("NewOrderProcessor = %v, want a preflight error", err)
+	}
+}
@@ -1,276 +1,6906 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"container/list"
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/fnv"
+	"io"
 	"log"
+	"log/slog"
+	"math"
+	"math/rand"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/sns"
+	snstypes "github.com/aws/aws-sdk-go-v2/service/sns/types"
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	tracenoop "go.opentelemetry.io/otel/trace/noop"
+	"google.golang.org/grpc"
+	grpccodes "google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"order_s/orderpb"
+)
+
+// tracer resolves against the global provider, so spans started before
+// setupTracing runs are simply not recorded
+var tracer = otel.Tracer("order_service")
+
+// Order represents an e-commerce order
+type Order struct {
+	OrderID     string    `json:"order_id"`
+	CustomerID  int       `json:"customer_id"`
+	Status      OrderStatus `json:"status"` // changed only through UpdateStatus
+	Items       []Item    `json:"items"`
+	Currency    string    `json:"currency,omitempty"` // ISO 4217, shared by all items
+	CreatedAt   time.Time `json:"created_at"`
+	ProcessedAt *time.Time `json:"processed_at,omitempty"`
+	// Earliest time the order may be charged (scheduled orders only)
+	ProcessAfter *flexTime `json:"process_after,omitempty"`
+	// Async orders not charged within this many seconds of CreatedAt are
+	// marked failed_timeout; the processor enforces the value carried here
+	MaxProcessingSeconds int `json:"max_processing_seconds,omitempty"`
+	// X-Request-ID of the call that submitted the order, carried through
+	// SNS so the processor's log lines can be correlated with it
+	RequestID string `json:"request_id,omitempty"`
+	// Sum of quantity * price in the order currency, rounded to cents
+	Total float64 `json:"total"`
+	// Payment retries made through POST /orders/{id}/retry
+	RetryCount int `json:"retry_count,omitempty"`
+	// Receives a signed POST when the order reaches a final status
+	CallbackURL string `json:"callback_url,omitempty"`
+	// Why the service failed the order before it reached a processor
+	FailureReason string `json:"failure_reason,omitempty"`
+	// When PATCH /orders/{id} last replaced the items; the processor
+	// charges the service's items instead of its queued copy once set
+	AmendedAt *time.Time `json:"amended_at,omitempty"`
+	// While processing: the order is stalled if it is still processing
+	// after this, so whoever charges it keeps pushing it back
+	LeaseExpiresAt *time.Time `json:"lease_expires_at,omitempty"`
+}
+
+// Item represents a product in an order
+type Item struct {
+	ProductID string  `json:"product_id"`
+	Quantity  int     `json:"quantity"`
+	Price     float64 `json:"price"`
+	Currency  string  `json:"currency,omitempty"`
+	// Price and currency as submitted, kept when the item was converted
+	// into the order currency
+	ListPrice    float64 `json:"list_price,omitempty"`
+	ListCurrency string  `json:"list_currency,omitempty"`
+	// Set when stock is reserved: the units that ship, and with
+	// PARTIAL_FULFILLMENT the units still waiting for stock
+	FulfilledQuantity   int `json:"fulfilled_quantity,omitempty"`
+	BackorderedQuantity int `json:"backordered_quantity,omitempty"`
+}
+
+// shippedQuantity is the units of an item that are reserved and charged:
+// everything ordered less any backorder
+func (i Item) shippedQuantity() int {
+	return i.Quantity - i.BackorderedQuantity
+}
+
+// backordered reports whether any item is waiting for stock
+func (o *Order) backordered() bool {
+	for _, item := range o.Items {
+		if item.BackorderedQuantity > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// chargedStatus is the status an order reaches once it is paid for:
+// completed, or partially_fulfilled if some units were backordered
+func (o *Order) chargedStatus() OrderStatus {
+	if o.backordered() {
+		return StatusPartiallyFulfilled
+	}
+	return StatusCompleted
+}
+
+// OrderTotal sums shipped quantity * price across all items. Each line is rounded
+// to cents and summed as integers so totals don't drift to 19.999999.
+func (o Order) OrderTotal() float64 {
+	return fromCents(o.totalCents())
+}
+
+// totalCents is OrderTotal in integer cents
+func (o Order) totalCents() int64 {
+	var cents int64
+	for _, item := range o.Items {
+		cents += toCents(item.Price) * int64(item.shippedQuantity())
+	}
+	return cents
+}
+
+// flexTime is a client-supplied timestamp. It accepts RFC 3339 strings,
+// a few common variants, and Unix epoch seconds or milliseconds as a
+// number or numeric string; it is always written back as UTC RFC 3339.
+type flexTime struct {
+	time.Time
+}
+
+// flexTimeLayouts are tried in order for string timestamps; layouts
+// without a zone are interpreted as UTC
+var flexTimeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05Z0700",
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05Z07:00",
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+	time.RFC1123Z,
+	time.RFC1123,
+}
+
+// timeFormatError reports a timestamp that none of the accepted formats match
+type timeFormatError struct {
+	value string
+}
+
+func (e *timeFormatError) Error() string {
+	return fmt.Sprintf("unrecognized timestamp %s: use RFC 3339 (e.g. 2024-01-02T15:04:05Z) or Unix epoch seconds/milliseconds", e.value)
+}
+
+// UnmarshalJSON parses any of the accepted timestamp formats
+func (t *flexTime) UnmarshalJSON(data []byte) error {
+	raw := strings.TrimSpace(string(data))
+	value := raw
+	if unquoted, err := strconv.Unquote(raw); err == nil {
+		value = strings.TrimSpace(unquoted)
+	}
+	
+	if epoch, err := strconv.ParseFloat(value, 64); err == nil {
+		// Anything past the year 33658 in seconds is taken as milliseconds
+		if math.Abs(epoch) >= 1e12 {
+			t.Time = time.UnixMilli(int64(epoch)).UTC()
+		} else {
+			t.Time = time.Unix(0, int64(epoch*float64(time.Second))).UTC()
+		}
+		return nil
+	}
+	for _, layout := range flexTimeLayouts {
+		if parsed, err := time.Parse(layout, value); err == nil {
+			t.Time = parsed.UTC()
+			return nil
+		}
+	}
+	return &timeFormatError{value: raw}
+}
+
+// MarshalJSON writes the timestamp as UTC RFC 3339
+func (t flexTime) MarshalJSON() ([]byte, error) {
+	return json.Marshal(t.UTC().Format(time.RFC3339Nano))
+}
+
+// invalidOrderMessage explains why an order body failed to decode,
+// surfacing timestamp problems instead of a generic message
+func invalidOrderMessage(err error) string {
+	var timeErr *timeFormatError
+	if errors.As(err, &timeErr) {
+		return "Invalid order data: " + timeErr.Error()
+	}
+	return "Invalid order data"
+}
+
+// fieldError names one invalid field of an order payload
+type fieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// orderLimits bound the size of one order: its line items (MAX_ITEMS) and
+// the quantity summed across them (MAX_QUANTITY). Zero disables a limit.
+type orderLimits struct {
+	maxItems    int
+	maxQuantity int
+}
+
+// validateOrder reports every field that makes an order unchargeable:
+// a missing customer, no items or more than limits allow, or items with a
+// bad quantity or price
+func validateOrder(order *Order, limits orderLimits) []fieldError {
+	var problems []fieldError
+	if order.CustomerID <= 0 {
+		problems = append(problems, fieldError{"customer_id", "must be positive"})
+	}
+	if len(order.Items) == 0 {
+		problems = append(problems, fieldError{"items", "must contain at least one item"})
+	}
+	if limits.maxItems > 0 && len(order.Items) > limits.maxItems {
+		problems = append(problems, fieldError{"items", fmt.Sprintf("has %d items, the maximum is %d", len(order.Items), limits.maxItems)})
+	}
+	if limits.maxQuantity > 0 {
+		// Counting down from the limit can't overflow the way a sum can
+		remaining := limits.maxQuantity
+		for _, item := range order.Items {
+			if item.Quantity <= 0 {
+				continue
+			}
+			if remaining -= item.Quantity; remaining < 0 {
+				problems = append(problems, fieldError{"items", fmt.Sprintf("total quantity exceeds the maximum of %d", limits.maxQuantity)})
+				break
+			}
+		}
+	}
+	for i, item := range order.Items {
+		if item.Quantity <= 0 {
+			problems = append(problems, fieldError{fmt.Sprintf("items[%d].quantity", i), "must be positive"})
+		}
+		if item.Price < 0 {
+			problems = append(problems, fieldError{fmt.Sprintf("items[%d].price", i), "must not be negative"})
+		}
+		if item.FulfilledQuantity != 0 {
+			problems = append(problems, fieldError{fmt.Sprintf("items[%d].fulfilled_quantity", i), "is set by the service"})
+		}
+		if item.BackorderedQuantity != 0 {
+			problems = append(problems, fieldError{fmt.Sprintf("items[%d].backordered_quantity", i), "is set by the service"})
+		}
+	}
+	if order.CallbackURL != "" {
+		if u, err := url.Parse(order.CallbackURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problems = append(problems, fieldError{"callback_url", "must be an absolute http or https URL"})
+		}
+	}
+	return problems
+}
+
+// orderProblems is validateOrder plus the checks that depend on how the
+// service is configured
+func (s *OrderService) orderProblems(order *Order) []fieldError {
+	problems := validateOrder(order, s.limits)
+	if order.CallbackURL != "" && s.webhooks == nil {
+		problems = append(problems, fieldError{"callback_url", "webhooks are not enabled (WEBHOOK_SECRET is unset)"})
+	}
+	return problems
+}
+
+// writeValidationErrors answers 422 with the offending fields
+func writeValidationErrors(w http.ResponseWriter, problems []fieldError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":  "Invalid order",
+		"fields": problems,
+	})
+}
+
+// orderError rejects a submission or lookup with the HTTP status the
+// handlers answer with; the gRPC server maps the same status onto a code
+type orderError struct {
+	status  int
+	message string
+	// Seconds the client should wait before retrying (zero omits it)
+	retryAfter int
+	// PaymentError reason of a 402, answered as JSON alongside message
+	reason string
+	// The offending fields of a 422 validation failure
+	fields []fieldError
+}
+
+func (e *orderError) Error() string {
+	return e.message
+}
+
+// rejectOrder builds an orderError without a retry hint
+func rejectOrder(status int, message string) *orderError {
+	return &orderError{status: status, message: message}
+}
+
+// orderResult is an accepted submission: the status to answer with and
+// the response body, shared by both transports
+type orderResult struct {
+	status   int
+	response map[string]interface{}
+}
+
+// orderSource carries the transport details the shared order logic needs
+type orderSource struct {
+	// Idempotency-Key header or its gRPC field; empty when not sent
+	idempotencyKey string
+	// Client address, rate-limiting orders that have no customer
+	client string
+}
+
+// writeOrderError answers with an orderError's status, Retry-After and
+// fields or payment failure reason, or 500 for any other error
+func writeOrderError(w http.ResponseWriter, err error) {
+	var rejected *orderError
+	if !errors.As(err, &rejected) {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if rejected.retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(rejected.retryAfter))
+	}
+	if rejected.fields != nil {
+		writeValidationErrors(w, rejected.fields)
+		return
+	}
+	if rejected.reason != "" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(rejected.status)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error":  rejected.message,
+			"reason": rejected.reason,
+		})
+		return
+	}
+	http.Error(w, rejected.message, rejected.status)
+}
+
+// writeOrderResult answers with an accepted submission
+func writeOrderResult(w http.ResponseWriter, result orderResult) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(result.status)
+	json.NewEncoder(w).Encode(result.response)
+}
+
+// decodeOrder reads a JSON order body, answering 415, 413 or 400 itself
+// when it can't
+func (s *OrderService) decodeOrder(w http.ResponseWriter, r *http.Request) (Order, bool) {
+	var order Order
+	if !requireJSON(w, r) {
+		return order, false
+	}
+	if err := s.decodeJSONBody(w, r, &order); err != nil {
+		writeBodyError(w, err, invalidOrderMessage(err))
+		return order, false
+	}
+	return order, true
+}
+
+// admitOrder runs the checks every new order passes before it is given an
+// ID: the sale is open, the customer is under its rate, and the order is
+// valid, priced in one currency and within the quantity limits
+func (s *OrderService) admitOrder(order *Order, source orderSource) error {
+	if !s.saleOpen() {
+		return rejectOrder(http.StatusGone, "Sale closed")
+	}
+	if err := s.rateLimitError(order, source.client); err != nil {
+		return err
+	}
+	if problems := s.orderProblems(order); len(problems) > 0 {
+		return &orderError{status: http.StatusUnprocessableEntity, message: "Invalid order", fields: problems}
+	}
+	
+	if err := s.currency.resolve(order); err != nil {
+		return rejectOrder(http.StatusUnprocessableEntity, err.Error())
+	}
+	if err := s.checkItemQuantities(order); err != nil {
+		return rejectOrder(http.StatusUnprocessableEntity, err.Error())
+	}
+	return nil
+}
+
+// assignOrderID gives a new order its ID, failing with 500 when the
+// system's random source is unavailable
+func (s *OrderService) assignOrderID(ctx context.Context, order *Order) error {
+	orderID, err := s.newOrderID()
+	if err != nil {
+		slog.Error("Rejecting order", "request_id", requestIDFrom(ctx), "error", err)
+		return rejectOrder(http.StatusInternalServerError, "Could not assign an order ID, please retry")
+	}
+	order.OrderID = orderID
+	order.RequestID = requestIDFrom(ctx)
+	order.CreatedAt = time.Now()
+	order.Total = order.OrderTotal()
+	return nil
+}
+
+// processingDeadline returns when an async order times out, if it can
+func (o *Order) processingDeadline() (time.Time, bool) {
+	if o.MaxProcessingSeconds <= 0 {
+		return time.Time{}, false
+	}
+	return o.CreatedAt.Add(time.Duration(o.MaxProcessingSeconds) * time.Second), true
+}
+
+// toCents converts a currency amount to integer cents, rounding to the
+// nearest cent so float drift never leaks into totals
+func toCents(amount float64) int64 {
+	return int64(math.Round(amount * 100))
+}
+
+// fromCents converts integer cents back to a currency amount
+func fromCents(cents int64) float64 {
+	return float64(cents) / 100
+}
+
+// ExchangeRateProvider converts an amount between two ISO 4217 currencies
+type ExchangeRateProvider interface {
+	Convert(amount float64, from, to string) (float64, error)
+}
+
+// staticRates converts with fixed rates, each the value of one unit of the
+// currency in a shared reference unit
+type staticRates map[string]float64
+
+// parseStaticRates reads a list such as "USD=1,EUR=1.08"
+func parseStaticRates(value string) (staticRates, error) {
+	rates := staticRates{}
+	for _, pair := range strings.Split(value, ",") {
+		code, rate, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		code = strings.ToUpper(strings.TrimSpace(code))
+		parsed, err := strconv.ParseFloat(strings.TrimSpace(rate), 64)
+		if !ok || len(code) != 3 || err != nil || parsed <= 0 {
+			return nil, fmt.Errorf("EXCHANGE_RATES entry %q must look like EUR=1.08", pair)
+		}
+		rates[code] = parsed
+	}
+	return rates, nil
+}
+
+// Convert rejects currencies it has no rate for
+func (r staticRates) Convert(amount float64, from, to string) (float64, error) {
+	fromRate, ok := r[from]
+	if !ok {
+		return 0, fmt.Errorf("no exchange rate for %s", from)
+	}
+	toRate, ok := r[to]
+	if !ok {
+		return 0, fmt.Errorf("no exchange rate for %s", to)
+	}
+	return amount * fromRate / toRate, nil
+}
+
+// currencyConfig controls how order currencies are resolved. With support
+// disabled every order is assumed to be in the fallback currency.
+type currencyConfig struct {
+	enabled   bool
+	supported map[string]bool
+	fallback  string
+	// With convert set, orders whose items are priced in several
+	// currencies are charged in base, with each item converted through
+	// rates; otherwise they are rejected
+	convert bool
+	base    string
+	rates   ExchangeRateProvider
+}
+
+// loadCurrencyConfig reads CURRENCY_SUPPORT, SUPPORTED_CURRENCIES,
+// DEFAULT_CURRENCY, CURRENCY_CONVERSION, BASE_CURRENCY (default
+// DEFAULT_CURRENCY) and EXCHANGE_RATES
+func loadCurrencyConfig() (currencyConfig, error) {
+	cfg := currencyConfig{
+		enabled:   os.Getenv("CURRENCY_SUPPORT") == "true",
+		convert:   os.Getenv("CURRENCY_CONVERSION") == "true",
+		supported: map[string]bool{},
+		fallback:  "USD",
+	}
+	if value := os.Getenv("DEFAULT_CURRENCY"); value != "" {
+		cfg.fallback = strings.ToUpper(value)
+	}
+	cfg.base = cfg.fallback
+	if value := os.Getenv("BASE_CURRENCY"); value != "" {
+		cfg.base = strings.ToUpper(value)
+	}
+	
+	supported := os.Getenv("SUPPORTED_CURRENCIES")
+	if supported == "" {
+		supported = "USD,EUR,GBP"
+	}
+	for _, code := range strings.Split(supported, ",") {
+		code = strings.ToUpper(strings.TrimSpace(code))
+		if len(code) != 3 {
+			return currencyConfig{}, fmt.Errorf("SUPPORTED_CURRENCIES contains invalid ISO 4217 code %q", code)
+		}
+		cfg.supported[code] = true
+	}
+	if !cfg.supported[cfg.fallback] {
+		return currencyConfig{}, fmt.Errorf("DEFAULT_CURRENCY %q is not in SUPPORTED_CURRENCIES", cfg.fallback)
+	}
+	if !cfg.supported[cfg.base] {
+		return currencyConfig{}, fmt.Errorf("BASE_CURRENCY %q is not in SUPPORTED_CURRENCIES", cfg.base)
+	}
+	
+	ratesValue := os.Getenv("EXCHANGE_RATES")
+	if ratesValue == "" {
+		ratesValue = "USD=1,EUR=1.08,GBP=1.27"
+	}
+	rates, err := parseStaticRates(ratesValue)
+	if err != nil {
+		return currencyConfig{}, err
+	}
+	if cfg.enabled && cfg.convert {
+		for code := range cfg.supported {
+			if _, ok := rates[code]; !ok {
+				return currencyConfig{}, fmt.Errorf("EXCHANGE_RATES has no rate for supported currency %s", code)
+			}
+		}
+	}
+	cfg.rates = rates
+	return cfg, nil
+}
+
+// resolve sets the currency of an order and all its items. Items without
+// a currency inherit the order's, and an order without one takes its
+// items'. An order may not mix currencies unless conversion is on; then an
+// order without a currency whose items differ is charged in the base
+// currency, and items priced in another currency are converted into the
+// order's.
+func (c currencyConfig) resolve(order *Order) error {
+	if !c.enabled {
+		order.Currency = c.fallback
+		for i := range order.Items {
+			order.Items[i].Currency = c.fallback
+		}
+		return nil
+	}
+	
+	currency := strings.ToUpper(order.Currency)
+	for _, item := range order.Items {
+		itemCurrency := strings.ToUpper(item.Currency)
+		if itemCurrency == "" {
+			continue
+		}
+		if currency == "" {
+			currency = itemCurrency
+		} else if itemCurrency != currency {
+			if !c.convert {
+				return fmt.Errorf("order mixes currencies %s and %s", currency, itemCurrency)
+			}
+			if order.Currency == "" {
+				currency = c.base
+			}
+			break
+		}
+	}
+	if currency == "" {
+		currency = c.fallback
+	}
+	if !c.supported[currency] {
+		return fmt.Errorf("currency %s is not supported", currency)
+	}
+	
+	for i := range order.Items {
+		item := &order.Items[i]
+		itemCurrency := strings.ToUpper(item.Currency)
+		if itemCurrency != "" && itemCurrency != currency {
+			if !c.supported[itemCurrency] {
+				return fmt.Errorf("currency %s is not supported", itemCurrency)
+			}
+			converted, err := c.rates.Convert(item.Price, itemCurrency, currency)
+			if err != nil {
+				return err
+			}
+			item.ListPrice, item.ListCurrency = item.Price, itemCurrency
+			item.Price = fromCents(toCents(converted))
+		}
+		item.Currency = currency
+	}
+	order.Currency = currency
+	return nil
+}
+
+// paymentDelayConfig scales the simulated payment delay with order value,
+// since high-value orders take longer to verify
+type paymentDelayConfig struct {
+	base   time.Duration
+	per100 time.Duration
+	max    time.Duration
+	// Each delay lands uniformly within base±jitter before scaling
+	jitter time.Duration
+}
+
+// loadPaymentDelayConfig reads PAYMENT_LATENCY (a duration, taking
+// precedence over PAYMENT_BASE_MS) and PAYMENT_LATENCY_JITTER, plus
+// PAYMENT_PER_100_MS and PAYMENT_MAX_MS; the defaults keep the flat 3
+// second delay, and PAYMENT_LATENCY=0 makes payments instant
+func loadPaymentDelayConfig() (paymentDelayConfig, error) {
+	base, err := envMillis("PAYMENT_BASE_MS", 3000)
+	if err != nil {
+		return paymentDelayConfig{}, err
+	}
+	if value := os.Getenv("PAYMENT_LATENCY"); value != "" {
+		if base, err = time.ParseDuration(value); err != nil || base < 0 {
+			return paymentDelayConfig{}, fmt.Errorf("PAYMENT_LATENCY must be a non-negative duration, got %q", value)
+		}
+	}
+	var jitter time.Duration
+	if value := os.Getenv("PAYMENT_LATENCY_JITTER"); value != "" {
+		if jitter, err = time.ParseDuration(value); err != nil || jitter < 0 {
+			return paymentDelayConfig{}, fmt.Errorf("PAYMENT_LATENCY_JITTER must be a non-negative duration, got %q", value)
+		}
+	}
+	per100, err := envMillis("PAYMENT_PER_100_MS", 0)
+	if err != nil {
+		return paymentDelayConfig{}, err
+	}
+	maxDelay, err := envMillis("PAYMENT_MAX_MS", 0)
+	if err != nil {
+		return paymentDelayConfig{}, err
+	}
+	return paymentDelayConfig{base: base, per100: per100, max: maxDelay, jitter: jitter}, nil
+}
+
+// delayFor returns the base delay, moved by up to jitter either way, plus
+// one increment per full $100 of the total, capped at max when a cap is
+// configured
+func (c paymentDelayConfig) delayFor(total float64) time.Duration {
+	delay := c.base
+	if c.jitter > 0 {
+		delay = max(0, delay+time.Duration(rand.Int63n(int64(2*c.jitter)+1))-c.jitter)
+	}
+	delay += time.Duration(math.Floor(total/100)) * c.per100
+	if c.max > 0 && delay > c.max {
+		delay = c.max
+	}
+	return delay
+}
+
+// PaymentGateway decides the outcome of a charge once the simulated
+// processing delay has elapsed
+type PaymentGateway interface {
+	Charge(ctx context.Context, orderID string, amount float64) error
+}
+
+// Reasons a charge can be refused with, carried by PaymentError
+const (
+	ReasonDeclined          = "declined"
+	ReasonInsufficientFunds = "insufficient_funds"
+	ReasonFraudSuspected    = "fraud_suspected"
+	ReasonGatewayTimeout    = "gateway_timeout"
+)
+
+// paymentFailureReasons lists every reason, in the order metrics report them
+var paymentFailureReasons = []string{ReasonDeclined, ReasonInsufficientFunds, ReasonFraudSuspected, ReasonGatewayTimeout}
+
+// defaultPaymentFailureReasons is PAYMENT_FAILURE_REASONS when unset
+const defaultPaymentFailureReasons = "declined=50,insufficient_funds=30,fraud_suspected=10,gateway_timeout=10"
+
+// PaymentError is a charge the gateway refused; Reason is one of the
+// Reason constants, so clients and metrics can tell failures apart
+type PaymentError struct {
+	OrderID string
+	Amount  float64
+	Reason  string
+}
+
+func (e *PaymentError) Error() string {
+	return fmt.Sprintf("payment refused for order %s (%.2f): %s", e.OrderID, e.Amount, e.Reason)
+}
+
+// paymentFailureReason returns the reason of a PaymentError anywhere in
+// err's chain, or "" for other errors
+func paymentFailureReason(err error) string {
+	var refused *PaymentError
+	if errors.As(err, &refused) {
+		return refused.Reason
+	}
+	return ""
+}
+
+// reasonWeight is one entry of PAYMENT_FAILURE_REASONS
+type reasonWeight struct {
+	reason string
+	weight int
+}
+
+// parseFailureReasons reads a comma-separated list of reason=weight pairs.
+// Weights are relative frequencies; reasons left out never occur.
+func parseFailureReasons(value string) ([]reasonWeight, error) {
+	var weights []reasonWeight
+	total := 0
+	for _, entry := range strings.Split(value, ",") {
+		reason, weightText, found := strings.Cut(strings.TrimSpace(entry), "=")
+		weight, err := strconv.Atoi(weightText)
+		if !found || err != nil || weight < 0 {
+			return nil, fmt.Errorf("entries must be reason=weight with a non-negative weight, got %q", entry)
+		}
+		if !slices.Contains(paymentFailureReasons, reason) {
+			return nil, fmt.Errorf("unknown reason %q, want one of %s", reason, strings.Join(paymentFailureReasons, ", "))
+		}
+		if weight > 0 {
+			weights = append(weights, reasonWeight{reason: reason, weight: weight})
+			total += weight
+		}
+	}
+	if total == 0 {
+		return nil, errors.New("at least one reason needs a positive weight")
+	}
+	return weights, nil
+}
+
+// simulatedGateway declines a configurable fraction of charges, giving
+// each a reason drawn from configured weights, using its own seeded
+// source so a fixed seed replays the same outcomes
+type simulatedGateway struct {
+	mu          sync.Mutex
+	rng         *rand.Rand
+	failureRate float64
+	reasons     []reasonWeight
+	totalWeight int
+}
+
+// newSimulatedGateway builds a gateway that declines failureRate of charges;
+// rates of 0 and 1 with a single reason never consult the source and are
+// fully deterministic
+func newSimulatedGateway(failureRate float64, reasons []reasonWeight, seed int64) *simulatedGateway {
+	gateway := &simulatedGateway{rng: rand.New(rand.NewSource(seed)), failureRate: failureRate, reasons: reasons}
+	for _, reason := range reasons {
+		gateway.totalWeight += reason.weight
+	}
+	return gateway
+}
+
+// loadPaymentGateway reads PAYMENT_FAILURE_RATE (0-1, default 0.01),
+// PAYMENT_FAILURE_REASONS (reason=weight pairs, default
+// defaultPaymentFailureReasons) and PAYMENT_FAILURE_SEED (default
+// time-based)
+func loadPaymentGateway() (PaymentGateway, error) {
+	failureRate := 0.01
+	if value := os.Getenv("PAYMENT_FAILURE_RATE"); value != "" {
+		parsed, err := strconv.ParseFloat(value, 64)
+		if err != nil || parsed < 0 || parsed > 1 {
+			return nil, fmt.Errorf("PAYMENT_FAILURE_RATE must be between 0 and 1, got %q", value)
+		}
+		failureRate = parsed
+	}
+	reasonsValue := defaultPaymentFailureReasons
+	if value := os.Getenv("PAYMENT_FAILURE_REASONS"); value != "" {
+		reasonsValue = value
+	}
+	reasons, err := parseFailureReasons(reasonsValue)
+	if err != nil {
+		return nil, fmt.Errorf("PAYMENT_FAILURE_REASONS: %w", err)
+	}
+	seed := time.Now().UnixNano()
+	if value := os.Getenv("PAYMENT_FAILURE_SEED"); value != "" {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("PAYMENT_FAILURE_SEED must be an integer, got %q", value)
+		}
+		seed = parsed
+	}
+	return newSimulatedGateway(failureRate, reasons, seed), nil
+}
+
+// Charge declines the order with probability failureRate, returning a
+// PaymentError with a weighted random reason
+func (g *simulatedGateway) Charge(ctx context.Context, orderID string, amount float64) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("payment for order %s abandoned: %w", orderID, err)
+	}
+	declined := g.failureRate >= 1
+	if g.failureRate > 0 && g.failureRate < 1 {
+		g.mu.Lock()
+		declined = g.rng.Float64() < g.failureRate
+		g.mu.Unlock()
+	}
+	if !declined {
+		return nil
+	}
+	reason := g.reasons[0].reason
+	if len(g.reasons) > 1 {
+		g.mu.Lock()
+		pick := g.rng.Intn(g.totalWeight)
+		g.mu.Unlock()
+		for _, candidate := range g.reasons {
+			if pick < candidate.weight {
+				reason = candidate.reason
+				break
+			}
+			pick -= candidate.weight
+		}
+	}
+	return &PaymentError{OrderID: orderID, Amount: amount, Reason: reason}
+}
+
+// paymentFailureCounts tallies refused charges by PaymentError reason
+type paymentFailureCounts map[string]*int64
+
+func newPaymentFailureCounts() paymentFailureCounts {
+	counts := paymentFailureCounts{}
+	for _, reason := range paymentFailureReasons {
+		counts[reason] = new(int64)
+	}
+	return counts
+}
+
+// record counts err if it carries a known reason
+func (c paymentFailureCounts) record(err error) {
+	if count, ok := c[paymentFailureReason(err)]; ok {
+		atomic.AddInt64(count, 1)
+	}
+}
+
+// snapshot reads every reason's count, zeros included
+func (c paymentFailureCounts) snapshot() map[string]int64 {
+	counts := make(map[string]int64, len(c))
+	for reason, count := range c {
+		counts[reason] = loadCounter(count)
+	}
+	return counts
+}
+
+
+// errChaosInjected marks a payment failure forced through /admin/chaos
+var errChaosInjected = errors.New("chaos: injected payment failure")
+
+// chaosInjector holds fault-injection settings changed at runtime through
+// POST /admin/chaos, so retry and dead-letter handling can be exercised on
+// demand. It only exists when CHAOS_ENABLED=true.
+type chaosInjector struct {
+	mu          sync.Mutex
+	rng         *rand.Rand
+	failureRate float64
+	// Replaces the simulated payment delay while set
+	latency  *time.Duration
+	injected int64
+}
+
+// loadChaosInjector returns nil unless CHAOS_ENABLED=true. It starts with
+// no failures and no latency override.
+func loadChaosInjector() *chaosInjector {
+	if os.Getenv("CHAOS_ENABLED") != "true" {
+		return nil
+	}
+	return &chaosInjector{rng: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+// set replaces the settings; a nil latency clears the override
+func (c *chaosInjector) set(failureRate float64, latency *time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.failureRate = failureRate
+	c.latency = latency
+}
+
+// delay returns the latency override, or normal when none is set
+func (c *chaosInjector) delay(normal time.Duration) time.Duration {
+	if c == nil {
+		return normal
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.latency != nil {
+		return *c.latency
+	}
+	return normal
+}
+
+// fail forces the charge for orderID to fail with probability failureRate
+func (c *chaosInjector) fail(orderID string) error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	failed := c.failureRate >= 1 || (c.failureRate > 0 && c.rng.Float64() < c.failureRate)
+	c.mu.Unlock()
+	if !failed {
+		return nil
+	}
+	atomic.AddInt64(&c.injected, 1)
+	return fmt.Errorf("%w for order %s", errChaosInjected, orderID)
+}
+
+// status reports the current settings for /metrics and /admin/chaos
+func (c *chaosInjector) status() map[string]interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var latencyMs interface{}
+	if c.latency != nil {
+		latencyMs = c.latency.Milliseconds()
+	}
+	return map[string]interface{}{
+		"enabled":           true,
+		"failure_rate":      c.failureRate,
+		"latency_ms":        latencyMs,
+		"failures_injected": loadCounter(&c.injected),
+	}
+}
+
+// envInt reads a non-negative integer from the environment
+func envInt(name string, defaultValue int) (int, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue, nil
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil || parsed < 0 {
+		return 0, fmt.Errorf("%s must be a non-negative integer, got %q", name, value)
+	}
+	return parsed, nil
+}
+
+// envMillis reads a non-negative millisecond count from the environment
+func envMillis(name string, defaultMs int) (time.Duration, error) {
+	ms := defaultMs
+	if value := os.Getenv(name); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 0 {
+			return 0, fmt.Errorf("%s must be a non-negative integer, got %q", name, value)
+		}
+		ms = parsed
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
+
+// serverTimeouts bound how long the HTTP server spends on one connection,
+// so slow or stalled clients can't hold connections open indefinitely
+type serverTimeouts struct {
+	readHeader time.Duration
+	read       time.Duration
+	write      time.Duration
+	idle       time.Duration
+}
+
+// loadServerTimeouts reads HTTP_READ_HEADER_TIMEOUT, HTTP_READ_TIMEOUT,
+// HTTP_WRITE_TIMEOUT and HTTP_IDLE_TIMEOUT; zero disables one
+func loadServerTimeouts() (serverTimeouts, error) {
+	timeouts := serverTimeouts{readHeader: 5 * time.Second, read: 30 * time.Second, write: 30 * time.Second, idle: 120 * time.Second}
+	for name, target := range map[string]*time.Duration{
+		"HTTP_READ_HEADER_TIMEOUT": &timeouts.readHeader,
+		"HTTP_READ_TIMEOUT":        &timeouts.read,
+		"HTTP_WRITE_TIMEOUT":       &timeouts.write,
+		"HTTP_IDLE_TIMEOUT":        &timeouts.idle,
+	} {
+		if value := os.Getenv(name); value != "" {
+			parsed, err := time.ParseDuration(value)
+			if err != nil || parsed < 0 {
+				return serverTimeouts{}, fmt.Errorf("%s must be a non-negative duration, got %q", name, value)
+			}
+			*target = parsed
+		}
+	}
+	return timeouts, nil
+}
+
+// newServer builds an HTTP server for handler with these timeouts
+func (t serverTimeouts) newServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: t.readHeader,
+		ReadTimeout:       t.read,
+		WriteTimeout:      t.write,
+		IdleTimeout:       t.idle,
+	}
+}
+
+// paymentLane identifies the kind of request waiting for a payment slot
+type paymentLane int
+
+const (
+	laneSync  paymentLane = iota // interactive requests with a client waiting
+	laneAsync                    // background orders from the local fallback pool
+)
+
+// paymentScheduler hands out payment slots. Go channels don't guarantee
+// FIFO wakeup, so waiters queue explicitly and each released slot goes
+// straight to a chosen waiter. Each lane is served in arrival order; when
+// both lanes are waiting, sync requests get up to syncRatio slots for
+// every async slot, and an async waiter older than asyncMaxWait is served
+// next regardless so background orders never starve.
+type paymentScheduler struct {
+	mu           sync.Mutex
+	free         int
+	lanes        [2]*list.List // of *slotWaiter, oldest first
+	syncRatio    int
+	asyncMaxWait time.Duration
+	syncStreak   int
+}
+
+// slotWaiter is a request queued for a payment slot
+type slotWaiter struct {
+	ready chan struct{}
+	since time.Time
+}
+
+func newPaymentScheduler(capacity, syncRatio int, asyncMaxWait time.Duration) *paymentScheduler {
+	return &paymentScheduler{
+		free:         capacity,
+		lanes:        [2]*list.List{list.New(), list.New()},
+		syncRatio:    syncRatio,
+		asyncMaxWait: asyncMaxWait,
+	}
+}
+
+// errPaymentBusy means no payment slot freed up within the allowed wait
+var errPaymentBusy = errors.New("payment processor busy")
+
+// Acquire blocks until a slot is granted or ctx is done
+func (ps *paymentScheduler) Acquire(ctx context.Context, lane paymentLane) error {
+	ps.mu.Lock()
+	if ps.takeFree() {
+		ps.mu.Unlock()
+		return nil
+	}
+	waiter := &slotWaiter{ready: make(chan struct{}), since: time.Now()}
+	elem := ps.lanes[lane].PushBack(waiter)
+	ps.mu.Unlock()
+	
+	select {
+	case <-waiter.ready:
+		return nil
+	case <-ctx.Done():
+	}
+	
+	ps.mu.Lock()
+	select {
+	case <-waiter.ready:
+		// The slot was granted while we were giving up; pass it on
+		ps.mu.Unlock()
+		ps.Release()
+	default:
+		ps.lanes[lane].Remove(elem)
+		ps.mu.Unlock()
+	}
+	return ctx.Err()
+}
+
+// TryAcquire is Acquire bounded by maxWait, returning errPaymentBusy if no
+// slot is granted in time. A zero maxWait only takes a slot that is free
+// right now.
+func (ps *paymentScheduler) TryAcquire(ctx context.Context, lane paymentLane, maxWait time.Duration) error {
+	if maxWait <= 0 {
+		ps.mu.Lock()
+		defer ps.mu.Unlock()
+		if ps.takeFree() {
+			return nil
+		}
+		return errPaymentBusy
+	}
+	
+	waitCtx, cancel := context.WithTimeout(ctx, maxWait)
+	defer cancel()
+	err := ps.Acquire(waitCtx, lane)
+	if err != nil && ctx.Err() == nil {
+		return errPaymentBusy
+	}
+	return err
+}
+
+// takeFree claims a free slot if nobody is queued ahead; callers must hold
+// ps.mu
+func (ps *paymentScheduler) takeFree() bool {
+	if ps.free > 0 && ps.lanes[laneSync].Len() == 0 && ps.lanes[laneAsync].Len() == 0 {
+		ps.free--
+		return true
+	}
+	return false
+}
+
+// Release returns a slot, handing it to the next waiter if there is one
+func (ps *paymentScheduler) Release() {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	
+	lane, ok := ps.nextLane()
+	if !ok {
+		ps.free++
+		return
+	}
+	
+	front := ps.lanes[lane].Front()
+	ps.lanes[lane].Remove(front)
+	close(front.Value.(*slotWaiter).ready)
+}
+
+// nextLane picks which lane gets the next slot; callers must hold ps.mu
+func (ps *paymentScheduler) nextLane() (paymentLane, bool) {
+	syncFront := ps.lanes[laneSync].Front()
+	asyncFront := ps.lanes[laneAsync].Front()
+	
+	switch {
+	case syncFront == nil && asyncFront == nil:
+		return 0, false
+	case asyncFront == nil:
+		return laneSync, true
+	case syncFront == nil:
+		ps.syncStreak = 0
+		return laneAsync, true
+	}
+	
+	// Both lanes are waiting: age out starved async orders first, then
+	// favour sync up to the configured ratio
+	aged := ps.asyncMaxWait > 0 && time.Since(asyncFront.Value.(*slotWaiter).since) >= ps.asyncMaxWait
+	if aged || ps.syncStreak >= ps.syncRatio {
+		ps.syncStreak = 0
+		return laneAsync, true
+	}
+	ps.syncStreak++
+	return laneSync, true
+}
+
+// Stats reports how many requests wait in each lane and how long the
+// oldest waiter across both lanes has waited
+func (ps *paymentScheduler) Stats() (syncWaiting, asyncWaiting int, oldestWait time.Duration) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	
+	for _, lane := range ps.lanes {
+		if front := lane.Front(); front != nil {
+			if wait := time.Since(front.Value.(*slotWaiter).since); wait > oldestWait {
+				oldestWait = wait
+			}
+		}
+	}
+	return ps.lanes[laneSync].Len(), ps.lanes[laneAsync].Len(), oldestWait
+}
+
+// admissionSmoother paces async order acceptance with a token bucket so a
+// burst at sale open reaches SNS as a steady stream. A request over the
+// rate waits for its token if that takes at most maxWait, otherwise it is
+// turned away with a hint of when to retry.
+type admissionSmoother struct {
+	mu       sync.Mutex
+	rate     float64 // tokens per second
+	burst    float64
+	maxWait  time.Duration
+	tokens   float64
+	last     time.Time
+	admitted int64
+	rejected int64
+	
+	// Admissions in the current and previous one-second windows
+	windowStart   time.Time
+	windowCount   int64
+	previousCount int64
+}
+
+func newAdmissionSmoother(rate, burst int, maxWait time.Duration) *admissionSmoother {
+	now := time.Now()
+	return &admissionSmoother{
+		rate:        float64(rate),
+		burst:       float64(burst),
+		maxWait:     maxWait,
+		tokens:      float64(burst),
+		last:        now,
+		windowStart: now,
+	}
+}
+
+// reserve claims the next token and returns how long the caller must wait
+// before using it. If the wait would exceed maxWait nothing is claimed,
+// ok is false and wait is the time until a token becomes available.
+func (a *admissionSmoother) reserve() (wait time.Duration, ok bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	
+	now := time.Now()
+	a.tokens = math.Min(a.burst, a.tokens+now.Sub(a.last).Seconds()*a.rate)
+	a.last = now
+	
+	if a.tokens < 1 {
+		wait = time.Duration((1 - a.tokens) / a.rate * float64(time.Second))
+		if wait > a.maxWait {
+			a.rejected++
+			return wait, false
+		}
+	}
+	a.tokens--
+	a.admitted++
+	
+	if elapsed := now.Sub(a.windowStart); elapsed >= time.Second {
+		if elapsed < 2*time.Second {
+			a.previousCount = a.windowCount
+		} else {
+			a.previousCount = 0
+		}
+		a.windowStart = now
+		a.windowCount = 0
+	}
+	a.windowCount++
+	return wait, true
+}
+
+// cancel returns a token claimed by reserve that was never used
+func (a *admissionSmoother) cancel() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.tokens = math.Min(a.burst, a.tokens+1)
+	a.admitted--
+}
+
+// Admit waits for a token, returning an error with the suggested retry
+// delay if admission would take longer than maxWait or ctx ends first
+func (a *admissionSmoother) Admit(ctx context.Context) (retryAfter time.Duration, err error) {
+	wait, ok := a.reserve()
+	if !ok {
+		return wait, fmt.Errorf("order intake over %.0f orders/s", a.rate)
+	}
+	if wait <= 0 {
+		return 0, nil
+	}
+	
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return 0, nil
+	case <-ctx.Done():
+		a.cancel()
+		return 0, ctx.Err()
+	}
+}
+
+// status reports the configured pace and the admissions in the last second
+func (a *admissionSmoother) status() map[string]interface{} {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	
+	acceptRate := a.previousCount
+	if elapsed := time.Since(a.windowStart); elapsed >= 2*time.Second {
+		acceptRate = 0
+	} else if elapsed >= time.Second {
+		acceptRate = a.windowCount
+	}
+	return map[string]interface{}{
+		"enabled":     true,
+		"target_rate": a.rate,
+		"burst":       a.burst,
+		"max_wait_ms": a.maxWait.Milliseconds(),
+		"accept_rate": acceptRate,
+		"admitted":    a.admitted,
+		"rejected":    a.rejected,
+	}
+}
+
+// rateLimiterShards spreads customer buckets over independently locked maps
+// so concurrent orders from different customers rarely contend
+const rateLimiterShards = 32
+
+// customerBucket is one caller's token bucket
+type customerBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// customerRateLimiter gives each customer (or client IP) its own token
+// bucket of rate tokens per second up to burst, so one caller can't take
+// every payment slot. Buckets left idle long enough to refill are swept,
+// which is indistinguishable from never having seen the caller.
+type customerRateLimiter struct {
+	rate      float64
+	burst     float64
+	shards    [rateLimiterShards]customerShard
+	allowed   int64
+	throttled int64
+}
+
+type customerShard struct {
+	mu      sync.Mutex
+	buckets map[string]*customerBucket
+}
+
+func newCustomerRateLimiter(rate, burst int) *customerRateLimiter {
+	l := &customerRateLimiter{rate: float64(rate), burst: float64(burst)}
+	for i := range l.shards {
+		l.shards[i].buckets = make(map[string]*customerBucket)
+	}
+	return l
+}
+
+// shard picks the map that holds key's bucket
+func (l *customerRateLimiter) shard(key string) *customerShard {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return &l.shards[h.Sum32()%rateLimiterShards]
+}
+
+// allow takes a token from key's bucket. When the bucket is empty nothing
+// is taken and retryAfter is the time until the next token.
+func (l *customerRateLimiter) allow(key string) (retryAfter time.Duration, ok bool) {
+	shard := l.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	
+	now := time.Now()
+	bucket, exists := shard.buckets[key]
+	if !exists {
+		bucket = &customerBucket{tokens: l.burst, last: now}
+		shard.buckets[key] = bucket
+	}
+	bucket.tokens = math.Min(l.burst, bucket.tokens+now.Sub(bucket.last).Seconds()*l.rate)
+	bucket.last = now
+	
+	if bucket.tokens < 1 {
+		atomic.AddInt64(&l.throttled, 1)
+		return time.Duration((1 - bucket.tokens) / l.rate * float64(time.Second)), false
+	}
+	bucket.tokens--
+	atomic.AddInt64(&l.allowed, 1)
+	return 0, true
+}
+
+// sweep drops buckets that have been idle long enough to be full again
+func (l *customerRateLimiter) sweep() {
+	refill := time.Duration(l.burst / l.rate * float64(time.Second))
+	cutoff := time.Now().Add(-refill)
+	for i := range l.shards {
+		shard := &l.shards[i]
+		shard.mu.Lock()
+		for key, bucket := range shard.buckets {
+			if bucket.last.Before(cutoff) {
+				delete(shard.buckets, key)
+			}
+		}
+		shard.mu.Unlock()
+	}
+}
+
+// sweepLoop runs sweep every interval for the life of the process
+func (l *customerRateLimiter) sweepLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		l.sweep()
+	}
+}
+
+// status reports the configured limit and how many callers are tracked
+func (l *customerRateLimiter) status() map[string]interface{} {
+	tracked := 0
+	for i := range l.shards {
+		l.shards[i].mu.Lock()
+		tracked += len(l.shards[i].buckets)
+		l.shards[i].mu.Unlock()
+	}
+	return map[string]interface{}{
+		"enabled":   true,
+		"rps":       l.rate,
+		"burst":     l.burst,
+		"tracked":   tracked,
+		"allowed":   loadCounter(&l.allowed),
+		"throttled": loadCounter(&l.throttled),
+	}
+}
+
+// fallbackPool processes async orders in-process when SNS is not
+// configured, so local runs still complete async orders
+type fallbackPool struct {
+	queue    chan *Order
+	inFlight int64
+	wg       sync.WaitGroup
+	
+	// mu guards draining so no order is enqueued after the queue closes
+	mu       sync.RWMutex
+	draining bool
+}
+
+// enqueue hands an order to the local workers without blocking
+func (p *fallbackPool) enqueue(order *Order) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	
+	if p.draining {
+		return fmt.Errorf("service is shutting down")
+	}
+	select {
+	case p.queue <- order:
+		return nil
+	default:
+		return fmt.Errorf("local async queue is full")
+	}
+}
+
+// drain stops intake and waits for queued orders to finish. Orders still
+// queued when ctx expires are returned so the caller can persist them.
+func (p *fallbackPool) drain(ctx context.Context) []*Order {
+	p.mu.Lock()
+	p.draining = true
+	close(p.queue)
+	p.mu.Unlock()
+	
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+	
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+	
+	// Compete with the workers for whatever is still queued
+	var remaining []*Order
+	for order := range p.queue {
+		remaining = append(remaining, order)
+	}
+	return remaining
+}
+
+// status reports the fallback backlog
+func (p *fallbackPool) status() map[string]interface{} {
+	p.mu.RLock()
+	draining := p.draining
+	p.mu.RUnlock()
+	
+	return map[string]interface{}{
+		"enabled":   true,
+		"queued":    len(p.queue),
+		"in_flight": atomic.LoadInt64(&p.inFlight),
+		"draining":  draining,
+	}
+}
+
+// errOutOfStock is returned when an order asks for more units than remain
+var errOutOfStock = errors.New("out of stock")
+
+// productStock is one product's inventory row
+type productStock struct {
+	mu    sync.Mutex
+	units int
+}
+
+// inventoryStore tracks remaining stock per product. Rows for products not
+// listed in INVENTORY are created on first use with defaultStock units, or
+// never if defaultStock is negative, leaving those products unlimited.
+// Rows are created with LoadOrStore so concurrent first orders for a new
+// product all share one row and one starting count. Stock is only checked
+// under the row's lock, so a product that sold out accepts orders again as
+// soon as it is replenished.
+type inventoryStore struct {
+	products     sync.Map // product ID -> *productStock
+	defaultStock int
+	// PARTIAL_FULFILLMENT: reserve what is left rather than refusing the
+	// order when a product runs short
+	partial bool
+}
+
+// loadInventory parses INVENTORY, a comma-separated list of
+// product_id=quantity pairs, and INVENTORY_DEFAULT_STOCK, the stock given
+// to any other product; with neither set every product is unlimited
+func loadInventory() (*inventoryStore, error) {
+	store := &inventoryStore{defaultStock: -1, partial: os.Getenv("PARTIAL_FULFILLMENT") == "true"}
+	if value := os.Getenv("INVENTORY_DEFAULT_STOCK"); value != "" {
+		defaultStock, err := envInt("INVENTORY_DEFAULT_STOCK", 0)
+		if err != nil {
+			return nil, err
+		}
+		store.defaultStock = defaultStock
+	}
+	
+	value := os.Getenv("INVENTORY")
+	if value == "" {
+		return store, nil
+	}
+	for _, entry := range strings.Split(value, ",") {
+		productID, qty, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		quantity, err := strconv.Atoi(qty)
+		if !ok || productID == "" || err != nil || quantity < 0 {
+			return nil, fmt.Errorf("INVENTORY entries must be product_id=quantity, got %q", entry)
+		}
+		store.products.Store(productID, &productStock{units: quantity})
+	}
+	return store, nil
+}
+
+// row returns a product's inventory row, creating it with the default
+// stock if create is set; nil means the product is not limited
+func (s *inventoryStore) row(productID string, create bool) *productStock {
+	if value, ok := s.products.Load(productID); ok {
+		return value.(*productStock)
+	}
+	if !create || s.defaultStock < 0 {
+		return nil
+	}
+	value, _ := s.products.LoadOrStore(productID, &productStock{units: s.defaultStock})
+	return value.(*productStock)
+}
+
+// reserve takes stock for the units each item ships. Without partial it
+// takes all of it, or none if any limited product has too few units left.
+// With partial it takes whatever is left, recording the shortfall in
+// BackorderedQuantity, and only refuses an order that would ship nothing.
+// Everything is decided under the row locks, so the backorders match the
+// stock actually taken. An item already carrying a backorder, as in a
+// retried order, asks only for the units it ships.
+func (s *inventoryStore) reserve(items []Item, partial bool) error {
+	rows, unlock := s.lockRows(items)
+	defer unlock()
+	return takeStock(rows, items, partial)
+}
+
+// exchange gives back the stock held by old, an order's reserved items,
+// and reserves replacement in its place the way reserve would. Both happen
+// under the same row locks, so no other order can take the units old gives
+// back before replacement has had them. If replacement can't be reserved
+// old keeps its stock.
+func (s *inventoryStore) exchange(old, replacement []Item, partial bool) error {
+	rows, unlock := s.lockRows(append(slices.Clone(old), replacement...))
+	defer unlock()
+	
+	for _, item := range old {
+		if row, limited := rows[item.ProductID]; limited {
+			row.units += item.shippedQuantity()
+		}
+	}
+	if err := takeStock(rows, replacement, partial); err != nil {
+		for _, item := range old {
+			if row, limited := rows[item.ProductID]; limited {
+				row.units -= item.shippedQuantity()
+			}
+		}
+		return err
+	}
+	return nil
+}
+
+// lockRows locks the rows of the limited products in items, in product ID
+// order so overlapping orders can't deadlock, and returns them keyed by
+// product along with the function that unlocks them
+func (s *inventoryStore) lockRows(items []Item) (map[string]*productStock, func()) {
+	productIDs := make([]string, 0, len(items))
+	for _, item := range items {
+		productIDs = append(productIDs, item.ProductID)
+	}
+	sort.Strings(productIDs)
+	productIDs = slices.Compact(productIDs)
+	
+	rows := make(map[string]*productStock, len(productIDs))
+	for _, productID := range productIDs {
+		if row := s.row(productID, true); row != nil {
+			row.mu.Lock()
+			rows[productID] = row
+		}
+	}
+	return rows, func() {
+		for _, row := range rows {
+			row.mu.Unlock()
+		}
+	}
+}
+
+// takeStock is reserve for rows the caller has locked
+func takeStock(rows map[string]*productStock, items []Item, partial bool) error {
+	needed := make(map[string]int)
+	for _, item := range items {
+		needed[item.ProductID] += item.shippedQuantity()
+	}
+	
+	if !partial {
+		productIDs := make([]string, 0, len(needed))
+		for productID := range needed {
+			productIDs = append(productIDs, productID)
+		}
+		sort.Strings(productIDs)
+		for _, productID := range productIDs {
+			if row, limited := rows[productID]; limited && row.units < needed[productID] {
+				return fmt.Errorf("%w: product %s has %d left, %d requested", errOutOfStock, productID, row.units, needed[productID])
+			}
+		}
+	}
+	
+	// Items for the same product take its units first come, first served
+	shipped := make([]int, len(items))
+	total := 0
+	for i, item := range items {
+		shipped[i] = item.shippedQuantity()
+		if row, limited := rows[item.ProductID]; limited {
+			shipped[i] = min(shipped[i], row.units)
+			row.units -= shipped[i]
+		}
+		total += shipped[i]
+	}
+	if total == 0 {
+		// Nothing was taken, so there is nothing to put back
+		return fmt.Errorf("%w: none of the requested products are left", errOutOfStock)
+	}
+	for i := range items {
+		items[i].BackorderedQuantity = items[i].Quantity - shipped[i]
+		items[i].FulfilledQuantity = shipped[i]
+	}
+	return nil
+}
+
+// remaining reports the units left for a product without creating its row;
+// limited is false for products that are not limited
+func (s *inventoryStore) remaining(productID string) (units int, limited bool) {
+	row := s.row(productID, false)
+	if row == nil {
+		return s.defaultStock, s.defaultStock >= 0
+	}
+	row.mu.Lock()
+	defer row.mu.Unlock()
+	return row.units, true
+}
+
+// release returns stock taken by reserve for an order that did not go through
+func (s *inventoryStore) release(items []Item) {
+	for _, item := range items {
+		if row := s.row(item.ProductID, false); row != nil {
+			row.mu.Lock()
+			row.units += item.shippedQuantity()
+			row.mu.Unlock()
+		}
+	}
+}
+
+// replenish adds qty units to a limited product and returns the stock
+// before and after; ok is false if the product is not limited
+func (s *inventoryStore) replenish(productID string, qty int) (before, after int, ok bool) {
+	row := s.row(productID, true)
+	if row == nil {
+		return 0, 0, false
+	}
+	row.mu.Lock()
+	defer row.mu.Unlock()
+	before = row.units
+	row.units += qty
+	return before, row.units, true
+}
+
+// seed sets the stock of each listed product, limiting it if it was not
+// already; stock already reserved by accepted orders is not given back
+func (s *inventoryStore) seed(stock map[string]int) {
+	for productID, units := range stock {
+		value, _ := s.products.LoadOrStore(productID, &productStock{})
+		row := value.(*productStock)
+		row.mu.Lock()
+		row.units = units
+		row.mu.Unlock()
+	}
+}
+
+// statusBroadcaster wakes the event streams watching an order. Each stream
+// gets a one-slot channel; a wake-up is dropped if one is already pending
+// since the stream re-reads the current status anyway.
+type statusBroadcaster struct {
+	mu          sync.Mutex
+	subscribers map[string]map[chan struct{}]struct{}
+}
+
+func (b *statusBroadcaster) subscribe(orderID string) chan struct{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	
+	if b.subscribers == nil {
+		b.subscribers = make(map[string]map[chan struct{}]struct{})
+	}
+	if b.subscribers[orderID] == nil {
+		b.subscribers[orderID] = make(map[chan struct{}]struct{})
+	}
+	wake := make(chan struct{}, 1)
+	b.subscribers[orderID][wake] = struct{}{}
+	return wake
+}
+
+func (b *statusBroadcaster) unsubscribe(orderID string, wake chan struct{}) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	
+	delete(b.subscribers[orderID], wake)
+	if len(b.subscribers[orderID]) == 0 {
+		delete(b.subscribers, orderID)
+	}
+}
+
+func (b *statusBroadcaster) publish(orderID string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	
+	for wake := range b.subscribers[orderID] {
+		select {
+		case wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// streamLimiter caps concurrent event streams; max <= 0 means unlimited
+type streamLimiter struct {
+	max      int64
+	open     int64
+	rejected int64
+}
+
+func (l *streamLimiter) acquire() bool {
+	if open := atomic.AddInt64(&l.open, 1); l.max > 0 && open > l.max {
+		atomic.AddInt64(&l.open, -1)
+		atomic.AddInt64(&l.rejected, 1)
+		return false
+	}
+	return true
+}
+
+func (l *streamLimiter) release() {
+	atomic.AddInt64(&l.open, -1)
+}
+
+func (l *streamLimiter) status() map[string]interface{} {
+	return map[string]interface{}{
+		"open":     atomic.LoadInt64(&l.open),
+		"max":      l.max,
+		"rejected": loadCounter(&l.rejected),
+	}
+}
+
+// errSKUBusy means a product of an order kept every one of its slots taken
+// for the whole acquire timeout
+var errSKUBusy = errors.New("too many orders in flight for one product")
+
+// skuLimiter lets at most max orders per product be in flight at once:
+// reserved, stored and charged for sync orders, or reserved, stored and
+// published for async ones. Orders for a hot SKU take turns while orders
+// for other products go ahead in parallel. A product's slots are a
+// buffered channel that stays in the map only while an order holds or
+// waits for one of them.
+type skuLimiter struct {
+	max int
+	// Longest acquire waits for all of an order's products
+	wait time.Duration
+	
+	mu    sync.Mutex
+	slots map[string]*skuSlots
+	
+	waiting  int64
+	rejected int64
+}
+
+// skuSlots are one product's slots and the number of orders using them
+type skuSlots struct {
+	held chan struct{}
+	refs int
+}
+
+func newSKULimiter(max int, wait time.Duration) *skuLimiter {
+	return &skuLimiter{max: max, wait: wait, slots: make(map[string]*skuSlots)}
+}
+
+// use returns a product's slots, creating them for its first order
+func (l *skuLimiter) use(productID string) *skuSlots {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	slots := l.slots[productID]
+	if slots == nil {
+		slots = &skuSlots{held: make(chan struct{}, l.max)}
+		l.slots[productID] = slots
+	}
+	slots.refs++
+	return slots
+}
+
+// done drops an order's use of a product's slots, forgetting the product
+// once no order is using it
+func (l *skuLimiter) done(productID string, slots *skuSlots) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if slots.refs--; slots.refs == 0 {
+		delete(l.slots, productID)
+	}
+}
+
+// acquire takes a slot for each product in items, in product ID order so
+// two orders can't each hold a slot the other is waiting for. It gives up
+// with errSKUBusy once the wait passes, or with ctx's error if the caller
+// goes away, keeping nothing; otherwise release frees every slot taken.
+func (l *skuLimiter) acquire(ctx context.Context, items []Item) (release func(), err error) {
+	productIDs := make([]string, 0, len(items))
+	for _, item := range items {
+		productIDs = append(productIDs, item.ProductID)
+	}
+	sort.Strings(productIDs)
+	productIDs = slices.Compact(productIDs)
+	
+	taken := make([]*skuSlots, 0, len(productIDs))
+	release = func() {
+		for i, slots := range taken {
+			<-slots.held
+			l.done(productIDs[i], slots)
+		}
+	}
+	timer := time.NewTimer(l.wait)
+	defer timer.Stop()
+	for _, productID := range productIDs {
+		slots := l.use(productID)
+		if err := l.take(ctx, slots, timer.C); err != nil {
+			l.done(productID, slots)
+			release()
+			if errors.Is(err, errSKUBusy) {
+				err = fmt.Errorf("%w: %s is at its limit of %d", errSKUBusy, productID, l.max)
+			}
+			return nil, err
+		}
+		taken = append(taken, slots)
+	}
+	return release, nil
+}
+
+// take waits for one of a product's slots until timeout fires or ctx ends
+func (l *skuLimiter) take(ctx context.Context, slots *skuSlots, timeout <-chan time.Time) error {
+	select {
+	case slots.held <- struct{}{}:
+		return nil
+	default:
+	}
+	
+	atomic.AddInt64(&l.waiting, 1)
+	defer atomic.AddInt64(&l.waiting, -1)
+	select {
+	case slots.held <- struct{}{}:
+		return nil
+	case <-timeout:
+		atomic.AddInt64(&l.rejected, 1)
+		return errSKUBusy
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (l *skuLimiter) status() map[string]interface{} {
+	l.mu.Lock()
+	active := len(l.slots)
+	l.mu.Unlock()
+	return map[string]interface{}{
+		"enabled":            true,
+		"max_per_sku":        l.max,
+		"acquire_timeout_ms": l.wait.Milliseconds(),
+		"active_skus":        active,
+		"waiting":            atomic.LoadInt64(&l.waiting),
+		"rejected":           loadCounter(&l.rejected),
+	}
+}
+
+// skuBusyError answers an order whose products stayed busy: 503 with a
+// retry hint, or 499 if the client went away while it waited
+func skuBusyError(err error) *orderError {
+	if errors.Is(err, errSKUBusy) {
+		return &orderError{status: http.StatusServiceUnavailable, message: "Product busy, retry later: " + err.Error(), retryAfter: 1}
+	}
+	return rejectOrder(statusClientClosedRequest, "Client went away while waiting for a busy product")
+}
+
+// processorBackpressure sheds async orders while the order processor
+// reports its workers saturated at PROCESSOR_STATUS_URL, so a backlog the
+// workers can't clear is refused at the door instead of growing on the
+// queue. The processor's status is fetched at most once per ttl and shared
+// by concurrent orders. A status that can't be fetched or read sheds
+// nothing: losing the signal should not turn into an outage of its own.
+type processorBackpressure struct {
+	url       string
+	threshold float64
+	ttl       time.Duration
+	client    *http.Client
+	
+	mu         sync.Mutex
+	checkedAt  time.Time
+	saturation float64
+	lastError  string
+	
+	shed int64
+}
+
+// loadProcessorBackpressure reads PROCESSOR_STATUS_URL, returning nil
+// when it is unset, along with PROCESSOR_SATURATION_THRESHOLD (default
+// 0.9), the saturation from which orders are shed, and PROCESSOR_STATUS_TTL
+// (default 2s), how long one fetched status is reused
+func loadProcessorBackpressure() (*processorBackpressure, error) {
+	url := os.Getenv("PROCESSOR_STATUS_URL")
+	if url == "" {
+		return nil, nil
+	}
+	threshold := 0.9
+	if value := os.Getenv("PROCESSOR_SATURATION_THRESHOLD"); value != "" {
+		parsed, err := strconv.ParseFloat(value, 64)
+		if err != nil || parsed <= 0 || parsed > 1 {
+			return nil, fmt.Errorf("PROCESSOR_SATURATION_THRESHOLD must be a number above 0 and at most 1, got %q", value)
+		}
+		threshold = parsed
+	}
+	ttl := 2 * time.Second
+	if value := os.Getenv("PROCESSOR_STATUS_TTL"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 {
+			return nil, fmt.Errorf("PROCESSOR_STATUS_TTL must be a positive duration, got %q", value)
+		}
+		ttl = parsed
+	}
+	return &processorBackpressure{
+		url:       url,
+		threshold: threshold,
+		ttl:       ttl,
+		client:    &http.Client{Timeout: 500 * time.Millisecond},
+	}, nil
+}
+
+// saturated reports whether the processor's latest saturation is at or
+// above the threshold, fetching it again once the cached one is stale
+func (b *processorBackpressure) saturated(ctx context.Context) (bool, float64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.checkedAt.IsZero() || time.Since(b.checkedAt) >= b.ttl {
+		// One client hanging up shouldn't blank the reading for everyone
+		saturation, err := b.fetch(context.WithoutCancel(ctx))
+		b.saturation, b.lastError = saturation, ""
+		if err != nil {
+			b.saturation, b.lastError = 0, err.Error()
+			slog.Warn("Processor status unavailable, not shedding async orders", "url", b.url, "error", err)
+		}
+		b.checkedAt = time.Now()
+	}
+	return b.saturation >= b.threshold, b.saturation
+}
+
+// fetch reads the saturation from the processor's GET /status
+func (b *processorBackpressure) fetch(ctx context.Context) (float64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, b.url, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("processor status returned %s", resp.Status)
+	}
+	
+	var status struct {
+		Saturation *float64 `json:"saturation"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return 0, fmt.Errorf("decoding processor status: %w", err)
+	}
+	if status.Saturation == nil {
+		return 0, errors.New("processor status has no saturation")
+	}
+	return *status.Saturation, nil
+}
+
+// reading is the cached saturation without fetching a new one
+func (b *processorBackpressure) reading() float64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.saturation
+}
+
+func (b *processorBackpressure) status() map[string]interface{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	status := map[string]interface{}{
+		"enabled":    true,
+		"status_url": b.url,
+		"threshold":  b.threshold,
+		"ttl_ms":     b.ttl.Milliseconds(),
+		"saturation": b.saturation,
+		"shed":       loadCounter(&b.shed),
+	}
+	if !b.checkedAt.IsZero() {
+		status["checked_at"] = b.checkedAt.UTC().Format(time.RFC3339)
+	}
+	if b.lastError != "" {
+		status["last_error"] = b.lastError
+	}
+	return status
+}
+
+// errPublishBusy means every SNS publish slot stayed taken for the whole
+// acquire timeout
+var errPublishBusy = errors.New("too many SNS publishes in flight")
+
+// publishLimiter caps concurrent SNS publishes, so a burst of async orders
+// waits briefly for a slot and is then turned away instead of piling up
+// request goroutines inside Publish. A nil slots channel is unlimited but
+// still counts what is in flight.
+type publishLimiter struct {
+	slots chan struct{}
+	// Longest acquire waits for a slot
+	wait     time.Duration
+	inFlight int64
+	peak     int64
+	rejected int64
+}
+
+func newPublishLimiter(max int, wait time.Duration) *publishLimiter {
+	limiter := &publishLimiter{wait: wait}
+	if max > 0 {
+		limiter.slots = make(chan struct{}, max)
+	}
+	return limiter
+}
+
+// acquire takes a publish slot, giving up with errPublishBusy after the
+// wait or with ctx's error if the caller goes away first
+func (l *publishLimiter) acquire(ctx context.Context) error {
+	if l.slots != nil {
+		timer := time.NewTimer(l.wait)
+		defer timer.Stop()
+		select {
+		case l.slots <- struct{}{}:
+		case <-timer.C:
+			atomic.AddInt64(&l.rejected, 1)
+			return errPublishBusy
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	inFlight := atomic.AddInt64(&l.inFlight, 1)
+	for {
+		peak := atomic.LoadInt64(&l.peak)
+		if inFlight <= peak || atomic.CompareAndSwapInt64(&l.peak, peak, inFlight) {
+			break
+		}
+	}
+	return nil
+}
+
+func (l *publishLimiter) release() {
+	atomic.AddInt64(&l.inFlight, -1)
+	if l.slots != nil {
+		<-l.slots
+	}
+}
+
+func (l *publishLimiter) status() map[string]interface{} {
+	return map[string]interface{}{
+		"in_flight":          atomic.LoadInt64(&l.inFlight),
+		"peak_in_flight":     atomic.LoadInt64(&l.peak),
+		"max":                cap(l.slots),
+		"acquire_timeout_ms": l.wait.Milliseconds(),
+		"rejected":           loadCounter(&l.rejected),
+	}
+}
+
+// dependencyHealth tracks the outcome of recent calls to one AWS dependency
+type dependencyHealth struct {
+	mu          sync.Mutex
+	calls       int64
+	lastSuccess time.Time
+	lastError   string
+	lastErrorAt time.Time
+}
+
+// record notes the result of a single call to the dependency
+func (d *dependencyHealth) record(err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.calls++
+	if err != nil {
+		d.lastError = err.Error()
+		d.lastErrorAt = time.Now()
+	} else {
+		d.lastSuccess = time.Now()
+	}
+}
+
+// degraded reports whether the most recent call to the dependency failed
+func (d *dependencyHealth) degraded() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.lastErrorAt.After(d.lastSuccess)
+}
+
+// snapshot returns the dependency's last success and last error
+func (d *dependencyHealth) snapshot() map[string]interface{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	
+	status := "ok"
+	if d.calls == 0 {
+		status = "unknown"
+	} else if d.lastErrorAt.After(d.lastSuccess) {
+		status = "degraded"
+	}
+	snapshot := map[string]interface{}{
+		"status": status,
+		"calls":  d.calls,
+	}
+	if !d.lastSuccess.IsZero() {
+		snapshot["last_success"] = d.lastSuccess.UTC().Format(time.RFC3339)
+	}
+	if d.lastError != "" {
+		snapshot["last_error"] = d.lastError
+		snapshot["last_error_at"] = d.lastErrorAt.UTC().Format(time.RFC3339)
+	}
+	return snapshot
+}
+
+// readinessProbe caches the result of checking each dependency for ttl so
+// frequent /ready polling doesn't turn into a stream of AWS calls
+type readinessProbe struct {
+	ttl   time.Duration
+	check func(ctx context.Context) map[string]error
+	
+	mu        sync.Mutex
+	checkedAt time.Time
+	results   map[string]error
+}
+
+// last returns the cached check without running a new one; ok is false
+// until the first check has run
+func (r *readinessProbe) last() (results map[string]error, ok bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.results, !r.checkedAt.IsZero()
+}
+
+// result returns the latest check per dependency (nil error when
+// reachable), running the check again once the cached one is stale.
+// Concurrent callers share one check rather than each making their own.
+func (r *readinessProbe) result(ctx context.Context) (map[string]error, time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.checkedAt.IsZero() || time.Since(r.checkedAt) >= r.ttl {
+		r.results = r.check(ctx)
+		r.checkedAt = time.Now()
+	}
+	return r.results, r.checkedAt
+}
+
+// writeReadiness responds 200 when every dependency in results is
+// reachable, or 503 naming the ones that are not. Each dependency also
+// gets a top-level "ok" or "unavailable" field for simple probes.
+func writeReadiness(w http.ResponseWriter, results map[string]error, checkedAt time.Time) {
+	response := map[string]interface{}{}
+	dependencies := map[string]interface{}{}
+	failed := []string{}
+	for name, err := range results {
+		if err != nil {
+			dependencies[name] = err.Error()
+			response[name] = "unavailable"
+			failed = append(failed, name)
+		} else {
+			dependencies[name] = "ok"
+			response[name] = "ok"
+		}
+	}
+	sort.Strings(failed)
+	
+	status := "ready"
+	w.Header().Set("Content-Type", "application/json")
+	if len(failed) > 0 {
+		status = "not_ready"
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	response["status"] = status
+	response["dependencies"] = dependencies
+	response["failed"] = failed
+	response["checked_at"] = checkedAt.UTC().Format(time.RFC3339)
+	json.NewEncoder(w).Encode(response)
+}
+
+// OrderStore keeps the service's orders. The in-memory default is private
+// to one replica; with REDIS_ADDR the orders live in Redis, so whichever
+// replica a request lands on sees the same order.
+type OrderStore interface {
+	// Put saves order, replacing any stored order with its ID
+	Put(order *Order) error
+	// Get returns the stored order, or nil if there is none
+	Get(orderID string) (*Order, error)
+	// UpdateStatus moves order from status from to to, saving processedAt
+	// and leaseExpiresAt with it. If the stored order is no longer in from
+	// nothing is written and its status is returned along with
+	// errStatusChanged.
+	UpdateStatus(order *Order, from, to OrderStatus, processedAt, leaseExpiresAt *time.Time) (OrderStatus, error)
+	// Amend replaces a pending order's items and total, stamping amendedAt.
+	// If the stored order is no longer pending nothing is written and its
+	// status is returned along with errStatusChanged.
+	Amend(order *Order, items []Item, total float64, amendedAt time.Time) (OrderStatus, error)
+	// List returns the orders in status, or every order when status is ""
+	List(status OrderStatus) ([]*Order, error)
+	// Delete removes an order; deleting a missing order is not an error
+	Delete(orderID string) error
+}
+
+// memoryOrderStore keeps orders in this process. Get hands out the stored
+// pointer itself, so callers share one Order and statusMu guards its status.
+type memoryOrderStore struct {
+	orders sync.Map
+	// The service's statusMu, held by List while it filters on status
+	statusMu *sync.Mutex
+}
+
+func (m *memoryOrderStore) Put(order *Order) error {
+	m.orders.Store(order.OrderID, order)
+	return nil
+}
+
+func (m *memoryOrderStore) Get(orderID string) (*Order, error) {
+	value, exists := m.orders.Load(orderID)
+	if !exists {
+		return nil, nil
+	}
+	return value.(*Order), nil
+}
+
+// UpdateStatus changes order in place, as it is the stored order; the
+// caller holds statusMu, which makes the check and the write atomic
+func (m *memoryOrderStore) UpdateStatus(order *Order, from, to OrderStatus, processedAt, leaseExpiresAt *time.Time) (OrderStatus, error) {
+	if order.Status != from {
+		return order.Status, errStatusChanged
+	}
+	order.Status = to
+	order.ProcessedAt = processedAt
+	order.LeaseExpiresAt = leaseExpiresAt
+	return to, nil
+}
+
+// Amend changes order in place under statusMu, like UpdateStatus
+func (m *memoryOrderStore) Amend(order *Order, items []Item, total float64, amendedAt time.Time) (OrderStatus, error) {
+	if order.Status != StatusPending {
+		return order.Status, errStatusChanged
+	}
+	order.Items = items
+	order.Total = total
+	order.AmendedAt = &amendedAt
+	return StatusPending, nil
+}
+
+func (m *memoryOrderStore) List(status OrderStatus) ([]*Order, error) {
+	if status != "" && m.statusMu != nil {
+		m.statusMu.Lock()
+		defer m.statusMu.Unlock()
+	}
+	var orders []*Order
+	m.orders.Range(func(key, value interface{}) bool {
+		if order := value.(*Order); status == "" || order.Status == status {
+			orders = append(orders, order)
+		}
+		return true
+	})
+	return orders, nil
+}
+
+func (m *memoryOrderStore) Delete(orderID string) error {
+	m.orders.Delete(orderID)
+	return nil
+}
+
+// redisOrderStore shares orders between replicas. Each order is a hash at
+// order:<id> holding its JSON in data and its status in status, and its ID
+// is kept in orders:all and in the orders:status:<status> set for its
+// status. Writes that touch more than one key run as Lua scripts, so a
+// status and its index never disagree and two replicas (or a replica and
+// the processor's status reports) can't both win a status change.
+type redisOrderStore struct {
+	client *redis.Client
+}
+
+const (
+	redisOrdersKey       = "orders:all"
+	redisStatusKeyPrefix = "orders:status:"
+)
+
+func (r *redisOrderStore) key(orderID string) string {
+	return "order:" + orderID
+}
+
+// redisPutOrder writes an order and moves its ID to its status's set.
+// KEYS: order hash, orders:all. ARGV: JSON, status, order ID, status set
+// prefix. The status sets are derived in the script, so it needs a single
+// Redis node rather than a cluster.
+var redisPutOrder = redis.NewScript(`
+local previous = redis.call('HGET', KEYS[1], 'status')
+if previous then
+	redis.call('SREM', ARGV[4] .. previous, ARGV[3])
+end
+redis.call('HSET', KEYS[1], 'data', ARGV[1], 'status', ARGV[2])
+redis.call('SADD', ARGV[4] .. ARGV[2], ARGV[3])
+redis.call('SADD', KEYS[2], ARGV[3])
+return 1
+`)
+
+// redisUpdateStatus writes an order only if its stored status is still the
+// expected one, returning {1, new status} or {0, stored status}; {0, ""}
+// means the order isn't stored. KEYS: order hash. ARGV: expected status,
+// new status, JSON, order ID, status set prefix.
+var redisUpdateStatus = redis.NewScript(`
+local current = redis.call('HGET', KEYS[1], 'status')
+if not current then
+	return {0, ''}
+end
+if current ~= ARGV[1] then
+	return {0, current}
+end
+redis.call('HSET', KEYS[1], 'data', ARGV[3], 'status', ARGV[2])
+redis.call('SMOVE', ARGV[5] .. ARGV[1], ARGV[5] .. ARGV[2], ARGV[4])
+return {1, ARGV[2]}
+`)
+
+// redisDeleteOrder removes an order and its ID from every set. KEYS: order
+// hash, orders:all. ARGV: order ID, status set prefix.
+var redisDeleteOrder = redis.NewScript(`
+local status = redis.call('HGET', KEYS[1], 'status')
+if status then
+	redis.call('SREM', ARGV[2] .. status, ARGV[1])
+end
+redis.call('SREM', KEYS[2], ARGV[1])
+redis.call('DEL', KEYS[1])
+return 1
+`)
+
+func (r *redisOrderStore) Put(order *Order) error {
+	data, err := json.Marshal(order)
+	if err != nil {
+		return fmt.Errorf("failed to encode order %s: %w", order.OrderID, err)
+	}
+	err = redisPutOrder.Run(context.TODO(), r.client, []string{r.key(order.OrderID), redisOrdersKey},
+		data, string(order.Status), order.OrderID, redisStatusKeyPrefix).Err()
+	if err != nil {
+		return fmt.Errorf("failed to store order %s: %w", order.OrderID, err)
+	}
+	return nil
+}
+
+func (r *redisOrderStore) Get(orderID string) (*Order, error) {
+	data, err := r.client.HGet(context.TODO(), r.key(orderID), "data").Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up order %s: %w", orderID, err)
+	}
+	var order Order
+	if err := json.Unmarshal(data, &order); err != nil {
+		return nil, fmt.Errorf("failed to decode order %s: %w", orderID, err)
+	}
+	return &order, nil
+}
+
+func (r *redisOrderStore) UpdateStatus(order *Order, from, to OrderStatus, processedAt, leaseExpiresAt *time.Time) (OrderStatus, error) {
+	updated := *order
+	updated.Status = to
+	updated.ProcessedAt = processedAt
+	updated.LeaseExpiresAt = leaseExpiresAt
+	return r.replace(&updated, from)
+}
+
+func (r *redisOrderStore) Amend(order *Order, items []Item, total float64, amendedAt time.Time) (OrderStatus, error) {
+	amended := *order
+	amended.Status = StatusPending
+	amended.Items = items
+	amended.Total = total
+	amended.AmendedAt = &amendedAt
+	return r.replace(&amended, StatusPending)
+}
+
+// replace writes updated over the stored order if that is still in status
+// from, moving it to updated's status
+func (r *redisOrderStore) replace(updated *Order, from OrderStatus) (OrderStatus, error) {
+	data, err := json.Marshal(updated)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode order %s: %w", updated.OrderID, err)
+	}
+	result, err := redisUpdateStatus.Run(context.TODO(), r.client, []string{r.key(updated.OrderID)},
+		string(from), string(updated.Status), data, updated.OrderID, redisStatusKeyPrefix).Slice()
+	if err != nil {
+		return "", fmt.Errorf("failed to update order %s: %w", updated.OrderID, err)
+	}
+	applied, _ := result[0].(int64)
+	stored, _ := result[1].(string)
+	switch {
+	case applied == 1:
+		return updated.Status, nil
+	case stored == "":
+		return "", fmt.Errorf("failed to update order %s: not in the order store", updated.OrderID)
+	default:
+		return OrderStatus(stored), errStatusChanged
+	}
+}
+
+func (r *redisOrderStore) List(status OrderStatus) ([]*Order, error) {
+	set := redisOrdersKey
+	if status != "" {
+		set = redisStatusKeyPrefix + string(status)
+	}
+	ids, err := r.client.SMembers(context.TODO(), set).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list orders: %w", err)
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	
+	pipe := r.client.Pipeline()
+	lookups := make([]*redis.StringCmd, len(ids))
+	for i, id := range ids {
+		lookups[i] = pipe.HGet(context.TODO(), r.key(id), "data")
+	}
+	// A missing hash only means the order was deleted after SMEMBERS
+	if _, err := pipe.Exec(context.TODO()); err != nil && !errors.Is(err, redis.Nil) {
+		return nil, fmt.Errorf("failed to list orders: %w", err)
+	}
+	orders := make([]*Order, 0, len(ids))
+	for i, lookup := range lookups {
+		data, err := lookup.Bytes()
+		if err != nil {
+			continue
+		}
+		var order Order
+		if err := json.Unmarshal(data, &order); err != nil {
+			return nil, fmt.Errorf("failed to decode order %s: %w", ids[i], err)
+		}
+		orders = append(orders, &order)
+	}
+	return orders, nil
+}
+
+func (r *redisOrderStore) Delete(orderID string) error {
+	err := redisDeleteOrder.Run(context.TODO(), r.client, []string{r.key(orderID), redisOrdersKey}, orderID, redisStatusKeyPrefix).Err()
+	if err != nil {
+		return fmt.Errorf("failed to delete order %s: %w", orderID, err)
+	}
+	return nil
+}
+
+// newRedisOrderStore connects to the Redis at addr, authenticating with
+// REDIS_PASSWORD when set
+func newRedisOrderStore(addr string, db int) *redisOrderStore {
+	return &redisOrderStore{client: redis.NewClient(&redis.Options{
+		Addr:     addr,
+		Password: os.Getenv("REDIS_PASSWORD"),
+		DB:       db,
+	})}
+}
+
+// loadOrderStore keeps orders in Redis at REDIS_ADDR (with REDIS_PASSWORD
+// and REDIS_DB, when set), or in memory when REDIS_ADDR is unset
+func loadOrderStore() (OrderStore, error) {
+	addr := os.Getenv("REDIS_ADDR")
+	if addr == "" {
+		return &memoryOrderStore{}, nil
+	}
+	db, err := envInt("REDIS_DB", 0)
+	if err != nil {
+		return nil, err
+	}
+	return newRedisOrderStore(addr, db), nil
+}
+
+// switchableOrderStore is the service's order store. It passes every call
+// to the store the service started with, until POST /admin/store/migrate
+// moves the service from memory onto Redis while it runs.
+type switchableOrderStore struct {
+	mu    sync.RWMutex
+	store OrderStore
+}
+
+// active is the store calls currently go to
+func (w *switchableOrderStore) active() OrderStore {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.store
+}
+
+// switchTo sends every later call to store
+func (w *switchableOrderStore) switchTo(store OrderStore) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.store = store
+}
+
+func (w *switchableOrderStore) Put(order *Order) error {
+	return w.active().Put(order)
+}
+
+func (w *switchableOrderStore) Get(orderID string) (*Order, error) {
+	return w.active().Get(orderID)
+}
+
+func (w *switchableOrderStore) UpdateStatus(order *Order, from, to OrderStatus, processedAt, leaseExpiresAt *time.Time) (OrderStatus, error) {
+	return w.active().UpdateStatus(order, from, to, processedAt, leaseExpiresAt)
+}
+
+func (w *switchableOrderStore) Amend(order *Order, items []Item, total float64, amendedAt time.Time) (OrderStatus, error) {
+	return w.active().Amend(order, items, total, amendedAt)
+}
+
+func (w *switchableOrderStore) List(status OrderStatus) ([]*Order, error) {
+	return w.active().List(status)
+}
+
+func (w *switchableOrderStore) Delete(orderID string) error {
+	return w.active().Delete(orderID)
+}
+
+// OrderService handles order processing
+type OrderService struct {
+	snsClient   *sns.Client
+	snsTopicArn string
+	// FIFO topics need a message group and deduplication ID on publish
+	fifo bool
+	// Orders totalling more than this, or placed by a customer in
+	// vipCustomers (VIP_CUSTOMER_IDS), publish with priority=high so an SNS
+	// filter policy can route them to the processor's high-priority queue
+	highValueThreshold float64
+	vipCustomers       map[int]bool
+	// Outcome of recent SNS publishes, reported by /metrics
+	snsHealth dependencyHealth
+	// Cached SNS reachability check served at /ready
+	readiness readinessProbe
+	
+	// Payment processor with limited throughput (simulates bottleneck)
+	paymentSemaphore *paymentScheduler
+	paymentDelay     paymentDelayConfig
+	payments         PaymentGateway
+	paymentFailures  paymentFailureCounts
+	slo              *sloTracker
+	chaos            *chaosInjector
+	currency         currencyConfig
+	
+	// Metrics
+	syncOrders       int64
+	asyncOrders      int64
+	failedOrders     int64
+	processedOrders  int64
+	cancelledOrders  int64
+	amendedOrders    int64
+	rejectedOrders   int64 // sync orders turned away while payment was busy
+	partialOrders    int64 // orders that reached partially_fulfilled
+	backorderedUnits int64
+	revenueCents     int64 // totals of completed orders
+	startTime        time.Time
+	
+	// Prometheus view of the counters above, served at /metrics/prometheus
+	promRegistry   *prometheus.Registry
+	paymentSeconds prometheus.Histogram
+	
+	// Order storage; statusMu serializes status transitions that race
+	orders   *switchableOrderStore
+	statusMu sync.Mutex
+	
+	// Wakes GET /orders/{id}/events streams when an order's status changes
+	statusEvents    statusBroadcaster
+	streams         streamLimiter
+	streamHeartbeat time.Duration
+	streamIdle      time.Duration
+	// Delivers callback_url notifications (nil unless WEBHOOK_SECRET is set)
+	webhooks *webhookNotifier
+	// Source of order IDs
+	newOrderID func() (string, error)
+	// Remaining stock for limited products
+	inventory *inventoryStore
+	// Anti-hoarding cap on a single line item's quantity (zero disables)
+	maxQuantityPerItem int
+	// Caps on an order's line items and total quantity
+	limits orderLimits
+	// Payment retries allowed per failed order
+	maxRetries int
+	
+	// Bulk import limits
+	importMaxOrders int
+	importRate      int
+	// Largest JSON request body accepted, from MAX_BODY_BYTES
+	maxBodyBytes int64
+	// HTTP server timeouts, from the HTTP_*_TIMEOUT variables
+	httpTimeouts serverTimeouts
+	// OpenAPI document served at /openapi.json
+	openAPISpec []byte
+	
+	// In-memory async workers used when SNS is not configured (nil if disabled)
+	fallback *fallbackPool
+	// Reject async orders with 503 when nothing could process them; on by
+	// default, ASYNC_STRICT=false stores such orders unqueued instead
+	asyncStrict bool
+	// When the sale was closed (unix nanos), or zero while it is open
+	saleClosedAt int64
+	// Longest a sync order may wait for and run its payment (zero disables)
+	paymentTimeout time.Duration
+	// Longest a sync order waits for a payment slot before it is turned
+	// away with 503 (negative waits indefinitely)
+	syncMaxWait time.Duration
+	// Whole seconds an async order may take before it fails (zero disables)
+	orderTimeoutSecs int
+	// Longest an SNS publish may take (zero disables)
+	publishTimeout time.Duration
+	// Caps concurrent SNS publishes (SNS_MAX_CONCURRENCY)
+	publishes *publishLimiter
+	// Caps orders in flight per product (nil if SKU_MAX_CONCURRENCY is unset)
+	skus *skuLimiter
+	// Sheds async orders while the processor is saturated (nil if
+	// PROCESSOR_STATUS_URL is unset)
+	backpressure *processorBackpressure
+	// Paces async order acceptance (nil if disabled)
+	admission *admissionSmoother
+	// Per-customer order rate limit for sync and async orders (nil if disabled)
+	customerLimits *customerRateLimiter
+	
+	// Server-side duplicate detection for clients that don't send
+	// idempotency keys: content hash -> *recentOrder (zero window disables)
+	contentDedupWindow time.Duration
+	recentOrders       sync.Map
+	contentDuplicates  int64
+	
+	// Best-effort guard against sync retries from clients that don't send
+	// idempotency keys: within syncResultWindow, a sync order with the same
+	// content hash gets the earlier order's result (waiting for it if still
+	// in flight) instead of a second charge. Failed payments are not cached,
+	// and a genuine repeat purchase inside the window is indistinguishable
+	// from a retry, so keep the window short. Zero disables.
+	syncResultWindow time.Duration
+	recentSyncOrders sync.Map
+	syncCacheHits    int64
+	
+	// Client-supplied Idempotency-Key -> *recentOrder for the first request
+	// that used it, kept for idempotencyTTL
+	idempotencyTTL  time.Duration
+	idempotencyKeys sync.Map
+	keyReplays      int64
+	
+	// A processing order carries a lease expiry in the order store, renewed
+	// while the order is being worked here or by a processor reporting it
+	// processing again, so an expired lease means the owner died and the
+	// order is stalled
+	processingLease time.Duration
+	stalledOrders   int64
+	
+	// Orders still pending pendingTTL after they were due are expired every
+	// pendingReapInterval, releasing their stock if expireReleases is set
+	pendingTTL          time.Duration
+	pendingReapInterval time.Duration
+	expireReleases      bool
+	expiredOrders       int64
+}
+
+// NewOrderService creates a new order service
+func NewOrderService() (*OrderService, error) {
+	paymentDelay, err := loadPaymentDelayConfig()
+	if err != nil {
+		return nil, err
+	}
+	
+	payments, err := loadPaymentGateway()
+	if err != nil {
+		return nil, err
+	}
+	
+	currency, err := loadCurrencyConfig()
+	if err != nil {
+		return nil, err
+	}
+	
+	maxBodyBytes, err := envInt("MAX_BODY_BYTES", 1<<20)
+	if err != nil {
+		return nil, err
+	}
+	if maxBodyBytes == 0 {
+		return nil, errors.New("MAX_BODY_BYTES must be positive")
+	}
+	httpTimeouts, err := loadServerTimeouts()
+	if err != nil {
+		return nil, err
+	}
+	openAPISpec, err := buildOpenAPISpec()
+	if err != nil {
+		return nil, fmt.Errorf("failed to build OpenAPI spec: %w", err)
+	}
+	
+	importMaxOrders, err := envInt("IMPORT_MAX_ORDERS", 10000)
+	if err != nil {
+		return nil, err
+	}
+	importRate, err := envInt("IMPORT_RATE", 50)
+	if err != nil {
+		return nil, err
+	}
+	
+	processingLease := 2 * time.Minute
+	if value := os.Getenv("PROCESSING_LEASE"); value != "" {
+		if processingLease, err = time.ParseDuration(value); err != nil || processingLease < minProcessingLease {
+			return nil, fmt.Errorf("PROCESSING_LEASE must be a duration of at least %s, got %q", minProcessingLease, value)
+		}
+	}
+	
+	pendingTTL := 10 * time.Minute
+	if value := os.Getenv("PENDING_TTL"); value != "" {
+		if pendingTTL, err = time.ParseDuration(value); err != nil || pendingTTL < 0 {
+			return nil, fmt.Errorf("PENDING_TTL must be a non-negative duration, got %q", value)
+		}
+	}
+	pendingReapInterval := time.Minute
+	if value := os.Getenv("PENDING_REAP_INTERVAL"); value != "" {
+		if pendingReapInterval, err = time.ParseDuration(value); err != nil || pendingReapInterval <= 0 {
+			return nil, fmt.Errorf("PENDING_REAP_INTERVAL must be a positive duration, got %q", value)
+		}
+	}
+	
+	syncRatio, err := envInt("PAYMENT_SYNC_RATIO", 3)
+	if err != nil {
+		return nil, err
+	}
+	asyncMaxWait := 30 * time.Second
+	if value := os.Getenv("PAYMENT_ASYNC_MAX_WAIT"); value != "" {
+		if asyncMaxWait, err = time.ParseDuration(value); err != nil || asyncMaxWait < 0 {
+			return nil, fmt.Errorf("PAYMENT_ASYNC_MAX_WAIT must be a non-negative duration, got %q", value)
+		}
+	}
+	
+	var contentDedupWindow time.Duration
+	if value := os.Getenv("CONTENT_DEDUP_WINDOW"); value != "" {
+		if contentDedupWindow, err = time.ParseDuration(value); err != nil || contentDedupWindow < 0 {
+			return nil, fmt.Errorf("CONTENT_DEDUP_WINDOW must be a non-negative duration, got %q", value)
+		}
+	}
+	
+	acceptRate, err := envInt("ACCEPT_RATE", 0)
+	if err != nil {
+		return nil, err
+	}
+	acceptBurst, err := envInt("ACCEPT_BURST", acceptRate)
+	if err != nil {
+		return nil, err
+	}
+	var highValueThreshold float64
+	if value := os.Getenv("HIGH_VALUE_THRESHOLD"); value != "" {
+		if highValueThreshold, err = strconv.ParseFloat(value, 64); err != nil || highValueThreshold < 0 {
+			return nil, fmt.Errorf("HIGH_VALUE_THRESHOLD must be a non-negative number, got %q", value)
+		}
+	}
+	vipCustomers := map[int]bool{}
+	for _, field := range strings.Split(os.Getenv("VIP_CUSTOMER_IDS"), ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+		id, err := strconv.Atoi(field)
+		if err != nil || id <= 0 {
+			return nil, fmt.Errorf("VIP_CUSTOMER_IDS must be comma-separated positive customer IDs, got %q", field)
+		}
+		vipCustomers[id] = true
+	}
+	
+	rateLimitRPS, err := envInt("RATE_LIMIT_RPS", 0)
+	if err != nil {
+		return nil, err
+	}
+	rateLimitBurst, err := envInt("RATE_LIMIT_BURST", rateLimitRPS)
+	if err != nil {
+		return nil, err
+	}
+	var acceptMaxWait time.Duration
+	if value := os.Getenv("ACCEPT_MAX_WAIT"); value != "" {
+		if acceptMaxWait, err = time.ParseDuration(value); err != nil || acceptMaxWait < 0 {
+			return nil, fmt.Errorf("ACCEPT_MAX_WAIT must be a non-negative duration, got %q", value)
+		}
+	}
+	
+	maxQuantityPerItem, err := envInt("MAX_QUANTITY_PER_ITEM", 10)
+	if err != nil {
+		return nil, err
+	}
+	maxItems, err := envInt("MAX_ITEMS", 50)
+	if err != nil {
+		return nil, err
+	}
+	maxQuantity, err := envInt("MAX_QUANTITY", 1000)
+	if err != nil {
+		return nil, err
+	}
+	maxRetries, err := envInt("MAX_RETRIES", 3)
+	if err != nil {
+		return nil, err
+	}
+	
+	var paymentTimeout time.Duration
+	if value := os.Getenv("PAYMENT_TIMEOUT"); value != "" {
+		if paymentTimeout, err = time.ParseDuration(value); err != nil || paymentTimeout < 0 {
+			return nil, fmt.Errorf("PAYMENT_TIMEOUT must be a non-negative duration, got %q", value)
+		}
+	}
+	// Unset keeps sync orders queueing for as long as it takes
+	syncMaxWait := time.Duration(-1)
+	if value := os.Getenv("PAYMENT_SYNC_MAX_WAIT"); value != "" {
+		if syncMaxWait, err = time.ParseDuration(value); err != nil || syncMaxWait < 0 {
+			return nil, fmt.Errorf("PAYMENT_SYNC_MAX_WAIT must be a non-negative duration, got %q", value)
+		}
+	}
+	
+	maxStreams, err := envInt("MAX_STREAM_CONNS", 1000)
+	if err != nil {
+		return nil, err
+	}
+	streamHeartbeat := 15 * time.Second
+	if value := os.Getenv("STREAM_HEARTBEAT"); value != "" {
+		if streamHeartbeat, err = time.ParseDuration(value); err != nil || streamHeartbeat <= 0 {
+			return nil, fmt.Errorf("STREAM_HEARTBEAT must be a positive duration, got %q", value)
+		}
+	}
+	streamIdle := 5 * time.Minute
+	if value := os.Getenv("STREAM_IDLE_TIMEOUT"); value != "" {
+		if streamIdle, err = time.ParseDuration(value); err != nil || streamIdle <= 0 {
+			return nil, fmt.Errorf("STREAM_IDLE_TIMEOUT must be a positive duration, got %q", value)
+		}
+	}
+	
+	webhooks, err := newWebhookNotifier()
+	if err != nil {
+		return nil, err
+	}
+	
+	readyCacheTTL := 5 * time.Second
+	if value := os.Getenv("READY_CACHE_TTL"); value != "" {
+		if readyCacheTTL, err = time.ParseDuration(value); err != nil || readyCacheTTL < 0 {
+			return nil, fmt.Errorf("READY_CACHE_TTL must be a non-negative duration, got %q", value)
+		}
+	}
+	
+	var orderTimeoutSecs int
+	if value := os.Getenv("ORDER_PROCESSING_TIMEOUT"); value != "" {
+		timeout, err := time.ParseDuration(value)
+		if err != nil || timeout < 0 {
+			return nil, fmt.Errorf("ORDER_PROCESSING_TIMEOUT must be a non-negative duration, got %q", value)
+		}
+		orderTimeoutSecs = int(math.Ceil(timeout.Seconds()))
+	}
+	
+	publishTimeout := 5 * time.Second
+	if value := os.Getenv("SNS_PUBLISH_TIMEOUT"); value != "" {
+		if publishTimeout, err = time.ParseDuration(value); err != nil || publishTimeout < 0 {
+			return nil, fmt.Errorf("SNS_PUBLISH_TIMEOUT must be a non-negative duration, got %q", value)
+		}
+	}
+	// Zero leaves SNS publishes unlimited
+	publishConcurrency, err := envInt("SNS_MAX_CONCURRENCY", 100)
+	if err != nil {
+		return nil, err
+	}
+	skuConcurrency, err := envInt("SKU_MAX_CONCURRENCY", 0)
+	if err != nil {
+		return nil, err
+	}
+	skuAcquireTimeout := time.Second
+	if value := os.Getenv("SKU_ACQUIRE_TIMEOUT"); value != "" {
+		if skuAcquireTimeout, err = time.ParseDuration(value); err != nil || skuAcquireTimeout < 0 {
+			return nil, fmt.Errorf("SKU_ACQUIRE_TIMEOUT must be a non-negative duration, got %q", value)
+		}
+	}
+	publishAcquireTimeout := 250 * time.Millisecond
+	if value := os.Getenv("SNS_ACQUIRE_TIMEOUT"); value != "" {
+		if publishAcquireTimeout, err = time.ParseDuration(value); err != nil || publishAcquireTimeout < 0 {
+			return nil, fmt.Errorf("SNS_ACQUIRE_TIMEOUT must be a non-negative duration, got %q", value)
+		}
+	}
+	
+	idempotencyTTL := 24 * time.Hour
+	if value := os.Getenv("IDEMPOTENCY_TTL"); value != "" {
+		if idempotencyTTL, err = time.ParseDuration(value); err != nil || idempotencyTTL <= 0 {
+			return nil, fmt.Errorf("IDEMPOTENCY_TTL must be a positive duration, got %q", value)
+		}
+	}
+	
+	var syncResultWindow time.Duration
+	if value := os.Getenv("SYNC_RESULT_CACHE_WINDOW"); value != "" {
+		if syncResultWindow, err = time.ParseDuration(value); err != nil || syncResultWindow < 0 {
+			return nil, fmt.Errorf("SYNC_RESULT_CACHE_WINDOW must be a non-negative duration, got %q", value)
+		}
+	}
+	
+	inventory, err := loadInventory()
+	if err != nil {
+		return nil, err
+	}
+	
+	fallbackWorkers, err := envInt("LOCAL_ASYNC_WORKERS", 0)
+	if err != nil {
+		return nil, err
+	}
+	fallbackQueueSize, err := envInt("LOCAL_ASYNC_QUEUE_SIZE", 1000)
+	if err != nil {
+		return nil, err
+	}
+	
+	orders, err := loadOrderStore()
+	if err != nil {
+		return nil, err
+	}
+	
+	slo, err := loadSLOTracker()
+	if err != nil {
+		return nil, err
+	}
+	backpressure, err := loadProcessorBackpressure()
+	if err != nil {
+		return nil, err
+	}
+	
+	// Initialize AWS config
+	cfg, err := config.LoadDefaultConfig(context.TODO(),
+		config.WithRegion(os.Getenv("AWS_REGION")),
+	)
+	if err != nil {
+		slog.Warn("Failed to load AWS config", "error", err)
+	}
+	
+	snsTopicArn := os.Getenv("SNS_TOPIC_ARN")
+	fifo, fifoErr := fifoMode(snsTopicArn)
+	if fifoErr != nil {
+		return nil, fifoErr
+	}
+	
+	service := &OrderService{
+		snsTopicArn: snsTopicArn,
+		fifo:        fifo,
+		// Payment processor can handle only 1 concurrent request (creates bottleneck)
+		paymentSemaphore:   newPaymentScheduler(1, syncRatio, asyncMaxWait),
+		paymentDelay:       paymentDelay,
+		payments:           payments,
+		paymentFailures:    newPaymentFailureCounts(),
+		orders:             &switchableOrderStore{store: orders},
+		slo:                slo,
+		backpressure:       backpressure,
+		chaos:              loadChaosInjector(),
+		currency:           currency,
+		newOrderID:         generateOrderID,
+		inventory:          inventory,
+		maxQuantityPerItem: maxQuantityPerItem,
+		limits:             orderLimits{maxItems: maxItems, maxQuantity: maxQuantity},
+		maxRetries:         maxRetries,
+		importMaxOrders:    importMaxOrders,
+		importRate:         importRate,
+		maxBodyBytes:       int64(maxBodyBytes),
+		httpTimeouts:       httpTimeouts,
+		openAPISpec:        openAPISpec,
+		startTime:          time.Now(),
+		processingLease:    processingLease,
+		pendingTTL:         pendingTTL,
+		expireReleases:     os.Getenv("EXPIRE_RELEASE_INVENTORY") != "false",
+		asyncStrict:        os.Getenv("ASYNC_STRICT") != "false",
+		paymentTimeout:     paymentTimeout,
+		syncMaxWait:        syncMaxWait,
+		orderTimeoutSecs:   orderTimeoutSecs,
+		publishTimeout:     publishTimeout,
+		publishes:          newPublishLimiter(publishConcurrency, publishAcquireTimeout),
+		contentDedupWindow: contentDedupWindow,
+		syncResultWindow:   syncResultWindow,
+		idempotencyTTL:     idempotencyTTL,
+		streams:            streamLimiter{max: int64(maxStreams)},
+		streamHeartbeat:    streamHeartbeat,
+		streamIdle:         streamIdle,
+		webhooks:           webhooks,
+		highValueThreshold: highValueThreshold,
+		vipCustomers:       vipCustomers,
+	}
+	service.readiness = readinessProbe{ttl: readyCacheTTL, check: service.checkDependencies}
+	if memory, ok := orders.(*memoryOrderStore); ok {
+		memory.statusMu = &service.statusMu
+	}
+	
+	// Only initialize SNS client if we have AWS config
+	if err == nil {
+		if err := preflightRegion(cfg.Region, service.snsTopicArn); err != nil {
+			return nil, err
+		}
+		service.snsClient = sns.NewFromConfig(cfg)
+	}
+	
+	if acceptRate > 0 {
+		service.admission = newAdmissionSmoother(acceptRate, max(acceptBurst, 1), acceptMaxWait)
+	}
+	if skuConcurrency > 0 {
+		service.skus = newSKULimiter(skuConcurrency, skuAcquireTimeout)
+	}
+	if rateLimitRPS > 0 {
+		service.customerLimits = newCustomerRateLimiter(rateLimitRPS, max(rateLimitBurst, 1))
+		go service.customerLimits.sweepLoop(time.Minute)
+	}
+	
+	go service.reapStalledOrders()
+	if pendingTTL > 0 {
+		service.pendingReapInterval = pendingReapInterval
+		go service.reapPendingOrders()
+	}
+	if contentDedupWindow > 0 {
+		go sweepRecentOrders(&service.recentOrders, contentDedupWindow)
+	}
+	if syncResultWindow > 0 {
+		go sweepRecentOrders(&service.recentSyncOrders, syncResultWindow)
+	}
+	go sweepRecentOrders(&service.idempotencyKeys, idempotencyTTL)
+	service.registerPrometheus()
+	
+	// Fall back to in-process async workers when there is no queue
+	if !service.snsConfigured() && fallbackWorkers > 0 {
+		service.startFallbackPool(fallbackWorkers, fallbackQueueSize)
+	}
+	
+	return service, nil
+}
+
+// generateOrderID returns a random UUID, reporting an error instead of
+// panicking when the system's random source is unavailable
+func generateOrderID() (string, error) {
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return "", fmt.Errorf("failed to generate order ID: %w", err)
+	}
+	return id.String(), nil
+}
+
+// regionFromTopicArn extracts the region from an SNS topic ARN of the form
+// arn:<partition>:sns:<region>:<account>:<topic>
+func regionFromTopicArn(topicArn string) (string, error) {
+	parts := strings.Split(topicArn, ":")
+	if len(parts) != 6 || parts[0] != "arn" || parts[2] != "sns" || parts[3] == "" {
+		return "", fmt.Errorf("malformed SNS topic ARN %q", topicArn)
+	}
+	return parts[3], nil
+}
+
+// preflightRegion fails fast when SNS_TOPIC_ARN belongs to a different
+// region than the AWS client, a common copy-paste misconfiguration that
+// otherwise surfaces as confusing publish errors. SKIP_PREFLIGHT=true
+// disables the check for local development.
+func preflightRegion(configured, topicArn string) error {
+	if os.Getenv("SKIP_PREFLIGHT") == "true" || topicArn == "" || configured == "" {
+		return nil
+	}
+	
+	topicRegion, err := regionFromTopicArn(topicArn)
+	if err != nil {
+		return fmt.Errorf("preflight: %w", err)
+	}
+	if topicRegion != configured {
+		return fmt.Errorf("preflight: SNS_TOPIC_ARN is in region %s but AWS_REGION is %s", topicRegion, configured)
+	}
+	return nil
+}
+
+// snsConfigured reports whether async orders can be published to SNS
+func (s *OrderService) snsConfigured() bool {
+	return s.snsClient != nil && s.snsTopicArn != ""
+}
+
+// startFallbackPool launches the in-memory async workers
+func (s *OrderService) startFallbackPool(workers, queueSize int) {
+	pool := &fallbackPool{queue: make(chan *Order, queueSize)}
+	for i := 0; i < workers; i++ {
+		pool.wg.Add(1)
+		go func() {
+			defer pool.wg.Done()
+			for order := range pool.queue {
+				atomic.AddInt64(&pool.inFlight, 1)
+				s.processLocalOrder(order)
+				atomic.AddInt64(&pool.inFlight, -1)
+			}
+		}()
+	}
+	s.fallback = pool
+	slog.Info("SNS not configured, processing async orders locally", "workers", workers)
+}
+
+// recentOrder remembers when an order with a given content hash was accepted
+type recentOrder struct {
+	orderID    string
+	acceptedAt time.Time
+	
+	// Sync orders only: done is closed once statusCode and either response
+	// (success) or message (failure) hold the order's result
+	done       chan struct{}
+	statusCode int
+	response   map[string]interface{}
+	message    string
+}
+
+// complete records a sync order's result and wakes retries waiting on it
+func (o *recentOrder) complete(statusCode int, response map[string]interface{}, message string) {
+	o.statusCode = statusCode
+	o.response = response
+	o.message = message
+	close(o.done)
+}
+
+// orderContentHash fingerprints an order by customer, items (in a stable
+// order) and total, so resubmitting the same cart yields the same hash
+func orderContentHash(order *Order) string {
+	items := append([]Item(nil), order.Items...)
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].ProductID != items[j].ProductID {
+			return items[i].ProductID < items[j].ProductID
+		}
+		if items[i].Quantity != items[j].Quantity {
+			return items[i].Quantity < items[j].Quantity
+		}
+		return items[i].Price < items[j].Price
+	})
+	
+	h := sha256.New()
+	fmt.Fprintf(h, "%d|%s|", order.CustomerID, order.Currency)
+	for _, item := range items {
+		fmt.Fprintf(h, "%s:%d:%d|", item.ProductID, item.Quantity, toCents(item.Price))
+	}
+	fmt.Fprintf(h, "%d", toCents(order.OrderTotal()))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// claimContent records candidate as the owner of hash in recent unless an
+// identical order was accepted within window, in which case that earlier
+// order is returned instead. Safe for concurrent identical submissions.
+func claimContent(recent *sync.Map, window time.Duration, hash string, candidate *recentOrder) (previous *recentOrder, duplicate bool) {
+	for {
+		actual, loaded := recent.LoadOrStore(hash, candidate)
+		if !loaded {
+			return nil, false
+		}
+		previous := actual.(*recentOrder)
+		if time.Since(previous.acceptedAt) < window {
+			return previous, true
+		}
+		// The earlier order is outside the window, so this is a new purchase
+		if recent.CompareAndSwap(hash, previous, candidate) {
+			return nil, false
+		}
+	}
+}
+
+// sweepRecentOrders forgets content hashes once they leave the window
+func sweepRecentOrders(recent *sync.Map, window time.Duration) {
+	ticker := time.NewTicker(window)
+	defer ticker.Stop()
+	
+	for range ticker.C {
+		recent.Range(func(key, value interface{}) bool {
+			if time.Since(value.(*recentOrder).acceptedAt) >= window {
+				recent.CompareAndDelete(key, value)
+			}
+			return true
+		})
+	}
+}
+
+// minProcessingLease keeps the lease long enough to be renewed over the
+// network, and its renewal and reaping tickers above zero
+const minProcessingLease = time.Second
+
+// holdLease keeps renewing the lease of an order this replica is charging
+// until the returned release func is called
+func (s *OrderService) holdLease(order *Order) (release func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(s.processingLease / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				s.UpdateStatus(order, StatusProcessing, StatusProcessing)
+			}
+		}
+	}()
+	
+	return func() { close(done) }
+}
+
+// reapStalledOrders marks processing orders whose lease expired as
+// "failed_stalled" for manual review. Orders still being worked, here or
+// by a processor, keep renewing their lease and are never touched; stalled
+// orders are not re-run automatically because the payment may already
+// have been charged.
+func (s *OrderService) reapStalledOrders() {
+	ticker := time.NewTicker(s.processingLease / 2)
+	defer ticker.Stop()
+	
+	for range ticker.C {
+		s.failStalledOrders(time.Now())
+	}
+}
+
+// failStalledOrders marks every processing order whose lease expired
+// before now as failed_stalled and returns how many it marked
+func (s *OrderService) failStalledOrders(now time.Time) int {
+	processing, err := s.orders.List(StatusProcessing)
+	if err != nil {
+		slog.Warn("Failed to list processing orders", "error", err)
+		return 0
+	}
+	stalled := 0
+	for _, order := range processing {
+		s.statusMu.Lock()
+		// Orders stored before leases were kept have none to go by
+		lease := order.LeaseExpiresAt
+		s.statusMu.Unlock()
+		if lease == nil || lease.After(now) {
+			continue
+		}
+		if s.UpdateStatus(order, StatusFailedStalled, StatusProcessing) != nil {
+			continue
+		}
+		stalled++
+		atomic.AddInt64(&s.stalledOrders, 1)
+		orderLogger(order.OrderID, order.RequestID).Warn("Order stalled in processing (lease expired), marked failed_stalled", "lease_expired_at", lease.UTC())
+	}
+	return stalled
+}
+
+// reapPendingOrders periodically expires orders that SNS never delivered or
+// that sat in a backed-up queue for longer than pendingTTL
+func (s *OrderService) reapPendingOrders() {
+	ticker := time.NewTicker(s.pendingReapInterval)
+	defer ticker.Stop()
+	
+	for range ticker.C {
+		if expired := s.expirePendingOrders(time.Now()); expired > 0 {
+			slog.Info("Expired pending orders", "count", expired, "pending_ttl", s.pendingTTL.String())
+		}
+	}
+}
+
+// expirePendingOrders moves every order pending for longer than pendingTTL
+// to expired and returns how many it moved. A scheduled order's age counts
+// from its process_after time rather than from when it was placed.
+func (s *OrderService) expirePendingOrders(now time.Time) int {
+	expired := 0
+	pending, err := s.orders.List(StatusPending)
+	if err != nil {
+		slog.Warn("Failed to list pending orders", "error", err)
+		return 0
+	}
+	for _, order := range pending {
+		due := order.CreatedAt
+		if order.ProcessAfter != nil && order.ProcessAfter.After(due) {
+			due = order.ProcessAfter.Time
+		}
+		if now.Sub(due) < s.pendingTTL {
+			continue
+		}
+		if s.UpdateStatus(order, StatusExpired, StatusPending) != nil {
+			continue
+		}
+		expired++
+		atomic.AddInt64(&s.expiredOrders, 1)
+		if s.expireReleases {
+			s.inventory.release(order.Items)
+		}
+		orderLogger(order.OrderID, order.RequestID).Warn("Pending order expired", "age", now.Sub(order.CreatedAt).Round(time.Second).String())
+	}
+	return expired
+}
+
+// processLocalOrder charges an async order taken from the fallback pool
+func (s *OrderService) processLocalOrder(order *Order) {
+	if s.UpdateStatus(order, StatusProcessing, StatusPending) != nil {
+		orderLogger(order.OrderID, order.RequestID).Info("Local async order no longer pending, skipping", "status", order.Status)
+		return
+	}
+	release := s.holdLease(order)
+	defer release()
+	
+	ctx := context.Background()
+	if deadline, ok := order.processingDeadline(); ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+	
+	logger := orderLogger(order.OrderID, order.RequestID)
+	startTime := time.Now()
+	err := s.ProcessPayment(ctx, laneAsync, order.OrderID, order.OrderTotal(), order.Currency)
+	s.paymentSeconds.Observe(time.Since(startTime).Seconds())
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			s.UpdateStatus(order, StatusFailedTimeout)
+			atomic.AddInt64(&s.failedOrders, 1)
+			logger.Warn("Local async order timed out, marked failed_timeout", "max_processing_seconds", order.MaxProcessingSeconds)
+			return
+		}
+		s.UpdateStatus(order, StatusFailed)
+		atomic.AddInt64(&s.failedOrders, 1)
+		logger.Error("Local async order failed", "error", err)
+		return
+	}
+	
+	now := time.Now()
+	order.ProcessedAt = &now
+	s.UpdateStatus(order, order.chargedStatus())
+	atomic.AddInt64(&s.processedOrders, 1)
+	atomic.AddInt64(&s.revenueCents, order.totalCents())
+	logger.Info("Local async order completed")
+}
+
+// ProcessPayment simulates payment verification with a delay that scales
+// with the order total. Callers queue for the payment slot in their lane
+// and give up their place, or the charge in progress, if ctx is cancelled.
+func (s *OrderService) ProcessPayment(ctx context.Context, lane paymentLane, orderID string, total float64, currency string) error {
+	// Acquire semaphore (blocks if at capacity); the span measures queueing
+	// delay separately from the charge itself
+	laneName := "sync"
+	if lane == laneAsync {
+		laneName = "async"
+	}
+	_, waitSpan := tracer.Start(ctx, "payment.semaphore_wait",
+		trace.WithAttributes(attribute.String("order.id", orderID), attribute.String("payment.lane", laneName)))
+	var err error
+	if lane == laneSync && s.syncMaxWait >= 0 {
+		err = s.paymentSemaphore.TryAcquire(ctx, lane, s.syncMaxWait)
+	} else {
+		err = s.paymentSemaphore.Acquire(ctx, lane)
+	}
+	waitSpan.End()
+	if err != nil {
+		return fmt.Errorf("gave up waiting for payment slot for order %s: %w", orderID, err)
+	}
+	defer s.paymentSemaphore.Release()
+	
+	ctx, span := tracer.Start(ctx, "payment.process", trace.WithAttributes(attribute.String("order.id", orderID)))
+	defer span.End()
+	
+	delay := s.chaos.delay(s.paymentDelay.delayFor(total))
+	logger := orderLogger(orderID, requestIDFrom(ctx))
+	logger.Info("Processing payment", "amount", total, "currency", currency, "delay", delay.String())
+	
+	// Simulate payment processing time; a caller that gives up (client gone
+	// or deadline passed) abandons the charge
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+		return fmt.Errorf("payment for order %s abandoned: %w", orderID, ctx.Err())
+	}
+	
+	if err := s.chaos.fail(orderID); err != nil {
+		return err
+	}
+	if err := s.payments.Charge(ctx, orderID, total); err != nil {
+		s.paymentFailures.record(err)
+		return err
+	}
+	
+	logger.Info("Payment processed successfully")
+	return nil
+}
+
+// requireJSON rejects request bodies that aren't declared as JSON with 415.
+// Parameters such as "; charset=utf-8" are accepted.
+func requireJSON(w http.ResponseWriter, r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/json" {
+		http.Error(w, "Unsupported Media Type: Content-Type must be application/json", http.StatusUnsupportedMediaType)
+		return false
+	}
+	return true
+}
+
+// decodeJSONBody decodes a JSON request body into v. Bodies over
+// maxBodyBytes and fields v doesn't declare are errors, which
+// writeBodyError turns into a response.
+func (s *OrderService) decodeJSONBody(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	r.Body = http.MaxBytesReader(w, r.Body, s.maxBodyBytes)
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(v)
+}
+
+// writeBodyError answers a decodeJSONBody error: 413 for an oversized body,
+// 400 naming the field for an unknown one, and 400 with message otherwise
+func writeBodyError(w http.ResponseWriter, err error, message string) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, fmt.Sprintf("Request body exceeds %d bytes", tooLarge.Limit), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if field, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+		http.Error(w, "Unknown field "+field, http.StatusBadRequest)
+		return
+	}
+	http.Error(w, message, http.StatusBadRequest)
+}
+
+// saleOpen reports whether new orders are being accepted
+func (s *OrderService) saleOpen() bool {
+	return atomic.LoadInt64(&s.saleClosedAt) == 0
+}
+
+// rateLimitError rejects the order with 429 when its customer, or the
+// client address for orders without one, is over its rate
+func (s *OrderService) rateLimitError(order *Order, client string) error {
+	if s.customerLimits == nil {
+		return nil
+	}
+	key := "ip:" + client
+	if order.CustomerID > 0 {
+		key = "customer:" + strconv.Itoa(order.CustomerID)
+	}
+	retryAfter, ok := s.customerLimits.allow(key)
+	if ok {
+		return nil
+	}
+	
+	return &orderError{
+		status:     http.StatusTooManyRequests,
+		message:    "Too many orders from this customer, retry later",
+		retryAfter: int(math.Ceil(retryAfter.Seconds())),
+	}
+}
+
+// saleStatus describes the sale lifecycle state for health and metrics
+func (s *OrderService) saleStatus() map[string]interface{} {
+	closedAt := atomic.LoadInt64(&s.saleClosedAt)
+	if closedAt == 0 {
+		return map[string]interface{}{"state": "open"}
+	}
+	return map[string]interface{}{
+		"state":     "closed",
+		"closed_at": time.Unix(0, closedAt).UTC().Format(time.RFC3339),
+	}
+}
+
+// HandleCloseSale stops new sync and async orders at once. Orders already
+// accepted keep draining; re-imports via /admin/orders/import are unaffected.
+func (s *OrderService) HandleCloseSale(w http.ResponseWriter, r *http.Request) {
+	if atomic.CompareAndSwapInt64(&s.saleClosedAt, 0, time.Now().UnixNano()) {
+		slog.Info("Sale closed, no longer accepting new orders")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.saleStatus())
+}
+
+// HandleOpenSale resumes accepting new orders
+func (s *OrderService) HandleOpenSale(w http.ResponseWriter, r *http.Request) {
+	if atomic.SwapInt64(&s.saleClosedAt, 0) != 0 {
+		slog.Info("Sale reopened, accepting new orders")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.saleStatus())
+}
+
+// HandleChaos replaces the chaos settings from a JSON body. failure_rate
+// (0-1) is required; latency_ms replaces the payment delay, and leaving it
+// out restores the normal delay.
+func (s *OrderService) HandleChaos(w http.ResponseWriter, r *http.Request) {
+	if !requireJSON(w, r) {
+		return
+	}
+	var request struct {
+		FailureRate *float64 `json:"failure_rate"`
+		LatencyMs   *int64   `json:"latency_ms"`
+	}
+	if err := s.decodeJSONBody(w, r, &request); err != nil {
+		writeBodyError(w, err, "Invalid request body")
+		return
+	}
+	if request.FailureRate == nil || *request.FailureRate < 0 || *request.FailureRate > 1 {
+		http.Error(w, "failure_rate must be between 0 and 1", http.StatusBadRequest)
+		return
+	}
+	var latency *time.Duration
+	if request.LatencyMs != nil {
+		if *request.LatencyMs < 0 {
+			http.Error(w, "latency_ms must not be negative", http.StatusBadRequest)
+			return
+		}
+		override := time.Duration(*request.LatencyMs) * time.Millisecond
+		latency = &override
+	}
+	
+	s.chaos.set(*request.FailureRate, latency)
+	status := s.chaos.status()
+	slog.Warn("Chaos settings changed", "failure_rate", status["failure_rate"], "latency_ms", status["latency_ms"])
+	
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// HandleSyncOrder processes orders synchronously (blocking)
+func (s *OrderService) HandleSyncOrder(w http.ResponseWriter, r *http.Request) {
+	ctx, span := tracer.Start(r.Context(), "HandleSyncOrder", trace.WithSpanKind(trace.SpanKindServer))
+	defer span.End()
+	atomic.AddInt64(&s.syncOrders, 1)
+	
+	order, ok := s.decodeOrder(w, r)
+	if !ok {
+		return
+	}
+	rearm := s.holdWriteDeadline(w)
+	result, err := s.SubmitSync(ctx, order, orderSource{idempotencyKey: r.Header.Get("Idempotency-Key"), client: clientIP(r)})
+	rearm()
+	if err != nil {
+		writeOrderError(w, err)
+		return
+	}
+	writeOrderResult(w, result)
+}
+
+// holdWriteDeadline lifts the server's WriteTimeout from a handler about to
+// wait on a payment. The payment alone takes PAYMENT_LATENCY (3s by
+// default) and, under load, it may queue behind others for longer than any
+// fixed timeout, which would drop the connection of a client whose order
+// was charged. The returned func re-arms the timeout once the payment is
+// done, so it only covers writing the response.
+func (s *OrderService) holdWriteDeadline(w http.ResponseWriter) (rearm func()) {
+	if s.httpTimeouts.write <= 0 {
+		return func() {}
+	}
+	controller := http.NewResponseController(w)
+	controller.SetWriteDeadline(time.Time{})
+	return func() {
+		controller.SetWriteDeadline(time.Now().Add(s.httpTimeouts.write))
+	}
+}
+
+// SubmitSync charges a new order before returning, as POST /orders/sync
+// and the SubmitSync RPC do. Rejections are orderErrors; a client that
+// goes away mid-payment gets 499 and the order is cancelled.
+func (s *OrderService) SubmitSync(ctx context.Context, order Order, source orderSource) (orderResult, error) {
+	if err := s.admitOrder(&order, source); err != nil {
+		return orderResult{}, err
+	}
+	if err := s.assignOrderID(ctx, &order); err != nil {
+		return orderResult{}, err
+	}
+	order.Status = StatusProcessing
+	
+	// Answer a retry carrying the same Idempotency-Key, or without a key a
+	// recent identical order, with the earlier order's result
+	settle, previous := s.claimIdempotencyKey("sync", source.idempotencyKey, order.OrderID)
+	if previous != nil {
+		return s.replayIdempotentResult(ctx, previous)
+	}
+	if settle == nil && s.syncResultWindow > 0 {
+		hash := orderContentHash(&order)
+		claim := &recentOrder{orderID: order.OrderID, acceptedAt: order.CreatedAt, done: make(chan struct{})}
+		if previous, duplicate := claimContent(&s.recentSyncOrders, s.syncResultWindow, hash, claim); duplicate {
+			return s.replaySyncResult(ctx, previous)
+		}
+		settle = func(statusCode int, response map[string]interface{}, message string) {
+			// Only successful charges are worth protecting; let a retry of a
+			// failed order try again
+			if statusCode != http.StatusOK {
+				s.recentSyncOrders.CompareAndDelete(hash, claim)
+			}
+			claim.complete(statusCode, response, message)
+		}
+	}
+	if settle == nil {
+		settle = func(statusCode int, response map[string]interface{}, message string) {}
+	}
+	reject := func(rejected *orderError) (orderResult, error) {
+		settle(rejected.status, nil, rejected.message)
+		return orderResult{}, rejected
+	}
+	
+	// Orders for the same product take turns, through to the end of payment
+	if s.skus != nil {
+		releaseSKUs, err := s.skus.acquire(ctx, order.Items)
+		if err != nil {
+			return reject(skuBusyError(err))
+		}
+		defer releaseSKUs()
+	}
+	
+	if err := s.reserveStock(&order); err != nil {
+		return reject(rejectOrder(http.StatusConflict, err.Error()))
+	}
+	
+	// Store order, leased to this replica while it is charged
+	leaseExpiresAt := time.Now().Add(s.processingLease)
+	order.LeaseExpiresAt = &leaseExpiresAt
+	if err := s.orders.Put(&order); err != nil {
+		s.inventory.release(order.Items)
+		orderLogger(order.OrderID, order.RequestID).Error("Failed to store order", "error", err)
+		return reject(rejectOrder(http.StatusServiceUnavailable, "Order store unavailable"))
+	}
+	
+	// Process payment synchronously (blocks for the payment delay). The
+	// payment is abandoned, freeing its slot, if the client goes away or
+	// PAYMENT_TIMEOUT passes.
+	if s.paymentTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.paymentTimeout)
+		defer cancel()
+	}
+	release := s.holdLease(&order)
+	startTime := time.Now()
+	err := s.ProcessPayment(ctx, laneSync, order.OrderID, order.OrderTotal(), order.Currency)
+	processingTime := time.Since(startTime)
+	s.paymentSeconds.Observe(processingTime.Seconds())
+	release()
+	logger := orderLogger(order.OrderID, order.RequestID)
+	
+	// Nothing was charged, so the order is dropped and the client told when
+	// the queue should have moved on
+	if errors.Is(err, errPaymentBusy) {
+		if err := s.orders.Delete(order.OrderID); err != nil {
+			logger.Warn("Failed to delete rejected order", "error", err)
+		}
+		atomic.AddInt64(&s.rejectedOrders, 1)
+		s.inventory.release(order.Items)
+		logger.Warn("Sync order rejected: payment processor busy", "waited_ms", processingTime.Milliseconds())
+		settle(http.StatusServiceUnavailable, nil, "Payment processor busy")
+		return orderResult{}, &orderError{
+			status:     http.StatusServiceUnavailable,
+			message:    "Payment processor busy, retry later",
+			retryAfter: s.paymentRetryAfter(),
+		}
+	}
+	if errors.Is(err, context.Canceled) {
+		s.UpdateStatus(&order, StatusCancelled)
+		atomic.AddInt64(&s.cancelledOrders, 1)
+		s.inventory.release(order.Items)
+		logger.Warn("Sync order cancelled: client went away", "duration_ms", processingTime.Milliseconds())
+		return reject(rejectOrder(statusClientClosedRequest, "Order cancelled"))
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		s.UpdateStatus(&order, StatusFailedTimeout)
+		atomic.AddInt64(&s.failedOrders, 1)
+		s.inventory.release(order.Items)
+		logger.Warn("Sync order timed out", "duration_ms", processingTime.Milliseconds())
+		return reject(rejectOrder(http.StatusGatewayTimeout, "Payment timed out"))
+	}
+	if err != nil {
+		s.UpdateStatus(&order, StatusFailed)
+		atomic.AddInt64(&s.failedOrders, 1)
+		s.inventory.release(order.Items)
+		logger.Error("Sync order failed", "duration_ms", processingTime.Milliseconds(), "error", err)
+		return reject(&orderError{
+			status:  http.StatusPaymentRequired,
+			message: "Payment processing failed",
+			reason:  paymentFailureReason(err),
+		})
+	}
+	
+	// Update order status
+	now := time.Now()
+	order.ProcessedAt = &now
+	s.UpdateStatus(&order, order.chargedStatus())
+	atomic.AddInt64(&s.processedOrders, 1)
+	atomic.AddInt64(&s.revenueCents, order.totalCents())
+	
+	response := map[string]interface{}{
+		"order_id": order.OrderID,
+		"status": order.Status,
+		"total": order.Total,
+		"processing_time": processingTime.Seconds(),
+		"message": "Order processed successfully",
+	}
+	if order.backordered() {
+		response["message"] = "Order processed; some items are backordered"
+		response["items"] = order.Items
+	}
+	settle(http.StatusOK, response, "")
+	logger.Info("Sync order completed", "duration_ms", processingTime.Milliseconds())
+	return orderResult{status: http.StatusOK, response: response}, nil
+}
+
+// reserveStock takes stock for a new order and reprices it for the units
+// that ship
+func (s *OrderService) reserveStock(order *Order) error {
+	if err := s.inventory.reserve(order.Items, s.inventory.partial); err != nil {
+		return err
+	}
+	order.Total = order.OrderTotal()
+	for _, item := range order.Items {
+		atomic.AddInt64(&s.backorderedUnits, int64(item.BackorderedQuantity))
+	}
+	return nil
+}
+
+// paymentRetryAfter estimates, in whole seconds, how long the current payment
+// queue takes to drain at the base payment delay
+func (s *OrderService) paymentRetryAfter() int {
+	syncWaiting, asyncWaiting, _ := s.paymentSemaphore.Stats()
+	wait := time.Duration(syncWaiting+asyncWaiting+1) * s.paymentDelay.base
+	return max(1, int(math.Ceil(wait.Seconds())))
+}
+
+// replaySyncResult answers a retried sync order with the result of the
+// earlier identical order, waiting for it to finish if it is still running
+func (s *OrderService) replaySyncResult(ctx context.Context, previous *recentOrder) (orderResult, error) {
+	select {
+	case <-previous.done:
+	case <-ctx.Done():
+		return orderResult{}, rejectOrder(statusClientClosedRequest, "Client went away")
+	}
+	
+	atomic.AddInt64(&s.syncCacheHits, 1)
+	orderLogger(previous.orderID, requestIDFrom(ctx)).Info("Sync order retry matched an earlier order, returning its result")
+	if previous.statusCode != http.StatusOK {
+		return orderResult{}, rejectOrder(previous.statusCode, previous.message)
+	}
+	
+	response := make(map[string]interface{}, len(previous.response)+1)
+	for key, value := range previous.response {
+		response[key] = value
+	}
+	response["cached"] = true
+	return orderResult{status: http.StatusOK, response: response}, nil
+}
+
+// HandleAsyncOrder accepts orders and queues them for async processing
+func (s *OrderService) HandleAsyncOrder(w http.ResponseWriter, r *http.Request) {
+	ctx, span := tracer.Start(r.Context(), "HandleAsyncOrder", trace.WithSpanKind(trace.SpanKindServer))
+	defer span.End()
+	atomic.AddInt64(&s.asyncOrders, 1)
+	
+	order, ok := s.decodeOrder(w, r)
+	if !ok {
+		return
+	}
+	result, err := s.SubmitAsync(ctx, order, orderSource{idempotencyKey: r.Header.Get("Idempotency-Key"), client: clientIP(r)})
+	if err != nil {
+		writeOrderError(w, err)
+		return
+	}
+	writeOrderResult(w, result)
+}
+
+// SubmitAsync stores a new order and queues it for processing, as POST
+// /orders/async and the SubmitAsync RPC do, answering 202 once it is queued
+func (s *OrderService) SubmitAsync(ctx context.Context, order Order, source orderSource) (orderResult, error) {
+	if err := s.admitOrder(&order, source); err != nil {
+		return orderResult{}, err
+	}
+	
+	// Without SNS or the local fallback nothing would ever process the order
+	queued := s.snsConfigured() || s.fallback != nil
+	if !queued && s.asyncStrict {
+		return orderResult{}, rejectOrder(http.StatusServiceUnavailable, "Async processing unavailable: no queue is configured")
+	}
+	// A topic that failed its last reachability check would only fail the
+	// publish after the order was stored and its stock reserved
+	if err := s.snsUnavailable(ctx); err != nil {
+		slog.Warn("Rejecting async order, SNS unavailable", "request_id", requestIDFrom(ctx), "error", err)
+		return orderResult{}, &orderError{
+			status:     http.StatusServiceUnavailable,
+			message:    "Async processing unavailable: order queue unreachable",
+			retryAfter: max(1, int(math.Ceil(s.readiness.ttl.Seconds()))),
+		}
+	}
+	// Queued orders would only wait behind a backlog the processor's
+	// workers are already failing to keep up with
+	if s.backpressure != nil && s.snsConfigured() {
+		if saturated, saturation := s.backpressure.saturated(ctx); saturated {
+			atomic.AddInt64(&s.backpressure.shed, 1)
+			slog.Warn("Shedding async order, order processor saturated", "request_id", requestIDFrom(ctx), "saturation", saturation)
+			return orderResult{}, &orderError{
+				status:     http.StatusServiceUnavailable,
+				message:    "Async processing busy: order processor saturated",
+				retryAfter: max(1, int(math.Ceil(s.backpressure.ttl.Seconds()))),
+			}
+		}
+	}
+	
+	// Smooth bursts of acceptances before they reach the queue
+	if s.admission != nil {
+		if retryAfter, err := s.admission.Admit(ctx); err != nil {
+			return orderResult{}, &orderError{
+				status:     http.StatusTooManyRequests,
+				message:    "Too many orders, retry later: " + err.Error(),
+				retryAfter: int(math.Ceil(retryAfter.Seconds())),
+			}
+		}
+	}
+	
+	if err := s.assignOrderID(ctx, &order); err != nil {
+		return orderResult{}, err
+	}
+	order.Status = StatusPending
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("order.id", order.OrderID), attribute.Int("customer.id", order.CustomerID))
+	
+	// A retry with the same Idempotency-Key gets the original order back
+	settle, previous := s.claimIdempotencyKey("async", source.idempotencyKey, order.OrderID)
+	if previous != nil {
+		return s.replayIdempotentResult(ctx, previous)
+	}
+	if settle == nil {
+		settle = func(statusCode int, response map[string]interface{}, message string) {}
+	}
+	
+	// Return the existing order for an identical submission within the window
+	if s.contentDedupWindow > 0 {
+		claim := &recentOrder{orderID: order.OrderID, acceptedAt: order.CreatedAt}
+		if previous, duplicate := claimContent(&s.recentOrders, s.contentDedupWindow, orderContentHash(&order), claim); duplicate {
+			existingID := previous.orderID
+			atomic.AddInt64(&s.contentDuplicates, 1)
+			status := StatusPending
+			if existing, err := s.orders.Get(existingID); err == nil && existing != nil {
+				status = existing.Status
+			}
+			orderLogger(existingID, order.RequestID).Info("Async order duplicates an existing order, returning it", "customer_id", order.CustomerID)
+			
+			response := map[string]interface{}{
+				"order_id":  existingID,
+				"status":    status,
+				"duplicate": true,
+				"message":   "Identical order already accepted",
+			}
+			settle(http.StatusOK, response, "")
+			return orderResult{status: http.StatusOK, response: response}, nil
+		}
+	}
+	
+	// Orders for the same product take turns until this one is queued
+	if s.skus != nil {
+		releaseSKUs, err := s.skus.acquire(ctx, order.Items)
+		if err != nil {
+			rejected := skuBusyError(err)
+			settle(rejected.status, nil, rejected.message)
+			return orderResult{}, rejected
+		}
+		defer releaseSKUs()
+	}
+	
+	// Wait briefly for an SNS publish slot before anything is stored, so
+	// an order turned away for it leaves nothing behind
+	if s.snsConfigured() {
+		if err := s.publishes.acquire(ctx); err != nil {
+			statusCode, message := http.StatusServiceUnavailable, "Async processing busy: too many orders being queued, retry later"
+			if !errors.Is(err, errPublishBusy) {
+				statusCode, message = statusClientClosedRequest, "Client went away while queueing order"
+			}
+			settle(statusCode, nil, message)
+			return orderResult{}, &orderError{status: statusCode, message: message, retryAfter: 1}
+		}
+		defer s.publishes.release()
+	}
+	
+	if err := s.reserveStock(&order); err != nil {
+		settle(http.StatusConflict, nil, err.Error())
+		return orderResult{}, rejectOrder(http.StatusConflict, err.Error())
+	}
+	
+	// Store order with its timeout, which travels with it so the client,
+	// the store and the processor see the same value
+	order.MaxProcessingSeconds = s.orderTimeoutSecs
+	if err := s.orders.Put(&order); err != nil {
+		s.inventory.release(order.Items)
+		orderLogger(order.OrderID, order.RequestID).Error("Failed to store order", "error", err)
+		settle(http.StatusServiceUnavailable, nil, "Order store unavailable")
+		return orderResult{}, rejectOrder(http.StatusServiceUnavailable, "Order store unavailable")
+	}
+	
+	// Publish to SNS for async processing; an order that never reached the
+	// queue is failed rather than left pending
+	if err := s.publishOrder(ctx, &order); err != nil {
+		s.inventory.release(order.Items)
+		orderLogger(order.OrderID, order.RequestID).Error("Failed to publish order to SNS", "error", err)
+		statusCode, message := http.StatusInternalServerError, "Failed to queue order"
+		switch {
+		case errors.Is(err, context.DeadlineExceeded):
+			statusCode, message = http.StatusGatewayTimeout, "Timed out queueing order"
+		case errors.Is(err, context.Canceled):
+			statusCode, message = statusClientClosedRequest, "Client went away while queueing order"
+		}
+		s.failOrder(&order, message+": "+err.Error())
+		settle(statusCode, nil, message)
+		return orderResult{}, rejectOrder(statusCode, message)
+	}
+	
+	response := map[string]interface{}{
+		"order_id": order.OrderID,
+		"status": "accepted",
+		"message": "Order accepted for processing",
+	}
+	if order.MaxProcessingSeconds > 0 {
+		response["max_processing_seconds"] = order.MaxProcessingSeconds
+	}
+	if order.backordered() {
+		response["items"] = order.Items
+	}
+	switch {
+	case s.snsConfigured():
+	case s.fallback != nil:
+		response["status"] = "accepted_local"
+		response["message"] = "Order accepted for in-memory processing (no external queue configured)"
+	default:
+		response["status"] = "accepted_local"
+		response["message"] = "Order stored but not queued: no external queue or local fallback is configured, so it will not be processed"
+	}
+	settle(http.StatusAccepted, response, "")
+	return orderResult{status: http.StatusAccepted, response: response}, nil
+}
+
+// claimIdempotencyKey serializes requests that carry the same
+// Idempotency-Key within scope. Without a key settle is nil. The first
+// request gets a settle func it must call with its result on every path;
+// a repeat gets the earlier claim instead, to be answered from with
+// replayIdempotentResult. Failed first attempts release the key so the
+// client can retry.
+func (s *OrderService) claimIdempotencyKey(scope, key, orderID string) (settle func(int, map[string]interface{}, string), previous *recentOrder) {
+	if key == "" {
+		return nil, nil
+	}
+	
+	scopedKey := scope + ":" + key
+	claim := &recentOrder{orderID: orderID, acceptedAt: time.Now(), done: make(chan struct{})}
+	if previous, duplicate := claimContent(&s.idempotencyKeys, s.idempotencyTTL, scopedKey, claim); duplicate {
+		return nil, previous
+	}
+	
+	return func(statusCode int, response map[string]interface{}, message string) {
+		if statusCode >= http.StatusBadRequest {
+			s.idempotencyKeys.CompareAndDelete(scopedKey, claim)
+		}
+		claim.complete(statusCode, response, message)
+	}, nil
+}
+
+// replayIdempotentResult answers a repeated Idempotency-Key with the
+// original order's ID and current status, or its error if it failed
+func (s *OrderService) replayIdempotentResult(ctx context.Context, previous *recentOrder) (orderResult, error) {
+	select {
+	case <-previous.done:
+	case <-ctx.Done():
+		return orderResult{}, rejectOrder(statusClientClosedRequest, "Client went away")
+	}
+	
+	atomic.AddInt64(&s.keyReplays, 1)
+	if previous.statusCode >= http.StatusBadRequest {
+		return orderResult{}, rejectOrder(previous.statusCode, previous.message)
+	}
+	
+	orderID, _ := previous.response["order_id"].(string)
+	status := previous.response["status"]
+	if existing, err := s.orders.Get(orderID); err == nil && existing != nil {
+		status = existing.Status
+	}
+	orderLogger(orderID, requestIDFrom(ctx)).Info("Idempotency-Key replay")
+	
+	return orderResult{status: http.StatusOK, response: map[string]interface{}{
+		"order_id":          orderID,
+		"status":            status,
+		"idempotent_replay": true,
+		"message":           "Order already submitted with this Idempotency-Key",
+	}}, nil
+}
+
+// publishOrder queues an order on SNS for async processing. The trace in
+// ctx travels in the message attributes so the processor can continue it.
+func (s *OrderService) publishOrder(ctx context.Context, order *Order) error {
+	if !s.snsConfigured() {
+		if s.fallback != nil {
+			return s.fallback.enqueue(order)
+		}
+		orderLogger(order.OrderID, order.RequestID).Info("Async order accepted (SNS not configured)")
+		return nil
+	}
+	
+	ctx, span := tracer.Start(ctx, "sns.publish", trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(attribute.String("order.id", order.OrderID)))
+	defer span.End()
+	input := s.publishInput(order)
+	otel.GetTextMapPropagator().Inject(ctx, snsAttributeCarrier(input.MessageAttributes))
+	
+	// A hung SNS call must not hold the request forever
+	if s.publishTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.publishTimeout)
+		defer cancel()
+	}
+	_, err := s.snsClient.Publish(ctx, input)
+	s.snsHealth.record(err)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "publish failed")
+		return err
+	}
+	
+	orderLogger(order.OrderID, order.RequestID).Info("Async order published to SNS")
+	return nil
+}
+
+// publishInput builds the SNS publish for an order. Its customer_id,
+// order_total and priority attributes let subscriptions filter orders with
+// SNS filter policies. On a FIFO topic orders are grouped per customer, so
+// one customer's orders stay in sequence, and deduplicated by order ID, so
+// a resubmitted order is delivered only once.
+func (s *OrderService) publishInput(order *Order) *sns.PublishInput {
+	orderJSON, _ := json.Marshal(order)
+	input := &sns.PublishInput{
+		TopicArn: aws.String(s.snsTopicArn),
+		Message:  aws.String(string(orderJSON)),
+		MessageAttributes: map[string]snstypes.MessageAttributeValue{
+			"customer_id": {DataType: aws.String("Number"), StringValue: aws.String(strconv.Itoa(order.CustomerID))},
+			"order_total": {DataType: aws.String("Number"), StringValue: aws.String(strconv.FormatFloat(order.Total, 'f', 2, 64))},
+			"priority":    {DataType: aws.String("String"), StringValue: aws.String(s.orderPriority(order))},
+		},
+	}
+	if s.fifo {
+		input.MessageGroupId = aws.String(strconv.Itoa(order.CustomerID))
+		input.MessageDeduplicationId = aws.String(order.OrderID)
+	}
+	return input
+}
+
+// orderPriority is "high" for orders above HIGH_VALUE_THRESHOLD or from a
+// VIP customer, else "normal"
+func (s *OrderService) orderPriority(order *Order) string {
+	if s.vipCustomers[order.CustomerID] {
+		return "high"
+	}
+	if s.highValueThreshold > 0 && order.OrderTotal() > s.highValueThreshold {
+		return "high"
+	}
+	return "normal"
+}
+
+// snsAttributeCarrier lets the trace propagator write trace context into
+// SNS message attributes
+type snsAttributeCarrier map[string]snstypes.MessageAttributeValue
+
+// Get returns the string value of an attribute
+func (c snsAttributeCarrier) Get(key string) string {
+	if value, ok := c[key]; ok && value.StringValue != nil {
+		return *value.StringValue
+	}
+	return ""
+}
+
+// Set stores value as a String attribute
+func (c snsAttributeCarrier) Set(key, value string) {
+	c[key] = snstypes.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String(value)}
+}
+
+// Keys lists the attribute names
+func (c snsAttributeCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for key := range c {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// fifoMode reports whether target is a FIFO topic or queue. FIFO_MODE
+// (true or false) overrides detection by the ".fifo" suffix.
+func fifoMode(target string) (bool, error) {
+	detected := strings.HasSuffix(target, ".fifo")
+	value := os.Getenv("FIFO_MODE")
+	if value == "" {
+		return detected, nil
+	}
+	
+	fifo, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("FIFO_MODE must be true or false, got %q", value)
+	}
+	if fifo && target != "" && !detected {
+		return false, fmt.Errorf("FIFO_MODE is true but %s is not a .fifo topic", target)
+	}
+	return fifo, nil
+}
+
+// importResult reports the outcome of one line of a bulk import
+type importResult struct {
+	Line    int    `json:"line"`
+	OrderID string `json:"order_id,omitempty"`
+	Status  string `json:"status"`
+	Error   string `json:"error,omitempty"`
+}
+
+// checkImportedOrder rejects orders that could never be charged
+func checkImportedOrder(order *Order) error {
+	if len(order.Items) == 0 {
+		return fmt.Errorf("order has no items")
+	}
+	for _, item := range order.Items {
+		if item.ProductID == "" {
+			return fmt.Errorf("item is missing product_id")
+		}
+		if item.Quantity <= 0 {
+			return fmt.Errorf("item %s has non-positive quantity", item.ProductID)
+		}
+		if item.Price < 0 {
+			return fmt.Errorf("item %s has negative price", item.ProductID)
+		}
+		if item.BackorderedQuantity < 0 || item.BackorderedQuantity >= item.Quantity {
+			return fmt.Errorf("item %s has backordered_quantity outside 0 to quantity-1", item.ProductID)
+		}
+	}
+	return nil
+}
+
+// HandleImportOrders re-injects a newline-delimited JSON stream of orders.
+// The body is read line by line so large files are never held in memory,
+// and enqueues are paced so the import doesn't flood the queue.
+func (s *OrderService) HandleImportOrders(w http.ResponseWriter, r *http.Request) {
+	// A paced import outlasts the server's read and write timeouts; it is
+	// bounded by IMPORT_MAX_ORDERS instead
+	controller := http.NewResponseController(w)
+	controller.SetReadDeadline(time.Time{})
+	controller.SetWriteDeadline(time.Time{})
+	
+	var pace <-chan time.Time
+	if s.importRate > 0 {
+		ticker := time.NewTicker(time.Second / time.Duration(s.importRate))
+		defer ticker.Stop()
+		pace = ticker.C
+	}
+	
+	scanner := bufio.NewScanner(r.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	
+	results := []importResult{}
+	accepted, rejected := 0, 0
+	line := 0
+	for scanner.Scan() {
+		line++
+		raw := bytes.TrimSpace(scanner.Bytes())
+		if len(raw) == 0 {
+			continue
+		}
+		if accepted+rejected >= s.importMaxOrders {
+			results = append(results, importResult{Line: line, Status: "skipped",
+				Error: fmt.Sprintf("import limit of %d orders reached", s.importMaxOrders)})
+			break
+		}
+		
+		var order Order
+		if err := json.Unmarshal(raw, &order); err != nil {
+			rejected++
+			results = append(results, importResult{Line: line, Status: "rejected", Error: "invalid JSON: " + err.Error()})
+			continue
+		}
+		if err := s.currency.resolve(&order); err != nil {
+			rejected++
+			results = append(results, importResult{Line: line, Status: "rejected", Error: err.Error()})
+			continue
+		}
+		if err := checkImportedOrder(&order); err != nil {
+			rejected++
+			results = append(results, importResult{Line: line, Status: "rejected", Error: err.Error()})
+			continue
+		}
+		if err := s.checkItemQuantities(&order); err != nil {
+			rejected++
+			results = append(results, importResult{Line: line, Status: "rejected", Error: err.Error()})
+			continue
+		}
+		
+		if pace != nil {
+			<-pace
+		}
+		
+		orderID, err := s.newOrderID()
+		if err != nil {
+			rejected++
+			results = append(results, importResult{Line: line, Status: "failed", Error: err.Error()})
+			continue
+		}
+		order.OrderID = orderID
+		order.RequestID = requestIDFrom(r.Context())
+		order.Status = StatusPending
+		order.CreatedAt = time.Now()
+		order.Total = order.OrderTotal()
+		order.MaxProcessingSeconds = s.orderTimeoutSecs
+		if err := s.orders.Put(&order); err != nil {
+			rejected++
+			results = append(results, importResult{Line: line, OrderID: order.OrderID, Status: "failed", Error: err.Error()})
+			continue
+		}
+		atomic.AddInt64(&s.asyncOrders, 1)
+		
+		if err := s.publishOrder(r.Context(), &order); err != nil {
+			s.failOrder(&order, "Failed to queue order: "+err.Error())
+			rejected++
+			results = append(results, importResult{Line: line, OrderID: order.OrderID, Status: "failed", Error: err.Error()})
+			continue
+		}
+		
+		accepted++
+		results = append(results, importResult{Line: line, OrderID: order.OrderID, Status: "accepted"})
+	}
+	
+	if err := scanner.Err(); err != nil {
+		results = append(results, importResult{Line: line + 1, Status: "rejected", Error: "failed to read input: " + err.Error()})
+	}
+	
+	slog.Info("Bulk import finished", "accepted", accepted, "rejected", rejected)
+	
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"accepted": accepted,
+		"rejected": rejected,
+		"results":  results,
+	})
+}
+
+// migrationFailure is one order POST /admin/store/migrate couldn't copy
+type migrationFailure struct {
+	OrderID string `json:"order_id"`
+	Error   string `json:"error"`
+}
+
+// HandleMigrateStore copies every order in the in-memory store into the
+// Redis at redis_addr (db redis_db, authenticating with REDIS_PASSWORD)
+// and reports how many were copied and which failed. With switch, and
+// only if every order was copied, reads and writes move to Redis: the
+// orders are copied again under statusMu so none changes status midway,
+// the service switches over, and orders stored in memory meanwhile are
+// copied last.
+func (s *OrderService) HandleMigrateStore(w http.ResponseWriter, r *http.Request) {
+	if !requireJSON(w, r) {
+		return
+	}
+	var request struct {
+		RedisAddr string `json:"redis_addr"`
+		RedisDB   int    `json:"redis_db"`
+		Switch    bool   `json:"switch"`
+	}
+	if err := s.decodeJSONBody(w, r, &request); err != nil {
+		writeBodyError(w, err, "Invalid request body")
+		return
+	}
+	if request.RedisAddr == "" || request.RedisDB < 0 {
+		http.Error(w, "redis_addr is required and redis_db must not be negative", http.StatusBadRequest)
+		return
+	}
+	memory, ok := s.orders.active().(*memoryOrderStore)
+	if !ok {
+		http.Error(w, "Orders are already kept outside this process", http.StatusConflict)
+		return
+	}
+	target := newRedisOrderStore(request.RedisAddr, request.RedisDB)
+	if err := target.client.Ping(r.Context()).Err(); err != nil {
+		target.client.Close()
+		http.Error(w, "Target store unreachable: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	
+	copied, failures := s.copyOrders(memory, target, false)
+	switched := false
+	if request.Switch && len(failures) == 0 {
+		s.statusMu.Lock()
+		copied, failures = s.copyOrders(memory, target, true)
+		if len(failures) == 0 {
+			s.orders.switchTo(target)
+			switched = true
+		}
+		s.statusMu.Unlock()
+	}
+	if switched {
+		// Orders put in memory while the final copy ran
+		orders, _ := memory.List("")
+		for _, order := range orders {
+			if stored, err := target.Get(order.OrderID); err == nil && stored == nil {
+				if err := target.Put(s.orderSnapshot(order)); err != nil {
+					failures = append(failures, migrationFailure{OrderID: order.OrderID, Error: err.Error()})
+					continue
+				}
+				copied++
+			}
+		}
+	} else {
+		target.client.Close()
+	}
+	
+	logger := slog.With("redis_addr", request.RedisAddr, "copied", copied, "failed", len(failures), "switched", switched)
+	status := http.StatusOK
+	if len(failures) > 0 {
+		status = http.StatusBadGateway
+		logger.Error("Order store migration incomplete")
+	} else {
+		logger.Info("Order store migrated")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"copied":   copied,
+		"failed":   len(failures),
+		"failures": failures,
+		"switched": switched,
+	})
+}
+
+// copyOrders puts a snapshot of every order in from into to. Unless the
+// caller holds statusMu (locked), each snapshot is taken under it.
+func (s *OrderService) copyOrders(from *memoryOrderStore, to OrderStore, locked bool) (copied int, failures []migrationFailure) {
+	orders, _ := from.List("")
+	for _, order := range orders {
+		var snapshot *Order
+		if locked {
+			snapshot = cloneOrder(order)
+		} else {
+			snapshot = s.orderSnapshot(order)
+		}
+		if err := to.Put(snapshot); err != nil {
+			failures = append(failures, migrationFailure{OrderID: order.OrderID, Error: err.Error()})
+			continue
+		}
+		copied++
+	}
+	return copied, failures
+}
+
+// orderSnapshot copies a shared order under statusMu
+func (s *OrderService) orderSnapshot(order *Order) *Order {
+	s.statusMu.Lock()
+	defer s.statusMu.Unlock()
+	return cloneOrder(order)
+}
+
+// cloneOrder copies order and its items
+func cloneOrder(order *Order) *Order {
+	clone := *order
+	clone.Items = slices.Clone(order.Items)
+	return &clone
+}
+
+// registerPrometheus builds the registry for /metrics/prometheus. Counters
+// read the same atomics as the JSON /metrics so the two never disagree.
+func (s *OrderService) registerPrometheus() {
+	counter := func(name, help string, values ...*int64) prometheus.CounterFunc {
+		return prometheus.NewCounterFunc(prometheus.CounterOpts{Name: name, Help: help}, func() float64 {
+			var total int64
+			for _, value := range values {
+				total += atomic.LoadInt64(value)
+			}
+			return float64(total)
+		})
+	}
+	
+	s.paymentSeconds = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "payment_processing_duration_seconds",
+		Help:    "Time spent charging an order, successful or not.",
+		Buckets: prometheus.ExponentialBuckets(0.05, 2, 10),
+	})
+	
+	s.promRegistry = prometheus.NewRegistry()
+	s.promRegistry.MustRegister(
+		counter("messages_received_total", "Orders received on /orders/sync and /orders/async.", &s.syncOrders, &s.asyncOrders),
+		counter("orders_processed_total", "Orders charged successfully in this service.", &s.processedOrders),
+		counter("orders_failed_total", "Orders whose payment failed in this service.", &s.failedOrders),
+		counter("orders_cancelled_total", "Orders cancelled by the client, including sync orders abandoned mid-payment.", &s.cancelledOrders),
+		counter("orders_amended_total", "Pending orders whose items were replaced with PATCH /orders/{id}.", &s.amendedOrders),
+		counter("orders_expired_total", "Orders expired after staying pending for longer than PENDING_TTL.", &s.expiredOrders),
+		counter("orders_rejected_total", "Sync orders turned away with 503 because no payment slot freed up in time.", &s.rejectedOrders),
+		counter("orders_partially_fulfilled_total", "Orders charged with some units backordered.", &s.partialOrders),
+		counter("backordered_units_total", "Units backordered because stock ran short.", &s.backorderedUnits),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{Name: "revenue_processed", Help: "Total of completed orders, in order currency units."}, func() float64 {
+			return fromCents(atomic.LoadInt64(&s.revenueCents))
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{Name: "sns_publishes_in_flight", Help: "Async orders holding an SNS publish slot, from before they are stored until their publish returns."}, func() float64 {
+			return float64(atomic.LoadInt64(&s.publishes.inFlight))
+		}),
+		counter("sns_publishes_rejected_total", "Async orders turned away with 503 because no SNS publish slot freed up in time.", &s.publishes.rejected),
+		s.paymentSeconds,
+		s.slo.histogram,
+	)
+	if s.customerLimits != nil {
+		s.promRegistry.MustRegister(counter("orders_rate_limited_total", "Orders rejected with 429 by the per-customer rate limit.", &s.customerLimits.throttled))
+	}
+	if s.webhooks != nil {
+		s.promRegistry.MustRegister(
+			counter("webhooks_delivered_total", "Order callbacks answered with 2xx.", &s.webhooks.delivered),
+			counter("webhooks_failed_total", "Order callbacks given up on after every attempt failed.", &s.webhooks.failed),
+		)
+	}
+	for _, reason := range paymentFailureReasons {
+		s.promRegistry.MustRegister(prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name:        "payment_failures_total",
+			Help:        "Charges refused by the payment gateway, by reason.",
+			ConstLabels: prometheus.Labels{"reason": reason},
+		}, func() float64 {
+			return float64(atomic.LoadInt64(s.paymentFailures[reason]))
+		}))
+	}
+	if s.backpressure != nil {
+		s.promRegistry.MustRegister(
+			prometheus.NewGaugeFunc(prometheus.GaugeOpts{Name: "processor_saturation", Help: "Order processor saturation last read from PROCESSOR_STATUS_URL, from 0 to 1."}, func() float64 {
+				return s.backpressure.reading()
+			}),
+			counter("orders_shed_total", "Async orders turned away with 503 because the order processor was saturated.", &s.backpressure.shed),
+		)
+	}
+	if s.skus != nil {
+		s.promRegistry.MustRegister(
+			prometheus.NewGaugeFunc(prometheus.GaugeOpts{Name: "sku_orders_waiting", Help: "Orders waiting for a slot on a product at SKU_MAX_CONCURRENCY."}, func() float64 {
+				return float64(atomic.LoadInt64(&s.skus.waiting))
+			}),
+			counter("sku_orders_rejected_total", "Orders turned away with 503 because a product stayed at SKU_MAX_CONCURRENCY.", &s.skus.rejected),
+		)
+	}
+	if s.chaos != nil {
+		s.promRegistry.MustRegister(counter("chaos_failures_injected_total", "Payments failed on purpose by the /admin/chaos settings.", &s.chaos.injected))
+	}
+}
+
+// sloBuckets are the end-to-end duration buckets, in seconds
+var sloBuckets = []float64{0.5, 1, 2, 3, 5, 10, 15, 30, 60, 120, 300, 600, 1800, 3600}
+
+// sloTracker measures how long charged orders took end to end, from when
+// they were placed (or became due, if scheduled) to ProcessedAt, and how
+// many finished within target
+type sloTracker struct {
+	target time.Duration
+	counts []int64 // one per sloBuckets bound plus an overflow bucket
+	met    int64
+	maxNs  int64
+	// Prometheus view of the same durations
+	histogram prometheus.Histogram
+}
+
+// loadSLOTracker reads SLO_TARGET_SECONDS (default 10), the end-to-end
+// duration an order must finish within to count as meeting the SLO
+func loadSLOTracker() (*sloTracker, error) {
+	target := 10.0
+	if value := os.Getenv("SLO_TARGET_SECONDS"); value != "" {
+		parsed, err := strconv.ParseFloat(value, 64)
+		if err != nil || parsed <= 0 {
+			return nil, fmt.Errorf("SLO_TARGET_SECONDS must be a positive number, got %q", value)
+		}
+		target = parsed
+	}
+	return &sloTracker{
+		target: time.Duration(target * float64(time.Second)),
+		counts: make([]int64, len(sloBuckets)+1),
+		histogram: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "order_end_to_end_duration_seconds",
+			Help:    "Time from an order being placed to it being charged.",
+			Buckets: sloBuckets,
+		}),
+	}, nil
+}
+
+// record adds the end-to-end duration of an order charged at processedAt.
+// A processor clock running behind this one can put processedAt before
+// the order was placed, which counts as instant.
+func (t *sloTracker) record(order *Order, processedAt time.Time) {
+	start := order.CreatedAt
+	if order.ProcessAfter != nil && order.ProcessAfter.After(start) {
+		start = order.ProcessAfter.Time
+	}
+	duration := max(0, processedAt.Sub(start))
+	seconds := duration.Seconds()
+	atomic.AddInt64(&t.counts[sort.SearchFloat64s(sloBuckets, seconds)], 1)
+	if duration <= t.target {
+		atomic.AddInt64(&t.met, 1)
+	}
+	for {
+		current := atomic.LoadInt64(&t.maxNs)
+		if int64(duration) <= current || atomic.CompareAndSwapInt64(&t.maxNs, current, int64(duration)) {
+			break
+		}
+	}
+	t.histogram.Observe(seconds)
+}
+
+// status reports the share of charged orders that met the target and
+// p50, p95 and p99 estimates. A percentile is the upper bound of the
+// bucket it falls in, capped at the longest duration seen.
+func (t *sloTracker) status() map[string]interface{} {
+	counts := make([]int64, len(t.counts))
+	var total int64
+	for bucket := range counts {
+		counts[bucket] = atomic.LoadInt64(&t.counts[bucket])
+		total += counts[bucket]
+	}
+	maxSeconds := time.Duration(atomic.LoadInt64(&t.maxNs)).Seconds()
+	met := atomic.LoadInt64(&t.met)
+	
+	percentile := func(q float64) float64 {
+		if total == 0 {
+			return 0
+		}
+		rank := int64(math.Ceil(q * float64(total)))
+		var seen int64
+		for bucket, count := range counts {
+			seen += count
+			if seen >= rank && bucket < len(sloBuckets) {
+				return math.Min(sloBuckets[bucket], maxSeconds)
+			}
+		}
+		return maxSeconds
+	}
+	metPercent := 100.0
+	if total > 0 {
+		metPercent = 100 * float64(met) / float64(total)
+	}
+	return map[string]interface{}{
+		"target_seconds": t.target.Seconds(),
+		"orders":         total,
+		"met":            met,
+		"met_percent":    metPercent,
+		"p50_seconds":    percentile(0.50),
+		"p95_seconds":    percentile(0.95),
+		"p99_seconds":    percentile(0.99),
+		"max_seconds":    maxSeconds,
+	}
+}
+
+// loadCounter reads a monotonically increasing metrics counter. An int64
+// counter would only wrap after ~9.2e18 increments, but if it ever does the
+// reading saturates at math.MaxInt64 instead of going negative; counts are
+// relative to counters_since, which resets with the process.
+func loadCounter(addr *int64) int64 {
+	value := atomic.LoadInt64(addr)
+	if value < 0 {
+		return math.MaxInt64
+	}
+	return value
+}
+
+// HandleHealth returns service health status. sns repeats the last /ready
+// check ("unknown" before the first) without calling AWS again.
+func (s *OrderService) HandleHealth(w http.ResponseWriter, r *http.Request) {
+	snsState := "unknown"
+	if results, ok := s.readiness.last(); ok {
+		switch err, checked := results["sns"]; {
+		case !checked:
+			snsState = "not_configured"
+		case err != nil:
+			snsState = "unavailable"
+		default:
+			snsState = "ok"
+		}
+	}
+	
+	w.Header().Set("Content-Type", "application/json")
+	health := map[string]interface{}{
+		"status": "healthy",
+		"timestamp": time.Now().Unix(),
+		"sale": s.saleStatus()["state"],
+		"sns": snsState,
+		"metrics": map[string]int64{
+			"sync_orders": loadCounter(&s.syncOrders),
+			"async_orders": loadCounter(&s.asyncOrders),
+			"processed_orders": loadCounter(&s.processedOrders),
+			"failed_orders": loadCounter(&s.failedOrders),
+		},
+	}
+	json.NewEncoder(w).Encode(health)
+}
+
+// checkDependencies confirms the SNS topic is reachable. Without a topic
+// orders are handled in-process, so there is nothing to wait for, unless
+// no local workers are configured either and async orders are refused.
+func (s *OrderService) checkDependencies(ctx context.Context) map[string]error {
+	results := map[string]error{}
+	if s.snsTopicArn == "" {
+		if s.fallback == nil && s.asyncStrict {
+			results["sns"] = errors.New("SNS_TOPIC_ARN is not set and LOCAL_ASYNC_WORKERS is 0")
+		}
+		return results
+	}
+	if s.snsClient == nil {
+		results["sns"] = errors.New("SNS client not initialized, AWS config unavailable")
+		return results
+	}
+	
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	_, err := s.snsClient.GetTopicAttributes(ctx, &sns.GetTopicAttributesInput{
+		TopicArn: aws.String(s.snsTopicArn),
+	})
+	s.snsHealth.record(err)
+	results["sns"] = err
+	return results
+}
+
+// snsUnavailable returns the error from the latest SNS reachability check,
+// rerun at most once per READY_CACHE_TTL, or nil when the topic answered or
+// no topic is configured
+func (s *OrderService) snsUnavailable(ctx context.Context) error {
+	if s.snsTopicArn == "" {
+		return nil
+	}
+	results, _ := s.readiness.result(ctx)
+	return results["sns"]
+}
+
+// HandleReady reports whether the service can accept orders: 503 until
+// the SNS topic answers. /health stays a liveness check that never calls AWS.
+func (s *OrderService) HandleReady(w http.ResponseWriter, r *http.Request) {
+	results, checkedAt := s.readiness.result(r.Context())
+	writeReadiness(w, results, checkedAt)
+}
+
+// HandleMetrics returns detailed metrics
+func (s *OrderService) HandleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	
+	// Count orders by status
+	statusCounts := map[string]int{
+		"pending": 0,
+		"processing": 0,
+		"completed": 0,
+		"failed": 0,
+	}
+	
+	orders, err := s.orders.List("")
+	if err != nil {
+		slog.Warn("Failed to list orders for metrics", "error", err)
+	}
+	for _, order := range orders {
+		statusCounts[string(s.currentStatus(order))]++
+	}
+	
+	syncWaiting, asyncWaiting, oldestWait := s.paymentSemaphore.Stats()
+	
+	admission := map[string]interface{}{"enabled": false}
+	if s.admission != nil {
+		admission = s.admission.status()
+	}
+	rateLimit := map[string]interface{}{"enabled": false}
+	if s.customerLimits != nil {
+		rateLimit = s.customerLimits.status()
+	}
+	webhooks := map[string]interface{}{"enabled": false}
+	if s.webhooks != nil {
+		webhooks = map[string]interface{}{
+			"enabled":   true,
+			"delivered": loadCounter(&s.webhooks.delivered),
+			"failed":    loadCounter(&s.webhooks.failed),
+		}
+	}
+	chaos := map[string]interface{}{"enabled": false}
+	if s.chaos != nil {
+		chaos = s.chaos.status()
+	}
+	skuLimits := map[string]interface{}{"enabled": false}
+	backpressure := map[string]interface{}{"enabled": false}
+	if s.backpressure != nil {
+		backpressure = s.backpressure.status()
+	}
+	if s.skus != nil {
+		skuLimits = s.skus.status()
+	}
+	
+	dependencies := map[string]interface{}{}
+	if s.snsConfigured() {
+		dependencies["sns"] = s.snsHealth.snapshot()
+	}
+	
+	metrics := map[string]interface{}{
+		"timestamp": time.Now().Unix(),
+		"counters_since": s.startTime.UTC().Format(time.RFC3339),
+		"totals": map[string]int64{
+			"sync_requests": loadCounter(&s.syncOrders),
+			"async_requests": loadCounter(&s.asyncOrders),
+			"processed": loadCounter(&s.processedOrders),
+			"failed": loadCounter(&s.failedOrders),
+			"cancelled": loadCounter(&s.cancelledOrders),
+			"amended": loadCounter(&s.amendedOrders),
+			"rejected_orders": loadCounter(&s.rejectedOrders),
+			"partially_fulfilled": loadCounter(&s.partialOrders),
+			"backordered_units": loadCounter(&s.backorderedUnits),
+			"stalled": loadCounter(&s.stalledOrders),
+			"expired": loadCounter(&s.expiredOrders),
+			"content_duplicates": loadCounter(&s.contentDuplicates),
+			"sync_cache_hits": loadCounter(&s.syncCacheHits),
+			"idempotency_replays": loadCounter(&s.keyReplays),
+		},
+		"order_status": statusCounts,
+		"revenue_processed": fromCents(loadCounter(&s.revenueCents)),
+		"streams": s.streams.status(),
+		"sns_publishes": s.publishes.status(),
+		"sku_limits": skuLimits,
+		"processor_backpressure": backpressure,
+		"webhooks": webhooks,
+		"chaos": chaos,
+		"payment_failures_by_reason": s.paymentFailures.snapshot(),
+		"slo": s.slo.status(),
+		"payment_processor": map[string]interface{}{
+			"max_concurrent": 1,
+			"wait_queue_length": syncWaiting + asyncWaiting,
+			"sync_waiting": syncWaiting,
+			"async_waiting": asyncWaiting,
+			"sync_ratio": s.paymentSemaphore.syncRatio,
+			"oldest_waiter_age_ms": oldestWait.Milliseconds(),
+			"bottleneck": fmt.Sprintf("%v per payment", s.paymentDelay.base),
+			"delay_per_100": s.paymentDelay.per100.String(),
+			"delay_max": s.paymentDelay.max.String(),
+			"delay_jitter": s.paymentDelay.jitter.String(),
+		},
+		"sale": s.saleStatus(),
+		"admission": admission,
+		"rate_limit": rateLimit,
+		"aws_degraded": s.snsConfigured() && s.snsHealth.degraded(),
+		"dependencies": dependencies,
+	}
+	
+	json.NewEncoder(w).Encode(metrics)
+}
+
+// checkItemQuantities rejects orders with a line item over the per-item cap
+func (s *OrderService) checkItemQuantities(order *Order) error {
+	if s.maxQuantityPerItem == 0 {
+		return nil
+	}
+	for _, item := range order.Items {
+		if item.Quantity > s.maxQuantityPerItem {
+			return fmt.Errorf("item %s has quantity %d, the maximum per item is %d", item.ProductID, item.Quantity, s.maxQuantityPerItem)
+		}
+	}
+	return nil
+}
+
+// HandlePreviewOrder prices an order and checks stock for each item
+// without storing the order or reserving inventory
+func (s *OrderService) HandlePreviewOrder(w http.ResponseWriter, r *http.Request) {
+	if !requireJSON(w, r) {
+		return
+	}
+	
+	var order Order
+	if err := s.decodeJSONBody(w, r, &order); err != nil {
+		writeBodyError(w, err, invalidOrderMessage(err))
+		return
+	}
+	if problems := s.orderProblems(&order); len(problems) > 0 {
+		writeValidationErrors(w, problems)
+		return
+	}
+	if err := s.currency.resolve(&order); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if err := s.checkItemQuantities(&order); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if err := checkImportedOrder(&order); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	
+	// Items for the same product draw on the same stock
+	needed := make(map[string]int)
+	for _, item := range order.Items {
+		needed[item.ProductID] += item.Quantity
+	}
+	
+	priced := buildReceipt(&order)
+	allAvailable := true
+	items := make([]map[string]interface{}, 0, len(priced.Items))
+	for _, line := range priced.Items {
+		entry := map[string]interface{}{
+			"product_id": line.ProductID,
+			"quantity":   line.Quantity,
+			"unit_price": line.UnitPrice,
+			"subtotal":   line.Subtotal,
+			"available":  true,
+		}
+		if units, tracked := s.inventory.remaining(line.ProductID); tracked {
+			entry["remaining"] = units
+			if units < needed[line.ProductID] {
+				entry["available"] = false
+				allAvailable = false
+			}
+		}
+		items = append(items, entry)
+	}
+	
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"total":         priced.Total,
+		"currency":      priced.Currency,
+		"items":         items,
+		"all_available": allAvailable,
+	})
+}
+
+// HandleReplenishInventory adds stock to a tracked product during a sale
+func (s *OrderService) HandleReplenishInventory(w http.ResponseWriter, r *http.Request) {
+	productID := mux.Vars(r)["productId"]
+	
+	var request struct {
+		Quantity int `json:"quantity"`
+	}
+	if err := s.decodeJSONBody(w, r, &request); err != nil {
+		writeBodyError(w, err, "quantity must be a positive integer")
+		return
+	}
+	if request.Quantity <= 0 {
+		http.Error(w, "quantity must be a positive integer", http.StatusBadRequest)
+		return
+	}
+	
+	before, after, ok := s.inventory.replenish(productID, request.Quantity)
+	if !ok {
+		http.Error(w, "Product not found in inventory", http.StatusNotFound)
+		return
+	}
+	slog.Info("Replenished product", "product_id", productID, "quantity", request.Quantity, "before", before, "after", after)
+	
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"product_id": productID,
+		"added":      request.Quantity,
+		"before":     before,
+		"after":      after,
+	})
+}
+
+// HandleSeedInventory sets absolute stock levels from a JSON object of
+// product_id -> quantity, typically just before a sale opens
+func (s *OrderService) HandleSeedInventory(w http.ResponseWriter, r *http.Request) {
+	var stock map[string]int
+	if err := s.decodeJSONBody(w, r, &stock); err != nil {
+		writeBodyError(w, err, "Body must be a JSON object of product_id to quantity")
+		return
+	}
+	if len(stock) == 0 {
+		http.Error(w, "Body must be a JSON object of product_id to quantity", http.StatusBadRequest)
+		return
+	}
+	for productID, units := range stock {
+		if productID == "" || units < 0 {
+			http.Error(w, fmt.Sprintf("Invalid stock %d for product %q", units, productID), http.StatusBadRequest)
+			return
+		}
+	}
+	
+	s.inventory.seed(stock)
+	slog.Info("Seeded inventory", "products", len(stock))
+	
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"seeded":   len(stock),
+		"products": stock,
+	})
+}
+
+// HandleDrainStatus reports the in-memory async backlog
+func (s *OrderService) HandleDrainStatus(w http.ResponseWriter, r *http.Request) {
+	status := map[string]interface{}{"enabled": false}
+	if s.fallback != nil {
+		status = s.fallback.status()
+	}
+	
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"timestamp": time.Now().Unix(),
+		"fallback":  status,
+	})
+}
+
+// Shutdown drains the in-memory async workers before exit. Orders that
+// could not be processed in time are written as newline-delimited JSON to
+// SHUTDOWN_DUMP_FILE (re-importable via /admin/orders/import) or, if no
+// file is configured, to the log.
+func (s *OrderService) Shutdown(ctx context.Context) {
+	if s.fallback == nil {
+		return
+	}
+	
+	remaining := s.fallback.drain(ctx)
+	if len(remaining) == 0 {
+		slog.Info("Local async queue drained")
+		return
+	}
+	
+	slog.Warn("Shutdown deadline reached with local async orders unprocessed", "unprocessed", len(remaining))
+	
+	var out *os.File
+	if path := os.Getenv("SHUTDOWN_DUMP_FILE"); path != "" {
+		var err error
+		out, err = os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			slog.Error("Failed to open dump file, logging unprocessed orders instead", "path", path, "error", err)
+			out = nil
+		} else {
+			defer out.Close()
+		}
+	}
+	
+	for _, order := range remaining {
+		orderJSON, _ := json.Marshal(order)
+		if out != nil {
+			out.Write(append(orderJSON, '\n'))
+		} else {
+			orderLogger(order.OrderID, order.RequestID).Warn("Unprocessed order", "order", json.RawMessage(orderJSON))
+		}
+	}
+}
+
+// receiptLine is one line item on an order receipt
+type receiptLine struct {
+	ProductID   string  `json:"product_id"`
+	Quantity    int     `json:"quantity"`
+	UnitPrice   float64 `json:"unit_price"`
+	Subtotal    float64 `json:"subtotal"`
+	Backordered int     `json:"backordered,omitempty"`
+}
+
+// receipt is the customer-facing summary of a completed order
+type receipt struct {
+	OrderID     string        `json:"order_id"`
+	CustomerID  int           `json:"customer_id"`
+	Currency    string        `json:"currency"`
+	Items       []receiptLine `json:"items"`
+	Total       float64       `json:"total"`
+	CreatedAt   time.Time     `json:"created_at"`
+	ProcessedAt *time.Time    `json:"processed_at,omitempty"`
+}
+
+// buildReceipt computes per-item subtotals and the grand total in cents
+func buildReceipt(order *Order) receipt {
+	rec := receipt{
+		OrderID:     order.OrderID,
+		CustomerID:  order.CustomerID,
+		Currency:    order.Currency,
+		Items:       make([]receiptLine, 0, len(order.Items)),
+		CreatedAt:   order.CreatedAt,
+		ProcessedAt: order.ProcessedAt,
+	}
+	
+	var totalCents int64
+	for _, item := range order.Items {
+		subtotalCents := toCents(item.Price) * int64(item.shippedQuantity())
+		totalCents += subtotalCents
+		rec.Items = append(rec.Items, receiptLine{
+			ProductID:   item.ProductID,
+			Quantity:    item.shippedQuantity(),
+			UnitPrice:   item.Price,
+			Subtotal:    fromCents(subtotalCents),
+			Backordered: item.BackorderedQuantity,
+		})
+	}
+	rec.Total = fromCents(totalCents)
+	return rec
+}
+
+// HandleGetReceipt returns a receipt for a completed order, as JSON or as
+// plain text when the client asks for text/plain
+func (s *OrderService) HandleGetReceipt(w http.ResponseWriter, r *http.Request) {
+	orderID := mux.Vars(r)["orderId"]
+	
+	order, err := s.LookupOrder(orderID)
+	if err != nil {
+		writeOrderError(w, err)
+		return
+	}
+	
+	if order.Status != StatusCompleted && order.Status != StatusPartiallyFulfilled {
+		http.Error(w, fmt.Sprintf("Order is %s, receipts are only available for paid orders", order.Status), http.StatusConflict)
+		return
+	}
+	
+	rec := buildReceipt(order)
+	
+	if strings.Contains(r.Header.Get("Accept"), "text/plain") {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintf(w, "Receipt for order %s\n", rec.OrderID)
+		fmt.Fprintf(w, "Customer: %d\n", rec.CustomerID)
+		fmt.Fprintf(w, "Placed:   %s\n", rec.CreatedAt.UTC().Format(time.RFC3339))
+		if rec.ProcessedAt != nil {
+			fmt.Fprintf(w, "Paid:     %s\n", rec.ProcessedAt.UTC().Format(time.RFC3339))
+		}
+		fmt.Fprintln(w)
+		for _, line := range rec.Items {
+			fmt.Fprintf(w, "%-20s %4d x %10.2f = %10.2f\n", line.ProductID, line.Quantity, line.UnitPrice, line.Subtotal)
+			if line.Backordered > 0 {
+				fmt.Fprintf(w, "%-20s %4d backordered\n", "", line.Backordered)
+			}
+		}
+		fmt.Fprintf(w, "\nTotal: %.2f %s\n", rec.Total, rec.Currency)
+		return
+	}
+	
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rec)
+}
+
+// OrderStatus is where an order is in its lifecycle
+type OrderStatus string
+
+const (
+	StatusPending            OrderStatus = "pending"
+	StatusProcessing         OrderStatus = "processing"
+	StatusCompleted          OrderStatus = "completed"
+	StatusPartiallyFulfilled OrderStatus = "partially_fulfilled" // paid for, some units backordered
+	StatusFailed             OrderStatus = "failed"
+	StatusFailedTimeout      OrderStatus = "failed_timeout" // passed its processing deadline
+	StatusFailedStalled      OrderStatus = "failed_stalled" // payment lease expired mid-charge
+	StatusCancelled          OrderStatus = "cancelled"
+	StatusExpired            OrderStatus = "expired" // still pending after PENDING_TTL, or its hold expired
+	StatusRejected           OrderStatus = "rejected" // held for review and rejected by an operator
+)
+
+// statusTransitions lists the statuses each status may move to; statuses
+// with no entry are final. Beyond pending->processing->{completed,failed}
+// and pending->cancelled:
+//   - processing->partially_fulfilled: a charged order with backorders
+//   - pending->failed and pending->failed_timeout: a publish fails, or the
+//     processor dead-letters or times out an order it never started
+//   - processing->pending: the processor schedules a retry
+//   - processing->failed_timeout and ->failed_stalled: deadlines and leases
+//   - processing->cancelled: a sync client goes away mid-payment
+//   - failed->processing: POST /orders/{id}/retry charges the order again
+//   - pending->expired: the order was never picked up within PENDING_TTL,
+//     or the processor held it for review and the hold expired
+//   - pending->rejected: an operator rejected the processor's hold
+var statusTransitions = map[OrderStatus][]OrderStatus{
+	StatusPending:    {StatusProcessing, StatusCancelled, StatusFailed, StatusFailedTimeout, StatusExpired, StatusRejected},
+	StatusProcessing: {StatusCompleted, StatusPartiallyFulfilled, StatusFailed, StatusFailedTimeout, StatusFailedStalled, StatusCancelled, StatusPending},
+	StatusFailed:     {StatusProcessing},
+}
+
+// errIllegalTransition rejects a status change the lifecycle doesn't allow
+var errIllegalTransition = errors.New("illegal status transition")
+
+// errStatusChanged means the order was no longer in the status a
+// conditional update expected, usually because another update won a race
+var errStatusChanged = errors.New("order status changed")
+
+// Transition reports whether an order may move from one status to another
+func Transition(from, to OrderStatus) error {
+	if slices.Contains(statusTransitions[from], to) {
+		return nil
+	}
+	return fmt.Errorf("%w: %s -> %s", errIllegalTransition, from, to)
+}
+
+// UpdateStatus is the only way a stored order's status changes. It rejects
+// and logs illegal transitions, treats a move to the current status as a
+// no-op (except that a processing order's lease is renewed), and wakes the
+// order's event streams. When from is given the order
+// must currently be in one of those statuses or errStatusChanged is
+// returned, so a cancellation and the start of payment can't both win.
+func (s *OrderService) UpdateStatus(order *Order, to OrderStatus, from ...OrderStatus) error {
+	return s.updateStatus(order, to, time.Time{}, from)
+}
+
+// updateStatus is UpdateStatus taking when a charged order was paid, as
+// reported by the processor; a zero chargedAt means now
+func (s *OrderService) updateStatus(order *Order, to OrderStatus, chargedAt time.Time, from []OrderStatus) error {
+	s.statusMu.Lock()
+	current := order.Status
+	if len(from) > 0 && !slices.Contains(from, current) {
+		s.statusMu.Unlock()
+		return fmt.Errorf("%w: order is %s", errStatusChanged, current)
+	}
+	// Entering processing starts a lease and staying there renews it
+	var leaseExpiresAt *time.Time
+	if to == StatusProcessing {
+		expiresAt := time.Now().Add(s.processingLease)
+		leaseExpiresAt = &expiresAt
+	}
+	if current == to {
+		err := s.renewLease(order, leaseExpiresAt)
+		s.statusMu.Unlock()
+		return err
+	}
+	if err := Transition(current, to); err != nil {
+		s.statusMu.Unlock()
+		orderLogger(order.OrderID, order.RequestID).Warn("Rejected illegal status transition", "from", current, "to", to)
+		return err
+	}
+	processedAt := order.ProcessedAt
+	if charged(to) && processedAt == nil {
+		if chargedAt.IsZero() {
+			chargedAt = time.Now()
+		}
+		processedAt = &chargedAt
+	}
+	stored, err := s.orders.UpdateStatus(order, current, to, processedAt, leaseExpiresAt)
+	if errors.Is(err, errStatusChanged) {
+		// Another replica changed the shared order first
+		order.Status = stored
+		s.statusMu.Unlock()
+		return fmt.Errorf("%w: order is %s", errStatusChanged, stored)
+	}
+	if err != nil {
+		s.statusMu.Unlock()
+		orderLogger(order.OrderID, order.RequestID).Error("Failed to save status change", "from", current, "to", to, "error", err)
+		return err
+	}
+	order.Status = to
+	order.ProcessedAt = processedAt
+	order.LeaseExpiresAt = leaseExpiresAt
+	if to == StatusPartiallyFulfilled {
+		atomic.AddInt64(&s.partialOrders, 1)
+	}
+	if charged(to) && !charged(current) {
+		s.slo.record(order, *processedAt)
+	}
+	callback := order.CallbackURL
+	event := webhookEvent{OrderID: order.OrderID, Status: to, ProcessedAt: order.ProcessedAt}
+	s.statusMu.Unlock()
+	
+	s.statusEvents.publish(order.OrderID)
+	if callback != "" && s.webhooks != nil && finalStatus(to) {
+		s.webhooks.notify(callback, event)
+	}
+	return nil
+}
+
+// renewLease saves a processing order's new lease expiry; other orders
+// have no lease and are left alone. The caller holds statusMu.
+func (s *OrderService) renewLease(order *Order, leaseExpiresAt *time.Time) error {
+	if leaseExpiresAt == nil {
+		return nil
+	}
+	stored, err := s.orders.UpdateStatus(order, StatusProcessing, StatusProcessing, order.ProcessedAt, leaseExpiresAt)
+	if errors.Is(err, errStatusChanged) {
+		order.Status = stored
+		return fmt.Errorf("%w: order is %s", errStatusChanged, stored)
+	}
+	if err != nil {
+		orderLogger(order.OrderID, order.RequestID).Error("Failed to renew processing lease", "error", err)
+		return err
+	}
+	order.LeaseExpiresAt = leaseExpiresAt
+	return nil
+}
+
+// failOrder moves an order to failed and records why
+func (s *OrderService) failOrder(order *Order, reason string) {
+	if s.UpdateStatus(order, StatusFailed) != nil {
+		return
+	}
+	s.statusMu.Lock()
+	order.FailureReason = reason
+	s.statusMu.Unlock()
+	if err := s.orders.Put(order); err != nil {
+		orderLogger(order.OrderID, order.RequestID).Warn("Failed to save failure reason", "error", err)
+	}
+}
+
+// statusClientClosedRequest is the nginx convention for a client that
+// disconnected before the response was written
+const statusClientClosedRequest = 499
+
+// currentStatus reads an order's status consistently with UpdateStatus
+func (s *OrderService) currentStatus(order *Order) OrderStatus {
+	s.statusMu.Lock()
+	defer s.statusMu.Unlock()
+	return order.Status
+}
+
+// charged reports whether an order in status has been paid for
+func charged(status OrderStatus) bool {
+	return status == StatusCompleted || status == StatusPartiallyFulfilled
+}
+
+// finalStatus reports whether an order has settled: it can no longer change
+// status, or it failed and only an explicit retry would move it on
+func finalStatus(status OrderStatus) bool {
+	return status == StatusFailed || len(statusTransitions[status]) == 0
+}
+
+// webhookEvent is the JSON body POSTed to an order's callback_url
+type webhookEvent struct {
+	OrderID     string      `json:"order_id"`
+	Status      OrderStatus `json:"status"`
+	ProcessedAt *time.Time  `json:"processed_at,omitempty"`
+}
+
+// webhookDelivery records how notifying one order's callback went
+type webhookDelivery struct {
+	Status      string     `json:"status"` // pending, delivered or failed
+	Attempts    int        `json:"attempts"`
+	LastError   string     `json:"last_error,omitempty"`
+	DeliveredAt *time.Time `json:"delivered_at,omitempty"`
+}
+
+// webhookNotifier POSTs order events to callback URLs, signing each body
+// with HMAC-SHA256 in X-Signature and retrying with exponential backoff
+type webhookNotifier struct {
+	client      *http.Client
+	secret      []byte
+	maxAttempts int
+	backoff     time.Duration
+	
+	mu         sync.Mutex
+	deliveries map[string]*webhookDelivery // by order ID, latest event only
+	delivered  int64
+	failed     int64
+}
+
+// newWebhookNotifier reads WEBHOOK_SECRET, WEBHOOK_MAX_ATTEMPTS (default 5)
+// and WEBHOOK_BACKOFF (default 1s); it returns nil when no secret is set
+func newWebhookNotifier() (*webhookNotifier, error) {
+	secret := os.Getenv("WEBHOOK_SECRET")
+	if secret == "" {
+		return nil, nil
+	}
+	maxAttempts, err := envInt("WEBHOOK_MAX_ATTEMPTS", 5)
+	if err != nil {
+		return nil, err
+	}
+	if maxAttempts < 1 {
+		return nil, fmt.Errorf("WEBHOOK_MAX_ATTEMPTS must be at least 1, got %d", maxAttempts)
+	}
+	backoff := time.Second
+	if value := os.Getenv("WEBHOOK_BACKOFF"); value != "" {
+		if backoff, err = time.ParseDuration(value); err != nil || backoff <= 0 {
+			return nil, fmt.Errorf("WEBHOOK_BACKOFF must be a positive duration, got %q", value)
+		}
+	}
+	return &webhookNotifier{
+		client:      &http.Client{Timeout: 5 * time.Second},
+		secret:      []byte(secret),
+		maxAttempts: maxAttempts,
+		backoff:     backoff,
+		deliveries:  map[string]*webhookDelivery{},
+	}, nil
+}
+
+// sign returns the X-Signature value for body
+func (n *webhookNotifier) sign(body []byte) string {
+	mac := hmac.New(sha256.New, n.secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// notify delivers event in the background
+func (n *webhookNotifier) notify(callbackURL string, event webhookEvent) {
+	delivery := &webhookDelivery{Status: "pending"}
+	n.mu.Lock()
+	n.deliveries[event.OrderID] = delivery
+	n.mu.Unlock()
+	go n.deliver(callbackURL, event, delivery)
+}
+
+// deliver POSTs event until the callback answers 2xx or maxAttempts is
+// reached, doubling the wait after each failure
+func (n *webhookNotifier) deliver(callbackURL string, event webhookEvent, delivery *webhookDelivery) {
+	body, _ := json.Marshal(event)
+	signature := n.sign(body)
+	logger := orderLogger(event.OrderID, "")
+	
+	wait := n.backoff
+	for attempt := 1; ; attempt++ {
+		err := n.post(callbackURL, body, signature)
+		
+		n.mu.Lock()
+		delivery.Attempts = attempt
+		if err == nil {
+			now := time.Now()
+			delivery.Status, delivery.LastError, delivery.DeliveredAt = "delivered", "", &now
+		} else {
+			delivery.LastError = err.Error()
+			if attempt >= n.maxAttempts {
+				delivery.Status = "failed"
+			}
+		}
+		n.mu.Unlock()
+		
+		if err == nil {
+			atomic.AddInt64(&n.delivered, 1)
+			logger.Info("Webhook delivered", "status", event.Status, "attempts", attempt)
+			return
+		}
+		if attempt >= n.maxAttempts {
+			atomic.AddInt64(&n.failed, 1)
+			logger.Error("Webhook delivery failed", "status", event.Status, "attempts", attempt, "error", err)
+			return
+		}
+		logger.Warn("Webhook delivery failed, retrying", "attempt", attempt, "retry_in", wait.String(), "error", err)
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
+
+// post makes one delivery attempt
+func (n *webhookNotifier) post(callbackURL string, body []byte, signature string) error {
+	req, err := http.NewRequest(http.MethodPost, callbackURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Signature", signature)
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("callback answered %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// delivery returns a copy of an order's latest delivery record
+func (n *webhookNotifier) delivery(orderID string) (webhookDelivery, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	delivery, ok := n.deliveries[orderID]
+	if !ok {
+		return webhookDelivery{}, false
+	}
+	return *delivery, true
+}
+
+// HandleGetWebhook reports delivery of an order's latest callback
+func (s *OrderService) HandleGetWebhook(w http.ResponseWriter, r *http.Request) {
+	orderID := mux.Vars(r)["orderId"]
+	if _, err := s.LookupOrder(orderID); err != nil {
+		writeOrderError(w, err)
+		return
+	}
+	var delivery webhookDelivery
+	var ok bool
+	if s.webhooks != nil {
+		delivery, ok = s.webhooks.delivery(orderID)
+	}
+	if !ok {
+		http.Error(w, "No webhook sent for this order", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"order_id": orderID,
+		"webhook":  delivery,
+	})
+}
+
+// HandleRetryOrder charges a failed order again, moving it through
+// processing to completed or back to failed. Other statuses get 409 and an
+// order that has used up MAX_RETRIES gets 429.
+func (s *OrderService) HandleRetryOrder(w http.ResponseWriter, r *http.Request) {
+	orderID := mux.Vars(r)["orderId"]
+	
+	order, err := s.LookupOrder(orderID)
+	if err != nil {
+		writeOrderError(w, err)
+		return
+	}
+	logger := orderLogger(orderID, requestIDFrom(r.Context()))
+	
+	s.statusMu.Lock()
+	status, retries := order.Status, order.RetryCount
+	s.statusMu.Unlock()
+	
+	w.Header().Set("Content-Type", "application/json")
+	if status != StatusFailed {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"order_id": orderID,
+			"status":   status,
+			"message":  "Only failed orders can be retried",
+		})
+		return
+	}
+	if retries >= s.maxRetries {
+		w.WriteHeader(http.StatusTooManyRequests)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"order_id":    orderID,
+			"retry_count": retries,
+			"max_retries": s.maxRetries,
+			"message":     "Retry limit reached",
+		})
+		return
+	}
+	
+	// The failed attempt released its stock, so claim it again first. The
+	// units that ship were settled by the first attempt. Stock is reserved
+	// on a copy of the items, as the shared order is only written under
+	// statusMu.
+	s.statusMu.Lock()
+	items := slices.Clone(order.Items)
+	s.statusMu.Unlock()
+	if err := s.inventory.reserve(items, false); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	// Only one of several concurrent retries gets to charge the order
+	if err := s.UpdateStatus(order, StatusProcessing, StatusFailed); err != nil {
+		s.inventory.release(items)
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"order_id": orderID,
+			"status":   s.currentStatus(order),
+			"message":  "Only failed orders can be retried",
+		})
+		return
+	}
+	s.statusMu.Lock()
+	order.Items = items
+	order.RetryCount++
+	retries = order.RetryCount
+	s.statusMu.Unlock()
+	
+	ctx := r.Context()
+	if s.paymentTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.paymentTimeout)
+		defer cancel()
+	}
+	release := s.holdLease(order)
+	rearm := s.holdWriteDeadline(w)
+	startTime := time.Now()
+	err = s.ProcessPayment(ctx, laneSync, orderID, order.OrderTotal(), order.Currency)
+	processingTime := time.Since(startTime)
+	s.paymentSeconds.Observe(processingTime.Seconds())
+	rearm()
+	release()
+	
+	// Whatever went wrong, the order goes back to failed so it can be
+	// retried again
+	if err != nil {
+		s.UpdateStatus(order, StatusFailed)
+		s.inventory.release(order.Items)
+		logger.Warn("Order retry failed", "retry_count", retries, "duration_ms", processingTime.Milliseconds(), "error", err)
+		if errors.Is(err, errPaymentBusy) {
+			w.Header().Set("Retry-After", strconv.Itoa(s.paymentRetryAfter()))
+			w.WriteHeader(http.StatusServiceUnavailable)
+		} else {
+			w.WriteHeader(http.StatusPaymentRequired)
+		}
+		response := map[string]interface{}{
+			"order_id":    orderID,
+			"status":      s.currentStatus(order),
+			"retry_count": retries,
+			"message":     "Payment processing failed",
+		}
+		if reason := paymentFailureReason(err); reason != "" {
+			response["reason"] = reason
+		}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	
+	s.UpdateStatus(order, order.chargedStatus())
+	atomic.AddInt64(&s.processedOrders, 1)
+	atomic.AddInt64(&s.revenueCents, order.totalCents())
+	logger.Info("Order retry completed", "retry_count", retries, "duration_ms", processingTime.Milliseconds())
+	
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"order_id": orderID,
+		"status": s.currentStatus(order),
+		"total": order.Total,
+		"retry_count": retries,
+		"processing_time": processingTime.Seconds(),
+		"message": "Order processed successfully",
+	})
+}
+
+// HandleCancelOrder cancels an order that has not started processing and
+// releases its stock. Orders already on SNS are skipped by the processor
+// and lambda, which check this service for a cancelled status before
+// charging (ORDER_SERVICE_URL).
+func (s *OrderService) HandleCancelOrder(w http.ResponseWriter, r *http.Request) {
+	orderID := mux.Vars(r)["orderId"]
+	
+	order, err := s.LookupOrder(orderID)
+	if err != nil {
+		writeOrderError(w, err)
+		return
+	}
+	
+	w.Header().Set("Content-Type", "application/json")
+	if s.UpdateStatus(order, StatusCancelled, StatusPending) != nil {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"order_id": orderID,
+			"status":   order.Status,
+			"message":  "Only pending orders can be cancelled",
+		})
+		return
+	}
+	
+	s.inventory.release(order.Items)
+	atomic.AddInt64(&s.cancelledOrders, 1)
+	orderLogger(orderID, requestIDFrom(r.Context())).Info("Order cancelled")
+	
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"order_id": orderID,
+		"status":   order.Status,
+	})
+}
+
+// HandleAmendOrder replaces the items of an order that has not started
+// processing. The body must hold only items; every other field is fixed
+// once the order is accepted. The new items are validated, priced and
+// reserved like a new order's, and the old items' stock is released.
+func (s *OrderService) HandleAmendOrder(w http.ResponseWriter, r *http.Request) {
+	orderID := mux.Vars(r)["orderId"]
+	
+	if !requireJSON(w, r) {
+		return
+	}
+	var patch map[string]json.RawMessage
+	if err := s.decodeJSONBody(w, r, &patch); err != nil {
+		writeBodyError(w, err, "Invalid request body")
+		return
+	}
+	var problems []fieldError
+	for field := range patch {
+		if field != "items" {
+			problems = append(problems, fieldError{field, "cannot be changed; only items can be amended"})
+		}
+	}
+	if _, ok := patch["items"]; !ok {
+		problems = append(problems, fieldError{"items", "is required"})
+	}
+	if len(problems) > 0 {
+		sort.Slice(problems, func(i, j int) bool { return problems[i].Field < problems[j].Field })
+		writeValidationErrors(w, problems)
+		return
+	}
+	var items []Item
+	decoder := json.NewDecoder(bytes.NewReader(patch["items"]))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&items); err != nil {
+		writeBodyError(w, err, "Invalid items")
+		return
+	}
+	
+	order, err := s.LookupOrder(orderID)
+	if err != nil {
+		writeOrderError(w, err)
+		return
+	}
+	
+	// Validate and price the items as part of a copy of the order
+	amended := *order
+	amended.Items = items
+	if problems := s.orderProblems(&amended); len(problems) > 0 {
+		writeValidationErrors(w, problems)
+		return
+	}
+	if err := s.currency.resolve(&amended); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if err := s.checkItemQuantities(&amended); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	
+	snapshot, err := s.amendOrder(order, amended.Items)
+	if err != nil {
+		if errors.Is(err, errStatusChanged) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"order_id": orderID,
+				"status":   s.currentStatus(order),
+				"message":  "Only pending orders can be amended",
+			})
+			return
+		}
+		writeOrderError(w, err)
+		return
+	}
+	atomic.AddInt64(&s.amendedOrders, 1)
+	orderLogger(orderID, requestIDFrom(r.Context())).Info("Order amended", "items", len(snapshot.Items), "total", snapshot.Total)
+	
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(snapshot)
+}
+
+// amendOrder swaps a pending order's items for items, which have already
+// passed validation, exchanging its stock and saving it, and returns a copy
+// of the amended order. It holds statusMu
+// throughout, as status changes do, so the processor can't pick the order
+// up for payment halfway through; an order no longer pending gets
+// errStatusChanged.
+func (s *OrderService) amendOrder(order *Order, items []Item) (Order, error) {
+	s.statusMu.Lock()
+	defer s.statusMu.Unlock()
+	if order.Status != StatusPending {
+		return Order{}, fmt.Errorf("%w: order is %s", errStatusChanged, order.Status)
+	}
+	
+	if err := s.inventory.exchange(order.Items, items, s.inventory.partial); err != nil {
+		return Order{}, rejectOrder(http.StatusConflict, err.Error())
+	}
+	total := Order{Items: items}.OrderTotal()
+	now := time.Now()
+	stored, err := s.orders.Amend(order, items, total, now)
+	if err != nil {
+		// Put the original items' stock back
+		if err := s.inventory.exchange(items, order.Items, true); err != nil {
+			orderLogger(order.OrderID, order.RequestID).Error("Failed to restore stock of amended order", "error", err)
+		}
+	}
+	if errors.Is(err, errStatusChanged) {
+		// Another replica changed the shared order first
+		order.Status = stored
+		return Order{}, fmt.Errorf("%w: order is %s", errStatusChanged, stored)
+	}
+	if err != nil {
+		orderLogger(order.OrderID, order.RequestID).Error("Failed to save amended order", "error", err)
+		return Order{}, rejectOrder(http.StatusServiceUnavailable, "Order store unavailable")
+	}
+	order.Items = items
+	order.Total = total
+	order.AmendedAt = &now
+	return *order, nil
+}
+
+// HandleOrderEvents streams an order's status changes as Server-Sent
+// Events until it reaches a final status, the client goes away, or nothing
+// has changed for streamIdle. Comments are sent every streamHeartbeat to
+// keep proxies from closing the connection.
+func (s *OrderService) HandleOrderEvents(w http.ResponseWriter, r *http.Request) {
+	orderID := mux.Vars(r)["orderId"]
+	
+	order, err := s.LookupOrder(orderID)
+	if err != nil {
+		writeOrderError(w, err)
+		return
+	}
+	
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	if !s.streams.acquire() {
+		http.Error(w, "Too many open event streams", http.StatusServiceUnavailable)
+		return
+	}
+	defer s.streams.release()
+	// The stream ends on its own after streamIdle, so the server's
+	// WriteTimeout must not cut it short
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+	
+	// Subscribe before the first read so no change is missed in between
+	wake := s.statusEvents.subscribe(orderID)
+	defer s.statusEvents.unsubscribe(orderID, wake)
+	
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	
+	var last OrderStatus
+	// send writes the status if it changed and reports whether it is final
+	send := func() bool {
+		status := s.currentStatus(order)
+		if status != last {
+			data, _ := json.Marshal(map[string]string{"order_id": orderID, "status": string(status)})
+			fmt.Fprintf(w, "event: status\ndata: %s\n\n", data)
+			flusher.Flush()
+			last = status
+		}
+		return finalStatus(status)
+	}
+	if send() {
+		return
+	}
+	
+	heartbeat := time.NewTicker(s.streamHeartbeat)
+	defer heartbeat.Stop()
+	idle := time.NewTimer(s.streamIdle)
+	defer idle.Stop()
+	
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-idle.C:
+			return
+		case <-heartbeat.C:
+			// Changes made through other replicas don't wake this one
+			if _, shared := s.orders.active().(*redisOrderStore); shared {
+				if fresh, err := s.orders.Get(orderID); err == nil && fresh != nil {
+					order = fresh
+				}
+				if send() {
+					return
+				}
+			}
+			fmt.Fprint(w, ": heartbeat\n\n")
+			flusher.Flush()
+		case <-wake:
+			if send() {
+				return
+			}
+			idle.Reset(s.streamIdle)
+		}
+	}
+}
+
+// HandleReportStatus lets the order processor write back the status of an
+// order it is charging, so GET /orders/{id} and event streams follow it.
+// Final statuses are never overwritten. Reporting an order processing again
+// renews its lease, and the response carries the new lease_expires_at. A
+// held order the processor reports rejected or expired was never charged,
+// so its stock is released.
+func (s *OrderService) HandleReportStatus(w http.ResponseWriter, r *http.Request) {
+	orderID := mux.Vars(r)["orderId"]
+	
+	var request struct {
+		Status OrderStatus `json:"status"`
+		// When the processor charged the order, for the end-to-end SLO
+		ProcessedAt *time.Time `json:"processed_at"`
+	}
+	if err := s.decodeJSONBody(w, r, &request); err != nil {
+		writeBodyError(w, err, "Invalid request body")
+		return
+	}
+	switch request.Status {
+	case StatusPending, StatusProcessing, StatusCompleted, StatusFailed, StatusFailedTimeout, StatusRejected, StatusExpired:
+	default:
+		http.Error(w, fmt.Sprintf("Unsupported status %q", request.Status), http.StatusBadRequest)
+		return
+	}
+	
+	order, err := s.LookupOrder(orderID)
+	if err != nil {
+		writeOrderError(w, err)
+		return
+	}
+	// The processor doesn't know about backorders
+	if request.Status == StatusCompleted {
+		request.Status = order.chargedStatus()
+	}
+	
+	var chargedAt time.Time
+	if request.ProcessedAt != nil {
+		chargedAt = *request.ProcessedAt
+	}
+	// Only the report that moves a hold out of pending releases its stock,
+	// so a repeated report can't release it twice
+	var from []OrderStatus
+	release := false
+	switch request.Status {
+	case StatusRejected:
+		from, release = []OrderStatus{StatusPending}, true
+	case StatusExpired:
+		from, release = []OrderStatus{StatusPending}, s.expireReleases
+	}
+	
+	w.Header().Set("Content-Type", "application/json")
+	if err := s.updateStatus(order, request.Status, chargedAt, from); err != nil {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]interface{}{"order_id": orderID, "status": s.currentStatus(order), "error": err.Error()})
+		return
+	}
+	if release {
+		s.inventory.release(order.Items)
+	}
+	response := map[string]interface{}{"order_id": orderID, "status": request.Status}
+	s.statusMu.Lock()
+	if request.Status == StatusProcessing && order.LeaseExpiresAt != nil {
+		response["lease_expires_at"] = order.LeaseExpiresAt.UTC()
+	}
+	s.statusMu.Unlock()
+	json.NewEncoder(w).Encode(response)
+}
+
+// HandleGetOrder retrieves order details
+func (s *OrderService) HandleGetOrder(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	orderID := vars["orderId"]
+	
+	order, err := s.LookupOrder(orderID)
+	if err != nil {
+		writeOrderError(w, err)
+		return
+	}
+	// A memory-store order is shared, so copy it while it can't change
+	snapshot := s.orderSnapshot(order)
+	
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(snapshot)
+}
+
+// LookupOrder returns a stored order, or a 404 orderError (503 if the
+// order store can't be reached)
+func (s *OrderService) LookupOrder(orderID string) (*Order, error) {
+	order, err := s.orders.Get(orderID)
+	if err != nil {
+		orderLogger(orderID, "").Error("Failed to look up order", "error", err)
+		return nil, rejectOrder(http.StatusServiceUnavailable, "Order store unavailable")
+	}
+	if order == nil {
+		return nil, rejectOrder(http.StatusNotFound, "Order not found")
+	}
+	return order, nil
+}
+
+// Page sizes for GET /orders
+const (
+	defaultListLimit = 50
+	maxListLimit     = 500
 )
 
-// Order represents an e-commerce order
-type Order struct {
-	OrderID     string    `json:"order_id"`
-	CustomerID  int       `json:"customer_id"`
-	Status      string    `json:"status"` // pending, processing, completed, failed
-	Items       []Item    `json:"items"`
-	CreatedAt   time.Time `json:"created_at"`
-	ProcessedAt *time.Time `json:"processed_at,omitempty"`
+// encodeOrderCursor makes the opaque next_cursor for a page ending at order
+func encodeOrderCursor(order *Order) string {
+	raw := strconv.FormatInt(order.CreatedAt.UnixNano(), 10) + ":" + order.OrderID
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+// decodeOrderCursor reverses encodeOrderCursor
+func decodeOrderCursor(cursor string) (createdAt int64, orderID string, err error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, "", err
+	}
+	nanos, orderID, found := strings.Cut(string(raw), ":")
+	if !found {
+		return 0, "", errors.New("missing separator")
+	}
+	createdAt, err = strconv.ParseInt(nanos, 10, 64)
+	return createdAt, orderID, err
+}
+
+// compareListPosition orders the listing by creation time, then by ID for
+// orders created in the same instant; it is negative when order sorts
+// before the position (createdAt, orderID)
+func compareListPosition(order *Order, createdAt int64, orderID string) int {
+	if nanos := order.CreatedAt.UnixNano(); nanos != createdAt {
+		if nanos < createdAt {
+			return -1
+		}
+		return 1
+	}
+	return strings.Compare(order.OrderID, orderID)
+}
+
+// listPageParams parses the limit and cursor query parameters shared by the
+// order listings, writing a 400 and returning ok false when either is bad
+func listPageParams(w http.ResponseWriter, query url.Values) (limit int, cursor string, afterCreated int64, afterID string, ok bool) {
+	limit = defaultListLimit
+	if value := query.Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 || parsed > maxListLimit {
+			http.Error(w, fmt.Sprintf("limit must be between 1 and %d", maxListLimit), http.StatusBadRequest)
+			return 0, "", 0, "", false
+		}
+		limit = parsed
+	}
+	
+	cursor = query.Get("cursor")
+	if cursor != "" {
+		var err error
+		if afterCreated, afterID, err = decodeOrderCursor(cursor); err != nil {
+			http.Error(w, "Invalid cursor", http.StatusBadRequest)
+			return 0, "", 0, "", false
+		}
+	}
+	return limit, cursor, afterCreated, afterID, true
+}
+
+// HandleListOrders lists orders oldest first, optionally filtered by status
+// and customer_id, a page of limit at a time. The cursor is keyed on the
+// last order returned, so orders placed while paging don't shift pages.
+// status_counts covers every order matching customer_id.
+func (s *OrderService) HandleListOrders(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	statusFilter := OrderStatus(query.Get("status"))
+	
+	customerFilter := 0
+	if value := query.Get("customer_id"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 {
+			http.Error(w, "customer_id must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		customerFilter = parsed
+	}
+	
+	limit, cursor, afterCreated, afterID, ok := listPageParams(w, query)
+	if !ok {
+		return
+	}
+	
+	orders, err := s.orders.List("")
+	if err != nil {
+		slog.Error("Failed to list orders", "error", err)
+		http.Error(w, "Order store unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	statusCounts := map[string]int{}
+	matched := []*Order{}
+	for _, order := range orders {
+		if customerFilter != 0 && order.CustomerID != customerFilter {
+			continue
+		}
+		status := s.currentStatus(order)
+		statusCounts[string(status)]++
+		if statusFilter == "" || status == statusFilter {
+			matched = append(matched, order)
+		}
+	}
+	sort.Slice(matched, func(i, j int) bool {
+		return compareListPosition(matched[i], matched[j].CreatedAt.UnixNano(), matched[j].OrderID) < 0
+	})
+	
+	// Skip everything up to and including the cursor's order
+	start := 0
+	if cursor != "" {
+		start = sort.Search(len(matched), func(i int) bool {
+			return compareListPosition(matched[i], afterCreated, afterID) > 0
+		})
+	}
+	page := matched[start:min(start+limit, len(matched))]
+	
+	response := map[string]interface{}{
+		"orders":        page,
+		"count":         len(page),
+		"total":         len(matched),
+		"status_counts": statusCounts,
+	}
+	if start+len(page) < len(matched) {
+		response["next_cursor"] = encodeOrderCursor(page[len(page)-1])
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// HandleCustomerOrders lists one customer's orders newest first, paged with
+// the same limit and cursor as GET /orders. A customer with no orders gets
+// an empty list rather than a 404, since customers aren't stored on their own.
+func (s *OrderService) HandleCustomerOrders(w http.ResponseWriter, r *http.Request) {
+	customerID, err := strconv.Atoi(mux.Vars(r)["customerId"])
+	if err != nil || customerID <= 0 {
+		http.Error(w, "customer ID must be a positive integer", http.StatusBadRequest)
+		return
+	}
+	
+	limit, cursor, afterCreated, afterID, ok := listPageParams(w, r.URL.Query())
+	if !ok {
+		return
+	}
+	
+	orders, err := s.orders.List("")
+	if err != nil {
+		slog.Error("Failed to list orders", "error", err)
+		http.Error(w, "Order store unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	matched := []*Order{}
+	for _, order := range orders {
+		if order.CustomerID == customerID {
+			matched = append(matched, order)
+		}
+	}
+	sort.Slice(matched, func(i, j int) bool {
+		return compareListPosition(matched[i], matched[j].CreatedAt.UnixNano(), matched[j].OrderID) > 0
+	})
+	
+	start := 0
+	if cursor != "" {
+		start = sort.Search(len(matched), func(i int) bool {
+			return compareListPosition(matched[i], afterCreated, afterID) < 0
+		})
+	}
+	page := matched[start:min(start+limit, len(matched))]
+	
+	response := map[string]interface{}{
+		"customer_id": customerID,
+		"orders":      page,
+		"count":       len(page),
+		"total":       len(matched),
+	}
+	if start+len(page) < len(matched) {
+		response["next_cursor"] = encodeOrderCursor(page[len(page)-1])
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// openAPISchemas collects the component schemas of the OpenAPI document,
+// keyed by name
+type openAPISchemas map[string]interface{}
+
+// openAPIReadOnly lists the fields the service sets itself, by Go type and
+// json name. They are marked readOnly, which takes them out of request
+// bodies even when they are required in responses.
+var openAPIReadOnly = map[string]bool{
+	"Order.order_id":               true,
+	"Order.status":                 true,
+	"Order.created_at":             true,
+	"Order.processed_at":           true,
+	"Order.max_processing_seconds": true,
+	"Order.request_id":             true,
+	"Order.total":                  true,
+	"Order.retry_count":            true,
+	"Order.failure_reason":         true,
+	"Item.fulfilled_quantity":      true,
+	"Item.backordered_quantity":    true,
+}
+
+// schemaFor describes t as an OpenAPI 3.0 schema, following encoding/json:
+// its json tags name the properties, and fields without omitempty are
+// required. Named structs are added to the components once and referenced,
+// so the spec tracks the Go types instead of being maintained by hand.
+func (c openAPISchemas) schemaFor(t reflect.Type) map[string]interface{} {
+	switch t {
+	case reflect.TypeOf(time.Time{}):
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case reflect.TypeOf(flexTime{}):
+		return map[string]interface{}{"type": "string", "format": "date-time",
+			"description": "RFC 3339, or Unix epoch seconds or milliseconds"}
+	case reflect.TypeOf(OrderStatus("")):
+		return map[string]interface{}{"type": "string", "enum": orderStatusNames()}
+	}
+	
+	switch t.Kind() {
+	case reflect.Pointer:
+		return c.schemaFor(t.Elem())
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": c.schemaFor(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": c.schemaFor(t.Elem())}
+	case reflect.Struct:
+		name := strings.ToUpper(t.Name()[:1]) + t.Name()[1:]
+		ref := map[string]interface{}{"$ref": "#/components/schemas/" + name}
+		if _, seen := c[name]; seen {
+			return ref
+		}
+		// Claim the name first so a type that refers to itself terminates
+		c[name] = nil
+		properties := map[string]interface{}{}
+		required := []string{}
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			tag := field.Tag.Get("json")
+			if !field.IsExported() || tag == "-" {
+				continue
+			}
+			jsonName, options, _ := strings.Cut(tag, ",")
+			if jsonName == "" {
+				jsonName = field.Name
+			}
+			property := c.schemaFor(field.Type)
+			if openAPIReadOnly[t.Name()+"."+jsonName] {
+				if _, isRef := property["$ref"]; !isRef {
+					property["readOnly"] = true
+				}
+			}
+			properties[jsonName] = property
+			if !strings.Contains(options, "omitempty") {
+				required = append(required, jsonName)
+			}
+		}
+		schema := map[string]interface{}{"type": "object", "properties": properties}
+		if len(required) > 0 {
+			schema["required"] = required
+		}
+		c[name] = schema
+		return ref
+	}
+	return map[string]interface{}{}
+}
+
+// orderStatusNames lists every status in statusTransitions, sorted
+func orderStatusNames() []string {
+	seen := map[string]bool{}
+	for from, targets := range statusTransitions {
+		seen[string(from)] = true
+		for _, to := range targets {
+			seen[string(to)] = true
+		}
+	}
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// buildOpenAPISpec assembles the OpenAPI 3 document served at
+// /openapi.json. Order, Item and the validation errors come from the Go
+// types; the submission responses are maps in the handlers, so their
+// schema is declared here and must be kept in step with SubmitSync and
+// SubmitAsync.
+func buildOpenAPISpec() ([]byte, error) {
+	schemas := openAPISchemas{}
+	order := schemas.schemaFor(reflect.TypeOf(Order{}))
+	item := schemas.schemaFor(reflect.TypeOf(Item{}))
+	schemas["ValidationError"] = map[string]interface{}{
+		"type":     "object",
+		"required": []string{"error", "fields"},
+		"properties": map[string]interface{}{
+			"error":  map[string]interface{}{"type": "string"},
+			"fields": map[string]interface{}{"type": "array", "items": schemas.schemaFor(reflect.TypeOf(fieldError{}))},
+		},
+	}
+	schemas["PaymentFailure"] = map[string]interface{}{
+		"type":     "object",
+		"required": []string{"error", "reason"},
+		"properties": map[string]interface{}{
+			"error":  map[string]interface{}{"type": "string"},
+			"reason": map[string]interface{}{"type": "string", "enum": paymentFailureReasons},
+		},
+	}
+	schemas["SubmitResponse"] = map[string]interface{}{
+		"type":     "object",
+		"required": []string{"order_id", "status", "message"},
+		"properties": map[string]interface{}{
+			"order_id":               map[string]interface{}{"type": "string"},
+			"status":                 map[string]interface{}{"type": "string", "description": "The order status, or accepted / accepted_local for async orders"},
+			"message":                map[string]interface{}{"type": "string"},
+			"total":                  map[string]interface{}{"type": "number"},
+			"processing_time":        map[string]interface{}{"type": "number", "description": "Seconds the sync payment took"},
+			"max_processing_seconds": map[string]interface{}{"type": "integer"},
+			"items":                  map[string]interface{}{"type": "array", "items": item, "description": "Present when some units are backordered"},
+			"duplicate":              map[string]interface{}{"type": "boolean"},
+			"idempotent_replay":      map[string]interface{}{"type": "boolean"},
+		},
+	}
+	
+	jsonContent := func(schema interface{}) map[string]interface{} {
+		return map[string]interface{}{"application/json": map[string]interface{}{"schema": schema}}
+	}
+	text := map[string]interface{}{"text/plain": map[string]interface{}{"schema": map[string]interface{}{"type": "string"}}}
+	response := func(description string, content map[string]interface{}) map[string]interface{} {
+		return map[string]interface{}{"description": description, "content": content}
+	}
+	submitResponse := map[string]interface{}{"$ref": "#/components/schemas/SubmitResponse"}
+	errorResponses := map[string]interface{}{
+		"400": response("Malformed JSON or unknown field", text),
+		"409": response("Out of stock", text),
+		"415": response("Content-Type is not application/json", text),
+		"422": response("The order failed validation", jsonContent(map[string]interface{}{"$ref": "#/components/schemas/ValidationError"})),
+		"503": response("Overloaded or shutting down; see Retry-After", text),
+	}
+	submit := func(summary string, accepted map[string]interface{}) map[string]interface{} {
+		responses := map[string]interface{}{}
+		for code, value := range errorResponses {
+			responses[code] = value
+		}
+		for code, value := range accepted {
+			responses[code] = value
+		}
+		return map[string]interface{}{
+			"summary": summary,
+			"parameters": []interface{}{map[string]interface{}{
+				"name": "Idempotency-Key", "in": "header", "required": false, "schema": map[string]interface{}{"type": "string"},
+			}},
+			"requestBody": map[string]interface{}{"required": true, "content": jsonContent(order)},
+			"responses":   responses,
+			"security":    []interface{}{map[string]interface{}{}, map[string]interface{}{"apiKey": []string{}}},
+		}
+	}
+	object := map[string]interface{}{"type": "object"}
+	orderIDParam := []interface{}{map[string]interface{}{
+		"name": "orderId", "in": "path", "required": true, "schema": map[string]interface{}{"type": "string"},
+	}}
+	
+	spec := map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "Order Service",
+			"version": "1.0.0",
+		},
+		"paths": map[string]interface{}{
+			"/orders/sync": map[string]interface{}{"post": submit("Charge an order before responding", map[string]interface{}{
+				"200": response("The order was charged", jsonContent(submitResponse)),
+				"402": response("Payment refused, with its reason as JSON; other payment failures are plain text", map[string]interface{}{
+					"application/json": jsonContent(map[string]interface{}{"$ref": "#/components/schemas/PaymentFailure"})["application/json"],
+					"text/plain":       text["text/plain"],
+				}),
+			})},
+			"/orders/async": map[string]interface{}{"post": submit("Queue an order for the processor", map[string]interface{}{
+				"202": response("The order was queued", jsonContent(submitResponse)),
+				"200": response("A duplicate or replayed order, answered with the original", jsonContent(submitResponse)),
+			})},
+			"/orders/{orderId}": map[string]interface{}{
+				"get": map[string]interface{}{
+					"summary":    "Get an order",
+					"parameters": orderIDParam,
+					"responses": map[string]interface{}{
+						"200": response("The order", jsonContent(order)),
+						"404": response("No such order", text),
+					},
+				},
+				"patch": map[string]interface{}{
+					"summary":    "Replace the items of a pending order",
+					"parameters": orderIDParam,
+					"requestBody": map[string]interface{}{"required": true, "content": jsonContent(map[string]interface{}{
+						"type":                 "object",
+						"required":             []string{"items"},
+						"properties":           map[string]interface{}{"items": map[string]interface{}{"type": "array", "items": item}},
+						"additionalProperties": false,
+					})},
+					"responses": map[string]interface{}{
+						"200": response("The amended order", jsonContent(order)),
+						"400": response("Malformed JSON or unknown item field", text),
+						"404": response("No such order", text),
+						"409": response("The order is no longer pending, answered as JSON with its status; out of stock is plain text", map[string]interface{}{
+							"application/json": jsonContent(object)["application/json"],
+							"text/plain":       text["text/plain"],
+						}),
+						"415": response("Content-Type is not application/json", text),
+						"422": response("The items failed validation, or a field other than items was sent", jsonContent(map[string]interface{}{"$ref": "#/components/schemas/ValidationError"})),
+					},
+					"security": []interface{}{map[string]interface{}{}, map[string]interface{}{"apiKey": []string{}}},
+				},
+			},
+			"/health": map[string]interface{}{"get": map[string]interface{}{
+				"summary":   "Liveness check",
+				"responses": map[string]interface{}{"200": response("The service is up", jsonContent(object))},
+			}},
+			"/metrics": map[string]interface{}{"get": map[string]interface{}{
+				"summary":   "Service metrics; the sections vary with the configuration",
+				"responses": map[string]interface{}{"200": response("Current metrics", jsonContent(object))},
+			}},
+		},
+		"components": map[string]interface{}{
+			"schemas": schemas,
+			"securitySchemes": map[string]interface{}{
+				"apiKey": map[string]interface{}{"type": "apiKey", "in": "header", "name": "X-API-Key",
+					"description": "Required on POST, PATCH and DELETE requests when AUTH_ENABLED=true"},
+			},
+		},
+	}
+	return json.Marshal(spec)
+}
+
+// HandleOpenAPI serves the OpenAPI document built at startup
+func (s *OrderService) HandleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(s.openAPISpec)
+}
+
+// accessLogWriter captures the status and size of a response for the
+// access log
+type accessLogWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *accessLogWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *accessLogWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the connection, as handlers
+// that move the server's deadlines need
+func (w *accessLogWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Flush lets streaming handlers push data through the wrapper
+func (w *accessLogWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// accessLogBody counts the request body bytes a handler reads
+type accessLogBody struct {
+	io.ReadCloser
+	bytes int64
+}
+
+func (b *accessLogBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.bytes += int64(n)
+	return n, err
+}
+
+// withAccessLog wraps next so every request, matched or not and let
+// through by next or refused by it, produces one JSON line on stdout,
+// apart from the business logs on stderr. router names the matched route.
+// Latency is measured until the handler returns, so for streaming
+// responses it is the connection duration.
+func withAccessLog(router *mux.Router, next http.Handler) http.Handler {
+	accessLog := log.New(os.Stdout, "", 0)
+	
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		
+		route := "unmatched"
+		var match mux.RouteMatch
+		if router.Match(r, &match) && match.Route != nil {
+			if template, err := match.Route.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+		
+		body := &accessLogBody{ReadCloser: r.Body}
+		r.Body = body
+		recorder := &accessLogWriter{ResponseWriter: w}
+		next.ServeHTTP(recorder, r)
+		
+		status := recorder.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		line, _ := json.Marshal(map[string]interface{}{
+			"time":           start.UTC().Format(time.RFC3339Nano),
+			"request_id":     requestIDFrom(r.Context()),
+			"method":         r.Method,
+			"route":          route,
+			"path":           r.URL.Path,
+			"status":         status,
+			"latency_ms":     float64(time.Since(start).Microseconds()) / 1000,
+			"request_bytes":  body.bytes,
+			"response_bytes": recorder.bytes,
+			"client_ip":      clientIP(r),
+			"user_agent":     r.UserAgent(),
+		})
+		accessLog.Println(string(line))
+	})
+}
+
+// withMiddleware wraps router in request IDs, the access log when
+// accessLog is set, and API key auth. The access log sits outside auth, so
+// refused requests are logged too.
+func withMiddleware(router *mux.Router, keys apiKeys, accessLog bool) http.Handler {
+	handler := withAPIKeyAuth(router, keys)
+	if accessLog {
+		handler = withAccessLog(router, handler)
+	}
+	return withRequestID(handler)
+}
+
+// requestIDKey is the context key withRequestID stores the request ID under
+type requestIDKey struct{}
+
+// withRequestID gives every request an ID, keeping an incoming X-Request-ID
+// or generating a UUID, and echoes it in the response
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get("X-Request-ID")
+		if requestID == "" {
+			requestID = uuid.NewString()
+			r.Header.Set("X-Request-ID", requestID)
+		}
+		w.Header().Set("X-Request-ID", requestID)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, requestID)))
+	})
+}
+
+// corsConfig lists the cross-origin callers allowed to use the API. With
+// no origins configured the service sends no CORS headers, so browsers
+// keep it same-origin only.
+type corsConfig struct {
+	origins map[string]bool // "*" allows any origin
+	methods []string
+	headers []string
+	maxAge  time.Duration
+}
+
+// loadCORSConfig reads CORS_ALLOWED_ORIGINS, CORS_ALLOWED_METHODS,
+// CORS_ALLOWED_HEADERS and CORS_MAX_AGE
+func loadCORSConfig() (corsConfig, error) {
+	cfg := corsConfig{
+		origins: map[string]bool{},
+		methods: []string{"GET", "POST", "PATCH", "DELETE"},
+		headers: []string{"Authorization", "Content-Type", "Idempotency-Key", "X-API-Key", "X-Request-ID"},
+		maxAge:  10 * time.Minute,
+	}
+	splitList := func(value string) []string {
+		var items []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		return items
+	}
+	for _, origin := range splitList(os.Getenv("CORS_ALLOWED_ORIGINS")) {
+		cfg.origins[strings.TrimSuffix(origin, "/")] = true
+	}
+	if value := os.Getenv("CORS_ALLOWED_METHODS"); value != "" {
+		cfg.methods = nil
+		for _, method := range splitList(value) {
+			cfg.methods = append(cfg.methods, strings.ToUpper(method))
+		}
+	}
+	if value := os.Getenv("CORS_ALLOWED_HEADERS"); value != "" {
+		cfg.headers = splitList(value)
+	}
+	if value := os.Getenv("CORS_MAX_AGE"); value != "" {
+		maxAge, err := time.ParseDuration(value)
+		if err != nil || maxAge < 0 {
+			return corsConfig{}, fmt.Errorf("CORS_MAX_AGE must be a non-negative duration, got %q", value)
+		}
+		cfg.maxAge = maxAge
+	}
+	return cfg, nil
+}
+
+// allowsOrigin reports whether a browser on origin may call the API
+func (c corsConfig) allowsOrigin(origin string) bool {
+	return c.origins["*"] || c.origins[origin]
 }
 
-// Item represents a product in an order
-type Item struct {
-	ProductID string  `json:"product_id"`
-	Quantity  int     `json:"quantity"`
-	Price     float64 `json:"price"`
+// allowsHeaders reports whether every header a preflight asks for is allowed
+func (c corsConfig) allowsHeaders(requested string) bool {
+	for _, header := range strings.Split(requested, ",") {
+		header = strings.TrimSpace(header)
+		if header == "" {
+			continue
+		}
+		if !slices.ContainsFunc(c.headers, func(allowed string) bool { return strings.EqualFold(allowed, header) }) {
+			return false
+		}
+	}
+	return true
 }
 
-// OrderService handles order processing
-type OrderService struct {
-	snsClient   *sns.Client
-	snsTopicArn string
-	
-	// Payment processor with limited throughput (simulates bottleneck)
-	paymentSemaphore chan struct{}
-	
-	// Metrics
-	syncOrders      int64
-	asyncOrders     int64
-	failedOrders    int64
-	processedOrders int64
+// withCORS answers preflight requests and adds Access-Control-* headers for
+// allowed origins. A preflight from any other origin, or asking for a
+// method or header that isn't allowed, gets 403; other requests from such
+// origins are served without CORS headers, so the browser hides the
+// response.
+func withCORS(next http.Handler, cfg corsConfig) http.Handler {
+	if len(cfg.origins) == 0 {
+		return next
+	}
+	methods := strings.Join(cfg.methods, ", ")
+	headers := strings.Join(cfg.headers, ", ")
+	maxAge := strconv.Itoa(int(cfg.maxAge.Seconds()))
 	
-	// Order storage
-	orders sync.Map
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Origin")
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+		
+		if !cfg.allowsOrigin(origin) {
+			if preflight {
+				http.Error(w, "Origin not allowed", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		
+		// Echo the origin rather than "*" so the answer is right for
+		// exactly this caller
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		if !preflight {
+			w.Header().Set("Access-Control-Expose-Headers", "X-Request-ID, Retry-After")
+			next.ServeHTTP(w, r)
+			return
+		}
+		
+		if !slices.Contains(cfg.methods, r.Header.Get("Access-Control-Request-Method")) || !cfg.allowsHeaders(r.Header.Get("Access-Control-Request-Headers")) {
+			http.Error(w, "Method or headers not allowed", http.StatusForbidden)
+			return
+		}
+		w.Header().Add("Vary", "Access-Control-Request-Method")
+		w.Header().Add("Vary", "Access-Control-Request-Headers")
+		w.Header().Set("Access-Control-Allow-Methods", methods)
+		w.Header().Set("Access-Control-Allow-Headers", headers)
+		w.Header().Set("Access-Control-Max-Age", maxAge)
+		w.WriteHeader(http.StatusNoContent)
+	})
 }
 
-// NewOrderService creates a new order service
-func NewOrderService() (*OrderService, error) {
-	// Initialize AWS config
-	cfg, err := config.LoadDefaultConfig(context.TODO(),
-		config.WithRegion(os.Getenv("AWS_REGION")),
-	)
-	if err != nil {
-		log.Printf("Warning: Failed to load AWS config: %v", err)
+// apiKeys holds SHA-256 digests of the accepted API keys. Comparing
+// fixed-length digests in constant time reveals neither a key's contents
+// nor its length.
+type apiKeys [][sha256.Size]byte
+
+// loadAPIKeys reads AUTH_ENABLED and the comma-separated API_KEYS, plus one
+// key per line from API_KEYS_FILE (for mounted secrets). It returns nil
+// when authentication is disabled.
+func loadAPIKeys() (apiKeys, error) {
+	if os.Getenv("AUTH_ENABLED") != "true" {
+		return nil, nil
 	}
-	
-	service := &OrderService{
-		snsTopicArn: os.Getenv("SNS_TOPIC_ARN"),
-		// Payment processor can handle only 1 concurrent request (creates bottleneck)
-		paymentSemaphore: make(chan struct{}, 1),
+	raw := strings.Split(os.Getenv("API_KEYS"), ",")
+	if path := os.Getenv("API_KEYS_FILE"); path != "" {
+		contents, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read API_KEYS_FILE: %w", err)
+		}
+		raw = append(raw, strings.Split(string(contents), "\n")...)
 	}
-	
-	// Only initialize SNS client if we have AWS config
-	if err == nil {
-		service.snsClient = sns.NewFromConfig(cfg)
+	var keys apiKeys
+	for _, key := range raw {
+		if key = strings.TrimSpace(key); key != "" {
+			keys = append(keys, sha256.Sum256([]byte(key)))
+		}
 	}
-	
-	return service, nil
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("AUTH_ENABLED is set but API_KEYS and API_KEYS_FILE provide no keys")
+	}
+	return keys, nil
 }
 
-// ProcessPayment simulates payment verification with 3-second delay
-func (s *OrderService) ProcessPayment(orderID string) error {
-	// Acquire semaphore (blocks if at capacity)
-	s.paymentSemaphore <- struct{}{}
-	defer func() { <-s.paymentSemaphore }()
-	
-	log.Printf("Processing payment for order %s (3 second delay)...", orderID)
-	
-	// Simulate payment processing time
-	time.Sleep(3 * time.Second)
-	
-	// Simulate 1% payment failures
-	if time.Now().UnixNano()%100 == 0 {
-		return fmt.Errorf("payment declined for order %s", orderID)
+// valid reports whether key is one of the accepted keys, checking every
+// key so the time taken doesn't depend on which one matched
+func (k apiKeys) valid(key string) bool {
+	digest := sha256.Sum256([]byte(key))
+	matched := 0
+	for _, accepted := range k {
+		matched |= subtle.ConstantTimeCompare(digest[:], accepted[:])
 	}
-	
-	log.Printf("Payment processed successfully for order %s", orderID)
-	return nil
+	return matched == 1
 }
 
-// HandleSyncOrder processes orders synchronously (blocking)
-func (s *OrderService) HandleSyncOrder(w http.ResponseWriter, r *http.Request) {
-	atomic.AddInt64(&s.syncOrders, 1)
-	
-	// Parse order from request
-	var order Order
-	if err := json.NewDecoder(r.Body).Decode(&order); err != nil {
-		http.Error(w, "Invalid order data", http.StatusBadRequest)
-		return
-	}
-	
-	// Generate order ID
-	order.OrderID = uuid.New().String()
-	order.Status = "processing"
-	order.CreatedAt = time.Now()
-	
-	// Store order
-	s.orders.Store(order.OrderID, &order)
-	
-	// Process payment synchronously (blocks for 3 seconds)
-	startTime := time.Now()
-	err := s.ProcessPayment(order.OrderID)
-	processingTime := time.Since(startTime)
-	
-	if err != nil {
-		order.Status = "failed"
-		atomic.AddInt64(&s.failedOrders, 1)
-		log.Printf("Sync order %s failed after %v: %v", order.OrderID, processingTime, err)
-		http.Error(w, "Payment processing failed", http.StatusPaymentRequired)
-		return
+// presentedAPIKey returns the key from X-API-Key or an
+// "Authorization: Bearer" header, or "" if the request carries neither
+func presentedAPIKey(r *http.Request) string {
+	return apiKeyFrom(r.Header.Get("X-API-Key"), r.Header.Get("Authorization"))
+}
+
+// apiKeyFrom picks the API key out of X-API-Key and Authorization values,
+// which arrive as HTTP headers or gRPC metadata
+func apiKeyFrom(apiKey, authorization string) string {
+	if apiKey != "" {
+		return apiKey
 	}
-	
-	// Update order status
-	now := time.Now()
-	order.Status = "completed"
-	order.ProcessedAt = &now
-	atomic.AddInt64(&s.processedOrders, 1)
-	
-	// Return response
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	response := map[string]interface{}{
-		"order_id": order.OrderID,
-		"status": order.Status,
-		"processing_time": processingTime.Seconds(),
-		"message": "Order processed successfully",
+	scheme, token, ok := strings.Cut(authorization, " ")
+	if ok && strings.EqualFold(scheme, "Bearer") {
+		return strings.TrimSpace(token)
 	}
-	json.NewEncoder(w).Encode(response)
-	
-	log.Printf("Sync order %s completed in %v", order.OrderID, processingTime)
+	return ""
 }
 
-// HandleAsyncOrder accepts orders and queues them for async processing
-func (s *OrderService) HandleAsyncOrder(w http.ResponseWriter, r *http.Request) {
-	atomic.AddInt64(&s.asyncOrders, 1)
-	
-	// Parse order from request
-	var order Order
-	if err := json.NewDecoder(r.Body).Decode(&order); err != nil {
-		http.Error(w, "Invalid order data", http.StatusBadRequest)
-		return
+// withAPIKeyAuth requires a valid API key on every request that changes
+// state; reads, /health and CORS preflights stay open. A missing key gets
+// 401 and an unknown one 403.
+func withAPIKeyAuth(next http.Handler, keys apiKeys) http.Handler {
+	if keys == nil {
+		return next
 	}
-	
-	// Generate order ID
-	order.OrderID = uuid.New().String()
-	order.Status = "pending"
-	order.CreatedAt = time.Now()
-	
-	// Store order
-	s.orders.Store(order.OrderID, &order)
-	
-	// Publish to SNS for async processing
-	if s.snsClient != nil && s.snsTopicArn != "" {
-		orderJSON, _ := json.Marshal(order)
-		_, err := s.snsClient.Publish(context.TODO(), &sns.PublishInput{
-			TopicArn: aws.String(s.snsTopicArn),
-			Message:  aws.String(string(orderJSON)),
-		})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			next.ServeHTTP(w, r)
+			return
+		}
 		
-		if err != nil {
-			log.Printf("Failed to publish order %s to SNS: %v", order.OrderID, err)
-			http.Error(w, "Failed to queue order", http.StatusInternalServerError)
+		key := presentedAPIKey(r)
+		if key == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="order-service"`)
+			http.Error(w, "API key required", http.StatusUnauthorized)
+			return
+		}
+		if !keys.valid(key) {
+			slog.Warn("Rejected request with invalid API key", "request_id", requestIDFrom(r.Context()), "method", r.Method, "path", r.URL.Path)
+			http.Error(w, "Invalid API key", http.StatusForbidden)
 			return
 		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// grpcOrderServer serves orderpb.OrderService on GRPC_PORT, calling the
+// same submission and lookup logic as the HTTP handlers
+type grpcOrderServer struct {
+	orderpb.UnimplementedOrderServiceServer
+	service *OrderService
+}
+
+// newGRPCServer builds the gRPC server with request IDs and, when keys is
+// set, API key checks on the submission RPCs
+func newGRPCServer(service *OrderService, keys apiKeys) *grpc.Server {
+	server := grpc.NewServer(grpc.UnaryInterceptor(grpcInterceptor(keys)))
+	orderpb.RegisterOrderServiceServer(server, &grpcOrderServer{service: service})
+	return server
+}
+
+// grpcInterceptor gives every call a request ID, keeping an incoming
+// x-request-id like withRequestID, and applies withAPIKeyAuth's rules: only
+// GetOrder may be called without a valid key
+func grpcInterceptor(keys apiKeys) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		first := func(name string) string {
+			if values := md.Get(name); len(values) > 0 {
+				return values[0]
+			}
+			return ""
+		}
+		requestID := first("x-request-id")
+		if requestID == "" {
+			requestID = uuid.NewString()
+		}
+		grpc.SetHeader(ctx, metadata.Pairs("x-request-id", requestID))
+		ctx = context.WithValue(ctx, requestIDKey{}, requestID)
 		
-		log.Printf("Async order %s published to SNS", order.OrderID)
-	} else {
-		log.Printf("Async order %s accepted (SNS not configured)", order.OrderID)
+		if keys != nil && info.FullMethod != orderpb.OrderService_GetOrder_FullMethodName {
+			key := apiKeyFrom(first("x-api-key"), first("authorization"))
+			if key == "" {
+				return nil, status.Error(grpccodes.Unauthenticated, "API key required")
+			}
+			if !keys.valid(key) {
+				slog.Warn("Rejected request with invalid API key", "request_id", requestID, "method", info.FullMethod)
+				return nil, status.Error(grpccodes.PermissionDenied, "Invalid API key")
+			}
+		}
+		return handler(ctx, req)
 	}
-	
-	// Return immediate response (202 Accepted)
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusAccepted)
-	response := map[string]interface{}{
-		"order_id": order.OrderID,
-		"status": "accepted",
-		"message": "Order accepted for processing",
+}
+
+// grpcCodes maps the HTTP statuses orderErrors carry onto gRPC codes
+var grpcCodes = map[int]grpccodes.Code{
+	http.StatusBadRequest:          grpccodes.InvalidArgument,
+	http.StatusUnprocessableEntity: grpccodes.InvalidArgument,
+	http.StatusPaymentRequired:     grpccodes.Aborted,
+	http.StatusNotFound:            grpccodes.NotFound,
+	http.StatusConflict:            grpccodes.FailedPrecondition,
+	http.StatusGone:                grpccodes.FailedPrecondition,
+	http.StatusTooManyRequests:     grpccodes.ResourceExhausted,
+	statusClientClosedRequest:      grpccodes.Canceled,
+	http.StatusServiceUnavailable:  grpccodes.Unavailable,
+	http.StatusGatewayTimeout:      grpccodes.DeadlineExceeded,
+}
+
+// grpcError converts an orderError to a gRPC status, sending its retry
+// hint as retry-after metadata and its invalid fields in the message
+func grpcError(ctx context.Context, err error) error {
+	var rejected *orderError
+	if !errors.As(err, &rejected) {
+		return status.Error(grpccodes.Internal, "internal error")
 	}
-	json.NewEncoder(w).Encode(response)
+	code, ok := grpcCodes[rejected.status]
+	if !ok {
+		code = grpccodes.Internal
+	}
+	if rejected.retryAfter > 0 {
+		grpc.SetHeader(ctx, metadata.Pairs("retry-after", strconv.Itoa(rejected.retryAfter)))
+	}
+	message := rejected.message
+	for i, field := range rejected.fields {
+		separator := "; "
+		if i == 0 {
+			separator = ": "
+		}
+		message += separator + field.Field + " " + field.Message
+	}
+	if rejected.reason != "" {
+		message += " (" + rejected.reason + ")"
+	}
+	return status.Error(code, message)
 }
 
-// HandleHealth returns service health status
-func (s *OrderService) HandleHealth(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	health := map[string]interface{}{
-		"status": "healthy",
-		"timestamp": time.Now().Unix(),
-		"metrics": map[string]int64{
-			"sync_orders": atomic.LoadInt64(&s.syncOrders),
-			"async_orders": atomic.LoadInt64(&s.asyncOrders),
-			"processed_orders": atomic.LoadInt64(&s.processedOrders),
-			"failed_orders": atomic.LoadInt64(&s.failedOrders),
-		},
+// grpcSource describes where an RPC came from for the shared order logic
+func grpcSource(ctx context.Context, req *orderpb.SubmitOrderRequest) orderSource {
+	source := orderSource{idempotencyKey: req.GetIdempotencyKey()}
+	if p, ok := peer.FromContext(ctx); ok {
+		source.client = p.Addr.String()
+		if host, _, err := net.SplitHostPort(source.client); err == nil {
+			source.client = host
+		}
 	}
-	json.NewEncoder(w).Encode(health)
+	return source
 }
 
-// HandleMetrics returns detailed metrics
-func (s *OrderService) HandleMetrics(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	
-	// Count orders by status
-	statusCounts := map[string]int{
-		"pending": 0,
-		"processing": 0,
-		"completed": 0,
-		"failed": 0,
+// orderFromProto builds the Order an HTTP client would have posted
+func orderFromProto(req *orderpb.SubmitOrderRequest) Order {
+	order := Order{
+		CustomerID:  int(req.GetCustomerId()),
+		Currency:    req.GetCurrency(),
+		CallbackURL: req.GetCallbackUrl(),
+	}
+	for _, item := range req.GetItems() {
+		order.Items = append(order.Items, Item{
+			ProductID: item.GetProductId(),
+			Quantity:  int(item.GetQuantity()),
+			Price:     item.GetPrice(),
+			Currency:  item.GetCurrency(),
+		})
+	}
+	if req.GetProcessAfter() != nil {
+		order.ProcessAfter = &flexTime{req.GetProcessAfter().AsTime()}
 	}
+	return order
+}
+
+// resultString and resultFloat read fields of an orderResult response
+func resultString(result orderResult, key string) string {
+	if value, ok := result.response[key]; ok {
+		return fmt.Sprint(value)
+	}
+	return ""
+}
+
+func resultFloat(result orderResult, key string) float64 {
+	value, _ := result.response[key].(float64)
+	return value
+}
+
+// SubmitSync implements the SubmitSync RPC
+func (g *grpcOrderServer) SubmitSync(ctx context.Context, req *orderpb.SubmitOrderRequest) (*orderpb.SubmitSyncResponse, error) {
+	ctx, span := tracer.Start(ctx, "grpc.SubmitSync", trace.WithSpanKind(trace.SpanKindServer))
+	defer span.End()
+	atomic.AddInt64(&g.service.syncOrders, 1)
 	
-	s.orders.Range(func(key, value interface{}) bool {
-		order := value.(*Order)
-		statusCounts[order.Status]++
-		return true
-	})
+	result, err := g.service.SubmitSync(ctx, orderFromProto(req), grpcSource(ctx, req))
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	return &orderpb.SubmitSyncResponse{
+		OrderId:               resultString(result, "order_id"),
+		Status:                resultString(result, "status"),
+		Total:                 resultFloat(result, "total"),
+		ProcessingTimeSeconds: resultFloat(result, "processing_time"),
+		Message:               resultString(result, "message"),
+		Cached:                result.response["cached"] == true,
+		IdempotentReplay:      result.response["idempotent_replay"] == true,
+	}, nil
+}
+
+// SubmitAsync implements the SubmitAsync RPC
+func (g *grpcOrderServer) SubmitAsync(ctx context.Context, req *orderpb.SubmitOrderRequest) (*orderpb.SubmitAsyncResponse, error) {
+	ctx, span := tracer.Start(ctx, "grpc.SubmitAsync", trace.WithSpanKind(trace.SpanKindServer))
+	defer span.End()
+	atomic.AddInt64(&g.service.asyncOrders, 1)
 	
-	metrics := map[string]interface{}{
-		"timestamp": time.Now().Unix(),
-		"totals": map[string]int64{
-			"sync_requests": atomic.LoadInt64(&s.syncOrders),
-			"async_requests": atomic.LoadInt64(&s.asyncOrders),
-			"processed": atomic.LoadInt64(&s.processedOrders),
-			"failed": atomic.LoadInt64(&s.failedOrders),
-		},
-		"order_status": statusCounts,
-		"payment_processor": map[string]interface{}{
-			"max_concurrent": 1,
-			"bottleneck": "3 seconds per payment",
-		},
+	result, err := g.service.SubmitAsync(ctx, orderFromProto(req), grpcSource(ctx, req))
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	maxProcessingSeconds, _ := result.response["max_processing_seconds"].(int)
+	return &orderpb.SubmitAsyncResponse{
+		OrderId:              resultString(result, "order_id"),
+		Status:               resultString(result, "status"),
+		Message:              resultString(result, "message"),
+		MaxProcessingSeconds: int32(maxProcessingSeconds),
+		Duplicate:            result.response["duplicate"] == true,
+		IdempotentReplay:     result.response["idempotent_replay"] == true,
+	}, nil
+}
+
+// GetOrder implements the GetOrder RPC
+func (g *grpcOrderServer) GetOrder(ctx context.Context, req *orderpb.GetOrderRequest) (*orderpb.Order, error) {
+	order, err := g.service.LookupOrder(req.GetOrderId())
+	if err != nil {
+		return nil, grpcError(ctx, err)
 	}
 	
-	json.NewEncoder(w).Encode(metrics)
+	reply := &orderpb.Order{
+		OrderId:       order.OrderID,
+		CustomerId:    int64(order.CustomerID),
+		Status:        string(order.Status),
+		Currency:      order.Currency,
+		Total:         order.Total,
+		CreatedAt:     timestamppb.New(order.CreatedAt),
+		RetryCount:    int32(order.RetryCount),
+		FailureReason: order.FailureReason,
+	}
+	for _, item := range order.Items {
+		reply.Items = append(reply.Items, &orderpb.Item{
+			ProductId:           item.ProductID,
+			Quantity:            int32(item.Quantity),
+			Price:               item.Price,
+			Currency:            item.Currency,
+			FulfilledQuantity:   int32(item.FulfilledQuantity),
+			BackorderedQuantity: int32(item.BackorderedQuantity),
+		})
+	}
+	if order.ProcessedAt != nil {
+		reply.ProcessedAt = timestamppb.New(*order.ProcessedAt)
+	}
+	return reply, nil
 }
 
-// HandleGetOrder retrieves order details
-func (s *OrderService) HandleGetOrder(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	orderID := vars["orderId"]
+// requestIDFrom returns the ID withRequestID attached to ctx, or ""
+func requestIDFrom(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDKey{}).(string)
+	return requestID
+}
+
+// orderLogger tags log lines with the order and, when known, the request
+// that submitted it
+func orderLogger(orderID, requestID string) *slog.Logger {
+	logger := slog.With("order_id", orderID)
+	if requestID != "" {
+		logger = logger.With("request_id", requestID)
+	}
+	return logger
+}
+
+// setupLogging sends slog and the standard log package through one JSON
+// handler on stderr, filtered at LOG_LEVEL (debug, info, warn or error)
+func setupLogging() error {
+	level := slog.LevelInfo
+	if value := os.Getenv("LOG_LEVEL"); value != "" {
+		if err := level.UnmarshalText([]byte(value)); err != nil {
+			return fmt.Errorf("LOG_LEVEL must be debug, info, warn or error, got %q", value)
+		}
+	}
+	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
+	return nil
+}
+
+// setupTracing exports spans over OTLP/HTTP to OTEL_EXPORTER_OTLP_ENDPOINT.
+// Without an endpoint a noop provider is installed, so local runs need no
+// collector. The returned func flushes buffered spans on shutdown.
+func setupTracing(serviceName string) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		otel.SetTracerProvider(tracenoop.NewTracerProvider())
+		return func(context.Context) error { return nil }, nil
+	}
 	
-	value, exists := s.orders.Load(orderID)
-	if !exists {
-		http.Error(w, "Order not found", http.StatusNotFound)
-		return
+	ctx := context.Background()
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		otel.SetTracerProvider(tracenoop.NewTracerProvider())
+		return func(context.Context) error { return nil }, fmt.Errorf("failed to create OTLP exporter: %w", err)
+	}
+	// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES override the default name
+	res, err := resource.New(ctx,
+		resource.WithAttributes(attribute.String("service.name", serviceName)),
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build trace resource: %w", err)
+	}
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// clientIP prefers the first X-Forwarded-For hop set by the load balancer
+func clientIP(r *http.Request) string {
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		first, _, _ := strings.Cut(forwarded, ",")
+		return strings.TrimSpace(first)
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
 	}
+	return r.RemoteAddr
+}
+
+// registerMonitoringRoutes mounts the health and metrics handlers for a
+// component under /{component}/health and /{component}/metrics. The bare
+// /health and /metrics paths go to the first component registered on the
+// router, so a combined deployment can compose several components without
+// route collisions.
+func registerMonitoringRoutes(router *mux.Router, component string, health, metrics http.HandlerFunc) {
+	sub := router.PathPrefix("/" + component).Subrouter()
+	sub.HandleFunc("/health", health).Methods("GET")
+	sub.HandleFunc("/metrics", metrics).Methods("GET")
 	
-	order := value.(*Order)
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(order)
+	if router.Get("health") == nil {
+		router.HandleFunc("/health", health).Methods("GET").Name("health")
+	}
+	if router.Get("metrics") == nil {
+		router.HandleFunc("/metrics", metrics).Methods("GET").Name("metrics")
+	}
 }
 
 func main() {
+	if err := setupLogging(); err != nil {
+		log.Fatal(err)
+	}
+	shutdownTracing, err := setupTracing("order-service")
+	if err != nil {
+		slog.Warn("Tracing disabled", "error", err)
+	}
+	
 	// Create service
 	service, err := NewOrderService()
+	if service == nil {
+		log.Fatalf("Failed to create service: %v", err)
+	}
 	if err != nil {
-		log.Printf("Warning: Service created with limited functionality: %v", err)
+		slog.Warn("Service created with limited functionality", "error", err)
 	}
 	
 	// Setup routes
@@ -279,11 +6909,35 @@ func main() {
 	// Order endpoints
 	router.HandleFunc("/orders/sync", service.HandleSyncOrder).Methods("POST")
 	router.HandleFunc("/orders/async", service.HandleAsyncOrder).Methods("POST")
+	router.HandleFunc("/orders/preview", service.HandlePreviewOrder).Methods("POST")
+	router.HandleFunc("/orders", service.HandleListOrders).Methods("GET")
 	router.HandleFunc("/orders/{orderId}", service.HandleGetOrder).Methods("GET")
+	router.HandleFunc("/orders/{orderId}", service.HandleCancelOrder).Methods("DELETE")
+	router.HandleFunc("/orders/{orderId}", service.HandleAmendOrder).Methods("PATCH")
+	router.HandleFunc("/orders/{orderId}/retry", service.HandleRetryOrder).Methods("POST")
+	router.HandleFunc("/orders/{orderId}/webhook", service.HandleGetWebhook).Methods("GET")
+	router.HandleFunc("/orders/{orderId}/receipt", service.HandleGetReceipt).Methods("GET")
+	router.HandleFunc("/orders/{orderId}/events", service.HandleOrderEvents).Methods("GET")
+	router.HandleFunc("/customers/{customerId}/orders", service.HandleCustomerOrders).Methods("GET")
+	
+	// Admin endpoints
+	router.HandleFunc("/admin/orders/import", service.HandleImportOrders).Methods("POST")
+	router.HandleFunc("/admin/store/migrate", service.HandleMigrateStore).Methods("POST")
+	router.HandleFunc("/admin/orders/{orderId}/status", service.HandleReportStatus).Methods("POST")
+	router.HandleFunc("/admin/inventory/seed", service.HandleSeedInventory).Methods("POST")
+	router.HandleFunc("/admin/inventory/{productId}/replenish", service.HandleReplenishInventory).Methods("POST")
+	router.HandleFunc("/admin/sale/close", service.HandleCloseSale).Methods("POST")
+	router.HandleFunc("/admin/sale/open", service.HandleOpenSale).Methods("POST")
+	if service.chaos != nil {
+		router.HandleFunc("/admin/chaos", service.HandleChaos).Methods("POST")
+	}
 	
 	// Monitoring endpoints
-	router.HandleFunc("/health", service.HandleHealth).Methods("GET")
-	router.HandleFunc("/metrics", service.HandleMetrics).Methods("GET")
+	registerMonitoringRoutes(router, "service", service.HandleHealth, service.HandleMetrics)
+	router.HandleFunc("/ready", service.HandleReady).Methods("GET")
+	router.HandleFunc("/openapi.json", service.HandleOpenAPI).Methods("GET")
+	router.HandleFunc("/drain-status", service.HandleDrainStatus).Methods("GET")
+	router.Handle("/metrics/prometheus", promhttp.HandlerFor(service.promRegistry, promhttp.HandlerOpts{})).Methods("GET")
 	
 	// Start server
 	port := os.Getenv("PORT")
@@ -291,15 +6945,101 @@ func main() {
 		port = "8080"
 	}
 	
-	log.Printf("Starting Order Service on port %s", port)
+	slog.Info("Starting Order Service", "port", port)
 	log.Printf("Endpoints:")
-	log.Printf("  POST /orders/sync  - Synchronous processing (3s delay)")
+	log.Printf("  POST /orders/sync  - Synchronous processing (%v delay)", service.paymentDelay.base)
 	log.Printf("  POST /orders/async - Asynchronous processing (immediate response)")
+	log.Printf("  GET  /orders       - List orders (status, customer_id, limit, cursor)")
+	log.Printf("  GET  /customers/{id}/orders - A customer's orders, newest first (limit, cursor)")
 	log.Printf("  GET  /orders/{id}  - Get order status")
+	log.Printf("  DELETE /orders/{id} - Cancel a pending order")
+	log.Printf("  PATCH /orders/{id} - Replace a pending order's items")
+	log.Printf("  POST /orders/{id}/retry - Retry payment for a failed order")
+	log.Printf("  GET  /orders/{id}/webhook - Delivery status of the order's callback")
+	log.Printf("  GET  /orders/{id}/receipt - Receipt for a completed order")
+	log.Printf("  GET  /orders/{id}/events - Server-Sent Events stream of status changes")
+	log.Printf("  POST /admin/orders/import - Bulk import newline-delimited JSON orders")
+	log.Printf("  POST /admin/store/migrate - Copy in-memory orders into Redis, optionally switching over")
 	log.Printf("  GET  /health       - Health check")
+	log.Printf("  GET  /ready        - Readiness check (SNS reachable)")
 	log.Printf("  GET  /metrics      - Service metrics")
+	log.Printf("  GET  /metrics/prometheus - Service metrics in Prometheus text format")
+	log.Printf("  GET  /drain-status - In-memory async backlog")
+	log.Printf("  GET  /openapi.json - OpenAPI description of the order API")
+	log.Printf("  gRPC orders.v1.OrderService on GRPC_PORT, when set")
+	
+	shutdownTimeout := 30 * time.Second
+	if value := os.Getenv("SHUTDOWN_TIMEOUT"); value != "" {
+		if shutdownTimeout, err = time.ParseDuration(value); err != nil {
+			log.Fatalf("Invalid SHUTDOWN_TIMEOUT %q: %v", value, err)
+		}
+	}
+	
+	cors, err := loadCORSConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	keys, err := loadAPIKeys()
+	if err != nil {
+		log.Fatal(err)
+	}
+	
+	handler := withMiddleware(router, keys, os.Getenv("ACCESS_LOG") == "true")
+	// Outermost so preflights are answered before anything else runs
+	handler = withCORS(handler, cors)
+	
+	server := service.httpTimeouts.newServer(":"+port, handler)
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("Server failed: %v", err)
+		}
+	}()
+	
+	// The gRPC API runs beside HTTP when GRPC_PORT is set
+	var grpcServer *grpc.Server
+	if grpcPort := os.Getenv("GRPC_PORT"); grpcPort != "" {
+		listener, err := net.Listen("tcp", ":"+grpcPort)
+		if err != nil {
+			log.Fatalf("Failed to listen on GRPC_PORT %s: %v", grpcPort, err)
+		}
+		grpcServer = newGRPCServer(service, keys)
+		go func() {
+			if err := grpcServer.Serve(listener); err != nil {
+				log.Fatalf("gRPC server failed: %v", err)
+			}
+		}()
+		slog.Info("gRPC API listening", "port", grpcPort)
+	}
+	
+	// Wait for a termination signal, then stop intake and drain
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-stop
+	slog.Info("Shutting down", "signal", sig.String(), "timeout", shutdownTimeout.String())
 	
-	if err := http.ListenAndServe(":"+port, router); err != nil {
-		log.Fatalf("Server failed: %v", err)
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		slog.Error("HTTP server shutdown", "error", err)
+	}
+	if grpcServer != nil {
+		// Let in-flight RPCs finish, but no later than the shutdown deadline
+		stopped := make(chan struct{})
+		go func() {
+			grpcServer.GracefulStop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-ctx.Done():
+			grpcServer.Stop()
+		}
+	}
+	service.Shutdown(ctx)
+	if shutdownTracing != nil {
+		if err := shutdownTracing(ctx); err != nil {
+			slog.Error("Tracing shutdown", "error", err)
+		}
 	}
+	slog.Info("Order Service stopped")
 }
\ No newline at end of file
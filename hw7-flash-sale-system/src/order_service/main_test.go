@@ -0,0 +1,4130 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	grpccodes "google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"order_s/orderpb"
+)
+
+// newTestService builds an OrderService with instant, always-successful
+// payments and no SNS topic, after applying env on top of those defaults.
+// Tests that start the local async pool shut it down themselves.
+func newTestService(t *testing.T, env map[string]string) *OrderService {
+	t.Helper()
+	defaults := map[string]string{
+		"AWS_REGION":            "us-east-1",
+		"AWS_ACCESS_KEY_ID":     "test",
+		"AWS_SECRET_ACCESS_KEY": "test",
+		"SNS_TOPIC_ARN":         "",
+		"PAYMENT_LATENCY":       "0",
+		"PAYMENT_FAILURE_RATE":  "0",
+	}
+	for name, value := range defaults {
+		t.Setenv(name, value)
+	}
+	for name, value := range env {
+		t.Setenv(name, value)
+	}
+	service, err := NewOrderService()
+	if err != nil {
+		t.Fatalf("NewOrderService: %v", err)
+	}
+	return service
+}
+
+// postJSON serves a JSON POST of body to handler
+func postJSON(handler http.HandlerFunc, path, body string) *httptest.ResponseRecorder {
+	return post(handler, path, "application/json", body)
+}
+
+// post serves a POST of body, declared as contentType unless that is
+// empty, to handler
+func post(handler http.HandlerFunc, path, contentType, body string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	if contentType != "" {
+		request.Header.Set("Content-Type", contentType)
+	}
+	rec := httptest.NewRecorder()
+	handler(rec, request)
+	return rec
+}
+
+// labelled answers with a fixed body so tests can tell handlers apart
+func labelled(label string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) { w.Write([]byte(label)) }
+}
+
+// get serves a GET for path and returns the recorded response
+func get(handler http.Handler, path string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	return rec
+}
+
+func TestCombinedRouterKeepsMonitoringRoutesApart(t *testing.T) {
+	service := newTestService(t, nil)
+	router := mux.NewRouter()
+	registerMonitoringRoutes(router, "service", service.HandleHealth, service.HandleMetrics)
+	// A second component on the same router must not panic or collide
+	registerMonitoringRoutes(router, "processor", labelled("processor health"), labelled("processor metrics"))
+
+	for path, want := range map[string]string{
+		"/processor/health":  "processor health",
+		"/processor/metrics": "processor metrics",
+	} {
+		if rec := get(router, path); rec.Code != http.StatusOK || rec.Body.String() != want {
+			t.Errorf("GET %s = %d %q, want %q", path, rec.Code, rec.Body, want)
+		}
+	}
+	for _, path := range []string{"/service/health", "/service/metrics", "/health", "/metrics"} {
+		rec := get(router, path)
+		if rec.Code != http.StatusOK {
+			t.Errorf("GET %s = %d, want 200", path, rec.Code)
+		}
+		if body := rec.Body.String(); body == "processor health" || body == "processor metrics" {
+			t.Errorf("GET %s reached the processor's handler", path)
+		}
+	}
+}
+
+func TestPaymentDelayScalesWithTotalWithinCap(t *testing.T) {
+	t.Setenv("PAYMENT_LATENCY", "")
+	t.Setenv("PAYMENT_LATENCY_JITTER", "")
+	t.Setenv("PAYMENT_BASE_MS", "1000")
+	t.Setenv("PAYMENT_PER_100_MS", "250")
+	t.Setenv("PAYMENT_MAX_MS", "2000")
+	delays, err := loadPaymentDelayConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		total float64
+		want  time.Duration
+	}{
+		{0, time.Second},
+		{99.99, time.Second},
+		{100, 1250 * time.Millisecond},
+		{350, 1750 * time.Millisecond},
+		{400, 2 * time.Second},
+		{10000, 2 * time.Second},
+	} {
+		if got := delays.delayFor(tc.total); got != tc.want {
+			t.Errorf("delayFor(%v) = %v, want %v", tc.total, got, tc.want)
+		}
+	}
+
+	t.Setenv("PAYMENT_PER_100_MS", "-1")
+	if _, err := loadPaymentDelayConfig(); err == nil {
+		t.Error("negative PAYMENT_PER_100_MS accepted")
+	}
+}
+
+// importOrders posts an NDJSON body to HandleImportOrders and decodes the
+// summary it returns
+func importOrders(t *testing.T, s *OrderService, body string) (accepted, rejected int, results []importResult) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	s.HandleImportOrders(rec, httptest.NewRequest(http.MethodPost, "/admin/orders/import", strings.NewReader(body)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("import returned %d: %s", rec.Code, rec.Body)
+	}
+	var summary struct {
+		Accepted int            `json:"accepted"`
+		Rejected int            `json:"rejected"`
+		Results  []importResult `json:"results"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&summary); err != nil {
+		t.Fatal(err)
+	}
+	return summary.Accepted, summary.Rejected, summary.Results
+}
+
+func TestImportReportsMalformedLinesAndKeepsGoing(t *testing.T) {
+	s := newTestService(t, map[string]string{"IMPORT_RATE": "0"})
+	body := strings.Join([]string{
+		`{"customer_id":1,"items":[{"product_id":"a","quantity":1,"price":5}]}`,
+		`{"customer_id":1,"items":[`,
+		``,
+		`{"customer_id":2,"items":[]}`,
+		`{"customer_id":3,"items":[{"product_id":"b","quantity":0,"price":5}]}`,
+		`{"customer_id":4,"items":[{"product_id":"c","quantity":2,"price":7.5}]}`,
+	}, "\n")
+
+	accepted, rejected, results := importOrders(t, s, body)
+	if accepted != 2 || rejected != 3 {
+		t.Fatalf("accepted %d, rejected %d; want 2 and 3", accepted, rejected)
+	}
+	want := map[int]string{1: "accepted", 2: "rejected", 4: "rejected", 5: "rejected", 6: "accepted"}
+	if len(results) != len(want) {
+		t.Fatalf("results %+v, want one per non-blank line", results)
+	}
+	for _, result := range results {
+		if result.Status != want[result.Line] {
+			t.Errorf("line %d %s (%s), want %s", result.Line, result.Status, result.Error, want[result.Line])
+		}
+		if result.Status == "rejected" && result.Error == "" {
+			t.Errorf("line %d rejected without a reason", result.Line)
+		}
+		if result.Status != "accepted" {
+			continue
+		}
+		stored, err := s.orders.Get(result.OrderID)
+		if err != nil || stored == nil || stored.Status != StatusPending {
+			t.Errorf("line %d order %q stored as %+v, %v; want pending", result.Line, result.OrderID, stored, err)
+		}
+	}
+}
+
+func TestImportStopsAtTheOrderCap(t *testing.T) {
+	s := newTestService(t, map[string]string{"IMPORT_RATE": "0", "IMPORT_MAX_ORDERS": "2"})
+	line := `{"customer_id":1,"items":[{"product_id":"a","quantity":1,"price":5}]}`
+
+	accepted, _, results := importOrders(t, s, strings.Repeat(line+"\n", 5))
+	if accepted != 2 {
+		t.Errorf("accepted %d, want the cap of 2", accepted)
+	}
+	if last := results[len(results)-1]; len(results) != 3 || last.Status != "skipped" || last.Line != 3 {
+		t.Errorf("results %+v, want two accepted then line 3 skipped", results)
+	}
+}
+
+func TestMetricsCountersStaySaneNearMax(t *testing.T) {
+	s := newTestService(t, nil)
+	s.processedOrders = math.MaxInt64 - 2
+
+	previous := 0.0
+	for i := 0; i < 5; i++ {
+		rec := get(http.HandlerFunc(s.HandleMetrics), "/metrics")
+		var metrics struct {
+			CountersSince time.Time          `json:"counters_since"`
+			Totals        map[string]float64 `json:"totals"`
+		}
+		if err := json.NewDecoder(rec.Body).Decode(&metrics); err != nil {
+			t.Fatal(err)
+		}
+		if metrics.CountersSince.IsZero() {
+			t.Fatal("metrics missing counters_since")
+		}
+		processed := metrics.Totals["processed"]
+		if processed < 0 || processed < previous {
+			t.Fatalf("after %d increments processed went from %v to %v", i, previous, processed)
+		}
+		previous = processed
+		// The third increment wraps the raw int64
+		atomic.AddInt64(&s.processedOrders, 1)
+	}
+	if got := loadCounter(&s.processedOrders); got != math.MaxInt64 {
+		t.Errorf("wrapped counter reads %d, want math.MaxInt64", got)
+	}
+}
+
+func TestMixedCurrencyOrdersAreRejected(t *testing.T) {
+	s := newTestService(t, map[string]string{"CURRENCY_SUPPORT": "true", "ASYNC_STRICT": "false"})
+
+	for name, body := range map[string]string{
+		"items differ": `{"customer_id":1,"items":[
+			{"product_id":"a","quantity":1,"price":10,"currency":"USD"},
+			{"product_id":"b","quantity":1,"price":10,"currency":"EUR"}]}`,
+		"item differs from order": `{"customer_id":1,"currency":"GBP","items":[
+			{"product_id":"a","quantity":1,"price":10,"currency":"EUR"}]}`,
+	} {
+		for _, path := range []string{"/orders/async", "/orders/sync"} {
+			handler := s.HandleAsyncOrder
+			if path == "/orders/sync" {
+				handler = s.HandleSyncOrder
+			}
+			rec := postJSON(handler, path, body)
+			if rec.Code != http.StatusUnprocessableEntity || !strings.Contains(rec.Body.String(), "mixes currencies") {
+				t.Errorf("%s to %s: %d %s, want 422 mixed currencies", name, path, rec.Code, rec.Body)
+			}
+		}
+	}
+	if orders, _ := s.orders.List(""); len(orders) != 0 {
+		t.Errorf("rejected orders were stored: %+v", orders)
+	}
+
+	rec := postJSON(s.HandleAsyncOrder, "/orders/async", `{"customer_id":1,"items":[
+		{"product_id":"a","quantity":1,"price":10,"currency":"eur"},
+		{"product_id":"b","quantity":1,"price":10}]}`)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("single-currency order: %d %s", rec.Code, rec.Body)
+	}
+	var accepted Order
+	json.NewDecoder(rec.Body).Decode(&accepted)
+	stored, err := s.orders.Get(accepted.OrderID)
+	if err != nil || stored == nil {
+		t.Fatalf("accepted order not stored: %v", err)
+	}
+	if stored.Currency != "EUR" || stored.Items[1].Currency != "EUR" {
+		t.Errorf("stored currency %s, item currency %s; want EUR for both", stored.Currency, stored.Items[1].Currency)
+	}
+}
+
+func TestDisabledCurrencySupportUsesTheDefault(t *testing.T) {
+	t.Setenv("CURRENCY_SUPPORT", "")
+	t.Setenv("DEFAULT_CURRENCY", "gbp")
+	currency, err := loadCurrencyConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	order := Order{Items: []Item{{ProductID: "a", Currency: "USD"}, {ProductID: "b", Currency: "EUR"}}}
+	if err := currency.resolve(&order); err != nil {
+		t.Fatalf("resolve: %v", err)
+	}
+	if order.Currency != "GBP" || order.Items[0].Currency != "GBP" || order.Items[1].Currency != "GBP" {
+		t.Errorf("order resolved to %+v, want GBP throughout", order)
+	}
+}
+
+// submitAsync places n single-item async orders and returns their IDs
+func submitAsync(t *testing.T, s *OrderService, n int) []string {
+	t.Helper()
+	orderIDs := make([]string, n)
+	for i := range orderIDs {
+		rec := postJSON(s.HandleAsyncOrder, "/orders/async", `{"customer_id":1,"items":[{"product_id":"a","quantity":1,"price":5}]}`)
+		if rec.Code != http.StatusAccepted {
+			t.Fatalf("async order %d: %d %s", i, rec.Code, rec.Body)
+		}
+		var order Order
+		json.NewDecoder(rec.Body).Decode(&order)
+		orderIDs[i] = order.OrderID
+	}
+	return orderIDs
+}
+
+// drainStatus returns the fallback section of /drain-status
+func drainStatus(t *testing.T, s *OrderService) map[string]interface{} {
+	t.Helper()
+	var status struct {
+		Fallback map[string]interface{} `json:"fallback"`
+	}
+	if err := json.NewDecoder(get(http.HandlerFunc(s.HandleDrainStatus), "/drain-status").Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	return status.Fallback
+}
+
+func TestShutdownFinishesQueuedLocalOrders(t *testing.T) {
+	s := newTestService(t, map[string]string{"LOCAL_ASYNC_WORKERS": "2", "PAYMENT_LATENCY": "20ms"})
+	orderIDs := submitAsync(t, s, 6)
+	if backlog := drainStatus(t, s); backlog["enabled"] != true || backlog["queued"].(float64)+backlog["in_flight"].(float64) == 0 {
+		t.Errorf("drain status %v, want the pending backlog reported", backlog)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	s.Shutdown(ctx)
+
+	for _, orderID := range orderIDs {
+		if order, _ := s.orders.Get(orderID); order == nil || order.Status != StatusCompleted {
+			t.Errorf("order %s after shutdown: %+v, want completed", orderID, order)
+		}
+	}
+	if backlog := drainStatus(t, s); backlog["draining"] != true || backlog["queued"].(float64) != 0 {
+		t.Errorf("drain status after shutdown %v, want draining with nothing queued", backlog)
+	}
+	if rec := postJSON(s.HandleAsyncOrder, "/orders/async", `{"customer_id":1,"items":[{"product_id":"a","quantity":1,"price":5}]}`); rec.Code == http.StatusAccepted {
+		t.Error("async order accepted after shutdown")
+	}
+}
+
+func TestShutdownDeadlinePersistsUnprocessedLocalOrders(t *testing.T) {
+	dump := filepath.Join(t.TempDir(), "unprocessed.ndjson")
+	s := newTestService(t, map[string]string{
+		"LOCAL_ASYNC_WORKERS": "1",
+		"PAYMENT_LATENCY":     "300ms",
+		"SHUTDOWN_DUMP_FILE":  dump,
+	})
+	orderIDs := submitAsync(t, s, 4)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	s.Shutdown(ctx)
+	// Let the order in flight at the deadline finish
+	time.Sleep(500 * time.Millisecond)
+
+	dumped := map[string]bool{}
+	data, err := os.ReadFile(dump)
+	if err != nil {
+		t.Fatalf("reading dump file: %v", err)
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var order Order
+		if err := json.Unmarshal([]byte(line), &order); err != nil {
+			t.Fatalf("dump line %q: %v", line, err)
+		}
+		dumped[order.OrderID] = true
+	}
+	if len(dumped) == 0 {
+		t.Fatal("nothing was dumped although the deadline passed with orders queued")
+	}
+	for _, orderID := range orderIDs {
+		order, _ := s.orders.Get(orderID)
+		switch {
+		case dumped[orderID] && order.Status != StatusPending:
+			t.Errorf("dumped order %s is %s, want still pending for re-import", orderID, order.Status)
+		case !dumped[orderID] && order.Status != StatusCompleted:
+			t.Errorf("order %s neither dumped nor completed: %s", orderID, order.Status)
+		}
+	}
+}
+
+func TestPaymentSlotIsGrantedInArrivalOrder(t *testing.T) {
+	slots := newPaymentScheduler(1, 1, 0)
+	if err := slots.Acquire(context.Background(), laneSync); err != nil {
+		t.Fatal(err)
+	}
+
+	const waiters = 8
+	var mu sync.Mutex
+	var served []int
+	var wg sync.WaitGroup
+	for i := 0; i < waiters; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := slots.Acquire(context.Background(), laneSync); err != nil {
+				t.Error(err)
+				return
+			}
+			mu.Lock()
+			served = append(served, i)
+			mu.Unlock()
+			slots.Release()
+		}()
+		// Queue the next waiter only once this one is in line
+		for {
+			if waiting, _, _ := slots.Stats(); waiting == i+1 {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	if _, _, oldest := slots.Stats(); oldest <= 0 {
+		t.Errorf("oldest waiter age %v with %d queued", oldest, waiters)
+	}
+
+	slots.Release()
+	wg.Wait()
+	for i, waiter := range served {
+		if waiter != i {
+			t.Fatalf("slots granted in order %v, want arrival order", served)
+		}
+	}
+}
+
+func TestPaymentSlotAcquireTimeoutLeavesTheQueue(t *testing.T) {
+	slots := newPaymentScheduler(1, 1, 0)
+	slots.Acquire(context.Background(), laneSync)
+
+	started := time.Now()
+	err := slots.TryAcquire(context.Background(), laneSync, 20*time.Millisecond)
+	if !errors.Is(err, errPaymentBusy) {
+		t.Fatalf("TryAcquire on a busy slot returned %v, want errPaymentBusy", err)
+	}
+	if waited := time.Since(started); waited < 20*time.Millisecond {
+		t.Errorf("gave up after %v, before the 20ms wait", waited)
+	}
+	if waiting, _, _ := slots.Stats(); waiting != 0 {
+		t.Errorf("%d waiters still queued after the timeout", waiting)
+	}
+	// The released slot is free again rather than granted to the timed-out waiter
+	slots.Release()
+	if err := slots.TryAcquire(context.Background(), laneSync, 0); err != nil {
+		t.Errorf("slot not free after release: %v", err)
+	}
+}
+
+// reportStatus posts a processor status report for orderID
+func reportStatus(s *OrderService, orderID string, status OrderStatus) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(http.MethodPost, "/admin/orders/"+orderID+"/status", strings.NewReader(`{"status":"`+string(status)+`"}`))
+	request.Header.Set("Content-Type", "application/json")
+	request = mux.SetURLVars(request, map[string]string{"orderId": orderID})
+	rec := httptest.NewRecorder()
+	s.HandleReportStatus(rec, request)
+	return rec
+}
+
+// storePending saves a pending single-item order under orderID
+func storePending(t *testing.T, s *OrderService, orderID string) *Order {
+	t.Helper()
+	order := &Order{OrderID: orderID, CustomerID: 1, Items: []Item{{ProductID: "a", Quantity: 1, Price: 5}}, Status: StatusPending, CreatedAt: time.Now()}
+	if err := s.orders.Put(order); err != nil {
+		t.Fatal(err)
+	}
+	return order
+}
+
+// storedStatus reads an order's status back from the store
+func storedStatus(t *testing.T, s *OrderService, orderID string) OrderStatus {
+	t.Helper()
+	order, err := s.orders.Get(orderID)
+	if err != nil || order == nil {
+		t.Fatalf("order %s not stored: %v", orderID, err)
+	}
+	return order.Status
+}
+
+func TestStalledProcessingOrdersAreFailed(t *testing.T) {
+	s := newTestService(t, map[string]string{"PROCESSING_LEASE": "1s"})
+	storePending(t, s, "crashed")
+	storePending(t, s, "alive")
+	for _, orderID := range []string{"crashed", "alive"} {
+		if rec := reportStatus(s, orderID, StatusProcessing); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "lease_expires_at") {
+			t.Fatalf("processing report for %s: %d %s", orderID, rec.Code, rec.Body)
+		}
+	}
+
+	if stalled := s.failStalledOrders(time.Now()); stalled != 0 {
+		t.Fatalf("%d orders failed within their lease", stalled)
+	}
+
+	// Only the live processor renews its order's lease
+	time.Sleep(600 * time.Millisecond)
+	reportStatus(s, "alive", StatusProcessing)
+	time.Sleep(600 * time.Millisecond)
+	// The background reaper may get to the stalled order first
+	s.failStalledOrders(time.Now())
+	if got := storedStatus(t, s, "crashed"); got != StatusFailedStalled {
+		t.Errorf("crashed order is %s, want failed_stalled", got)
+	}
+	if got := storedStatus(t, s, "alive"); got != StatusProcessing {
+		t.Errorf("renewed order is %s, want still processing", got)
+	}
+
+	// A late report from the crashed processor can't revive the order
+	if rec := reportStatus(s, "crashed", StatusProcessing); rec.Code != http.StatusConflict {
+		t.Errorf("processing report on a stalled order returned %d, want 409", rec.Code)
+	}
+}
+
+func TestHeldLeaseKeepsLocalOrderFromStalling(t *testing.T) {
+	s := newTestService(t, map[string]string{"PROCESSING_LEASE": "1s"})
+	order := storePending(t, s, "slow")
+	if err := s.UpdateStatus(order, StatusProcessing, StatusPending); err != nil {
+		t.Fatal(err)
+	}
+	release := s.holdLease(order)
+	time.Sleep(1500 * time.Millisecond)
+	if stalled := s.failStalledOrders(time.Now()); stalled != 0 {
+		t.Errorf("%d orders failed while their lease was held", stalled)
+	}
+
+	release()
+	s.failStalledOrders(time.Now().Add(2 * time.Second))
+	if got := storedStatus(t, s, "slow"); got != StatusFailedStalled {
+		t.Errorf("order is %s once its released lease ran out, want failed_stalled", got)
+	}
+}
+
+func TestProcessingLeaseHasAFloor(t *testing.T) {
+	t.Setenv("PROCESSING_LEASE", "2ms")
+	if _, err := NewOrderService(); err == nil {
+		t.Error("PROCESSING_LEASE below the minimum accepted")
+	}
+}
+
+func TestOrderEndpointsRequireJSONContentType(t *testing.T) {
+	s := newTestService(t, map[string]string{"ASYNC_STRICT": "false"})
+	body := `{"customer_id":1,"items":[{"product_id":"a","quantity":1,"price":5}]}`
+	handlers := map[string]http.HandlerFunc{
+		"/orders/sync":    s.HandleSyncOrder,
+		"/orders/async":   s.HandleAsyncOrder,
+		"/orders/preview": s.HandlePreviewOrder,
+		"/orders/missing": s.HandleAmendOrder,
+	}
+
+	for _, tc := range []struct {
+		contentType string
+		accepted    bool
+	}{
+		{"", false},
+		{"text/plain", false},
+		{"application/x-www-form-urlencoded", false},
+		{"application/xml", false},
+		{"application/json", true},
+		{"application/json; charset=utf-8", true},
+		{"Application/JSON;charset=UTF-8", true},
+	} {
+		for path, handler := range handlers {
+			rec := post(handler, path, tc.contentType, body)
+			if rejected := rec.Code == http.StatusUnsupportedMediaType; rejected == tc.accepted {
+				t.Errorf("POST %s with Content-Type %q: %d %s", path, tc.contentType, rec.Code, rec.Body)
+			}
+			if !tc.accepted && !strings.Contains(rec.Body.String(), "application/json") {
+				t.Errorf("POST %s with Content-Type %q: message %q doesn't name the expected type", path, tc.contentType, rec.Body)
+			}
+		}
+	}
+}
+
+// submitted is the part of an order submission response dedup tests read
+type submitted struct {
+	code      int
+	OrderID   string `json:"order_id"`
+	Duplicate bool   `json:"duplicate"`
+}
+
+// submitOrder posts body to the async endpoint and decodes the response
+func submitOrder(t *testing.T, s *OrderService, body string) submitted {
+	t.Helper()
+	rec := postJSON(s.HandleAsyncOrder, "/orders/async", body)
+	result := submitted{code: rec.Code}
+	if err := json.NewDecoder(rec.Body).Decode(&result); err != nil {
+		t.Fatalf("async order %s: %d with undecodable body: %v", body, rec.Code, err)
+	}
+	return result
+}
+
+func TestContentDedupWithinWindow(t *testing.T) {
+	s := newTestService(t, map[string]string{"CONTENT_DEDUP_WINDOW": "300ms", "ASYNC_STRICT": "false"})
+	order := `{"customer_id":1,"items":[{"product_id":"a","quantity":1,"price":5},{"product_id":"b","quantity":2,"price":3}]}`
+	sameItemsReordered := `{"customer_id":1,"items":[{"product_id":"b","quantity":2,"price":3},{"product_id":"a","quantity":1,"price":5}]}`
+
+	first := submitOrder(t, s, order)
+	if first.code != http.StatusAccepted || first.Duplicate {
+		t.Fatalf("first order: %+v", first)
+	}
+	again := submitOrder(t, s, sameItemsReordered)
+	if again.code != http.StatusOK || !again.Duplicate || again.OrderID != first.OrderID {
+		t.Errorf("identical order within the window: %+v, want %s returned as duplicate", again, first.OrderID)
+	}
+
+	for name, body := range map[string]string{
+		"other quantity": `{"customer_id":1,"items":[{"product_id":"a","quantity":2,"price":5},{"product_id":"b","quantity":2,"price":3}]}`,
+		"other customer": `{"customer_id":2,"items":[{"product_id":"a","quantity":1,"price":5},{"product_id":"b","quantity":2,"price":3}]}`,
+	} {
+		if different := submitOrder(t, s, body); different.code != http.StatusAccepted || different.Duplicate || different.OrderID == first.OrderID {
+			t.Errorf("%s: %+v, want a new order", name, different)
+		}
+	}
+
+	// The same purchase again after the window is a new order
+	time.Sleep(350 * time.Millisecond)
+	if later := submitOrder(t, s, order); later.code != http.StatusAccepted || later.Duplicate || later.OrderID == first.OrderID {
+		t.Errorf("identical order after the window: %+v, want a new order", later)
+	}
+}
+
+func TestContentDedupUnderConcurrentDoubleSubmits(t *testing.T) {
+	s := newTestService(t, map[string]string{"CONTENT_DEDUP_WINDOW": "1m", "ASYNC_STRICT": "false"})
+	order := `{"customer_id":7,"items":[{"product_id":"a","quantity":1,"price":5}]}`
+
+	var wg sync.WaitGroup
+	results := make([]submitted, 10)
+	for i := range results {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = submitOrder(t, s, order)
+		}()
+	}
+	wg.Wait()
+
+	created := map[string]bool{}
+	for _, result := range results {
+		if !result.Duplicate {
+			created[result.OrderID] = true
+		}
+	}
+	if len(created) != 1 {
+		t.Fatalf("%d orders created from identical concurrent submissions, want 1", len(created))
+	}
+	for _, result := range results {
+		if !created[result.OrderID] {
+			t.Errorf("duplicate returned %s, not the created order", result.OrderID)
+		}
+	}
+}
+
+func TestContentDedupIsOffByDefault(t *testing.T) {
+	s := newTestService(t, map[string]string{"ASYNC_STRICT": "false"})
+	order := `{"customer_id":1,"items":[{"product_id":"a","quantity":1,"price":5}]}`
+	if first, second := submitOrder(t, s, order), submitOrder(t, s, order); second.Duplicate || second.OrderID == first.OrderID {
+		t.Errorf("repeated order deduplicated without CONTENT_DEDUP_WINDOW: %+v then %+v", first, second)
+	}
+}
+
+// replenish posts a replenishment of quantity units of productID
+func replenish(s *OrderService, productID string, quantity int) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(http.MethodPost, "/admin/inventory/"+productID+"/replenish", strings.NewReader(fmt.Sprintf(`{"quantity":%d}`, quantity)))
+	request.Header.Set("Content-Type", "application/json")
+	request = mux.SetURLVars(request, map[string]string{"productId": productID})
+	rec := httptest.NewRecorder()
+	s.HandleReplenishInventory(rec, request)
+	return rec
+}
+
+func TestReplenishedProductSellsAgain(t *testing.T) {
+	s := newTestService(t, map[string]string{"INVENTORY": "tee=2", "ASYNC_STRICT": "false"})
+	order := `{"customer_id":1,"items":[{"product_id":"tee","quantity":1,"price":20}]}`
+	for i := 0; i < 2; i++ {
+		if rec := postJSON(s.HandleAsyncOrder, "/orders/async", order); rec.Code != http.StatusAccepted {
+			t.Fatalf("order %d while in stock: %d %s", i, rec.Code, rec.Body)
+		}
+	}
+	if rec := postJSON(s.HandleAsyncOrder, "/orders/async", order); rec.Code != http.StatusConflict {
+		t.Fatalf("order once sold out: %d %s, want 409", rec.Code, rec.Body)
+	}
+
+	rec := replenish(s, "tee", 3)
+	var counts struct{ Before, After int }
+	json.NewDecoder(rec.Body).Decode(&counts)
+	if rec.Code != http.StatusOK || counts.Before != 0 || counts.After != 3 {
+		t.Fatalf("replenish: %d, before %d after %d; want 200 from 0 to 3", rec.Code, counts.Before, counts.After)
+	}
+	for i := 0; i < 3; i++ {
+		if rec := postJSON(s.HandleAsyncOrder, "/orders/async", order); rec.Code != http.StatusAccepted {
+			t.Fatalf("order %d after replenishing: %d %s", i, rec.Code, rec.Body)
+		}
+	}
+	if rec := postJSON(s.HandleAsyncOrder, "/orders/async", order); rec.Code != http.StatusConflict {
+		t.Errorf("order beyond the replenished stock: %d, want 409", rec.Code)
+	}
+}
+
+func TestReplenishIsAtomicAgainstReservations(t *testing.T) {
+	s := newTestService(t, map[string]string{"INVENTORY": "tee=0", "ASYNC_STRICT": "false"})
+	order := `{"customer_id":1,"items":[{"product_id":"tee","quantity":1,"price":20}]}`
+
+	// Replenish one unit at a time while buyers race for the stock
+	var wg sync.WaitGroup
+	var sold int64
+	for i := 0; i < 50; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			replenish(s, "tee", 1)
+		}()
+		go func() {
+			defer wg.Done()
+			if postJSON(s.HandleAsyncOrder, "/orders/async", order).Code == http.StatusAccepted {
+				atomic.AddInt64(&sold, 1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	var counts struct{ Before int }
+	json.NewDecoder(replenish(s, "tee", 1).Body).Decode(&counts)
+	if remaining := counts.Before; int64(remaining)+sold != 50 {
+		t.Errorf("sold %d with %d left from 50 replenished units", sold, remaining)
+	}
+}
+
+func TestReplenishRejectsUnknownProductsAndBadQuantities(t *testing.T) {
+	s := newTestService(t, map[string]string{"INVENTORY": "tee=1"})
+	if rec := replenish(s, "mug", 5); rec.Code != http.StatusNotFound {
+		t.Errorf("replenishing an untracked product: %d, want 404", rec.Code)
+	}
+	for _, quantity := range []int{0, -3} {
+		if rec := replenish(s, "tee", quantity); rec.Code != http.StatusBadRequest {
+			t.Errorf("replenishing %d units: %d, want 400", quantity, rec.Code)
+		}
+	}
+}
+
+// streamsOpen reads the open stream count from /metrics
+func streamsOpen(t *testing.T, s *OrderService) float64 {
+	t.Helper()
+	var metrics struct {
+		Streams map[string]float64 `json:"streams"`
+	}
+	if err := json.NewDecoder(get(http.HandlerFunc(s.HandleMetrics), "/metrics").Body).Decode(&metrics); err != nil {
+		t.Fatal(err)
+	}
+	return metrics.Streams["open"]
+}
+
+// openStream starts an event stream for orderID on server and waits for
+// its response headers
+func openStream(t *testing.T, server *httptest.Server, orderID string) *http.Response {
+	t.Helper()
+	response, err := server.Client().Get(server.URL + "/orders/" + orderID + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { response.Body.Close() })
+	return response
+}
+
+func TestEventStreamsBeyondTheCapAreRejected(t *testing.T) {
+	s := newTestService(t, map[string]string{"MAX_STREAM_CONNS": "3"})
+	storePending(t, s, "watched")
+	router := mux.NewRouter()
+	router.HandleFunc("/orders/{orderId}/events", s.HandleOrderEvents)
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+
+	var streams []*http.Response
+	for i := 0; i < 3; i++ {
+		response := openStream(t, server, "watched")
+		if response.StatusCode != http.StatusOK {
+			t.Fatalf("stream %d within the cap: %d", i, response.StatusCode)
+		}
+		streams = append(streams, response)
+	}
+	if open := streamsOpen(t, s); open != 3 {
+		t.Errorf("metrics report %v open streams, want 3", open)
+	}
+	for i := 0; i < 2; i++ {
+		if response := openStream(t, server, "watched"); response.StatusCode != http.StatusServiceUnavailable {
+			t.Errorf("stream beyond the cap: %d, want 503", response.StatusCode)
+		}
+	}
+
+	// Closing a stream frees its place
+	streams[0].Body.Close()
+	if !eventually(t, 2*time.Second, func() bool { return streamsOpen(t, s) == 2 }) {
+		t.Fatalf("closed stream still counted: %v open", streamsOpen(t, s))
+	}
+	if response := openStream(t, server, "watched"); response.StatusCode != http.StatusOK {
+		t.Errorf("stream after one closed: %d, want 200", response.StatusCode)
+	}
+}
+
+func TestIdleEventStreamsAreClosed(t *testing.T) {
+	s := newTestService(t, map[string]string{"STREAM_IDLE_TIMEOUT": "50ms", "STREAM_HEARTBEAT": "20ms"})
+	storePending(t, s, "quiet")
+	router := mux.NewRouter()
+	router.HandleFunc("/orders/{orderId}/events", s.HandleOrderEvents)
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+
+	response := openStream(t, server, "quiet")
+	done := make(chan error, 1)
+	go func() {
+		_, err := io.ReadAll(response.Body)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("idle stream ended with %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("idle stream was never closed")
+	}
+	if !eventually(t, 2*time.Second, func() bool { return streamsOpen(t, s) == 0 }) {
+		t.Errorf("%v streams still counted after the idle one closed", streamsOpen(t, s))
+	}
+}
+
+// eventually polls condition every 10ms until it holds or timeout passes
+func eventually(t *testing.T, timeout time.Duration, condition func() bool) bool {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return true
+}
+
+func TestQuantityPerItemCap(t *testing.T) {
+	s := newTestService(t, map[string]string{"MAX_QUANTITY_PER_ITEM": "5", "ASYNC_STRICT": "false"})
+	for _, tc := range []struct {
+		quantity int
+		want     int
+	}{
+		{4, http.StatusAccepted},
+		{5, http.StatusAccepted},
+		{6, http.StatusUnprocessableEntity},
+	} {
+		body := fmt.Sprintf(`{"customer_id":1,"items":[{"product_id":"a","quantity":1,"price":5},{"product_id":"gpu","quantity":%d,"price":5}]}`, tc.quantity)
+		rec := postJSON(s.HandleAsyncOrder, "/orders/async", body)
+		if rec.Code != tc.want {
+			t.Errorf("quantity %d: %d %s, want %d", tc.quantity, rec.Code, rec.Body, tc.want)
+		}
+		if tc.want == http.StatusUnprocessableEntity && !strings.Contains(rec.Body.String(), "gpu") {
+			t.Errorf("quantity %d: rejection %q doesn't name the item", tc.quantity, rec.Body)
+		}
+	}
+
+	// The preview applies the same rule
+	if rec := postJSON(s.HandlePreviewOrder, "/orders/preview", `{"customer_id":1,"items":[{"product_id":"gpu","quantity":6,"price":5}]}`); rec.Code != http.StatusUnprocessableEntity {
+		t.Errorf("preview above the cap: %d, want 422", rec.Code)
+	}
+}
+
+func TestQuantityPerItemCapDefaultsAndDisables(t *testing.T) {
+	if s := newTestService(t, nil); s.maxQuantityPerItem != 10 {
+		t.Errorf("default cap %d, want 10", s.maxQuantityPerItem)
+	}
+	s := newTestService(t, map[string]string{"MAX_QUANTITY_PER_ITEM": "0", "ASYNC_STRICT": "false"})
+	if rec := postJSON(s.HandleAsyncOrder, "/orders/async", `{"customer_id":1,"items":[{"product_id":"a","quantity":500,"price":1}]}`); rec.Code != http.StatusAccepted {
+		t.Errorf("large quantity with the cap disabled: %d %s", rec.Code, rec.Body)
+	}
+}
+
+// failingIDs is an order ID generator whose random source is unavailable
+func failingIDs() (string, error) {
+	return "", errors.New("crypto/rand: entropy source unavailable")
+}
+
+func TestOrderIDFailureIsAGraceful500(t *testing.T) {
+	s := newTestService(t, map[string]string{"ASYNC_STRICT": "false"})
+	s.newOrderID = failingIDs
+	body := `{"customer_id":1,"items":[{"product_id":"a","quantity":1,"price":5}]}`
+
+	for path, handler := range map[string]http.HandlerFunc{
+		"/orders/sync":  s.HandleSyncOrder,
+		"/orders/async": s.HandleAsyncOrder,
+	} {
+		rec := postJSON(handler, path, body)
+		if rec.Code != http.StatusInternalServerError || !strings.Contains(rec.Body.String(), "Could not assign an order ID") {
+			t.Errorf("POST %s: %d %s, want 500 naming the ID failure", path, rec.Code, rec.Body)
+		}
+	}
+	if accepted, rejected, results := importOrders(t, s, body); accepted != 0 || rejected != 1 || results[0].Status != "failed" {
+		t.Errorf("import: accepted %d, rejected %d, %+v; want the line failed", accepted, rejected, results)
+	}
+	if orders, _ := s.orders.List(""); len(orders) != 0 {
+		t.Errorf("%d orders stored without IDs", len(orders))
+	}
+
+	// Once IDs can be generated again orders go through
+	s.newOrderID = generateOrderID
+	if rec := postJSON(s.HandleAsyncOrder, "/orders/async", body); rec.Code != http.StatusAccepted {
+		t.Errorf("order after recovery: %d %s", rec.Code, rec.Body)
+	}
+}
+
+// promValues gathers registry and returns each unlabelled metric's value,
+// with histograms reduced to their sample count
+func promValues(t *testing.T, registry *prometheus.Registry) map[string]float64 {
+	t.Helper()
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("Gather: %v", err)
+	}
+	values := make(map[string]float64)
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			if len(metric.GetLabel()) > 0 {
+				continue
+			}
+			switch {
+			case metric.GetCounter() != nil:
+				values[family.GetName()] = metric.GetCounter().GetValue()
+			case metric.GetGauge() != nil:
+				values[family.GetName()] = metric.GetGauge().GetValue()
+			case metric.GetHistogram() != nil:
+				values[family.GetName()] = float64(metric.GetHistogram().GetSampleCount())
+			}
+		}
+	}
+	return values
+}
+
+func TestPrometheusCountersFollowSyncOrders(t *testing.T) {
+	const order = `{"customer_id":1,"items":[{"product_id":"a","quantity":1,"price":5}]}`
+	for _, tc := range []struct {
+		name              string
+		failureRate       string
+		processed, failed float64
+	}{
+		{"payments succeed", "0", 2, 0},
+		{"payments fail", "1", 0, 2},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestService(t, map[string]string{"PAYMENT_FAILURE_RATE": tc.failureRate})
+			for i := 0; i < 2; i++ {
+				postJSON(s.HandleSyncOrder, "/orders/sync", order)
+			}
+			values := promValues(t, s.promRegistry)
+			for name, want := range map[string]float64{
+				"messages_received_total":             2,
+				"orders_processed_total":              tc.processed,
+				"orders_failed_total":                 tc.failed,
+				"payment_processing_duration_seconds": 2,
+			} {
+				if values[name] != want {
+					t.Errorf("%s = %v, want %v", name, values[name], want)
+				}
+			}
+
+			rec := get(promhttp.HandlerFor(s.promRegistry, promhttp.HandlerOpts{}), "/metrics/prometheus")
+			if !strings.Contains(rec.Body.String(), "messages_received_total 2") {
+				t.Errorf("scrape is missing messages_received_total 2:\n%s", rec.Body)
+			}
+		})
+	}
+}
+
+func TestValidateOrderRejectsEachBadField(t *testing.T) {
+	valid := func() Order {
+		return Order{CustomerID: 1, Items: []Item{{ProductID: "a", Quantity: 2, Price: 5}, {ProductID: "b", Quantity: 1, Price: 0}}}
+	}
+	for _, tc := range []struct {
+		name   string
+		mutate func(*Order)
+		fields []string
+	}{
+		{"valid order", func(*Order) {}, nil},
+		{"no items", func(o *Order) { o.Items = nil }, []string{"items"}},
+		{"zero quantity", func(o *Order) { o.Items[1].Quantity = 0 }, []string{"items[1].quantity"}},
+		{"negative quantity", func(o *Order) { o.Items[0].Quantity = -3 }, []string{"items[0].quantity"}},
+		{"negative price", func(o *Order) { o.Items[0].Price = -0.01 }, []string{"items[0].price"}},
+		{"zero customer", func(o *Order) { o.CustomerID = 0 }, []string{"customer_id"}},
+		{"negative customer", func(o *Order) { o.CustomerID = -7 }, []string{"customer_id"}},
+		{"several problems", func(o *Order) { o.CustomerID = 0; o.Items[1].Price = -1 }, []string{"customer_id", "items[1].price"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			order := valid()
+			tc.mutate(&order)
+			var fields []string
+			for _, problem := range validateOrder(&order, orderLimits{}) {
+				fields = append(fields, problem.Field)
+			}
+			if strings.Join(fields, ",") != strings.Join(tc.fields, ",") {
+				t.Errorf("validateOrder flagged %v, want %v", fields, tc.fields)
+			}
+		})
+	}
+}
+
+func TestInvalidOrderIsRejectedWith422(t *testing.T) {
+	s := newTestService(t, nil)
+	rec := postJSON(s.HandleSyncOrder, "/orders/sync", `{"customer_id":0,"items":[{"product_id":"a","quantity":-1,"price":5}]}`)
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("invalid order = %d, want 422", rec.Code)
+	}
+	var body struct {
+		Fields []fieldError `json:"fields"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatalf("undecodable 422 body: %v", err)
+	}
+	if len(body.Fields) != 2 || body.Fields[0].Field != "customer_id" || body.Fields[1].Field != "items[0].quantity" {
+		t.Errorf("422 listed %+v, want customer_id and items[0].quantity", body.Fields)
+	}
+}
+
+func TestRateLimitThrottlesOnlyTheBusyCustomer(t *testing.T) {
+	s := newTestService(t, map[string]string{"RATE_LIMIT_RPS": "1", "RATE_LIMIT_BURST": "3"})
+	order := func(customer int) string {
+		return fmt.Sprintf(`{"customer_id":%d,"items":[{"product_id":"a","quantity":1,"price":5}]}`, customer)
+	}
+
+	var wg sync.WaitGroup
+	var busyThrottled, othersThrottled atomic.Int64
+	var retryAfter atomic.Value
+	for i := 0; i < 20; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if rec := postJSON(s.HandleSyncOrder, "/orders/sync", order(1)); rec.Code == http.StatusTooManyRequests {
+				busyThrottled.Add(1)
+				retryAfter.Store(rec.Header().Get("Retry-After"))
+			}
+		}()
+		go func(customer int) {
+			defer wg.Done()
+			if rec := postJSON(s.HandleSyncOrder, "/orders/sync", order(customer)); rec.Code == http.StatusTooManyRequests {
+				othersThrottled.Add(1)
+			}
+		}(i + 2)
+	}
+	wg.Wait()
+
+	// A token may refill while the 20 orders are in flight
+	if got := busyThrottled.Load(); got < 16 || got > 17 {
+		t.Errorf("busy customer had %d of 20 orders throttled, want all but its burst of 3", got)
+	}
+	if got := othersThrottled.Load(); got != 0 {
+		t.Errorf("%d orders from other customers were throttled", got)
+	}
+	if header, _ := retryAfter.Load().(string); header != "1" {
+		t.Errorf("Retry-After = %q, want 1", header)
+	}
+}
+
+func TestRateLimitSweepDropsRefilledBuckets(t *testing.T) {
+	limiter := newCustomerRateLimiter(100, 1)
+	limiter.allow("customer:1")
+	limiter.sweep()
+	if tracked := limiter.status()["tracked"]; tracked != 1 {
+		t.Fatalf("tracked = %v right after an order, want 1", tracked)
+	}
+	// The one-token bucket refills in 10ms
+	time.Sleep(20 * time.Millisecond)
+	limiter.sweep()
+	if tracked := limiter.status()["tracked"]; tracked != 0 {
+		t.Errorf("tracked = %v after the bucket refilled, want the idle bucket swept", tracked)
+	}
+	if _, ok := limiter.allow("customer:1"); !ok {
+		t.Error("swept customer was throttled")
+	}
+}
+
+// listPage is the part of a GET /orders response listing tests read
+type listPage struct {
+	Orders []struct {
+		OrderID string `json:"order_id"`
+	} `json:"orders"`
+	Total        int            `json:"total"`
+	StatusCounts map[string]int `json:"status_counts"`
+	NextCursor   string         `json:"next_cursor"`
+}
+
+// listOrders serves GET /orders?query and decodes a 200 response
+func listOrders(t *testing.T, s *OrderService, query string) listPage {
+	t.Helper()
+	rec := get(http.HandlerFunc(s.HandleListOrders), "/orders?"+query)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /orders?%s = %d %s", query, rec.Code, rec.Body)
+	}
+	var page listPage
+	if err := json.NewDecoder(rec.Body).Decode(&page); err != nil {
+		t.Fatalf("GET /orders?%s: undecodable body: %v", query, err)
+	}
+	return page
+}
+
+// ids lists a page's order IDs in order
+func (p listPage) ids() string {
+	var ids []string
+	for _, order := range p.Orders {
+		ids = append(ids, order.OrderID)
+	}
+	return strings.Join(ids, ",")
+}
+
+// storeListedOrders saves o0 to o6, created a second apart; every third
+// is completed and the rest pending, and o5 and o6 belong to customer 2
+func storeListedOrders(t *testing.T, s *OrderService) {
+	t.Helper()
+	created := time.Now().Add(-time.Hour)
+	for i := 0; i < 7; i++ {
+		order := &Order{
+			OrderID:    fmt.Sprintf("o%d", i),
+			CustomerID: 1 + i/5,
+			Items:      []Item{{ProductID: "a", Quantity: 1, Price: 5}},
+			Status:     StatusPending,
+			CreatedAt:  created.Add(time.Duration(i) * time.Second),
+		}
+		if i%3 == 0 {
+			order.Status = StatusCompleted
+		}
+		if err := s.orders.Put(order); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestListOrdersFiltersByStatusAndCustomer(t *testing.T) {
+	s := newTestService(t, nil)
+	storeListedOrders(t, s)
+
+	for _, tc := range []struct {
+		query, ids string
+		counts     map[string]int
+	}{
+		{"", "o0,o1,o2,o3,o4,o5,o6", map[string]int{"completed": 3, "pending": 4}},
+		{"status=completed", "o0,o3,o6", map[string]int{"completed": 3, "pending": 4}},
+		{"status=failed", "", map[string]int{"completed": 3, "pending": 4}},
+		{"customer_id=2", "o5,o6", map[string]int{"completed": 1, "pending": 1}},
+		{"customer_id=2&status=pending", "o5", map[string]int{"completed": 1, "pending": 1}},
+	} {
+		page := listOrders(t, s, tc.query)
+		if page.ids() != tc.ids || page.Total != len(page.Orders) || page.NextCursor != "" {
+			t.Errorf("%q listed [%s] of %d, cursor %q; want [%s] on one page", tc.query, page.ids(), page.Total, page.NextCursor, tc.ids)
+		}
+		if !maps.Equal(page.StatusCounts, tc.counts) {
+			t.Errorf("%q status_counts = %v, want %v", tc.query, page.StatusCounts, tc.counts)
+		}
+	}
+}
+
+func TestListOrdersPagesUpToTheLastOrder(t *testing.T) {
+	s := newTestService(t, nil)
+	storeListedOrders(t, s)
+
+	for _, tc := range []struct {
+		limit int
+		pages []string
+	}{
+		{3, []string{"o0,o1,o2", "o3,o4,o5", "o6"}},
+		{6, []string{"o0,o1,o2,o3,o4,o5", "o6"}},
+		{7, []string{"o0,o1,o2,o3,o4,o5,o6"}},
+		{500, []string{"o0,o1,o2,o3,o4,o5,o6"}},
+	} {
+		var pages []string
+		cursor := ""
+		for len(pages) <= len(tc.pages) {
+			query := fmt.Sprintf("limit=%d", tc.limit)
+			if cursor != "" {
+				query += "&cursor=" + url.QueryEscape(cursor)
+			}
+			page := listOrders(t, s, query)
+			pages = append(pages, page.ids())
+			if cursor = page.NextCursor; cursor == "" {
+				break
+			}
+		}
+		if !slices.Equal(pages, tc.pages) {
+			t.Errorf("limit %d paged %q, want %q", tc.limit, pages, tc.pages)
+		}
+	}
+
+	// An order placed while paging lands after the cursor, not on a seen page
+	first := listOrders(t, s, "limit=3")
+	storePending(t, s, "late")
+	if rest := listOrders(t, s, "limit=10&cursor="+url.QueryEscape(first.NextCursor)); rest.ids() != "o3,o4,o5,o6,late" {
+		t.Errorf("after the first page: [%s], want o3 to o6 then late", rest.ids())
+	}
+
+	for _, query := range []string{"limit=0", "limit=501", "limit=ten", "cursor=garbage", "customer_id=-1"} {
+		if rec := get(http.HandlerFunc(s.HandleListOrders), "/orders?"+query); rec.Code != http.StatusBadRequest {
+			t.Errorf("GET /orders?%s = %d, want 400", query, rec.Code)
+		}
+	}
+}
+
+func TestTransitionAllowsOnlyTheLifecycle(t *testing.T) {
+	all := []OrderStatus{StatusPending, StatusProcessing, StatusCompleted, StatusPartiallyFulfilled, StatusFailed,
+		StatusFailedTimeout, StatusFailedStalled, StatusCancelled, StatusExpired, StatusRejected}
+	legal := map[[2]OrderStatus]bool{
+		{StatusPending, StatusProcessing}:            true,
+		{StatusPending, StatusCancelled}:             true,
+		{StatusPending, StatusFailed}:                true,
+		{StatusPending, StatusFailedTimeout}:         true,
+		{StatusPending, StatusExpired}:               true,
+		{StatusPending, StatusRejected}:              true,
+		{StatusProcessing, StatusCompleted}:          true,
+		{StatusProcessing, StatusPartiallyFulfilled}: true,
+		{StatusProcessing, StatusFailed}:             true,
+		{StatusProcessing, StatusFailedTimeout}:      true,
+		{StatusProcessing, StatusFailedStalled}:      true,
+		{StatusProcessing, StatusCancelled}:          true,
+		{StatusProcessing, StatusPending}:            true,
+		{StatusFailed, StatusProcessing}:             true,
+	}
+	for _, from := range all {
+		for _, to := range all {
+			err := Transition(from, to)
+			if legal[[2]OrderStatus{from, to}] {
+				if err != nil {
+					t.Errorf("%s -> %s rejected: %v", from, to, err)
+				}
+			} else if !errors.Is(err, errIllegalTransition) {
+				t.Errorf("%s -> %s = %v, want errIllegalTransition", from, to, err)
+			}
+		}
+	}
+}
+
+func TestUpdateStatusRejectsIllegalMoves(t *testing.T) {
+	s := newTestService(t, nil)
+	order := storePending(t, s, "o1")
+	for _, to := range []OrderStatus{StatusProcessing, StatusCompleted} {
+		if err := s.UpdateStatus(order, to); err != nil {
+			t.Fatalf("move to %s: %v", to, err)
+		}
+	}
+	for _, to := range []OrderStatus{StatusPending, StatusProcessing, StatusFailed, StatusCancelled} {
+		if err := s.UpdateStatus(order, to); !errors.Is(err, errIllegalTransition) {
+			t.Errorf("completed -> %s = %v, want errIllegalTransition", to, err)
+		}
+	}
+	if got := storedStatus(t, s, "o1"); got != StatusCompleted {
+		t.Errorf("stored status = %s after illegal moves, want completed", got)
+	}
+	// Staying put is a no-op, not an illegal transition
+	if err := s.UpdateStatus(order, StatusCompleted); err != nil {
+		t.Errorf("completed -> completed: %v", err)
+	}
+
+	// A guarded move loses to whatever changed the order first
+	racing := storePending(t, s, "o2")
+	if err := s.UpdateStatus(racing, StatusCancelled); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.UpdateStatus(racing, StatusProcessing, StatusPending); !errors.Is(err, errStatusChanged) {
+		t.Errorf("start payment of a cancelled order = %v, want errStatusChanged", err)
+	}
+}
+
+// recordingGateway is a deterministic PaymentGateway that refuses the
+// orders in decline and records every charge it sees
+type recordingGateway struct {
+	mu      sync.Mutex
+	decline map[string]bool
+	charged []string
+}
+
+func (g *recordingGateway) Charge(ctx context.Context, orderID string, amount float64) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.charged = append(g.charged, orderID)
+	if g.decline[orderID] {
+		return &PaymentError{OrderID: orderID, Amount: amount, Reason: ReasonDeclined}
+	}
+	return nil
+}
+
+func TestSimulatedGatewayReplaysItsSeed(t *testing.T) {
+	reasons, err := parseFailureReasons(defaultPaymentFailureReasons)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outcomes := func(seed int64) []string {
+		gateway := newSimulatedGateway(0.5, reasons, seed)
+		var got []string
+		for i := 0; i < 50; i++ {
+			got = append(got, paymentFailureReason(gateway.Charge(context.Background(), fmt.Sprintf("o%d", i), 10)))
+		}
+		return got
+	}
+	first := outcomes(42)
+	if !slices.Equal(first, outcomes(42)) {
+		t.Error("the same seed gave different outcomes")
+	}
+	if !slices.Contains(first, "") || !slices.ContainsFunc(first, func(reason string) bool { return reason != "" }) {
+		t.Errorf("half-failing gateway gave %v, want both outcomes", first)
+	}
+}
+
+func TestPaymentFailureRateDecidesOutcomes(t *testing.T) {
+	for _, tc := range []struct {
+		rate    string
+		refused bool
+	}{
+		{"0", false},
+		{"1", true},
+	} {
+		s := newTestService(t, map[string]string{"PAYMENT_FAILURE_RATE": tc.rate, "PAYMENT_FAILURE_REASONS": "fraud_suspected=1"})
+		for i := 0; i < 20; i++ {
+			err := s.ProcessPayment(context.Background(), laneSync, fmt.Sprintf("o%d", i), 10, "USD")
+			if refused := paymentFailureReason(err) == ReasonFraudSuspected; refused != tc.refused || (!refused && err != nil) {
+				t.Fatalf("rate %s: charge %d = %v", tc.rate, i, err)
+			}
+		}
+		if got := s.paymentFailures.snapshot()[ReasonFraudSuspected]; tc.refused && got != 20 {
+			t.Errorf("rate %s: %v fraud failures recorded, want 20", tc.rate, got)
+		}
+	}
+}
+
+func TestInjectedGatewayDecidesSyncOrders(t *testing.T) {
+	s := newTestService(t, nil)
+	gateway := &recordingGateway{decline: map[string]bool{"order-2": true}}
+	s.payments = gateway
+	var issued atomic.Int64
+	s.newOrderID = func() (string, error) {
+		return fmt.Sprintf("order-%d", issued.Add(1)), nil
+	}
+
+	for i := 0; i < 2; i++ {
+		postJSON(s.HandleSyncOrder, "/orders/sync", `{"customer_id":1,"items":[{"product_id":"a","quantity":1,"price":5}]}`)
+	}
+	if got := storedStatus(t, s, "order-1"); got != StatusCompleted {
+		t.Errorf("order-1 is %s, want completed", got)
+	}
+	if got := storedStatus(t, s, "order-2"); got != StatusFailed {
+		t.Errorf("order-2 is %s, want failed by the gateway", got)
+	}
+	if !slices.Equal(gateway.charged, []string{"order-1", "order-2"}) {
+		t.Errorf("gateway charged %v", gateway.charged)
+	}
+}
+
+// floodSyncOrders posts n sync orders at once and counts the responses by
+// status code, keeping one Retry-After seen on a 503
+func floodSyncOrders(s *OrderService, n int) (codes map[int]int, retryAfter string) {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	codes = map[int]int{}
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rec := postJSON(s.HandleSyncOrder, "/orders/sync", `{"customer_id":1,"items":[{"product_id":"a","quantity":1,"price":5}]}`)
+			mu.Lock()
+			defer mu.Unlock()
+			codes[rec.Code]++
+			if rec.Code == http.StatusServiceUnavailable {
+				retryAfter = rec.Header().Get("Retry-After")
+			}
+		}()
+	}
+	wg.Wait()
+	return codes, retryAfter
+}
+
+func TestBusyPaymentSlotTurnsSyncOrdersAway(t *testing.T) {
+	s := newTestService(t, map[string]string{"PAYMENT_LATENCY": "300ms", "PAYMENT_SYNC_MAX_WAIT": "50ms"})
+
+	started := time.Now()
+	codes, retryAfter := floodSyncOrders(s, 8)
+	if took := time.Since(started); took > time.Second {
+		t.Errorf("flood took %v, want turned-away orders to fail fast", took)
+	}
+	if codes[http.StatusOK] != 1 || codes[http.StatusServiceUnavailable] != 7 {
+		t.Errorf("flood of 8 answered %v, want one 200 and seven 503s", codes)
+	}
+	if n, err := strconv.Atoi(retryAfter); err != nil || n < 1 {
+		t.Errorf("503 Retry-After = %q, want a positive number of seconds", retryAfter)
+	}
+	if got := atomic.LoadInt64(&s.rejectedOrders); got != 7 {
+		t.Errorf("rejected_orders = %d, want 7", got)
+	}
+	if orders, _ := s.orders.List(""); len(orders) != 1 {
+		t.Errorf("%d orders stored, want only the one charged", len(orders))
+	}
+}
+
+func TestSyncOrdersQueueWithoutAMaxWait(t *testing.T) {
+	s := newTestService(t, map[string]string{"PAYMENT_LATENCY": "50ms"})
+	if codes, _ := floodSyncOrders(s, 4); codes[http.StatusOK] != 4 {
+		t.Errorf("flood of 4 answered %v, want all queued and charged", codes)
+	}
+}
+
+// storeFailed saves an order under orderID that failed its first payment
+func storeFailed(t *testing.T, s *OrderService, orderID string) *Order {
+	t.Helper()
+	order := storePending(t, s, orderID)
+	for _, to := range []OrderStatus{StatusProcessing, StatusFailed} {
+		if err := s.UpdateStatus(order, to); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return order
+}
+
+// retryOrder serves POST /orders/{orderID}/retry and decodes the response
+func retryOrder(t *testing.T, s *OrderService, orderID string) (int, map[string]interface{}) {
+	t.Helper()
+	request := httptest.NewRequest(http.MethodPost, "/orders/"+orderID+"/retry", nil)
+	request = mux.SetURLVars(request, map[string]string{"orderId": orderID})
+	rec := httptest.NewRecorder()
+	s.HandleRetryOrder(rec, request)
+	var body map[string]interface{}
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatalf("retry of %s: %d with undecodable body: %v", orderID, rec.Code, err)
+	}
+	return rec.Code, body
+}
+
+func TestRetryChargesAFailedOrderAgain(t *testing.T) {
+	s := newTestService(t, map[string]string{"MAX_RETRIES": "2"})
+	s.payments = &recordingGateway{}
+	storeFailed(t, s, "o1")
+
+	code, body := retryOrder(t, s, "o1")
+	if code != http.StatusOK || body["status"] != string(StatusCompleted) || body["retry_count"] != 1.0 {
+		t.Errorf("retry: %d %v, want 200 completed on retry 1", code, body)
+	}
+	if got := storedStatus(t, s, "o1"); got != StatusCompleted {
+		t.Errorf("stored status %s, want completed", got)
+	}
+}
+
+func TestRetryStopsAtMaxRetries(t *testing.T) {
+	s := newTestService(t, map[string]string{"MAX_RETRIES": "2"})
+	gateway := &recordingGateway{decline: map[string]bool{"o1": true}}
+	s.payments = gateway
+	storeFailed(t, s, "o1")
+
+	for attempt := 1; attempt <= 2; attempt++ {
+		code, body := retryOrder(t, s, "o1")
+		if code != http.StatusPaymentRequired || body["status"] != string(StatusFailed) || body["retry_count"] != float64(attempt) || body["reason"] != ReasonDeclined {
+			t.Errorf("retry %d: %d %v, want 402 failed with reason declined", attempt, code, body)
+		}
+	}
+	code, body := retryOrder(t, s, "o1")
+	if code != http.StatusTooManyRequests || body["max_retries"] != 2.0 {
+		t.Errorf("retry past the limit: %d %v, want 429", code, body)
+	}
+	if len(gateway.charged) != 2 {
+		t.Errorf("gateway charged %d times, want once per allowed retry", len(gateway.charged))
+	}
+}
+
+func TestRetryRejectsOrdersThatDidNotFail(t *testing.T) {
+	s := newTestService(t, nil)
+	gateway := &recordingGateway{}
+	s.payments = gateway
+	order := storePending(t, s, "done")
+	s.UpdateStatus(order, StatusProcessing)
+	s.UpdateStatus(order, StatusCompleted)
+	storePending(t, s, "waiting")
+
+	for orderID, status := range map[string]OrderStatus{"done": StatusCompleted, "waiting": StatusPending} {
+		if code, body := retryOrder(t, s, orderID); code != http.StatusConflict || body["status"] != string(status) {
+			t.Errorf("retry of a %s order: %d %v, want 409", status, code, body)
+		}
+	}
+	if len(gateway.charged) != 0 {
+		t.Errorf("gateway charged %v", gateway.charged)
+	}
+}
+
+// doubledRates is an ExchangeRateProvider where EUR is worth two USD and
+// nothing else converts
+type doubledRates struct{}
+
+func (doubledRates) Convert(amount float64, from, to string) (float64, error) {
+	switch {
+	case from == "EUR" && to == "USD":
+		return amount * 2, nil
+	case from == "USD" && to == "EUR":
+		return amount / 2, nil
+	}
+	return 0, fmt.Errorf("no exchange rate for %s to %s", from, to)
+}
+
+func TestStaticRatesConvertThroughTheReferenceUnit(t *testing.T) {
+	rates, err := parseStaticRates("USD=1, eur=1.25,GBP=1.5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		from, to string
+		want     float64
+	}{
+		{"EUR", "USD", 12.5},
+		{"USD", "EUR", 8},
+		{"GBP", "EUR", 12},
+		{"USD", "USD", 10},
+	} {
+		if got, err := rates.Convert(10, tc.from, tc.to); err != nil || math.Abs(got-tc.want) > 1e-9 {
+			t.Errorf("10 %s in %s = %v, %v; want %v", tc.from, tc.to, got, err, tc.want)
+		}
+	}
+	if _, err := rates.Convert(10, "JPY", "USD"); err == nil {
+		t.Error("converted from a currency without a rate")
+	}
+	for _, bad := range []string{"EUR", "EURO=1", "EUR=-1", "EUR=x"} {
+		if _, err := parseStaticRates(bad); err == nil {
+			t.Errorf("EXCHANGE_RATES %q was accepted", bad)
+		}
+	}
+}
+
+func TestResolveConvertsMixedItemsOnlyWhenEnabled(t *testing.T) {
+	mixed := func() Order {
+		return Order{Items: []Item{{ProductID: "a", Price: 10, Currency: "USD"}, {ProductID: "b", Price: 5.555, Currency: "eur"}}}
+	}
+	cfg := currencyConfig{enabled: true, supported: map[string]bool{"USD": true, "EUR": true}, fallback: "EUR", base: "USD", rates: doubledRates{}}
+
+	order := mixed()
+	if err := cfg.resolve(&order); err == nil || !strings.Contains(err.Error(), "mixes currencies") {
+		t.Errorf("conversion off: resolve = %v, want mixed currencies rejected", err)
+	}
+
+	cfg.convert = true
+	order = mixed()
+	if err := cfg.resolve(&order); err != nil {
+		t.Fatalf("conversion on: %v", err)
+	}
+	converted := order.Items[1]
+	if order.Currency != "USD" || converted.Currency != "USD" || converted.Price != 11.11 || converted.ListPrice != 5.555 || converted.ListCurrency != "EUR" {
+		t.Errorf("converted to %s: %+v, want 11.11 USD listed as 5.555 EUR", order.Currency, converted)
+	}
+	if order.Items[0].ListCurrency != "" {
+		t.Errorf("item already in the base currency was converted: %+v", order.Items[0])
+	}
+
+	// An order that names its currency is charged in it, not the base
+	order = mixed()
+	order.Currency = "EUR"
+	if err := cfg.resolve(&order); err != nil || order.Items[0].Price != 5 || order.Items[0].Currency != "EUR" {
+		t.Errorf("EUR order: %v, %+v; want the USD item converted to 5 EUR", err, order.Items[0])
+	}
+
+	order = mixed()
+	order.Items[1].Currency = "XYZ"
+	if err := cfg.resolve(&order); err == nil || !strings.Contains(err.Error(), "XYZ is not supported") {
+		t.Errorf("unknown code: resolve = %v, want XYZ rejected", err)
+	}
+}
+
+func TestMixedCurrencyOrdersAreConvertedWithConversionOn(t *testing.T) {
+	s := newTestService(t, map[string]string{
+		"CURRENCY_SUPPORT":    "true",
+		"CURRENCY_CONVERSION": "true",
+		"BASE_CURRENCY":       "USD",
+		"EXCHANGE_RATES":      "USD=1,EUR=1.5,GBP=2",
+	})
+
+	rec := postJSON(s.HandleSyncOrder, "/orders/sync", `{"customer_id":1,"items":[
+		{"product_id":"a","quantity":1,"price":10,"currency":"USD"},
+		{"product_id":"b","quantity":2,"price":10,"currency":"EUR"}]}`)
+	var charged struct {
+		OrderID string  `json:"order_id"`
+		Total   float64 `json:"total"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&charged); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("mixed order: %d %v", rec.Code, err)
+	}
+	if charged.Total != 40 {
+		t.Errorf("total %v, want 10 USD plus 2 x 15 USD", charged.Total)
+	}
+
+	rec = postJSON(s.HandleSyncOrder, "/orders/sync", `{"customer_id":1,"items":[
+		{"product_id":"a","quantity":1,"price":10,"currency":"USD"},
+		{"product_id":"b","quantity":1,"price":10,"currency":"XYZ"}]}`)
+	if rec.Code != http.StatusUnprocessableEntity || !strings.Contains(rec.Body.String(), "XYZ") {
+		t.Errorf("unknown currency: %d %s, want 422 naming XYZ", rec.Code, rec.Body)
+	}
+}
+
+// webhookReceiver is a callback endpoint that verifies each X-Signature
+// against secret and answers the first failFirst deliveries with a 500
+type webhookReceiver struct {
+	secret    string
+	failFirst int
+
+	mu       sync.Mutex
+	attempts int
+	verified []webhookEvent
+	badSigs  int
+}
+
+func (rcv *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	mac := hmac.New(sha256.New, []byte(rcv.secret))
+	mac.Write(body)
+	want := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+	rcv.attempts++
+	if !hmac.Equal([]byte(r.Header.Get("X-Signature")), []byte(want)) {
+		rcv.badSigs++
+		http.Error(w, "bad signature", http.StatusUnauthorized)
+		return
+	}
+	if rcv.attempts <= rcv.failFirst {
+		http.Error(w, "try again", http.StatusInternalServerError)
+		return
+	}
+	var event webhookEvent
+	json.Unmarshal(body, &event)
+	rcv.verified = append(rcv.verified, event)
+}
+
+// webhookTestService starts a receiver and a service signing with its
+// secret, retrying up to maxAttempts times
+func webhookTestService(t *testing.T, failFirst int, maxAttempts string) (*OrderService, *webhookReceiver, string) {
+	t.Helper()
+	receiver := &webhookReceiver{secret: "s3cret", failFirst: failFirst}
+	server := httptest.NewServer(receiver)
+	t.Cleanup(server.Close)
+	s := newTestService(t, map[string]string{"WEBHOOK_SECRET": receiver.secret, "WEBHOOK_BACKOFF": "10ms", "WEBHOOK_MAX_ATTEMPTS": maxAttempts})
+	return s, receiver, server.URL + "/hooks/orders"
+}
+
+func TestWebhookIsSignedAndRetried(t *testing.T) {
+	s, receiver, callback := webhookTestService(t, 1, "3")
+	rec := postJSON(s.HandleSyncOrder, "/orders/sync", `{"customer_id":1,"callback_url":"`+callback+`","items":[{"product_id":"a","quantity":1,"price":5}]}`)
+	var order Order
+	if err := json.NewDecoder(rec.Body).Decode(&order); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("sync order: %d %v", rec.Code, err)
+	}
+
+	if !eventually(t, 2*time.Second, func() bool {
+		delivery, _ := s.webhooks.delivery(order.OrderID)
+		return delivery.Status == "delivered"
+	}) {
+		t.Fatal("webhook never delivered")
+	}
+	delivery, _ := s.webhooks.delivery(order.OrderID)
+	if delivery.Attempts != 2 || delivery.DeliveredAt == nil {
+		t.Errorf("delivery %+v, want delivered on the second attempt", delivery)
+	}
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+	if receiver.badSigs != 0 || len(receiver.verified) != 1 {
+		t.Fatalf("%d bad signatures, %d verified events", receiver.badSigs, len(receiver.verified))
+	}
+	if event := receiver.verified[0]; event.OrderID != order.OrderID || event.Status != StatusCompleted || event.ProcessedAt == nil {
+		t.Errorf("event %+v, want %s completed with processed_at", event, order.OrderID)
+	}
+}
+
+func TestWebhookGivesUpAfterMaxAttempts(t *testing.T) {
+	s, receiver, callback := webhookTestService(t, 100, "2")
+	rec := postJSON(s.HandleSyncOrder, "/orders/sync", `{"customer_id":1,"callback_url":"`+callback+`","items":[{"product_id":"a","quantity":1,"price":5}]}`)
+	var order Order
+	json.NewDecoder(rec.Body).Decode(&order)
+
+	if !eventually(t, 2*time.Second, func() bool {
+		delivery, _ := s.webhooks.delivery(order.OrderID)
+		return delivery.Status == "failed"
+	}) {
+		t.Fatal("webhook delivery never gave up")
+	}
+	delivery, _ := s.webhooks.delivery(order.OrderID)
+	if delivery.Attempts != 2 || !strings.Contains(delivery.LastError, "500") {
+		t.Errorf("delivery %+v, want failed after 2 attempts with the 500", delivery)
+	}
+	if got := loadCounter(&s.webhooks.failed); got != 1 {
+		t.Errorf("webhooks failed = %d, want 1", got)
+	}
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+	if receiver.attempts != 2 {
+		t.Errorf("receiver saw %d attempts, want 2", receiver.attempts)
+	}
+}
+
+func TestWebhookSignatureCoversTheBody(t *testing.T) {
+	t.Setenv("WEBHOOK_SECRET", "s3cret")
+	notifier, err := newWebhookNotifier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := []byte(`{"order_id":"o1","status":"completed"}`)
+	if notifier.sign(body) == notifier.sign([]byte(`{"order_id":"o1","status":"failed"}`)) {
+		t.Error("different bodies share a signature")
+	}
+	t.Setenv("WEBHOOK_SECRET", "other")
+	other, _ := newWebhookNotifier()
+	if notifier.sign(body) == other.sign(body) {
+		t.Error("different secrets share a signature")
+	}
+}
+
+// useHungSNS points the SNS client at an endpoint that never answers a
+// publish, holding each request until the caller gives up on it. Topic
+// health checks are answered, so async orders get as far as publishing.
+func useHungSNS(t *testing.T) map[string]string {
+	t.Helper()
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Form.Get("Action") == "GetTopicAttributes" {
+			w.Header().Set("Content-Type", "text/xml")
+			io.WriteString(w, `<GetTopicAttributesResponse xmlns="http://sns.amazonaws.com/doc/2010-03-31/"><GetTopicAttributesResult><Attributes></Attributes></GetTopicAttributesResult></GetTopicAttributesResponse>`)
+			return
+		}
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}))
+	// Cleanups run last first, so held requests are let go before Close
+	t.Cleanup(server.Close)
+	t.Cleanup(func() { close(release) })
+	return map[string]string{
+		"AWS_ENDPOINT_URL_SNS": server.URL,
+		"SNS_TOPIC_ARN":        "arn:aws:sns:us-east-1:000000000000:orders",
+		"AWS_MAX_ATTEMPTS":     "1",
+	}
+}
+
+// asyncOrderWith serves an async order on ctx and returns the response
+// with the order stored for it
+func asyncOrderWith(t *testing.T, s *OrderService, ctx context.Context) (*httptest.ResponseRecorder, *Order) {
+	t.Helper()
+	request := httptest.NewRequest(http.MethodPost, "/orders/async", strings.NewReader(`{"customer_id":1,"items":[{"product_id":"a","quantity":1,"price":5}]}`)).WithContext(ctx)
+	request.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	s.HandleAsyncOrder(rec, request)
+	orders, err := s.orders.List("")
+	if err != nil || len(orders) != 1 {
+		t.Fatalf("%d orders stored (%v), want the one submitted", len(orders), err)
+	}
+	return rec, orders[0]
+}
+
+func TestHungSNSPublishTimesOut(t *testing.T) {
+	env := useHungSNS(t)
+	env["SNS_PUBLISH_TIMEOUT"] = "100ms"
+	s := newTestService(t, env)
+
+	started := time.Now()
+	rec, order := asyncOrderWith(t, s, context.Background())
+	if took := time.Since(started); took > 2*time.Second {
+		t.Errorf("handler held for %v by a hung publish", took)
+	}
+	if rec.Code != http.StatusGatewayTimeout {
+		t.Errorf("hung publish answered %d %s, want 504", rec.Code, rec.Body)
+	}
+	if got := storedStatus(t, s, order.OrderID); got != StatusFailed || order.FailureReason == "" {
+		t.Errorf("order left %s with reason %q, want failed with a reason", got, order.FailureReason)
+	}
+}
+
+func TestClientGoneDuringPublishIs499(t *testing.T) {
+	env := useHungSNS(t)
+	env["SNS_PUBLISH_TIMEOUT"] = "10s"
+	s := newTestService(t, env)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	rec, order := asyncOrderWith(t, s, ctx)
+	if rec.Code != statusClientClosedRequest {
+		t.Errorf("publish abandoned by the client answered %d, want 499", rec.Code)
+	}
+	if got := storedStatus(t, s, order.OrderID); got != StatusFailed {
+		t.Errorf("order left %s, want failed rather than pending", got)
+	}
+}
+
+// corsRequest serves method on /orders/sync from origin through handler;
+// a preflightFor method makes it a CORS preflight
+func corsRequest(handler http.Handler, method, origin, preflightFor, requestHeaders string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(method, "/orders/sync", nil)
+	if origin != "" {
+		request.Header.Set("Origin", origin)
+	}
+	if preflightFor != "" {
+		request.Header.Set("Access-Control-Request-Method", preflightFor)
+	}
+	if requestHeaders != "" {
+		request.Header.Set("Access-Control-Request-Headers", requestHeaders)
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, request)
+	return rec
+}
+
+func TestCORSAllowsOnlyConfiguredOrigins(t *testing.T) {
+	t.Setenv("CORS_ALLOWED_ORIGINS", "https://shop.example.com/, https://admin.example.com")
+	t.Setenv("CORS_ALLOWED_METHODS", "get,post")
+	t.Setenv("CORS_MAX_AGE", "90s")
+	cfg, err := loadCORSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := withCORS(labelled("order"), cfg)
+	allowed, disallowed := "https://shop.example.com", "https://evil.example.com"
+
+	rec := corsRequest(handler, http.MethodOptions, allowed, "POST", "content-type, x-api-key")
+	if rec.Code != http.StatusNoContent || rec.Body.String() == "order" {
+		t.Errorf("allowed preflight: %d %q, want 204 from the middleware", rec.Code, rec.Body)
+	}
+	for header, want := range map[string]string{
+		"Access-Control-Allow-Origin":  allowed,
+		"Access-Control-Allow-Methods": "GET, POST",
+		"Access-Control-Max-Age":       "90",
+	} {
+		if got := rec.Header().Get(header); got != want {
+			t.Errorf("allowed preflight %s = %q, want %q", header, got, want)
+		}
+	}
+	if got := rec.Header().Get("Access-Control-Allow-Headers"); !strings.Contains(got, "Content-Type") || !strings.Contains(got, "X-API-Key") {
+		t.Errorf("allowed preflight Access-Control-Allow-Headers = %q", got)
+	}
+
+	for name, rec := range map[string]*httptest.ResponseRecorder{
+		"disallowed origin":  corsRequest(handler, http.MethodOptions, disallowed, "POST", ""),
+		"disallowed method":  corsRequest(handler, http.MethodOptions, allowed, "DELETE", ""),
+		"disallowed headers": corsRequest(handler, http.MethodOptions, allowed, "POST", "X-Evil"),
+	} {
+		if rec.Code != http.StatusForbidden || rec.Header().Get("Access-Control-Allow-Methods") != "" {
+			t.Errorf("%s preflight: %d with methods %q, want 403 without CORS headers", name, rec.Code, rec.Header().Get("Access-Control-Allow-Methods"))
+		}
+	}
+
+	rec = corsRequest(handler, http.MethodPost, allowed, "", "")
+	if rec.Body.String() != "order" || rec.Header().Get("Access-Control-Allow-Origin") != allowed || !strings.Contains(rec.Header().Get("Access-Control-Expose-Headers"), "Retry-After") {
+		t.Errorf("allowed request: %q with headers %v", rec.Body, rec.Header())
+	}
+	rec = corsRequest(handler, http.MethodPost, disallowed, "", "")
+	if rec.Body.String() != "order" || rec.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("disallowed request: %q with Allow-Origin %q, want served without CORS headers", rec.Body, rec.Header().Get("Access-Control-Allow-Origin"))
+	}
+	if got := rec.Header().Values("Vary"); !slices.Contains(got, "Origin") {
+		t.Errorf("Vary = %v, want Origin", got)
+	}
+}
+
+func TestCORSIsSameOriginOnlyWhenUnconfigured(t *testing.T) {
+	t.Setenv("CORS_ALLOWED_ORIGINS", "")
+	cfg, err := loadCORSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := withCORS(labelled("order"), cfg)
+	for _, method := range []string{http.MethodOptions, http.MethodPost} {
+		rec := corsRequest(handler, method, "https://shop.example.com", "POST", "")
+		if origin := rec.Header().Get("Access-Control-Allow-Origin"); origin != "" {
+			t.Errorf("%s allowed origin %q with CORS unconfigured", method, origin)
+		}
+	}
+}
+
+func TestAPIKeyAuthOnMutatingRoutes(t *testing.T) {
+	t.Setenv("AUTH_ENABLED", "true")
+	t.Setenv("API_KEYS", "key-one, key-two")
+	keyFile := filepath.Join(t.TempDir(), "keys")
+	os.WriteFile(keyFile, []byte("key-three\n\n"), 0o600)
+	t.Setenv("API_KEYS_FILE", keyFile)
+	keys, err := loadAPIKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := withAPIKeyAuth(labelled("served"), keys)
+
+	for _, tc := range []struct {
+		name, method, header, value string
+		code                        int
+	}{
+		{"missing key", http.MethodPost, "", "", http.StatusUnauthorized},
+		{"empty bearer token", http.MethodPost, "Authorization", "Bearer ", http.StatusUnauthorized},
+		{"invalid X-API-Key", http.MethodPost, "X-API-Key", "key-four", http.StatusForbidden},
+		{"invalid bearer token", http.MethodDelete, "Authorization", "Bearer key-on", http.StatusForbidden},
+		{"valid X-API-Key", http.MethodPost, "X-API-Key", "key-two", http.StatusOK},
+		{"valid bearer token", http.MethodPatch, "Authorization", "bearer key-one", http.StatusOK},
+		{"key from the file", http.MethodPost, "X-API-Key", "key-three", http.StatusOK},
+		{"read without a key", http.MethodGet, "", "", http.StatusOK},
+		{"preflight without a key", http.MethodOptions, "", "", http.StatusOK},
+	} {
+		request := httptest.NewRequest(tc.method, "/orders/sync", nil)
+		if tc.header != "" {
+			request.Header.Set(tc.header, tc.value)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, request)
+		if rec.Code != tc.code {
+			t.Errorf("%s: %d %s, want %d", tc.name, rec.Code, rec.Body, tc.code)
+		}
+		if tc.code == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s: 401 without WWW-Authenticate", tc.name)
+		}
+	}
+}
+
+func TestAPIKeyAuthIsOptIn(t *testing.T) {
+	t.Setenv("AUTH_ENABLED", "")
+	t.Setenv("API_KEYS", "key-one")
+	if keys, err := loadAPIKeys(); keys != nil || err != nil {
+		t.Errorf("auth disabled loaded %v, %v", keys, err)
+	}
+	rec := httptest.NewRecorder()
+	withAPIKeyAuth(labelled("served"), nil).ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/orders/sync", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("POST with auth disabled = %d, want served", rec.Code)
+	}
+
+	t.Setenv("AUTH_ENABLED", "true")
+	t.Setenv("API_KEYS", " , ")
+	if _, err := loadAPIKeys(); err == nil {
+		t.Error("auth enabled without any key was accepted")
+	}
+}
+
+// setChaos posts body to HandleChaos and returns the recorded response
+func setChaos(handler http.HandlerFunc, body string) *httptest.ResponseRecorder {
+	return postJSON(handler, "/admin/chaos", body)
+}
+
+func TestChaosFailsEveryOrderAtRateOne(t *testing.T) {
+	s := newTestService(t, map[string]string{"CHAOS_ENABLED": "true"})
+	if rec := setChaos(s.HandleChaos, `{"failure_rate":1}`); rec.Code != http.StatusOK {
+		t.Fatalf("set chaos: %d %s", rec.Code, rec.Body)
+	}
+	for i := 0; i < 10; i++ {
+		if rec := postJSON(s.HandleSyncOrder, "/orders/sync", `{"customer_id":1,"items":[{"product_id":"a","quantity":1,"price":5}]}`); rec.Code == http.StatusOK {
+			t.Fatalf("order %d succeeded under chaos: %s", i, rec.Body)
+		}
+	}
+	if failed, processed := atomic.LoadInt64(&s.failedOrders), atomic.LoadInt64(&s.processedOrders); failed != 10 || processed != 0 {
+		t.Errorf("%d failed and %d processed, want all 10 failed", failed, processed)
+	}
+	var metrics struct {
+		Chaos map[string]interface{} `json:"chaos"`
+	}
+	json.NewDecoder(get(http.HandlerFunc(s.HandleMetrics), "/metrics").Body).Decode(&metrics)
+	if metrics.Chaos["failure_rate"] != 1.0 || metrics.Chaos["failures_injected"] != 10.0 {
+		t.Errorf("/metrics chaos = %v, want rate 1 with 10 failures injected", metrics.Chaos)
+	}
+
+	setChaos(s.HandleChaos, `{"failure_rate":0}`)
+	if rec := postJSON(s.HandleSyncOrder, "/orders/sync", `{"customer_id":1,"items":[{"product_id":"a","quantity":1,"price":5}]}`); rec.Code != http.StatusOK {
+		t.Errorf("order with chaos off: %d %s", rec.Code, rec.Body)
+	}
+}
+
+// useMissingSNS points the SNS client at an endpoint that answers every
+// call with NotFound, counting the calls it gets
+func useMissingSNS(t *testing.T) (map[string]string, *int64) {
+	t.Helper()
+	var calls int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&calls, 1)
+		w.Header().Set("Content-Type", "text/xml")
+		w.WriteHeader(http.StatusNotFound)
+		io.WriteString(w, `<ErrorResponse><Error><Type>Sender</Type><Code>NotFound</Code><Message>Topic does not exist</Message></Error><RequestId>1</RequestId></ErrorResponse>`)
+	}))
+	t.Cleanup(server.Close)
+	return map[string]string{
+		"AWS_ENDPOINT_URL_SNS": server.URL,
+		"SNS_TOPIC_ARN":        "arn:aws:sns:us-east-1:000000000000:orders",
+		"AWS_MAX_ATTEMPTS":     "1",
+		"READY_CACHE_TTL":      "1m",
+	}, &calls
+}
+
+func TestUnreachableSNSRefusesAsyncOrders(t *testing.T) {
+	env, calls := useMissingSNS(t)
+	s := newTestService(t, env)
+
+	rec := postJSON(s.HandleAsyncOrder, "/orders/async", `{"customer_id":1,"items":[{"product_id":"a","quantity":1,"price":5}]}`)
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") == "" {
+		t.Fatalf("async order = %d (Retry-After %q), want 503 with Retry-After", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	if orders, _ := s.orders.List(""); len(orders) != 0 {
+		t.Errorf("%d orders stored, want the refused order dropped before storing", len(orders))
+	}
+
+	ready := get(http.HandlerFunc(s.HandleReady), "/ready")
+	var readiness map[string]interface{}
+	json.NewDecoder(ready.Body).Decode(&readiness)
+	if ready.Code != http.StatusServiceUnavailable || readiness["sns"] != "unavailable" {
+		t.Errorf("/ready = %d %v, want 503 with sns unavailable", ready.Code, readiness)
+	}
+
+	var health map[string]interface{}
+	json.NewDecoder(get(http.HandlerFunc(s.HandleHealth), "/health").Body).Decode(&health)
+	if health["sns"] != "unavailable" {
+		t.Errorf("/health sns = %v, want unavailable", health["sns"])
+	}
+	// The order and /ready share one cached check; /health never calls AWS
+	if got := atomic.LoadInt64(calls); got != 1 {
+		t.Errorf("%d SNS calls, want the one cached check", got)
+	}
+}
+
+func TestAsyncOrdersWithoutSNSOrWorkersAreRefused(t *testing.T) {
+	s := newTestService(t, map[string]string{"SNS_TOPIC_ARN": "", "LOCAL_ASYNC_WORKERS": "0", "ASYNC_STRICT": "true"})
+	if rec := postJSON(s.HandleAsyncOrder, "/orders/async", `{"customer_id":1,"items":[{"product_id":"a","quantity":1,"price":5}]}`); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("async order = %d, want 503", rec.Code)
+	}
+	if ready := get(http.HandlerFunc(s.HandleReady), "/ready"); ready.Code != http.StatusServiceUnavailable {
+		t.Errorf("/ready = %d, want 503", ready.Code)
+	}
+}
+
+// dialBufconn serves newGRPCServer over an in-memory listener and returns
+// a client connected to it
+func dialBufconn(t *testing.T, s *OrderService, keys apiKeys) orderpb.OrderServiceClient {
+	t.Helper()
+	listener := bufconn.Listen(1 << 20)
+	server := newGRPCServer(s, keys)
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatalf("dial bufconn: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return orderpb.NewOrderServiceClient(conn)
+}
+
+// protoOrder is a one-item order request for the gRPC tests
+func protoOrder() *orderpb.SubmitOrderRequest {
+	return &orderpb.SubmitOrderRequest{
+		CustomerId: 1,
+		Items:      []*orderpb.Item{{ProductId: "a", Quantity: 2, Price: 5}},
+	}
+}
+
+func TestGRPCSubmitAndGetOrders(t *testing.T) {
+	s := newTestService(t, map[string]string{"ASYNC_STRICT": "false"})
+	client := dialBufconn(t, s, nil)
+	ctx := context.Background()
+
+	synced, err := client.SubmitSync(ctx, protoOrder())
+	if err != nil || synced.GetStatus() != string(StatusCompleted) || synced.GetTotal() != 10 {
+		t.Fatalf("SubmitSync = %v, %v; want a completed order totalling 10", synced, err)
+	}
+	order, err := client.GetOrder(ctx, &orderpb.GetOrderRequest{OrderId: synced.GetOrderId()})
+	if err != nil || order.GetStatus() != string(StatusCompleted) || len(order.GetItems()) != 1 || order.GetItems()[0].GetQuantity() != 2 {
+		t.Errorf("GetOrder = %v, %v; want the completed order", order, err)
+	}
+
+	queued, err := client.SubmitAsync(ctx, protoOrder())
+	if err != nil || queued.GetOrderId() == "" || queued.GetOrderId() == synced.GetOrderId() {
+		t.Fatalf("SubmitAsync = %v, %v; want a new queued order", queued, err)
+	}
+	if order, err := client.GetOrder(ctx, &orderpb.GetOrderRequest{OrderId: queued.GetOrderId()}); err != nil || order.GetOrderId() != queued.GetOrderId() {
+		t.Errorf("GetOrder(queued) = %v, %v", order, err)
+	}
+	if atomic.LoadInt64(&s.syncOrders) != 1 || atomic.LoadInt64(&s.asyncOrders) != 1 {
+		t.Errorf("counted %d sync and %d async orders, want one each", s.syncOrders, s.asyncOrders)
+	}
+}
+
+func TestGRPCErrorsMapToStatusCodes(t *testing.T) {
+	s := newTestService(t, nil)
+	client := dialBufconn(t, s, apiKeys{sha256.Sum256([]byte("secret"))})
+	authed := metadata.AppendToOutgoingContext(context.Background(), "x-api-key", "secret")
+
+	invalid := protoOrder()
+	invalid.Items[0].Quantity = 0
+	tests := []struct {
+		name string
+		call func() error
+		want grpccodes.Code
+	}{
+		{"missing order", func() error {
+			_, err := client.GetOrder(context.Background(), &orderpb.GetOrderRequest{OrderId: "nope"})
+			return err
+		}, grpccodes.NotFound},
+		{"invalid order", func() error {
+			_, err := client.SubmitSync(authed, invalid)
+			return err
+		}, grpccodes.InvalidArgument},
+		{"no API key", func() error {
+			_, err := client.SubmitSync(context.Background(), protoOrder())
+			return err
+		}, grpccodes.Unauthenticated},
+		{"wrong API key", func() error {
+			_, err := client.SubmitSync(metadata.AppendToOutgoingContext(context.Background(), "x-api-key", "guess"), protoOrder())
+			return err
+		}, grpccodes.PermissionDenied},
+		{"no SNS or workers", func() error {
+			_, err := client.SubmitAsync(authed, protoOrder())
+			return err
+		}, grpccodes.Unavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := status.Code(tt.call()); got != tt.want {
+				t.Errorf("code = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOrderBodyLimitAndUnknownFields(t *testing.T) {
+	s := newTestService(t, map[string]string{"MAX_BODY_BYTES": "64", "ASYNC_STRICT": "false"})
+	oversized := `{"customer_id":1,"items":[{"product_id":"` + strings.Repeat("a", 100) + `","quantity":1,"price":5}]}`
+	for _, handler := range []http.HandlerFunc{s.HandleSyncOrder, s.HandleAsyncOrder} {
+		if rec := postJSON(handler, "/orders", oversized); rec.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("oversized body = %d, want 413", rec.Code)
+		}
+		rec := postJSON(handler, "/orders", `{"customer_id":1,"itemz":[]}`)
+		if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), `"itemz"`) {
+			t.Errorf("unknown field = %d %q, want 400 naming itemz", rec.Code, rec.Body)
+		}
+	}
+	if orders, _ := s.orders.List(""); len(orders) != 0 {
+		t.Errorf("%d orders stored from rejected bodies", len(orders))
+	}
+}
+
+// customerOrders serves GET /customers/{id}/orders?query through the router
+// and decodes a 200 response, returning the raw body too
+func customerOrders(t *testing.T, s *OrderService, id, query string) (listPage, string) {
+	t.Helper()
+	router := mux.NewRouter()
+	router.HandleFunc("/customers/{customerId}/orders", s.HandleCustomerOrders)
+	rec := get(router, "/customers/"+id+"/orders?"+query)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /customers/%s/orders?%s = %d %s", id, query, rec.Code, rec.Body)
+	}
+	raw := rec.Body.String()
+	var page listPage
+	if err := json.Unmarshal([]byte(raw), &page); err != nil {
+		t.Fatalf("undecodable body: %v", err)
+	}
+	return page, raw
+}
+
+func TestCustomerOrdersPageNewestFirst(t *testing.T) {
+	s := newTestService(t, nil)
+	storeListedOrders(t, s)
+
+	var pages []string
+	cursor := ""
+	for {
+		page, _ := customerOrders(t, s, "1", "limit=2&cursor="+url.QueryEscape(cursor))
+		if page.Total != 5 {
+			t.Errorf("total = %d, want customer 1's 5 orders", page.Total)
+		}
+		pages = append(pages, page.ids())
+		if cursor = page.NextCursor; cursor == "" {
+			break
+		}
+	}
+	if got := strings.Join(pages, " | "); got != "o4,o3 | o2,o1 | o0" {
+		t.Errorf("pages = %s, want o4,o3 | o2,o1 | o0", got)
+	}
+	if page, _ := customerOrders(t, s, "2", ""); page.ids() != "o6,o5" {
+		t.Errorf("customer 2 = %s, want o6,o5", page.ids())
+	}
+}
+
+func TestCustomerWithoutOrdersGetsEmptyList(t *testing.T) {
+	s := newTestService(t, nil)
+	storeListedOrders(t, s)
+	page, raw := customerOrders(t, s, "9", "")
+	if page.Total != 0 || !strings.Contains(raw, `"orders":[]`) {
+		t.Errorf("customer 9 = %s, want an empty orders array", raw)
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/customers/{customerId}/orders", s.HandleCustomerOrders)
+	if rec := get(router, "/customers/abc/orders"); rec.Code != http.StatusBadRequest {
+		t.Errorf("non-numeric customer = %d, want 400", rec.Code)
+	}
+}
+
+func TestVIPAndHighValueOrdersPublishWithHighPriority(t *testing.T) {
+	s := newTestService(t, map[string]string{"VIP_CUSTOMER_IDS": "7, 9", "HIGH_VALUE_THRESHOLD": "100"})
+	for _, tc := range []struct {
+		name  string
+		order Order
+		want  string
+	}{
+		{"VIP customer", Order{CustomerID: 9, Items: []Item{{ProductID: "a", Quantity: 1, Price: 5}}}, "high"},
+		{"over threshold", Order{CustomerID: 1, Items: []Item{{ProductID: "a", Quantity: 3, Price: 40}}}, "high"},
+		{"at threshold", Order{CustomerID: 1, Items: []Item{{ProductID: "a", Quantity: 2, Price: 50}}}, "normal"},
+		{"ordinary", Order{CustomerID: 1, Items: []Item{{ProductID: "a", Quantity: 1, Price: 5}}}, "normal"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			attribute := s.publishInput(&tc.order).MessageAttributes["priority"]
+			if got := aws.ToString(attribute.StringValue); got != tc.want {
+				t.Errorf("priority = %q, want %q", got, tc.want)
+			}
+		})
+	}
+
+	t.Setenv("VIP_CUSTOMER_IDS", "7,vip")
+	if _, err := NewOrderService(); err == nil {
+		t.Error("non-numeric VIP_CUSTOMER_IDS accepted")
+	}
+}
+
+func TestOpenAPIDocumentIsValid(t *testing.T) {
+	s := newTestService(t, nil)
+	rec := get(http.HandlerFunc(s.HandleOpenAPI), "/openapi.json")
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("GET /openapi.json = %d %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+
+	doc, err := openapi3.NewLoader().LoadFromData(rec.Body.Bytes())
+	if err != nil {
+		t.Fatalf("document does not parse as OpenAPI: %v", err)
+	}
+	if err := doc.Validate(context.Background()); err != nil {
+		t.Fatalf("document is not valid OpenAPI 3: %v", err)
+	}
+
+	for path, codes := range map[string][]string{
+		"/orders/sync":       {"200", "400", "402"},
+		"/orders/async":      {"202", "400"},
+		"/orders/{order_id}": {"200", "404"},
+		"/health":            {"200"},
+		"/metrics":           {"200"},
+	} {
+		item := doc.Paths.Find(path)
+		if item == nil {
+			t.Errorf("%s is not described", path)
+			continue
+		}
+		for _, operation := range item.Operations() {
+			for _, code := range codes {
+				if operation.Responses.Value(code) == nil {
+					t.Errorf("%s does not describe a %s response", path, code)
+				}
+			}
+		}
+	}
+
+	order := doc.Components.Schemas["Order"]
+	if order == nil || order.Value.Properties["items"] == nil || doc.Components.Schemas["Item"] == nil {
+		t.Fatal("Order and Item schemas are missing")
+	}
+	// The schemas track the Go types, so every json field of Order appears
+	for i := 0; i < reflect.TypeOf(Order{}).NumField(); i++ {
+		name, _, _ := strings.Cut(reflect.TypeOf(Order{}).Field(i).Tag.Get("json"), ",")
+		if name != "" && name != "-" && order.Value.Properties[name] == nil {
+			t.Errorf("Order schema lacks %s", name)
+		}
+	}
+}
+
+// reasonCounts reads payment_failures_total from registry by reason label
+func reasonCounts(t *testing.T, registry *prometheus.Registry) map[string]float64 {
+	t.Helper()
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("Gather: %v", err)
+	}
+	counts := map[string]float64{}
+	for _, family := range families {
+		if family.GetName() != "payment_failures_total" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "reason" {
+					counts[label.GetValue()] = metric.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+	return counts
+}
+
+func TestEachPaymentFailureReasonIsReportedAndCounted(t *testing.T) {
+	for _, reason := range paymentFailureReasons {
+		t.Run(reason, func(t *testing.T) {
+			s := newTestService(t, map[string]string{"PAYMENT_FAILURE_RATE": "1", "PAYMENT_FAILURE_REASONS": reason + "=1"})
+			rec := postJSON(s.HandleSyncOrder, "/orders/sync", `{"customer_id":1,"items":[{"product_id":"a","quantity":1,"price":5}]}`)
+			var body map[string]interface{}
+			json.NewDecoder(rec.Body).Decode(&body)
+			if rec.Code != http.StatusPaymentRequired || body["reason"] != reason {
+				t.Fatalf("sync order = %d %v, want 402 with reason %s", rec.Code, body, reason)
+			}
+
+			var metrics struct {
+				ByReason map[string]float64 `json:"payment_failures_by_reason"`
+			}
+			json.NewDecoder(get(http.HandlerFunc(s.HandleMetrics), "/metrics").Body).Decode(&metrics)
+			counted := reasonCounts(t, s.promRegistry)
+			for _, other := range paymentFailureReasons {
+				want := 0.0
+				if other == reason {
+					want = 1
+				}
+				if metrics.ByReason[other] != want {
+					t.Errorf("payment_failures_by_reason[%s] = %v, want %v", other, metrics.ByReason[other], want)
+				}
+				if counted[other] != want {
+					t.Errorf("payment_failures_total{reason=%q} = %v, want %v", other, counted[other], want)
+				}
+			}
+		})
+	}
+
+	t.Setenv("PAYMENT_FAILURE_REASONS", "declined=1,stolen=2")
+	if _, err := NewOrderService(); err == nil {
+		t.Error("unknown failure reason accepted")
+	}
+}
+
+// useMiniredis starts an in-process Redis and points REDIS_ADDR at it, so
+// every service built afterwards in the test shares its orders
+func useMiniredis(t *testing.T) (*miniredis.Miniredis, map[string]string) {
+	t.Helper()
+	server := miniredis.RunT(t)
+	return server, map[string]string{"REDIS_ADDR": server.Addr()}
+}
+
+func TestRedisStoreSharesOrdersAcrossReplicas(t *testing.T) {
+	server, env := useMiniredis(t)
+	writer, reader := newTestService(t, env), newTestService(t, env)
+
+	rec := postJSON(writer.HandleSyncOrder, "/orders/sync", `{"customer_id":1,"items":[{"product_id":"a","quantity":1,"price":5}]}`)
+	var created map[string]interface{}
+	json.NewDecoder(rec.Body).Decode(&created)
+	orderID, _ := created["order_id"].(string)
+	if rec.Code != http.StatusOK || orderID == "" {
+		t.Fatalf("sync order = %d %v", rec.Code, created)
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/orders/{orderId}", reader.HandleGetOrder)
+	got := get(router, "/orders/"+orderID)
+	var order Order
+	json.NewDecoder(got.Body).Decode(&order)
+	if got.Code != http.StatusOK || order.Status != StatusCompleted {
+		t.Fatalf("GET on the other replica = %d %+v, want the completed order", got.Code, order)
+	}
+
+	if status := server.HGet("order:"+orderID, "status"); status != string(StatusCompleted) {
+		t.Errorf("hash status = %q, want completed", status)
+	}
+	if ok, _ := server.SIsMember("orders:status:completed", orderID); !ok {
+		t.Error("order missing from the completed status set")
+	}
+	if ok, _ := server.SIsMember("orders:status:pending", orderID); ok {
+		t.Error("order left in the pending status set")
+	}
+}
+
+func TestRedisStoreListsAndDeletesByStatus(t *testing.T) {
+	server, env := useMiniredis(t)
+	s := newTestService(t, env)
+	storeListedOrders(t, s)
+
+	pending, err := s.orders.List(StatusPending)
+	if err != nil || len(pending) != 4 {
+		t.Fatalf("List(pending) = %d orders (%v), want 4", len(pending), err)
+	}
+	all, _ := s.orders.List("")
+	if len(all) != 7 {
+		t.Errorf("List() = %d orders, want 7", len(all))
+	}
+
+	if err := s.orders.Delete("o1"); err != nil {
+		t.Fatal(err)
+	}
+	if order, err := s.orders.Get("o1"); order != nil || err != nil {
+		t.Errorf("Get after Delete = %v, %v", order, err)
+	}
+	if ok, _ := server.SIsMember("orders:status:pending", "o1"); ok {
+		t.Error("deleted order left in its status set")
+	}
+	if err := s.orders.Delete("o1"); err != nil {
+		t.Errorf("deleting a missing order: %v", err)
+	}
+}
+
+func TestRedisUpdateStatusHasOneWinner(t *testing.T) {
+	_, env := useMiniredis(t)
+	replicas := []*OrderService{newTestService(t, env), newTestService(t, env)}
+	order := &Order{OrderID: "contended", CustomerID: 1, Items: []Item{{ProductID: "a", Quantity: 1, Price: 5}}, Status: StatusPending, CreatedAt: time.Now()}
+	if err := replicas[0].orders.Put(order); err != nil {
+		t.Fatal(err)
+	}
+
+	var wins, conflicts int64
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(store OrderStore) {
+			defer wg.Done()
+			now := time.Now()
+			stored, err := store.UpdateStatus(order, StatusPending, StatusCompleted, &now, nil)
+			switch {
+			case err == nil:
+				atomic.AddInt64(&wins, 1)
+			case errors.Is(err, errStatusChanged) && stored == StatusCompleted:
+				atomic.AddInt64(&conflicts, 1)
+			default:
+				t.Errorf("UpdateStatus = %q, %v", stored, err)
+			}
+		}(replicas[i%2].orders)
+	}
+	wg.Wait()
+	if wins != 1 || conflicts != 19 {
+		t.Errorf("%d updates won and %d conflicted, want 1 and 19", wins, conflicts)
+	}
+	if stored, _ := replicas[1].orders.Get("contended"); stored == nil || stored.Status != StatusCompleted || stored.ProcessedAt == nil {
+		t.Errorf("stored order = %+v, want completed with ProcessedAt", stored)
+	}
+}
+
+func TestSLOPercentagesFromKnownDurations(t *testing.T) {
+	t.Setenv("SLO_TARGET_SECONDS", "5")
+	tracker, err := loadSLOTracker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	created := time.Now().Add(-time.Hour)
+	for _, seconds := range []float64{1, 1, 2, 2, 3, 3, 4, 4, 20, 40} {
+		order := &Order{CreatedAt: created}
+		tracker.record(order, created.Add(time.Duration(seconds*float64(time.Second))))
+	}
+	// A scheduled order is timed from when it became due
+	due := created.Add(time.Minute)
+	tracker.record(&Order{CreatedAt: created, ProcessAfter: &flexTime{due}}, due.Add(5*time.Second))
+
+	got := tracker.status()
+	want := map[string]interface{}{
+		"target_seconds": 5.0,
+		"orders":         int64(11),
+		"met":            int64(9),
+		"p50_seconds":    3.0,
+		"p95_seconds":    40.0,
+		"p99_seconds":    40.0,
+		"max_seconds":    40.0,
+	}
+	for name, value := range want {
+		if got[name] != value {
+			t.Errorf("%s = %v, want %v", name, got[name], value)
+		}
+	}
+	if percent := got["met_percent"].(float64); math.Abs(percent-100*9.0/11) > 1e-9 {
+		t.Errorf("met_percent = %v, want %v", percent, 100*9.0/11)
+	}
+
+	for _, value := range []string{"0", "-1", "soon"} {
+		t.Setenv("SLO_TARGET_SECONDS", value)
+		if _, err := loadSLOTracker(); err == nil {
+			t.Errorf("SLO_TARGET_SECONDS=%q accepted", value)
+		}
+	}
+}
+
+func TestProcessorReportedChargeTimeCountsTowardsSLO(t *testing.T) {
+	s := newTestService(t, map[string]string{"SLO_TARGET_SECONDS": "10"})
+	created := time.Now().Add(-time.Minute)
+	for _, id := range []string{"quick", "slow"} {
+		s.orders.Put(&Order{OrderID: id, CustomerID: 1, Items: []Item{{ProductID: "a", Quantity: 1, Price: 5}}, Status: StatusProcessing, CreatedAt: created})
+	}
+	router := mux.NewRouter()
+	router.HandleFunc("/admin/orders/{orderId}/status", s.HandleReportStatus)
+	for id, after := range map[string]time.Duration{"quick": 3 * time.Second, "slow": 30 * time.Second} {
+		body := `{"status":"completed","processed_at":"` + created.Add(after).UTC().Format(time.RFC3339Nano) + `"}`
+		request := httptest.NewRequest(http.MethodPost, "/admin/orders/"+id+"/status", strings.NewReader(body))
+		request.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, request)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("report %s = %d %s", id, rec.Code, rec.Body)
+		}
+	}
+
+	var metrics struct {
+		SLO map[string]interface{} `json:"slo"`
+	}
+	json.NewDecoder(get(http.HandlerFunc(s.HandleMetrics), "/metrics").Body).Decode(&metrics)
+	if metrics.SLO["orders"] != 2.0 || metrics.SLO["met"] != 1.0 || metrics.SLO["met_percent"] != 50.0 || metrics.SLO["max_seconds"] != 30.0 {
+		t.Errorf("/metrics slo = %v, want 1 of 2 orders within 10s and a 30s max", metrics.SLO)
+	}
+}
+
+// amendOrder serves PATCH /orders/{id} with a JSON body
+func amendOrder(s *OrderService, orderID, body string) *httptest.ResponseRecorder {
+	router := mux.NewRouter()
+	router.HandleFunc("/orders/{orderId}", s.HandleAmendOrder)
+	request := httptest.NewRequest(http.MethodPatch, "/orders/"+orderID, strings.NewReader(body))
+	request.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, request)
+	return rec
+}
+
+// storeOrderIn saves a one-item order worth 5.00 in status
+func storeOrderIn(t *testing.T, s *OrderService, orderID string, status OrderStatus) {
+	t.Helper()
+	order := &Order{OrderID: orderID, CustomerID: 1, Items: []Item{{ProductID: "a", Quantity: 1, Price: 5}}, Total: 5, Status: status, CreatedAt: time.Now()}
+	if err := s.orders.Put(order); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAmendPendingOrderRecomputesTotal(t *testing.T) {
+	s := newTestService(t, nil)
+	storeOrderIn(t, s, "o1", StatusPending)
+
+	rec := amendOrder(s, "o1", `{"items":[{"product_id":"a","quantity":1,"price":5},{"product_id":"b","quantity":2,"price":7.5}]}`)
+	var amended Order
+	json.NewDecoder(rec.Body).Decode(&amended)
+	if rec.Code != http.StatusOK || amended.Total != 20 || len(amended.Items) != 2 || amended.AmendedAt == nil {
+		t.Fatalf("amend = %d %+v, want 200 with two items totalling 20", rec.Code, amended)
+	}
+	stored, _ := s.orders.Get("o1")
+	if stored.Total != 20 || len(stored.Items) != 2 || stored.Status != StatusPending {
+		t.Errorf("stored order = %+v, want the amended pending order", stored)
+	}
+	if got := atomic.LoadInt64(&s.amendedOrders); got != 1 {
+		t.Errorf("amended_orders = %d, want 1", got)
+	}
+}
+
+func TestAmendIsRejectedOnceProcessingOrForImmutableFields(t *testing.T) {
+	s := newTestService(t, nil)
+	storeOrderIn(t, s, "busy", StatusProcessing)
+	storeOrderIn(t, s, "o1", StatusPending)
+	items := `"items":[{"product_id":"b","quantity":1,"price":9}]`
+
+	rec := amendOrder(s, "busy", "{"+items+"}")
+	if rec.Code != http.StatusConflict || !strings.Contains(rec.Body.String(), `"status":"processing"`) {
+		t.Errorf("amend processing order = %d %s, want 409 naming its status", rec.Code, rec.Body)
+	}
+	for _, body := range []string{
+		`{"order_id":"other",` + items + `}`,
+		`{"created_at":"2020-01-01T00:00:00Z",` + items + `}`,
+		`{"customer_id":2}`,
+		`{"items":[{"product_id":"b","quantity":0,"price":9}]}`,
+	} {
+		if rec := amendOrder(s, "o1", body); rec.Code != http.StatusUnprocessableEntity {
+			t.Errorf("amend %s = %d, want 422", body, rec.Code)
+		}
+	}
+	if rec := amendOrder(s, "missing", "{"+items+"}"); rec.Code != http.StatusNotFound {
+		t.Errorf("amend missing order = %d, want 404", rec.Code)
+	}
+	if stored, _ := s.orders.Get("o1"); stored.Total != 5 || stored.Items[0].ProductID != "a" {
+		t.Errorf("rejected amends changed the order: %+v", stored)
+	}
+}
+
+// useSlowSNS points the SNS client at an endpoint that answers topic
+// checks at once and takes delay over each publish, recording the most
+// publishes it ever held at one time
+func useSlowSNS(t *testing.T, delay time.Duration) (env map[string]string, peak *int64) {
+	t.Helper()
+	var inFlight int64
+	peak = new(int64)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		w.Header().Set("Content-Type", "text/xml")
+		if r.Form.Get("Action") == "GetTopicAttributes" {
+			io.WriteString(w, `<GetTopicAttributesResponse xmlns="http://sns.amazonaws.com/doc/2010-03-31/"><GetTopicAttributesResult><Attributes></Attributes></GetTopicAttributesResult></GetTopicAttributesResponse>`)
+			return
+		}
+		now := atomic.AddInt64(&inFlight, 1)
+		for {
+			seen := atomic.LoadInt64(peak)
+			if now <= seen || atomic.CompareAndSwapInt64(peak, seen, now) {
+				break
+			}
+		}
+		time.Sleep(delay)
+		atomic.AddInt64(&inFlight, -1)
+		io.WriteString(w, `<PublishResponse xmlns="http://sns.amazonaws.com/doc/2010-03-31/"><PublishResult><MessageId>m1</MessageId></PublishResult></PublishResponse>`)
+	}))
+	t.Cleanup(server.Close)
+	return map[string]string{
+		"AWS_ENDPOINT_URL_SNS": server.URL,
+		"SNS_TOPIC_ARN":        "arn:aws:sns:us-east-1:000000000000:orders",
+		"AWS_MAX_ATTEMPTS":     "1",
+	}, peak
+}
+
+func TestFloodedAsyncOrdersStayWithinThePublishLimit(t *testing.T) {
+	env, peak := useSlowSNS(t, 100*time.Millisecond)
+	env["SNS_MAX_CONCURRENCY"] = "3"
+	env["SNS_ACQUIRE_TIMEOUT"] = "150ms"
+	s := newTestService(t, env)
+
+	codes := make(chan int, 40)
+	var wg sync.WaitGroup
+	for i := 0; i < cap(codes); i++ {
+		wg.Add(1)
+		go func(customer int) {
+			defer wg.Done()
+			body := fmt.Sprintf(`{"customer_id":%d,"items":[{"product_id":"a","quantity":1,"price":5}]}`, customer)
+			codes <- postJSON(s.HandleAsyncOrder, "/orders/async", body).Code
+		}(i + 1)
+	}
+	wg.Wait()
+	close(codes)
+
+	counts := map[int]int{}
+	for code := range codes {
+		counts[code]++
+	}
+	if counts[http.StatusAccepted] == 0 || counts[http.StatusServiceUnavailable] == 0 || counts[http.StatusAccepted]+counts[http.StatusServiceUnavailable] != 40 {
+		t.Errorf("responses %v, want some 202s and the rest 503", counts)
+	}
+	if got := atomic.LoadInt64(peak); got > 3 {
+		t.Errorf("SNS saw %d publishes at once, want at most 3", got)
+	}
+
+	var metrics struct {
+		Publishes map[string]float64 `json:"sns_publishes"`
+	}
+	json.NewDecoder(get(http.HandlerFunc(s.HandleMetrics), "/metrics").Body).Decode(&metrics)
+	if metrics.Publishes["peak_in_flight"] > 3 || metrics.Publishes["in_flight"] != 0 || metrics.Publishes["max"] != 3 {
+		t.Errorf("/metrics sns_publishes = %v, want a peak of at most 3 and none left in flight", metrics.Publishes)
+	}
+	if got := metrics.Publishes["rejected"]; int(got) != counts[http.StatusServiceUnavailable] {
+		t.Errorf("rejected = %v, want the %d 503s", got, counts[http.StatusServiceUnavailable])
+	}
+}
+
+func TestSKULimiterCapsOrdersInFlightPerProduct(t *testing.T) {
+	l := newSKULimiter(2, time.Second)
+	items := []Item{{ProductID: "hot", Quantity: 1}}
+	var inFlight, peak int64
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			release, err := l.acquire(context.Background(), items)
+			if err != nil {
+				t.Errorf("acquire: %v", err)
+				return
+			}
+			defer release()
+			now := atomic.AddInt64(&inFlight, 1)
+			for seen := atomic.LoadInt64(&peak); now > seen && !atomic.CompareAndSwapInt64(&peak, seen, now); seen = atomic.LoadInt64(&peak) {
+			}
+			time.Sleep(2 * time.Millisecond)
+			atomic.AddInt64(&inFlight, -1)
+		}()
+	}
+	wg.Wait()
+	if peak > 2 {
+		t.Errorf("peak of %d orders in flight for one product, want at most 2", peak)
+	}
+	if status := l.status(); status["active_skus"] != 0 || status["rejected"] != int64(0) {
+		t.Errorf("status once every order is done: %v", status)
+	}
+}
+
+func TestSKULimiterTimesOutOnlyTheBusyProduct(t *testing.T) {
+	l := newSKULimiter(1, 20*time.Millisecond)
+	release, err := l.acquire(context.Background(), []Item{{ProductID: "hot"}})
+	if err != nil {
+		t.Fatalf("first acquire: %v", err)
+	}
+
+	// Another product goes straight ahead while hot is held
+	other, err := l.acquire(context.Background(), []Item{{ProductID: "cold"}})
+	if err != nil {
+		t.Fatalf("acquiring an idle product: %v", err)
+	}
+	other()
+
+	// An order for hot and cold gives up on hot and keeps neither slot
+	if _, err := l.acquire(context.Background(), []Item{{ProductID: "cold"}, {ProductID: "hot"}}); !errors.Is(err, errSKUBusy) {
+		t.Fatalf("acquiring a held product: %v, want errSKUBusy", err)
+	}
+	if rejected := atomic.LoadInt64(&l.rejected); rejected != 1 {
+		t.Errorf("rejected = %d, want 1", rejected)
+	}
+	cold, err := l.acquire(context.Background(), []Item{{ProductID: "cold"}})
+	if err != nil {
+		t.Fatalf("cold after a timed out order: %v", err)
+	}
+	cold()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := l.acquire(ctx, []Item{{ProductID: "hot"}}); !errors.Is(err, context.Canceled) {
+		t.Errorf("acquiring with a cancelled context: %v, want context.Canceled", err)
+	}
+
+	release()
+	l.mu.Lock()
+	left := len(l.slots)
+	l.mu.Unlock()
+	if left != 0 {
+		t.Errorf("%d products still tracked once every slot is released", left)
+	}
+}
+
+func TestSKULimiterOrdersSharingProductsDontDeadlock(t *testing.T) {
+	l := newSKULimiter(1, 5*time.Second)
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		items := []Item{{ProductID: "a"}, {ProductID: "b"}}
+		if i%2 == 1 {
+			items = []Item{{ProductID: "b"}, {ProductID: "a"}}
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			release, err := l.acquire(context.Background(), items)
+			if err != nil {
+				t.Errorf("acquire %v: %v", items, err)
+				return
+			}
+			time.Sleep(time.Millisecond)
+			release()
+		}()
+	}
+	wg.Wait()
+}
+
+func TestHotSKUOrdersTakeTurnsWithoutOverselling(t *testing.T) {
+	s := newTestService(t, map[string]string{
+		"SKU_MAX_CONCURRENCY": "1",
+		"SKU_ACQUIRE_TIMEOUT": "10s",
+		"INVENTORY":           "hot=10",
+		"PAYMENT_LATENCY":     "1ms",
+	})
+	var wg sync.WaitGroup
+	var sold, soldOut int64
+	for customer := 1; customer <= 30; customer++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			order := fmt.Sprintf(`{"customer_id":%d,"items":[{"product_id":"hot","quantity":1,"price":5}]}`, customer)
+			switch rec := postJSON(s.HandleSyncOrder, "/orders/sync", order); rec.Code {
+			case http.StatusOK:
+				atomic.AddInt64(&sold, 1)
+			case http.StatusConflict:
+				atomic.AddInt64(&soldOut, 1)
+			default:
+				t.Errorf("customer %d: %d %s", customer, rec.Code, rec.Body)
+			}
+		}()
+	}
+	wg.Wait()
+	if sold != 10 || soldOut != 20 {
+		t.Errorf("sold %d and turned away %d as sold out, want 10 and 20", sold, soldOut)
+	}
+}
+
+func TestHotSKUOrderGivesUpWithRetryAfter(t *testing.T) {
+	s := newTestService(t, map[string]string{
+		"SKU_MAX_CONCURRENCY": "1",
+		"SKU_ACQUIRE_TIMEOUT": "20ms",
+		"PAYMENT_LATENCY":     "500ms",
+	})
+	order := func(customer int) string {
+		return fmt.Sprintf(`{"customer_id":%d,"items":[{"product_id":"hot","quantity":1,"price":5}]}`, customer)
+	}
+	first := make(chan int)
+	go func() { first <- postJSON(s.HandleSyncOrder, "/orders/sync", order(1)).Code }()
+	eventuallyHeld := time.Now().Add(time.Second)
+	for s.skus.status()["active_skus"] != 1 && time.Now().Before(eventuallyHeld) {
+		time.Sleep(time.Millisecond)
+	}
+
+	rec := postJSON(s.HandleSyncOrder, "/orders/sync", order(2))
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") == "" {
+		t.Errorf("order while the product is held: %d, Retry-After %q; want 503 with a hint", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	if code := <-first; code != http.StatusOK {
+		t.Errorf("order holding the product: %d, want 200", code)
+	}
+	if got := promValues(t, s.promRegistry)["sku_orders_rejected_total"]; got != 1 {
+		t.Errorf("sku_orders_rejected_total = %v, want 1", got)
+	}
+}
+
+// fakeProcessorStatus serves a settable order processor GET /status body
+// and counts how often it is fetched
+type fakeProcessorStatus struct {
+	mu    sync.Mutex
+	code  int
+	body  string
+	calls int64
+}
+
+// useProcessorStatus starts a fake processor status at saturation and
+// returns it with the env pointing the service at it
+func useProcessorStatus(t *testing.T, saturation float64) (*fakeProcessorStatus, map[string]string) {
+	t.Helper()
+	status := &fakeProcessorStatus{}
+	status.set(http.StatusOK, fmt.Sprintf(`{"saturation":%v,"in_flight":0,"workers":4}`, saturation))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&status.calls, 1)
+		status.mu.Lock()
+		defer status.mu.Unlock()
+		w.WriteHeader(status.code)
+		io.WriteString(w, status.body)
+	}))
+	t.Cleanup(server.Close)
+	return status, map[string]string{"PROCESSOR_STATUS_URL": server.URL + "/status"}
+}
+
+func (f *fakeProcessorStatus) set(code int, body string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.code, f.body = code, body
+}
+
+// backpressuredService is a service publishing to a fake SNS topic that
+// polls status for the processor's saturation
+func backpressuredService(t *testing.T, saturation float64, env map[string]string) (*OrderService, *fakeProcessorStatus) {
+	t.Helper()
+	snsEnv, _ := useSlowSNS(t, 0)
+	status, statusEnv := useProcessorStatus(t, saturation)
+	maps.Copy(snsEnv, statusEnv)
+	maps.Copy(snsEnv, env)
+	return newTestService(t, snsEnv), status
+}
+
+func TestSaturatedProcessorShedsAsyncOrders(t *testing.T) {
+	for _, tc := range []struct {
+		saturation float64
+		threshold  string
+		shed       bool
+	}{
+		{0.5, "", false},
+		{0.89, "", false},
+		{0.9, "", true},
+		{1, "", true},
+		{0.6, "0.5", true},
+		{0.4, "0.5", false},
+	} {
+		t.Run(fmt.Sprintf("%v of %q", tc.saturation, tc.threshold), func(t *testing.T) {
+			env := map[string]string{}
+			if tc.threshold != "" {
+				env["PROCESSOR_SATURATION_THRESHOLD"] = tc.threshold
+			}
+			s, _ := backpressuredService(t, tc.saturation, env)
+
+			rec := postJSON(s.HandleAsyncOrder, "/orders/async", `{"customer_id":1,"items":[{"product_id":"a","quantity":1,"price":5}]}`)
+			if !tc.shed {
+				if rec.Code != http.StatusAccepted {
+					t.Errorf("order below the threshold: %d %s, want 202", rec.Code, rec.Body)
+				}
+				return
+			}
+			if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") != "2" || !strings.Contains(rec.Body.String(), "order processor saturated") {
+				t.Errorf("order at the threshold: %d (Retry-After %q) %s, want 503 saturated with Retry-After 2", rec.Code, rec.Header().Get("Retry-After"), rec.Body)
+			}
+			if orders, _ := s.orders.List(""); len(orders) != 0 {
+				t.Errorf("%d orders stored, want the shed order dropped", len(orders))
+			}
+			values := promValues(t, s.promRegistry)
+			if values["orders_shed_total"] != 1 || values["processor_saturation"] != tc.saturation {
+				t.Errorf("orders_shed_total = %v, processor_saturation = %v; want 1 and %v", values["orders_shed_total"], values["processor_saturation"], tc.saturation)
+			}
+		})
+	}
+}
+
+func TestSyncOrdersAreNotShed(t *testing.T) {
+	s, status := backpressuredService(t, 1, nil)
+	if rec := postJSON(s.HandleSyncOrder, "/orders/sync", `{"customer_id":1,"items":[{"product_id":"a","quantity":1,"price":5}]}`); rec.Code != http.StatusOK {
+		t.Errorf("sync order with the processor saturated: %d %s, want 200", rec.Code, rec.Body)
+	}
+	if calls := atomic.LoadInt64(&status.calls); calls != 0 {
+		t.Errorf("processor status fetched %d times for a sync order", calls)
+	}
+}
+
+func TestProcessorStatusIsCachedForTheTTL(t *testing.T) {
+	s, status := backpressuredService(t, 1, map[string]string{"PROCESSOR_STATUS_TTL": "100ms"})
+	order := `{"customer_id":1,"items":[{"product_id":"a","quantity":1,"price":5}]}`
+	for i := 0; i < 5; i++ {
+		postJSON(s.HandleAsyncOrder, "/orders/async", order)
+	}
+	if calls := atomic.LoadInt64(&status.calls); calls != 1 {
+		t.Errorf("processor status fetched %d times within one TTL, want 1", calls)
+	}
+
+	// The processor catching up is seen once the cached status goes stale
+	status.set(http.StatusOK, `{"saturation":0.2}`)
+	if rec := postJSON(s.HandleAsyncOrder, "/orders/async", order); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("order within the TTL: %d, want the cached 503", rec.Code)
+	}
+	time.Sleep(150 * time.Millisecond)
+	if rec := postJSON(s.HandleAsyncOrder, "/orders/async", order); rec.Code != http.StatusAccepted {
+		t.Errorf("order after the TTL: %d %s, want 202", rec.Code, rec.Body)
+	}
+	if calls := atomic.LoadInt64(&status.calls); calls != 2 {
+		t.Errorf("processor status fetched %d times over two TTLs, want 2", calls)
+	}
+}
+
+func TestUnreadableProcessorStatusShedsNothing(t *testing.T) {
+	for name, response := range map[string]struct {
+		code int
+		body string
+	}{
+		"error status":       {http.StatusInternalServerError, `{"saturation":1}`},
+		"garbage body":       {http.StatusOK, `not json`},
+		"missing saturation": {http.StatusOK, `{"workers":4}`},
+	} {
+		t.Run(name, func(t *testing.T) {
+			s, status := backpressuredService(t, 1, nil)
+			status.set(response.code, response.body)
+			if rec := postJSON(s.HandleAsyncOrder, "/orders/async", `{"customer_id":1,"items":[{"product_id":"a","quantity":1,"price":5}]}`); rec.Code != http.StatusAccepted {
+				t.Errorf("order with an unreadable status: %d %s, want 202", rec.Code, rec.Body)
+			}
+			if got := s.backpressure.status()["last_error"]; got == nil {
+				t.Errorf("status has no last_error: %v", s.backpressure.status())
+			}
+		})
+	}
+}
+
+func TestProcessorBackpressureSettingsAreValidated(t *testing.T) {
+	for name, env := range map[string]map[string]string{
+		"zero threshold":  {"PROCESSOR_SATURATION_THRESHOLD": "0"},
+		"threshold above": {"PROCESSOR_SATURATION_THRESHOLD": "1.5"},
+		"bad threshold":   {"PROCESSOR_SATURATION_THRESHOLD": "high"},
+		"zero ttl":        {"PROCESSOR_STATUS_TTL": "0s"},
+		"bad ttl":         {"PROCESSOR_STATUS_TTL": "soon"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv("PROCESSOR_STATUS_URL", "http://processor/status")
+			for key, value := range env {
+				t.Setenv(key, value)
+			}
+			if _, err := loadProcessorBackpressure(); err == nil {
+				t.Errorf("%v accepted", env)
+			}
+		})
+	}
+	t.Setenv("PROCESSOR_STATUS_URL", "")
+	if backpressure, err := loadProcessorBackpressure(); backpressure != nil || err != nil {
+		t.Errorf("without PROCESSOR_STATUS_URL: %v, %v; want nil", backpressure, err)
+	}
+}
+
+// orderOf builds an order for customer 1 with one line item per quantity
+func orderOf(quantities ...int) Order {
+	order := Order{CustomerID: 1}
+	for i, quantity := range quantities {
+		order.Items = append(order.Items, Item{ProductID: fmt.Sprintf("p%d", i), Quantity: quantity, Price: 1})
+	}
+	return order
+}
+
+func TestValidateOrderEnforcesItemAndQuantityLimits(t *testing.T) {
+	limits := orderLimits{maxItems: 3, maxQuantity: 10}
+	for _, tc := range []struct {
+		name       string
+		limits     orderLimits
+		quantities []int
+		message    string
+	}{
+		{"items at the limit", limits, []int{1, 1, 1}, ""},
+		{"one item over", limits, []int{1, 1, 1, 1}, "has 4 items, the maximum is 3"},
+		{"quantity at the limit", limits, []int{5, 5}, ""},
+		{"quantity one over", limits, []int{5, 6}, "total quantity exceeds the maximum of 10"},
+		{"single item over the quantity", limits, []int{11}, "total quantity exceeds the maximum of 10"},
+		{"quantities that would overflow a sum", limits, []int{math.MaxInt, math.MaxInt}, "total quantity exceeds the maximum of 10"},
+		{"limits disabled", orderLimits{}, slices.Repeat([]int{1000}, 100), ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			order := orderOf(tc.quantities...)
+			var messages []string
+			for _, problem := range validateOrder(&order, tc.limits) {
+				if problem.Field != "items" {
+					t.Errorf("unexpected problem %+v", problem)
+				}
+				messages = append(messages, problem.Message)
+			}
+			var want []string
+			if tc.message != "" {
+				want = []string{tc.message}
+			}
+			if !slices.Equal(messages, want) {
+				t.Errorf("validateOrder reported %q, want %q", messages, want)
+			}
+		})
+	}
+}
+
+func TestOrderLimitsComeFromTheEnvironment(t *testing.T) {
+	s := newTestService(t, map[string]string{
+		"MAX_ITEMS":             "2",
+		"MAX_QUANTITY":          "20",
+		"MAX_QUANTITY_PER_ITEM": "0",
+		"ASYNC_STRICT":          "false",
+	})
+	for _, tc := range []struct {
+		items string
+		code  int
+	}{
+		{`[{"product_id":"a","quantity":10,"price":1},{"product_id":"b","quantity":10,"price":1}]`, http.StatusOK},
+		{`[{"product_id":"a","quantity":10,"price":1},{"product_id":"b","quantity":11,"price":1}]`, http.StatusUnprocessableEntity},
+		{`[{"product_id":"a","quantity":1,"price":1},{"product_id":"b","quantity":1,"price":1},{"product_id":"c","quantity":1,"price":1}]`, http.StatusUnprocessableEntity},
+	} {
+		if rec := postJSON(s.HandleSyncOrder, "/orders/sync", `{"customer_id":1,"items":`+tc.items+`}`); rec.Code != tc.code {
+			t.Errorf("items %s: %d %s, want %d", tc.items, rec.Code, rec.Body, tc.code)
+		}
+	}
+
+	for _, name := range []string{"MAX_ITEMS", "MAX_QUANTITY"} {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv(name, "-1")
+			if _, err := NewOrderService(); err == nil || !strings.Contains(err.Error(), name) {
+				t.Errorf("negative %s: %v, want an error naming it", name, err)
+			}
+		})
+	}
+}
+
+func TestRetryWaitingOnACancelledSyncOrderIsAlso499(t *testing.T) {
+	for name, key := range map[string]string{"Idempotency-Key": "k1", "identical order": ""} {
+		t.Run(name, func(t *testing.T) {
+			s := newTestService(t, map[string]string{"PAYMENT_LATENCY": "2s", "SYNC_RESULT_CACHE_WINDOW": "1m"})
+			order := func() Order {
+				return Order{CustomerID: 1, Items: []Item{{ProductID: "a", Quantity: 1, Price: 5}}}
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			owner := make(chan error, 1)
+			go func() {
+				_, err := s.SubmitSync(ctx, order(), orderSource{idempotencyKey: key})
+				owner <- err
+			}()
+			// Let the owner claim the order before the retry arrives
+			time.Sleep(50 * time.Millisecond)
+			retry := make(chan error, 1)
+			go func() {
+				_, err := s.SubmitSync(context.Background(), order(), orderSource{idempotencyKey: key})
+				retry <- err
+			}()
+			time.Sleep(50 * time.Millisecond)
+			cancel()
+
+			for who, errs := range map[string]chan error{"owner": owner, "retry": retry} {
+				var rejected *orderError
+				if err := <-errs; !errors.As(err, &rejected) || rejected.status != statusClientClosedRequest {
+					t.Errorf("%s answered %v, want 499", who, err)
+				}
+			}
+		})
+	}
+}
+
+func TestConcurrentRetriesChargeAFailedOrderOnce(t *testing.T) {
+	s := newTestService(t, map[string]string{"INVENTORY": "a=5"})
+	storeOrderIn(t, s, "o1", StatusFailed)
+	router := mux.NewRouter()
+	router.HandleFunc("/orders/{orderId}", s.HandleGetOrder).Methods("GET")
+	router.HandleFunc("/orders/{orderId}/retry", s.HandleRetryOrder).Methods("POST")
+
+	codes := make(chan int, 10)
+	var wg sync.WaitGroup
+	for i := 0; i < cap(codes); i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/orders/o1/retry", nil))
+			codes <- rec.Code
+		}()
+		go func() {
+			defer wg.Done()
+			get(router, "/orders/o1")
+		}()
+	}
+	wg.Wait()
+	close(codes)
+
+	charged := 0
+	for code := range codes {
+		switch code {
+		case http.StatusOK:
+			charged++
+		case http.StatusConflict:
+		default:
+			t.Errorf("retry answered %d", code)
+		}
+	}
+	if charged != 1 {
+		t.Errorf("%d retries charged the order, want 1", charged)
+	}
+	if units, _ := s.inventory.remaining("a"); units != 4 {
+		t.Errorf("%d units of a left, want 4 taken by the one retry", units)
+	}
+}
+
+func TestAsyncOrderTimeoutIsStoredAndEnforced(t *testing.T) {
+	_, redisEnv := useMiniredis(t)
+	for name, storeEnv := range map[string]map[string]string{"memory store": nil, "redis store": redisEnv} {
+		t.Run(name, func(t *testing.T) {
+			env := map[string]string{
+				"LOCAL_ASYNC_WORKERS":      "1",
+				"ORDER_PROCESSING_TIMEOUT": "1s",
+				"PAYMENT_LATENCY":          "3s",
+			}
+			maps.Copy(env, storeEnv)
+			s := newTestService(t, env)
+			t.Cleanup(func() {
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+				s.Shutdown(ctx)
+			})
+
+			rec := postJSON(s.HandleAsyncOrder, "/orders/async", `{"customer_id":1,"items":[{"product_id":"a","quantity":1,"price":5}]}`)
+			var accepted struct {
+				OrderID              string  `json:"order_id"`
+				MaxProcessingSeconds float64 `json:"max_processing_seconds"`
+			}
+			json.NewDecoder(rec.Body).Decode(&accepted)
+			if rec.Code != http.StatusAccepted || accepted.MaxProcessingSeconds != 1 {
+				t.Fatalf("async order = %d with max_processing_seconds %v, want 202 with 1", rec.Code, accepted.MaxProcessingSeconds)
+			}
+			stored, err := s.orders.Get(accepted.OrderID)
+			if err != nil || stored == nil || stored.MaxProcessingSeconds != 1 {
+				t.Fatalf("stored order %+v (%v), want max_processing_seconds 1", stored, err)
+			}
+
+			// The memory store's order is shared with its worker
+			status := func() OrderStatus {
+				order, _ := s.orders.Get(accepted.OrderID)
+				return s.currentStatus(order)
+			}
+			if !eventually(t, 3*time.Second, func() bool { return status() == StatusFailedTimeout }) {
+				t.Errorf("slow order ended %s, want failed_timeout", status())
+			}
+		})
+	}
+}
+
+// captureStdout sends os.Stdout to a pipe until the returned func is
+// called, which restores it and returns the JSON lines written meanwhile
+func captureStdout(t *testing.T) func() []map[string]interface{} {
+	t.Helper()
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := os.Stdout
+	os.Stdout = writer
+	output := make(chan []byte)
+	go func() {
+		data, _ := io.ReadAll(reader)
+		output <- data
+	}()
+	var lines []map[string]interface{}
+	return func() []map[string]interface{} {
+		if os.Stdout == writer {
+			os.Stdout = saved
+			writer.Close()
+			for _, line := range strings.Split(strings.TrimSpace(string(<-output)), "\n") {
+				var entry map[string]interface{}
+				if err := json.Unmarshal([]byte(line), &entry); err != nil {
+					t.Fatalf("stdout line %q is not JSON: %v", line, err)
+				}
+				lines = append(lines, entry)
+			}
+		}
+		return lines
+	}
+}
+
+func TestRefusedRequestsAreAccessLogged(t *testing.T) {
+	t.Setenv("AUTH_ENABLED", "true")
+	t.Setenv("API_KEYS", "key-one")
+	keys, err := loadAPIKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := mux.NewRouter()
+	router.HandleFunc("/admin/drain", labelled("served")).Methods("POST")
+	logged := captureStdout(t)
+	handler := withMiddleware(router, keys, true)
+	t.Cleanup(func() { logged() })
+
+	for _, key := range []string{"", "key-two"} {
+		request := httptest.NewRequest(http.MethodPost, "/admin/drain", nil)
+		if key != "" {
+			request.Header.Set("X-API-Key", key)
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), request)
+	}
+	lines := logged()
+	if len(lines) != 2 {
+		t.Fatalf("%d access log lines, want one per refused request: %v", len(lines), lines)
+	}
+	for i, want := range []float64{http.StatusUnauthorized, http.StatusForbidden} {
+		if lines[i]["status"] != want || lines[i]["route"] != "/admin/drain" {
+			t.Errorf("line %d = %v, want status %v on /admin/drain", i, lines[i], want)
+		}
+	}
+}
+
+func TestAccessLogLineFields(t *testing.T) {
+	s := newTestService(t, nil)
+	router := mux.NewRouter()
+	router.HandleFunc("/orders/sync", s.HandleSyncOrder).Methods("POST")
+	logged := captureStdout(t)
+	handler := withMiddleware(router, nil, true)
+	t.Cleanup(func() { logged() })
+
+	body := `{"customer_id":1,"items":[{"product_id":"a","quantity":1,"price":5}]}`
+	request := httptest.NewRequest(http.MethodPost, "/orders/sync", strings.NewReader(body))
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("X-Request-ID", "req-1")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, request)
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/nowhere", nil))
+
+	lines := logged()
+	if len(lines) != 2 {
+		t.Fatalf("%d access log lines, want 2: %v", len(lines), lines)
+	}
+	line := lines[0]
+	for field, want := range map[string]interface{}{
+		"method":         "POST",
+		"route":          "/orders/sync",
+		"path":           "/orders/sync",
+		"status":         float64(http.StatusOK),
+		"request_id":     "req-1",
+		"request_bytes":  float64(len(body)),
+		"response_bytes": float64(rec.Body.Len()),
+	} {
+		if line[field] != want {
+			t.Errorf("%s = %v, want %v", field, line[field], want)
+		}
+	}
+	if latency, ok := line["latency_ms"].(float64); !ok || latency <= 0 {
+		t.Errorf("latency_ms = %v, want a positive duration", line["latency_ms"])
+	}
+	if _, err := time.Parse(time.RFC3339Nano, fmt.Sprint(line["time"])); err != nil {
+		t.Errorf("time = %v: %v", line["time"], err)
+	}
+	if unmatched := lines[1]; unmatched["route"] != "unmatched" || unmatched["status"] != float64(http.StatusNotFound) {
+		t.Errorf("unrouted request logged as %v, want an unmatched 404", unmatched)
+	}
+}
+
+func TestAccessLogLatencyOfAStreamIsTheConnectionDuration(t *testing.T) {
+	s := newTestService(t, map[string]string{"STREAM_IDLE_TIMEOUT": "300ms", "STREAM_HEARTBEAT": "100ms"})
+	storePending(t, s, "watched")
+	router := mux.NewRouter()
+	router.HandleFunc("/orders/{orderId}/events", s.HandleOrderEvents).Methods("GET")
+	logged := captureStdout(t)
+	server := httptest.NewServer(withMiddleware(router, nil, true))
+	t.Cleanup(func() { logged() })
+
+	io.Copy(io.Discard, openStream(t, server, "watched").Body)
+	// Close waits for the handler, and so its log line
+	server.Close()
+	lines := logged()
+	if len(lines) != 1 {
+		t.Fatalf("%d access log lines, want 1: %v", len(lines), lines)
+	}
+	line := lines[0]
+	if line["route"] != "/orders/{orderId}/events" || line["status"] != float64(http.StatusOK) || line["response_bytes"] == float64(0) {
+		t.Errorf("stream logged as %v", line)
+	}
+	if latency, _ := line["latency_ms"].(float64); latency < 300 {
+		t.Errorf("latency_ms = %v, want the stream's whole 300ms or more", latency)
+	}
+}
+
+// migrateStore serves POST /admin/store/migrate with body
+func migrateStore(s *OrderService, body string) (*httptest.ResponseRecorder, map[string]interface{}) {
+	rec := postJSON(s.HandleMigrateStore, "/admin/store/migrate", body)
+	var report map[string]interface{}
+	json.Unmarshal(rec.Body.Bytes(), &report)
+	return rec, report
+}
+
+func TestMigrateCopiesMemoryOrdersIntoRedis(t *testing.T) {
+	server, _ := useMiniredis(t)
+	s := newTestService(t, nil)
+	storeListedOrders(t, s)
+
+	rec, report := migrateStore(s, fmt.Sprintf(`{"redis_addr":%q}`, server.Addr()))
+	if rec.Code != http.StatusOK || report["copied"] != 7.0 || report["failed"] != 0.0 || report["switched"] != false {
+		t.Fatalf("migrate = %d %v, want 7 copied, none failed, not switched", rec.Code, report)
+	}
+	target := newRedisOrderStore(server.Addr(), 0)
+	memoryOrders, _ := s.orders.List("")
+	for _, order := range memoryOrders {
+		copied, err := target.Get(order.OrderID)
+		if err != nil || copied == nil || copied.Status != order.Status || copied.CustomerID != order.CustomerID || !copied.CreatedAt.Equal(order.CreatedAt) {
+			t.Errorf("order %s in Redis = %+v (%v), want %+v", order.OrderID, copied, err, order)
+		}
+	}
+	// Without switch the service keeps its memory store
+	if _, memory := s.orders.active().(*memoryOrderStore); !memory {
+		t.Errorf("service moved to %T without switch", s.orders.active())
+	}
+}
+
+func TestMigrateWithSwitchMovesReadsAndWritesToRedis(t *testing.T) {
+	server, _ := useMiniredis(t)
+	s := newTestService(t, nil)
+	storeOrderIn(t, s, "before", StatusPending)
+
+	if rec, report := migrateStore(s, fmt.Sprintf(`{"redis_addr":%q,"switch":true}`, server.Addr())); rec.Code != http.StatusOK || report["copied"] != 1.0 || report["switched"] != true {
+		t.Fatalf("migrate = %d %v, want 1 copied and switched", rec.Code, report)
+	}
+	if _, shared := s.orders.active().(*redisOrderStore); !shared {
+		t.Fatalf("service still on %T after switching", s.orders.active())
+	}
+
+	// A status change and a new order land in Redis, where another
+	// replica sees them
+	order, _ := s.orders.Get("before")
+	if err := s.UpdateStatus(order, StatusProcessing); err != nil {
+		t.Fatal(err)
+	}
+	rec := postJSON(s.HandleSyncOrder, "/orders/sync", `{"customer_id":1,"items":[{"product_id":"a","quantity":1,"price":5}]}`)
+	var created map[string]interface{}
+	json.NewDecoder(rec.Body).Decode(&created)
+	replica := newTestService(t, map[string]string{"REDIS_ADDR": server.Addr()})
+	if got := storedStatus(t, replica, "before"); got != StatusProcessing {
+		t.Errorf("migrated order is %s in Redis, want processing", got)
+	}
+	if orderID, _ := created["order_id"].(string); storedStatus(t, replica, orderID) != StatusCompleted {
+		t.Errorf("order placed after the switch is not completed in Redis")
+	}
+
+	if rec, _ := migrateStore(s, fmt.Sprintf(`{"redis_addr":%q}`, server.Addr())); rec.Code != http.StatusConflict {
+		t.Errorf("migrating again = %d, want 409", rec.Code)
+	}
+}
+
+func TestMigrateRefusesBadTargets(t *testing.T) {
+	s := newTestService(t, nil)
+	storeOrderIn(t, s, "o1", StatusPending)
+	if rec, _ := migrateStore(s, `{"switch":true}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("migrate without redis_addr = %d, want 400", rec.Code)
+	}
+
+	server, _ := useMiniredis(t)
+	addr := server.Addr()
+	server.Close()
+	if rec, _ := migrateStore(s, fmt.Sprintf(`{"redis_addr":%q,"switch":true}`, addr)); rec.Code != http.StatusBadGateway {
+		t.Errorf("migrate to a stopped Redis = %d, want 502", rec.Code)
+	}
+	if _, memory := s.orders.active().(*memoryOrderStore); !memory {
+		t.Errorf("service moved to %T after a failed migration", s.orders.active())
+	}
+}
+
+func TestConcurrentOrdersForANewProductShareOneRow(t *testing.T) {
+	s := newTestService(t, map[string]string{"INVENTORY_DEFAULT_STOCK": "40"})
+	// No product has a row yet; each round releases 100 goroutines at once
+	// to race for creating both of its products, named in either order
+	for round := 0; round < 20; round++ {
+		first, second := fmt.Sprintf("fresh-%d", round), fmt.Sprintf("also-fresh-%d", round)
+		start := make(chan struct{})
+		reserved := make(chan bool, 100)
+		var wg sync.WaitGroup
+		for i := 0; i < cap(reserved); i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				items := []Item{{ProductID: first, Quantity: 1, Price: 1}, {ProductID: second, Quantity: 1, Price: 1}}
+				if i%2 == 1 {
+					items[0], items[1] = items[1], items[0]
+				}
+				<-start
+				err := s.inventory.reserve(items, false)
+				if err != nil && !errors.Is(err, errOutOfStock) {
+					t.Errorf("reserve: %v", err)
+				}
+				reserved <- err == nil
+			}()
+		}
+		close(start)
+		wg.Wait()
+		close(reserved)
+
+		taken := 0
+		for ok := range reserved {
+			if ok {
+				taken++
+			}
+		}
+		if taken != 40 {
+			t.Errorf("round %d: %d orders reserved stock, want the 40 units allowed", round, taken)
+		}
+		for _, product := range []string{first, second} {
+			if units, limited := s.inventory.remaining(product); !limited || units != 0 {
+				t.Errorf("%s has %d units left (limited %v), want 0", product, units, limited)
+			}
+		}
+	}
+}
+
+func TestReceiptIsOnlyForPaidOrdersAsJSONOrText(t *testing.T) {
+	s := newTestService(t, nil)
+	processed := time.Date(2026, 3, 1, 12, 0, 5, 0, time.UTC)
+	paid := &Order{
+		OrderID:    "paid",
+		CustomerID: 7,
+		Currency:   "USD",
+		Items: []Item{
+			{ProductID: "a", Quantity: 3, Price: 0.1},
+			{ProductID: "b", Quantity: 2, Price: 19.99},
+		},
+		Status:      StatusCompleted,
+		CreatedAt:   processed.Add(-5 * time.Second),
+		ProcessedAt: &processed,
+	}
+	if err := s.orders.Put(paid); err != nil {
+		t.Fatal(err)
+	}
+	storeOrderIn(t, s, "pending", StatusPending)
+	storeOrderIn(t, s, "failed", StatusFailed)
+	router := mux.NewRouter()
+	router.HandleFunc("/orders/{orderId}/receipt", s.HandleGetReceipt).Methods("GET")
+	receiptFor := func(orderID, accept string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodGet, "/orders/"+orderID+"/receipt", nil)
+		if accept != "" {
+			request.Header.Set("Accept", accept)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, request)
+		return rec
+	}
+
+	for _, orderID := range []string{"pending", "failed"} {
+		if rec := receiptFor(orderID, ""); rec.Code != http.StatusConflict || !strings.Contains(rec.Body.String(), "Order is "+orderID) {
+			t.Errorf("receipt for a %s order = %d %q, want 409 naming its status", orderID, rec.Code, rec.Body.String())
+		}
+	}
+	if rec := receiptFor("missing", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("receipt for an unknown order = %d, want 404", rec.Code)
+	}
+
+	rec := receiptFor("paid", "application/json")
+	var got receipt
+	if err := json.NewDecoder(rec.Body).Decode(&got); rec.Code != http.StatusOK || err != nil {
+		t.Fatalf("JSON receipt = %d, %v", rec.Code, err)
+	}
+	want := receipt{
+		OrderID:    "paid",
+		CustomerID: 7,
+		Currency:   "USD",
+		Items: []receiptLine{
+			{ProductID: "a", Quantity: 3, UnitPrice: 0.1, Subtotal: 0.3},
+			{ProductID: "b", Quantity: 2, UnitPrice: 19.99, Subtotal: 39.98},
+		},
+		Total: 40.28,
+	}
+	if got.ProcessedAt == nil || !got.ProcessedAt.Equal(processed) {
+		t.Errorf("processed_at = %v, want %v", got.ProcessedAt, processed)
+	}
+	got.CreatedAt, got.ProcessedAt = time.Time{}, nil
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("JSON receipt = %+v, want %+v", got, want)
+	}
+
+	rec = receiptFor("paid", "text/plain")
+	text := rec.Body.String()
+	if rec.Code != http.StatusOK || !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain") {
+		t.Fatalf("text receipt = %d %s", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	for _, line := range []string{
+		"Receipt for order paid",
+		"Customer: 7",
+		"Paid:     2026-03-01T12:00:05Z",
+		"b                       2 x      19.99 =      39.98",
+		"Total: 40.28 USD",
+	} {
+		if !strings.Contains(text, line) {
+			t.Errorf("text receipt is missing %q:\n%s", line, text)
+		}
+	}
+}
+
+func TestPartialFulfillmentShipsWhatIsLeft(t *testing.T) {
+	s := newTestService(t, map[string]string{"PARTIAL_FULFILLMENT": "true", "INVENTORY": "a=5,b=0"})
+	type line struct{ fulfilled, backordered int }
+	tests := []struct {
+		name       string
+		order      string
+		wantCode   int
+		wantStatus OrderStatus
+		wantTotal  float64
+		// Only an order with backorders lists its items
+		wantLines []line
+		left      int
+	}{
+		{
+			name:       "enough stock",
+			order:      `{"customer_id":1,"items":[{"product_id":"a","quantity":2,"price":2}]}`,
+			wantCode:   http.StatusOK,
+			wantStatus: StatusCompleted,
+			wantTotal:  4,
+			left:       3,
+		},
+		{
+			name:       "some stock",
+			order:      `{"customer_id":1,"items":[{"product_id":"a","quantity":5,"price":2},{"product_id":"b","quantity":1,"price":3}]}`,
+			wantCode:   http.StatusOK,
+			wantStatus: StatusPartiallyFulfilled,
+			wantTotal:  6,
+			wantLines:  []line{{3, 2}, {0, 1}},
+		},
+		{
+			name:     "no stock",
+			order:    `{"customer_id":1,"items":[{"product_id":"a","quantity":1,"price":2}]}`,
+			wantCode: http.StatusConflict,
+		},
+	}
+	for _, tt := range tests {
+		rec := postJSON(s.HandleSyncOrder, "/orders/sync", tt.order)
+		if rec.Code != tt.wantCode {
+			t.Fatalf("%s: order = %d %s, want %d", tt.name, rec.Code, rec.Body.String(), tt.wantCode)
+		}
+		if units, _ := s.inventory.remaining("a"); units != tt.left {
+			t.Errorf("%s: %d units of a left, want %d", tt.name, units, tt.left)
+		}
+		if tt.wantCode != http.StatusOK {
+			continue
+		}
+		var charged struct {
+			Status OrderStatus `json:"status"`
+			Total  float64     `json:"total"`
+			Items  []Item      `json:"items"`
+		}
+		json.NewDecoder(rec.Body).Decode(&charged)
+		if charged.Status != tt.wantStatus || charged.Total != tt.wantTotal {
+			t.Errorf("%s: charged %s for %v, want %s for %v", tt.name, charged.Status, charged.Total, tt.wantStatus, tt.wantTotal)
+		}
+		var lines []line
+		for _, item := range charged.Items {
+			lines = append(lines, line{item.FulfilledQuantity, item.BackorderedQuantity})
+		}
+		if !reflect.DeepEqual(lines, tt.wantLines) {
+			t.Errorf("%s: fulfilled and backordered = %v, want %v", tt.name, lines, tt.wantLines)
+		}
+	}
+
+	if got := promValues(t, s.promRegistry)["orders_partially_fulfilled_total"]; got != 1 {
+		t.Errorf("orders_partially_fulfilled_total = %v, want 1", got)
+	}
+}
+
+func TestPreviewPricesAndChecksStockWithoutTakingIt(t *testing.T) {
+	s := newTestService(t, map[string]string{"INVENTORY": "a=3"})
+	before := promValues(t, s.promRegistry)
+
+	// Both a lines draw on the same 3 units; c is not limited
+	rec := postJSON(s.HandlePreviewOrder, "/orders/preview", `{"customer_id":1,"items":[`+
+		`{"product_id":"a","quantity":2,"price":1.5},{"product_id":"a","quantity":2,"price":1.5},{"product_id":"c","quantity":1,"price":0.1}]}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("preview = %d %s", rec.Code, rec.Body.String())
+	}
+	var preview struct {
+		Total        float64 `json:"total"`
+		AllAvailable bool    `json:"all_available"`
+		Items        []struct {
+			ProductID string  `json:"product_id"`
+			Subtotal  float64 `json:"subtotal"`
+			Available bool    `json:"available"`
+			Remaining *int    `json:"remaining"`
+		} `json:"items"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&preview); err != nil {
+		t.Fatal(err)
+	}
+	if preview.Total != 6.1 || preview.AllAvailable || len(preview.Items) != 3 {
+		t.Fatalf("preview = %+v, want a total of 6.1 that is not all available", preview)
+	}
+	for i, item := range preview.Items {
+		wantAvailable := item.ProductID == "c"
+		if item.Available != wantAvailable {
+			t.Errorf("item %d (%s) available = %v, want %v", i, item.ProductID, item.Available, wantAvailable)
+		}
+		if limited := item.ProductID == "a"; limited != (item.Remaining != nil) || limited && *item.Remaining != 3 {
+			t.Errorf("item %d (%s) remaining = %v, want 3 only for the limited product", i, item.ProductID, item.Remaining)
+		}
+	}
+
+	if units, _ := s.inventory.remaining("a"); units != 3 {
+		t.Errorf("preview left %d units of a, want all 3", units)
+	}
+	if stored, err := s.orders.List(""); err != nil || len(stored) != 0 {
+		t.Errorf("preview stored %d orders (%v), want none", len(stored), err)
+	}
+	if after := promValues(t, s.promRegistry); !reflect.DeepEqual(after, before) {
+		t.Errorf("preview changed the metrics from %v to %v", before, after)
+	}
+}
+
+func TestSyncRetryInsideTheWindowGetsTheCachedResult(t *testing.T) {
+	s := newTestService(t, map[string]string{"SYNC_RESULT_CACHE_WINDOW": "300ms"})
+	order := `{"customer_id":1,"items":[{"product_id":"a","quantity":1,"price":5}]}`
+	charge := func(body string) map[string]interface{} {
+		t.Helper()
+		rec := postJSON(s.HandleSyncOrder, "/orders/sync", body)
+		var response map[string]interface{}
+		if err := json.NewDecoder(rec.Body).Decode(&response); rec.Code != http.StatusOK || err != nil {
+			t.Fatalf("sync order = %d, %v", rec.Code, err)
+		}
+		return response
+	}
+
+	first := charge(order)
+	retry := charge(order)
+	if retry["order_id"] != first["order_id"] || retry["cached"] != true || retry["status"] != first["status"] {
+		t.Errorf("retry = %v, want the first result %v marked cached", retry, first)
+	}
+	if _, cached := first["cached"]; cached {
+		t.Errorf("first result is marked cached: %v", first)
+	}
+	other := charge(`{"customer_id":2,"items":[{"product_id":"a","quantity":1,"price":5}]}`)
+	if other["order_id"] == first["order_id"] || other["cached"] != nil {
+		t.Errorf("a different order got the cached result: %v", other)
+	}
+
+	time.Sleep(400 * time.Millisecond)
+	late := charge(order)
+	if late["order_id"] == first["order_id"] || late["cached"] != nil {
+		t.Errorf("a retry after the window got the cached result: %v", late)
+	}
+	if stored, _ := s.orders.List(""); len(stored) != 3 {
+		t.Errorf("%d orders stored, want 3 with the cached retry charging nothing", len(stored))
+	}
+	if hits := atomic.LoadInt64(&s.syncCacheHits); hits != 1 {
+		t.Errorf("sync_cache_hits = %d, want 1", hits)
+	}
+}
+
+func TestPendingOrdersExpireAfterTheTTL(t *testing.T) {
+	s := newTestService(t, map[string]string{"PENDING_TTL": "500ms", "PENDING_REAP_INTERVAL": "20ms", "INVENTORY": "a=10"})
+	now := time.Now()
+	pending := func(orderID string, createdAt time.Time, processAfter *flexTime) *Order {
+		order := &Order{OrderID: orderID, CustomerID: 1, Items: []Item{{ProductID: "a", Quantity: 2, Price: 5}}, Total: 10, Status: StatusPending, CreatedAt: createdAt, ProcessAfter: processAfter}
+		if err := s.inventory.reserve(order.Items, false); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.orders.Put(order); err != nil {
+			t.Fatal(err)
+		}
+		return order
+	}
+	old := pending("old", now.Add(-time.Second), nil)
+	recent := pending("recent", now, nil)
+	// Placed as long ago as old, but not due for another minute
+	scheduled := pending("scheduled", now.Add(-time.Second), &flexTime{now.Add(time.Minute)})
+
+	if !eventually(t, time.Second, func() bool { return s.currentStatus(old) == StatusExpired }) {
+		t.Fatalf("old pending order is %s, want expired", s.currentStatus(old))
+	}
+	for _, order := range []*Order{recent, scheduled} {
+		if status := s.currentStatus(order); status != StatusPending {
+			t.Errorf("%s order is %s, want it still pending", order.OrderID, status)
+		}
+	}
+	if units, _ := s.inventory.remaining("a"); units != 6 {
+		t.Errorf("%d units of a left, want 6 with the expired order's 2 given back", units)
+	}
+	if expired := atomic.LoadInt64(&s.expiredOrders); expired != 1 {
+		t.Errorf("orders_expired_total = %d, want 1", expired)
+	}
+}
+
+func TestClosingTheSaleStopsNewOrdersButFinishesAcceptedOnes(t *testing.T) {
+	s := newTestService(t, map[string]string{"PAYMENT_LATENCY": "300ms"})
+	order := `{"customer_id":1,"items":[{"product_id":"a","quantity":1,"price":5}]}`
+	saleState := func(rec *httptest.ResponseRecorder) map[string]interface{} {
+		t.Helper()
+		var state map[string]interface{}
+		if err := json.NewDecoder(rec.Body).Decode(&state); rec.Code != http.StatusOK || err != nil {
+			t.Fatalf("sale admin = %d, %v", rec.Code, err)
+		}
+		return state
+	}
+
+	inFlight := make(chan int, 1)
+	go func() { inFlight <- postJSON(s.HandleSyncOrder, "/orders/sync", order).Code }()
+	if !eventually(t, time.Second, func() bool {
+		processing, _ := s.orders.List(StatusProcessing)
+		return len(processing) == 1
+	}) {
+		t.Fatal("the first order never started paying")
+	}
+
+	closed := saleState(post(s.HandleCloseSale, "/admin/sale/close", "", ""))
+	if closed["state"] != "closed" || closed["closed_at"] == nil {
+		t.Fatalf("close = %v, want closed with a closed_at", closed)
+	}
+	if again := saleState(post(s.HandleCloseSale, "/admin/sale/close", "", "")); again["closed_at"] != closed["closed_at"] {
+		t.Errorf("closing again moved closed_at from %v to %v", closed["closed_at"], again["closed_at"])
+	}
+	for name, handler := range map[string]http.HandlerFunc{"sync": s.HandleSyncOrder, "async": s.HandleAsyncOrder} {
+		if rec := postJSON(handler, "/orders/"+name, order); rec.Code != http.StatusGone {
+			t.Errorf("%s order after close = %d, want 410", name, rec.Code)
+		}
+	}
+	if code := <-inFlight; code != http.StatusOK {
+		t.Errorf("order accepted before close = %d, want it charged with 200", code)
+	}
+
+	if opened := saleState(post(s.HandleOpenSale, "/admin/sale/open", "", "")); opened["state"] != "open" || opened["closed_at"] != nil {
+		t.Errorf("open = %v, want open", opened)
+	}
+	if rec := postJSON(s.HandleSyncOrder, "/orders/sync", order); rec.Code != http.StatusOK {
+		t.Errorf("order after reopening = %d, want 200", rec.Code)
+	}
+}
+
+func TestAdmissionSmootherPacesABurst(t *testing.T) {
+	env, _ := useSlowSNS(t, 0)
+	env["ACCEPT_RATE"] = "5"
+	env["ACCEPT_BURST"] = "5"
+	env["ACCEPT_MAX_WAIT"] = "250ms"
+	s := newTestService(t, env)
+	created := time.Now()
+
+	// The burst takes 5 tokens at once, the next is worth waiting 200ms
+	// for and the rest would wait longer than 250ms
+	type answer struct {
+		code       int
+		retryAfter string
+		took       time.Duration
+	}
+	answers := make(chan answer, 10)
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < cap(answers); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			began := time.Now()
+			rec := postJSON(s.HandleAsyncOrder, "/orders/async", fmt.Sprintf(`{"customer_id":%d,"items":[{"product_id":"a","quantity":1,"price":5}]}`, i+1))
+			answers <- answer{rec.Code, rec.Header().Get("Retry-After"), time.Since(began)}
+		}()
+	}
+	close(start)
+	wg.Wait()
+	close(answers)
+
+	var accepted, paced, rejected int
+	for a := range answers {
+		switch a.code {
+		case http.StatusAccepted:
+			accepted++
+			if a.took >= 150*time.Millisecond {
+				paced++
+			}
+		case http.StatusTooManyRequests:
+			rejected++
+			if a.retryAfter != "1" {
+				t.Errorf("Retry-After = %q, want 1", a.retryAfter)
+			}
+		default:
+			t.Errorf("async order answered %d", a.code)
+		}
+	}
+	if accepted != 6 || paced != 1 || rejected != 4 {
+		t.Errorf("burst of 10: %d accepted (%d after waiting), %d rejected; want 6 (1), 4", accepted, paced, rejected)
+	}
+
+	// accept_rate reports the admissions of the last full second
+	time.Sleep(time.Until(created.Add(1200 * time.Millisecond)))
+	rec := httptest.NewRecorder()
+	s.HandleMetrics(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	var metrics struct {
+		Admission struct {
+			AcceptRate int64 `json:"accept_rate"`
+			Admitted   int64 `json:"admitted"`
+			Rejected   int64 `json:"rejected"`
+		} `json:"admission"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&metrics); err != nil {
+		t.Fatal(err)
+	}
+	if a := metrics.Admission; a.AcceptRate != 6 || a.Admitted != 6 || a.Rejected != 4 {
+		t.Errorf("admission metrics = %+v, want accept_rate 6, admitted 6, rejected 4", a)
+	}
+}
+
+func TestFlexTimeAcceptsEpochAndRFC3339(t *testing.T) {
+	want := time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+	for _, input := range []string{
+		`1704207845`,
+		`1704207845000`,
+		`"1704207845"`,
+		`"2024-01-02T15:04:05Z"`,
+		`"2024-01-02T17:04:05+02:00"`,
+		`"2024-01-02T15:04:05"`,
+		`"2024-01-02 15:04:05"`,
+	} {
+		var got flexTime
+		if err := json.Unmarshal([]byte(input), &got); err != nil || !got.Equal(want) {
+			t.Errorf("%s parsed as %v, %v; want %v", input, got.Time, err, want)
+		}
+	}
+	if got, _ := json.Marshal(flexTime{want.In(time.FixedZone("CEST", 2*3600))}); string(got) != `"2024-01-02T15:04:05Z"` {
+		t.Errorf("flexTime is written as %s, want UTC RFC 3339", got)
+	}
+
+	for _, input := range []string{`"next tuesday"`, `"2024-13-45T99:00:00Z"`, `true`} {
+		var got flexTime
+		var formatErr *timeFormatError
+		if err := json.Unmarshal([]byte(input), &got); !errors.As(err, &formatErr) {
+			t.Errorf("%s: error = %v, want a timeFormatError", input, err)
+		}
+	}
+
+	s := newTestService(t, nil)
+	rec := postJSON(s.HandleSyncOrder, "/orders/sync", `{"customer_id":1,"process_after":"soonish","items":[{"product_id":"a","quantity":1,"price":5}]}`)
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "unrecognized timestamp") {
+		t.Errorf("garbage process_after = %d %q, want 400 explaining the timestamp", rec.Code, rec.Body.String())
+	}
+}
+
+func TestMetricsReportSNSFailuresAlongsideLocalCounters(t *testing.T) {
+	var failing atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		w.Header().Set("Content-Type", "text/xml")
+		switch {
+		case r.Form.Get("Action") == "GetTopicAttributes":
+			io.WriteString(w, `<GetTopicAttributesResponse xmlns="http://sns.amazonaws.com/doc/2010-03-31/"><GetTopicAttributesResult><Attributes></Attributes></GetTopicAttributesResult></GetTopicAttributesResponse>`)
+		case failing.Load():
+			w.WriteHeader(http.StatusInternalServerError)
+			io.WriteString(w, `<ErrorResponse><Error><Type>Receiver</Type><Code>InternalError</Code><Message>Publish failed</Message></Error><RequestId>1</RequestId></ErrorResponse>`)
+		default:
+			io.WriteString(w, `<PublishResponse xmlns="http://sns.amazonaws.com/doc/2010-03-31/"><PublishResult><MessageId>m1</MessageId></PublishResult></PublishResponse>`)
+		}
+	}))
+	t.Cleanup(server.Close)
+	s := newTestService(t, map[string]string{
+		"AWS_ENDPOINT_URL_SNS": server.URL,
+		"SNS_TOPIC_ARN":        "arn:aws:sns:us-east-1:000000000000:orders",
+		"AWS_MAX_ATTEMPTS":     "1",
+	})
+	order := `{"customer_id":1,"items":[{"product_id":"a","quantity":1,"price":5}]}`
+	metrics := func() (degraded interface{}, sns map[string]interface{}, asyncRequests interface{}) {
+		var body struct {
+			AWSDegraded  interface{}                       `json:"aws_degraded"`
+			Dependencies map[string]map[string]interface{} `json:"dependencies"`
+			Totals       map[string]interface{}            `json:"totals"`
+		}
+		json.NewDecoder(get(http.HandlerFunc(s.HandleMetrics), "/metrics").Body).Decode(&body)
+		return body.AWSDegraded, body.Dependencies["sns"], body.Totals["async_requests"]
+	}
+
+	if degraded, sns, _ := metrics(); degraded != false || sns["status"] != "unknown" {
+		t.Errorf("before any publish: aws_degraded %v, sns %v; want false and unknown", degraded, sns)
+	}
+
+	failing.Store(true)
+	if rec := postJSON(s.HandleAsyncOrder, "/orders/async", order); rec.Code == http.StatusAccepted {
+		t.Fatal("async order was accepted though its publish failed")
+	}
+	degraded, sns, asyncRequests := metrics()
+	if degraded != true || sns["status"] != "degraded" || !strings.Contains(fmt.Sprint(sns["last_error"]), "Publish failed") {
+		t.Errorf("failing SNS: aws_degraded %v, sns %v; want true and degraded with the error", degraded, sns)
+	}
+	if asyncRequests != float64(1) {
+		t.Errorf("async_requests = %v, want the refused order counted", asyncRequests)
+	}
+
+	failing.Store(false)
+	if rec := postJSON(s.HandleAsyncOrder, "/orders/async", order); rec.Code != http.StatusAccepted {
+		t.Fatalf("async order after SNS recovered = %d", rec.Code)
+	}
+	if degraded, sns, _ := metrics(); degraded != false || sns["status"] != "ok" || sns["last_error"] == nil {
+		t.Errorf("recovered SNS: aws_degraded %v, sns %v; want false and ok, keeping the last error", degraded, sns)
+	}
+}
+
+func TestAsyncResponseSaysWhetherAnythingWillProcessTheOrder(t *testing.T) {
+	order := `{"customer_id":1,"items":[{"product_id":"a","quantity":1,"price":5}]}`
+	for _, tc := range []struct {
+		name        string
+		env         map[string]string
+		wantCode    int
+		wantStatus  string
+		wantMessage string
+		stored      int
+	}{
+		{
+			name:        "strict by default",
+			env:         map[string]string{"LOCAL_ASYNC_WORKERS": "0"},
+			wantCode:    http.StatusServiceUnavailable,
+			wantMessage: "Async processing unavailable: no queue is configured",
+		},
+		{
+			name:        "not strict",
+			env:         map[string]string{"LOCAL_ASYNC_WORKERS": "0", "ASYNC_STRICT": "false"},
+			wantCode:    http.StatusAccepted,
+			wantStatus:  "accepted_local",
+			wantMessage: "Order stored but not queued: no external queue or local fallback is configured, so it will not be processed",
+			stored:      1,
+		},
+		{
+			name:        "local fallback",
+			env:         map[string]string{"LOCAL_ASYNC_WORKERS": "1"},
+			wantCode:    http.StatusAccepted,
+			wantStatus:  "accepted_local",
+			wantMessage: "Order accepted for in-memory processing (no external queue configured)",
+			stored:      1,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestService(t, tc.env)
+			t.Cleanup(func() {
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+				s.Shutdown(ctx)
+			})
+
+			rec := postJSON(s.HandleAsyncOrder, "/orders/async", order)
+			if rec.Code != tc.wantCode {
+				t.Fatalf("async order = %d %s, want %d", rec.Code, rec.Body.String(), tc.wantCode)
+			}
+			if tc.wantCode != http.StatusAccepted {
+				if got := strings.TrimSpace(rec.Body.String()); got != tc.wantMessage {
+					t.Errorf("refusal = %q, want %q", got, tc.wantMessage)
+				}
+			} else {
+				var response map[string]interface{}
+				json.NewDecoder(rec.Body).Decode(&response)
+				if response["status"] != tc.wantStatus || response["message"] != tc.wantMessage || response["order_id"] == nil {
+					t.Errorf("response = %v, want status %q with message %q", response, tc.wantStatus, tc.wantMessage)
+				}
+			}
+			if orders, _ := s.orders.List(""); len(orders) != tc.stored {
+				t.Errorf("%d orders stored, want %d", len(orders), tc.stored)
+			}
+		})
+	}
+}
+
+// queueLanes holds slots' only slot, queues a waiter for each lane in
+// lanes in turn and returns a func that frees the slot and returns the
+// lanes in the order they were served
+func queueLanes(t *testing.T, slots *paymentScheduler, lanes ...paymentLane) func() []paymentLane {
+	t.Helper()
+	if err := slots.Acquire(context.Background(), laneSync); err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	var served []paymentLane
+	var wg sync.WaitGroup
+	for i, lane := range lanes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := slots.Acquire(context.Background(), lane); err != nil {
+				t.Error(err)
+				return
+			}
+			mu.Lock()
+			served = append(served, lane)
+			mu.Unlock()
+			slots.Release()
+		}()
+		for {
+			if syncWaiting, asyncWaiting, _ := slots.Stats(); syncWaiting+asyncWaiting == i+1 {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	return func() []paymentLane {
+		slots.Release()
+		wg.Wait()
+		return served
+	}
+}
+
+func TestPaymentSlotsFavourSyncAtTheConfiguredRatio(t *testing.T) {
+	const S, A = laneSync, laneAsync
+	slots := newPaymentScheduler(1, 3, 0)
+	// Async orders arrive first but sync ones get three slots for each of theirs
+	release := queueLanes(t, slots, A, A, A, A, S, S, S, S, S, S, S, S)
+	want := []paymentLane{S, S, S, A, S, S, S, A, S, S, A, A}
+	if served := release(); !slices.Equal(served, want) {
+		t.Errorf("lanes served %v, want %v", served, want)
+	}
+}
+
+func TestAgedAsyncWaiterIsServedAheadOfSync(t *testing.T) {
+	const S, A = laneSync, laneAsync
+	slots := newPaymentScheduler(1, 1000, 50*time.Millisecond)
+
+	// A young async waiter yields to sync
+	release := queueLanes(t, slots, A, S, S)
+	if served := release(); !slices.Equal(served, []paymentLane{S, S, A}) {
+		t.Errorf("young async waiter: lanes served %v, want sync first", served)
+	}
+
+	// One that has waited past asyncMaxWait goes next despite the ratio
+	release = queueLanes(t, slots, A, S, S)
+	time.Sleep(60 * time.Millisecond)
+	if served := release(); !slices.Equal(served, []paymentLane{A, S, S}) {
+		t.Errorf("aged async waiter: lanes served %v, want it first", served)
+	}
+}
+
+// usePublishRecorder points the SNS client at an endpoint that accepts
+// every publish and returns the message attributes of each, by name
+func usePublishRecorder(t *testing.T) (env map[string]string, published func() []map[string]string) {
+	t.Helper()
+	var mu sync.Mutex
+	var attributes []map[string]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		w.Header().Set("Content-Type", "text/xml")
+		if r.Form.Get("Action") == "GetTopicAttributes" {
+			io.WriteString(w, `<GetTopicAttributesResponse xmlns="http://sns.amazonaws.com/doc/2010-03-31/"><GetTopicAttributesResult><Attributes></Attributes></GetTopicAttributesResult></GetTopicAttributesResponse>`)
+			return
+		}
+		// Attributes arrive as MessageAttributes.entry.N.Name and
+		// MessageAttributes.entry.N.Value.StringValue
+		publish := map[string]string{}
+		for n := 1; r.Form.Has(fmt.Sprintf("MessageAttributes.entry.%d.Name", n)); n++ {
+			prefix := fmt.Sprintf("MessageAttributes.entry.%d.", n)
+			publish[r.Form.Get(prefix+"Name")] = r.Form.Get(prefix + "Value.StringValue")
+		}
+		mu.Lock()
+		attributes = append(attributes, publish)
+		mu.Unlock()
+		io.WriteString(w, `<PublishResponse xmlns="http://sns.amazonaws.com/doc/2010-03-31/"><PublishResult><MessageId>m1</MessageId></PublishResult></PublishResponse>`)
+	}))
+	t.Cleanup(server.Close)
+	return map[string]string{
+		"AWS_ENDPOINT_URL_SNS": server.URL,
+		"SNS_TOPIC_ARN":        "arn:aws:sns:us-east-1:000000000000:orders",
+		"AWS_MAX_ATTEMPTS":     "1",
+	}, func() []map[string]string {
+		mu.Lock()
+		defer mu.Unlock()
+		return slices.Clone(attributes)
+	}
+}
+
+func TestPublishedOrdersCarryFilterAndTraceAttributes(t *testing.T) {
+	saved := otel.GetTextMapPropagator()
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() { otel.SetTextMapPropagator(saved) })
+
+	env, published := usePublishRecorder(t)
+	env["VIP_CUSTOMER_IDS"] = "9"
+	s := newTestService(t, env)
+
+	// The caller's trace continues through SNS to the processor
+	traceID, _ := trace.TraceIDFromHex("4bf92f3577b34da6a3ce929d0e0e4736")
+	spanID, _ := trace.SpanIDFromHex("00f067aa0ba902b7")
+	ctx := trace.ContextWithRemoteSpanContext(context.Background(), trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID: traceID, SpanID: spanID, TraceFlags: trace.FlagsSampled,
+	}))
+	for _, customer := range []int{1, 9} {
+		order := Order{CustomerID: customer, Items: []Item{{ProductID: "a", Quantity: 3, Price: 2.5}}}
+		if _, err := s.SubmitAsync(ctx, order, orderSource{}); err != nil {
+			t.Fatalf("SubmitAsync: %v", err)
+		}
+	}
+
+	got := published()
+	if len(got) != 2 {
+		t.Fatalf("%d publishes, want 2", len(got))
+	}
+	for i, want := range []map[string]string{
+		{"customer_id": "1", "order_total": "7.50", "priority": "normal"},
+		{"customer_id": "9", "order_total": "7.50", "priority": "high"},
+	} {
+		traceparent := got[i]["traceparent"]
+		if !strings.HasPrefix(traceparent, "00-"+traceID.String()+"-") {
+			t.Errorf("publish %d traceparent = %q, want the caller's trace %s", i, traceparent, traceID)
+		}
+		delete(got[i], "traceparent")
+		if !maps.Equal(got[i], want) {
+			t.Errorf("publish %d attributes = %v, want %v", i, got[i], want)
+		}
+	}
+}
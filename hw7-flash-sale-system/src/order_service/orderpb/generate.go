@@ -0,0 +1,5 @@
+// Package orderpb holds the gRPC contract for the order service; the
+// generated files come from orders.proto
+package orderpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative orders.proto
@@ -25,7 +25,7 @@ resource "aws_lb_target_group" "order_service" {
     unhealthy_threshold = 2
     timeout             = 5
     interval            = 30
-    path                = "/health"
+    path                = "/ready"
     matcher             = "200"
   }
 
@@ -47,7 +47,7 @@ resource "aws_lb_target_group" "order_processor" {
     unhealthy_threshold = 2
     timeout             = 5
     interval            = 30
-    path                = "/health"
+    path                = "/ready"
     matcher             = "200"
   }
 